@@ -3,22 +3,39 @@ package main
 import (
 	"context"
 	"database/sql"
-	"errors"
-	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 	"usersegmentator/config"
-	errs "usersegmentator/pkg/errors"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/auth"
+	"usersegmentator/pkg/cache"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/events"
 	"usersegmentator/pkg/handlers"
+	"usersegmentator/pkg/history"
+	"usersegmentator/pkg/idempotency"
+	"usersegmentator/pkg/jobs"
+	"usersegmentator/pkg/leader"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/metrics"
+	"usersegmentator/pkg/migrate"
+	"usersegmentator/pkg/outbox"
+	"usersegmentator/pkg/ramp"
+	"usersegmentator/pkg/ratelimit"
+	"usersegmentator/pkg/segment"
+	"usersegmentator/pkg/tracing"
+	"usersegmentator/pkg/webhook"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 )
 
+// shutdownTimeout bounds the HTTP server drain and the background jobs stop together.
+const shutdownTimeout = 10 * time.Second
+
 //	@title			Dynamic User Segmentation Service API
 //	@version		1.0
 //	@description	Avito Tech backend trainee assignment 2023
@@ -27,81 +44,259 @@ import (
 // @contact.url	http://t.me/nervous_void
 // @contact.email	androsov.p.v@gmail.com
 
-func main() {
-	infoLog := log.New(os.Stdout, "INFO\tMAIN\t", log.Ldate|log.Ltime)
-	errLog := log.New(os.Stderr, "ERROR\tMAIN\t", log.Ldate|log.Ltime)
+// @securityDefinitions.apikey	ApiKeyAuth
+// @in							header
+// @name						X-API-Key
+
+// @securityDefinitions.apikey	BearerAuth
+// @in							header
+// @name						Authorization
+// @description				"Bearer" followed by an identity provider JWT
 
+func main() {
 	cfg, err := config.NewConfig()
 	if err != nil {
-		errLog.Printf("Error reading config: %s", err)
+		slog.Error("Error reading config", logging.Err(err))
 		return
 	}
 
-	dsn := fmt.Sprintf(
-		"root:%s@tcp(%s:%s)/%s?",
-		cfg.Password,
-		cfg.MySQL.Host,
-		cfg.MySQL.Port,
-		cfg.MySQL.Name,
-	)
-	dsn += "&charset=utf8"
-	dsn += "&multiStatements=true"
-	dsn += "&interpolateParams=true"
-	dsn += "&parseTime=true"
+	logger, err := logging.New(cfg)
+	if err != nil {
+		slog.Error("Error creating logger", logging.Err(err))
+		return
+	}
+	slog.SetDefault(logger)
+	mainLog := logging.For("main")
 
-	db, err := errs.DBConnectLoop(dsn, time.Duration(cfg.Timeout*1e9)) //nolint:gomnd // converting nanosecs to secs
+	db, err := dialect.Open(cfg)
 	if err != nil {
-		errLog.Printf("Couldn't start database driver: %s\n", err)
+		mainLog.Error("Couldn't start database driver", logging.Err(err))
 		return
 	}
 
 	defer func(db *sql.DB) {
 		err = db.Close()
 		if err != nil {
-			errLog.Printf("Error closing database connection: %s\n", err)
+			mainLog.Error("Error closing database connection", logging.Err(err))
 		}
 	}(db)
-	db.SetMaxOpenConns(cfg.MaxConnections)
 
-	segmentHandler := handlers.NewSegmentsHandler(db, cfg)
-	reportHandler := handlers.NewHistoryHandler(db, cfg)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err = runMigrate(context.Background(), cfg, db, os.Args[2:])
+		if err != nil {
+			mainLog.Error("Migration failed", logging.Err(err))
+			_ = db.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.Migrations.AutoMigrate {
+		migrator, err := migrate.NewMigrator(db, cfg)
+		if err == nil {
+			err = migrator.Up(context.Background(), 0)
+		}
+		if err != nil {
+			mainLog.Error("Error applying migrations", logging.Err(err))
+			return
+		}
+	}
+
+	exporter, err := tracing.NewExporter(context.Background(), cfg)
+	if err != nil {
+		mainLog.Error("Error creating tracing exporter", logging.Err(err))
+		return
+	}
+	if provider := tracing.NewTracerProvider(exporter, cfg); provider != nil {
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err = provider.Shutdown(ctx); err != nil {
+				mainLog.Error("Error flushing spans", logging.Err(err))
+			}
+		}()
+	}
+
+	broker := events.NewBroker(cfg)
+	m := metrics.NewMetrics(db, dialect.For(cfg).DatabaseName(cfg))
+
+	var userCache cache.Cache
+	if cfg.Cache.Enabled {
+		userCache, err = cache.New(cfg)
+		if err != nil {
+			mainLog.Error("Error creating cache", logging.Err(err))
+			return
+		}
+	}
+
+	segmentHandler := handlers.NewSegmentsHandler(db, cfg, broker, m, userCache)
+	reportHandler := handlers.NewHistoryHandler(db, cfg, m)
+	eventsHandler := handlers.NewEventsHandler(broker, cfg)
+	webhooksHandler := handlers.NewWebhooksHandler(db, cfg)
+	authHandler := handlers.NewAuthHandler(db, cfg)
+	auditHandler := handlers.NewAuditHandler(db, cfg)
+	elector, err := leader.NewElector(db, cfg, leader.LeaseBackgroundJobs, m)
+	if err != nil {
+		mainLog.Error("Error creating leader elector", logging.Err(err))
+		return
+	}
+
+	ttlWorker := segment.NewTTLWorker(segmentHandler.SegmentsRepo, cfg, m)
+	healthHandler := handlers.NewHealthHandler(db, cfg, ttlWorker, elector)
+
+	publisher, err := outbox.NewPublisher(cfg)
+	if err != nil {
+		mainLog.Error("Error creating outbox publisher", logging.Err(err))
+		return
+	}
+	relay := outbox.NewRelay(outbox.NewOutboxRepo(db, cfg), publisher, cfg)
+	defer func() {
+		if err = relay.Close(); err != nil {
+			mainLog.Error("Error closing outbox publisher", logging.Err(err))
+		}
+	}()
+
+	rampRunner := ramp.NewRunner(segmentHandler.RampRepo, segmentHandler.SegmentsRepo, cfg)
+	idempotent := idempotency.NewMiddleware(idempotency.NewIdempotencyRepo(db, cfg), cfg, m)
+
+	dispatcher := webhook.NewDispatcher(webhook.NewWebhooksRepo(db, cfg), broker, cfg)
+	reportCleaner := history.NewReportCleaner(cfg)
+
+	scheduler := jobs.NewScheduler(cfg, elector, m)
+	backgroundJobs := []jobs.Job{
+		{Name: "expire_memberships", Interval: ttlWorker.Interval(), LeaderOnly: true, Run: ttlWorker.Expire},
+		{Name: "outbox_relay", Interval: relay.Interval(), LeaderOnly: true, Run: relay.Drain},
+		{Name: "purge_outbox", Interval: relay.PurgeInterval(), LeaderOnly: true, Run: relay.Purge},
+		{Name: "deliver_webhooks", Interval: dispatcher.Interval(), Run: dispatcher.Deliver},
+		{Name: "advance_ramp_plans", Interval: rampRunner.Interval(), LeaderOnly: true, Run: rampRunner.Advance},
+	}
+	if cfg.Idempotency.Enabled {
+		backgroundJobs = append(backgroundJobs,
+			jobs.Job{Name: "purge_idempotency_keys", Interval: idempotent.Interval(), LeaderOnly: true, Run: idempotent.Purge})
+	}
+	if cfg.Report.TTL > 0 {
+		backgroundJobs = append(backgroundJobs,
+			jobs.Job{Name: "purge_reports", Interval: reportCleaner.Interval(), Run: reportCleaner.Purge})
+	}
+	for _, job := range backgroundJobs {
+		if err = scheduler.Register(job); err != nil {
+			mainLog.Error("Error registering background job", logging.Err(err))
+			return
+		}
+	}
+	jobsHandler := handlers.NewJobsHandler(scheduler)
+
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	scheduler.Start(workersCtx)
+
+	go dispatcher.Run(workersCtx)
+
+	var jwtVerifier *auth.JWTVerifier
+	if cfg.Auth.JWT {
+		jwtVerifier, err = auth.NewJWTVerifier(workersCtx, cfg)
+		if err != nil {
+			mainLog.Error("Error initializing JWT verifier", logging.Err(err))
+			return
+		}
+	}
+
+	limiter, err := ratelimit.NewLimiter(cfg)
+	if err != nil {
+		mainLog.Error("Error creating rate limiter", logging.Err(err))
+		return
+	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/api/create_segment", segmentHandler.AddSegment).Methods("POST")
-	r.HandleFunc("/api/delete_segment", segmentHandler.DeleteSegment).Methods("DELETE")
-	r.HandleFunc("/api/update_user_segments", segmentHandler.UpdateUserSegments).Methods("POST")
-	r.HandleFunc("/api/get_user_segments", segmentHandler.GetUserSegments).Methods("GET")
-	r.HandleFunc("/api/get_user_history", reportHandler.GetUserHistory).Methods("GET")
+	authenticator, err := auth.NewAuthenticator(auth.NewAPIKeysRepo(db, cfg), jwtVerifier, cfg)
+	if err != nil {
+		mainLog.Error("Error creating authenticator", logging.Err(err))
+		return
+	}
+	auditor := audit.NewAuditor(audit.NewAuditRepo(db, cfg))
+	rateLimiter := ratelimit.NewMiddleware(limiter, cfg)
+	r.Use(logging.RequestID, tracing.Middleware, m.Middleware, rateLimiter.IPHandler, auditor.Middleware,
+		authenticator.Middleware, rateLimiter.Handler, idempotent.Handler)
+
+	authenticator.Public(r.Handle("/metrics", m.Handler()).Methods("GET"))
+	authenticator.Public(r.HandleFunc("/healthz", healthHandler.Liveness).Methods("GET"))
+	authenticator.Public(r.HandleFunc("/readyz", healthHandler.Readiness).Methods("GET"))
+	authenticator.Public(r.HandleFunc("/version", healthHandler.GetVersion).Methods("GET"))
+
+	authenticator.Require(auth.ScopeSegmentsWrite,
+		r.HandleFunc("/api/create_segment", segmentHandler.AddSegment).Methods("POST"))
+	authenticator.Require(auth.ScopeSegmentsWrite,
+		r.HandleFunc("/api/delete_segment", segmentHandler.DeleteSegment).Methods("DELETE"))
+	authenticator.Require(auth.ScopeSegmentsWrite,
+		r.HandleFunc("/api/update_user_segments", segmentHandler.UpdateUserSegments).Methods("POST"))
+	authenticator.Require(auth.ScopeSegmentsWrite,
+		r.HandleFunc("/api/update_users_segments", segmentHandler.UpdateUsersSegments).Methods("POST"))
+	authenticator.Require(auth.ScopeSegmentsWrite,
+		r.HandleFunc("/api/update_segments_expiry", segmentHandler.UpdateSegmentsExpiry).Methods("POST"))
+	authenticator.Require(auth.ScopeSegmentsWrite,
+		r.HandleFunc("/api/set_ramp_plan", segmentHandler.SetRampPlan).Methods("POST"))
+	authenticator.Require(auth.ScopeSegmentsWrite,
+		r.HandleFunc("/api/update_ramp_plan", segmentHandler.UpdateRampPlan).Methods("POST"))
+	authenticator.Require(auth.ScopeSegmentsRead,
+		r.HandleFunc("/api/get_ramp_plan", segmentHandler.GetRampPlan).Methods("GET"))
+	authenticator.Require(auth.ScopeSegmentsRead,
+		r.HandleFunc("/api/get_user_segments", segmentHandler.GetUserSegments).Methods("GET"))
+	authenticator.Require(auth.ScopeSegmentsRead,
+		r.HandleFunc("/api/get_users_segments", segmentHandler.GetUsersSegments).Methods("GET"))
+	authenticator.Require(auth.ScopeSegmentsRead,
+		r.HandleFunc("/api/get_segments_snapshot", segmentHandler.GetSnapshot).Methods("GET"))
+	authenticator.Require(auth.ScopeHistoryRead, auditor.Audit(
+		r.HandleFunc("/api/get_user_history", reportHandler.GetUserHistory).Methods("GET")))
+	authenticator.Require(auth.ScopeSegmentsRead,
+		r.HandleFunc("/api/events", eventsHandler.StreamEvents).Methods("GET"))
+
+	r.HandleFunc("/api/create_webhook", webhooksHandler.AddWebhook).Methods("POST")
+	r.HandleFunc("/api/delete_webhook", webhooksHandler.DeleteWebhook).Methods("DELETE")
+	r.HandleFunc("/api/get_webhooks", webhooksHandler.GetWebhooks).Methods("GET")
+	r.HandleFunc("/api/get_webhook_dead_letters", webhooksHandler.GetDeadLetters).Methods("GET")
+	idempotent.Exclude(r.HandleFunc("/api/admin/create_api_key", authHandler.CreateAPIKey).Methods("POST"))
+	r.HandleFunc("/api/admin/get_api_keys", authHandler.GetAPIKeys).Methods("GET")
+	idempotent.Exclude(r.HandleFunc("/api/admin/revoke_api_key", authHandler.RevokeAPIKey).Methods("DELETE"))
+	r.HandleFunc("/api/admin/get_audit_log", auditHandler.GetAuditLog).Methods("GET")
+	r.HandleFunc("/api/admin/get_job_runs", jobsHandler.GetJobRuns).Methods("GET")
 
-	r.PathPrefix("/reports/").Handler(
-		http.StripPrefix("/reports/",
-			http.FileServer(http.Dir("./"+cfg.StorageDir))))
+	authenticator.Require(auth.ScopeHistoryRead,
+		r.PathPrefix("/reports/").Handler(
+			http.StripPrefix("/reports/",
+				http.FileServer(http.Dir("./"+cfg.StorageDir)))))
 
 	srv := &http.Server{
-		Addr:    cfg.HTTP.Host + ":" + cfg.HTTP.Port,
-		Handler: r,
+		Addr:     cfg.HTTP.Host + ":" + cfg.HTTP.Port,
+		Handler:  r,
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
 	}
+	srv.RegisterOnShutdown(broker.Close)
 
-	stopped := make(chan struct{})
+	serverErr := make(chan error, 1)
 	go func() {
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-		<-sigint
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		if err = srv.Shutdown(ctx); err != nil {
-			errLog.Printf("HTTP Server Shutdown Error: %v\n", err)
-		}
-		close(stopped)
+		mainLog.Info("Starting HTTP server", "host", cfg.HTTP.Host, "port", cfg.HTTP.Port)
+		serverErr <- srv.ListenAndServe()
 	}()
 
-	infoLog.Printf("Starting HTTP server at %s:%s\n", cfg.HTTP.Host, cfg.HTTP.Port)
-
-	if err = srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-		errLog.Printf("HTTP server ListenAndServe error: %v\n", err)
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-sigint:
+	case err = <-serverErr:
+		mainLog.Error("HTTP server ListenAndServe error", logging.Err(err))
 	}
 
-	<-stopped
+	// the server drains first, so that no request runs into stopped jobs
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != nil {
+		mainLog.Error("HTTP Server Shutdown Error", logging.Err(err))
+	}
+	if err = scheduler.Stop(ctx); err != nil {
+		mainLog.Error("Error stopping background jobs", logging.Err(err))
+	}
+	stopWorkers()
 
-	infoLog.Println("Server has been gracefully stopped")
+	mainLog.Info("Server has been gracefully stopped")
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/migrate"
+)
+
+const (
+	seedFirstUserID = 1000
+	seedLastUserID  = 2000
+)
+
+const migrateUsage = `usage: usersegmentator migrate <command>
+
+commands:
+  up [N]         apply N pending migrations, all of them by default
+  down [N]       revert the last N migrations, 1 by default
+  status         list migrations and when they were applied
+  force VERSION  mark migrations up to VERSION as applied after fixing a failed one
+  seed [FIRST LAST]  create test users with IDs FIRST..LAST, 1000..2000 by default`
+
+// runMigrate implements the migrate subcommand.
+func runMigrate(ctx context.Context, cfg *config.Config, db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", migrateUsage)
+	}
+
+	migrator, err := migrate.NewMigrator(db, cfg)
+	if err != nil {
+		return err
+	}
+
+	command, params := args[0], args[1:]
+	switch command {
+	case "up":
+		steps, err := intArg(params, 0, 0)
+		if err != nil {
+			return err
+		}
+		return migrator.Up(ctx, steps)
+
+	case "down":
+		steps, err := intArg(params, 0, 1)
+		if err != nil {
+			return err
+		}
+		return migrator.Down(ctx, steps)
+
+	case "force":
+		if len(params) == 0 {
+			return fmt.Errorf("%s", migrateUsage)
+		}
+		version, err := intArg(params, 0, 0)
+		if err != nil {
+			return err
+		}
+		return migrator.Force(ctx, version)
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		return printStatus(statuses)
+
+	case "seed":
+		first, err := intArg(params, 0, seedFirstUserID)
+		if err != nil {
+			return err
+		}
+		last, err := intArg(params, 1, seedLastUserID)
+		if err != nil {
+			return err
+		}
+		created, err := migrate.SeedUsers(ctx, db, cfg, first, last)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created %d users\n", created)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", command, migrateUsage)
+	}
+}
+
+// intArg parses the i-th parameter, returning def if it is absent.
+func intArg(params []string, i, def int) (int, error) {
+	if len(params) <= i {
+		return def, nil
+	}
+	n, err := strconv.Atoi(params[i])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number %q", params[i])
+	}
+	return n, nil
+}
+
+func printStatus(statuses []migrate.MigrationStatus) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0) //nolint:gomnd // column padding
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	for _, status := range statuses {
+		appliedAt := "pending"
+		switch {
+		case status.Dirty:
+			appliedAt = "dirty"
+		case status.AppliedAt != nil:
+			appliedAt = status.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+	}
+	return w.Flush()
+}
@@ -8,10 +8,27 @@ import (
 
 type Config struct {
 	UserSegmentator `yaml:"usersegmentator"`
+	Database        `yaml:"database"`
 	MySQL           `yaml:"mysql"`
+	Postgres        `yaml:"postgres"`
+	SQLite          `yaml:"sqlite"`
 	HTTP            `yaml:"http"`
 	Report          `yaml:"report"`
 	Segment         `yaml:"segment"`
+	Events          `yaml:"events"`
+	Webhooks        `yaml:"webhooks"`
+	Outbox          `yaml:"outbox"`
+	Auth            `yaml:"auth"`
+	RateLimit       `yaml:"rate_limit"`
+	Tracing         `yaml:"tracing"`
+	Log             `yaml:"log"`
+	Health          `yaml:"health"`
+	Migrations      `yaml:"migrations"`
+	Cache           `yaml:"cache"`
+	Leader          `yaml:"leader"`
+	Jobs            `yaml:"jobs"`
+	Idempotency     `yaml:"idempotency"`
+	Ramp            `yaml:"ramp"`
 }
 
 type UserSegmentator struct {
@@ -19,34 +36,185 @@ type UserSegmentator struct {
 	Version string `yaml:"version"`
 }
 
-type MySQL struct {
-	Name           string `env-required:"true"  env:"MYSQL_DATABASE"`
-	Password       string `env-required:"true"  env:"MYSQL_ROOT_PASSWORD"`
-	MaxConnections int    `yaml:"maxConns"`
-	Host           string `yaml:"host"`
-	Port           string `yaml:"port"`
+// Database selects the storage backend: "mysql", "postgres" or "sqlite".
+type Database struct {
+	Backend        string `yaml:"backend" env:"DB_BACKEND" env-default:"mysql"`
+	MaxConnections int    `yaml:"max_conns"`
 	Timeout        int    `yaml:"conn_timeout"`
 }
 
+type MySQL struct {
+	Name     string `env:"MYSQL_DATABASE"`
+	Password string `env:"MYSQL_ROOT_PASSWORD"`
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+}
+
+type Postgres struct {
+	Name     string `env:"POSTGRES_DB"`
+	User     string `env:"POSTGRES_USER" env-default:"postgres"`
+	Password string `env:"POSTGRES_PASSWORD"`
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	SSLMode  string `yaml:"sslmode"`
+}
+
 type HTTP struct {
 	Host string `yaml:"host"`
 	Port string `yaml:"port"`
 }
 
+// Report: the reports are deleted TTL seconds after they are written, checked
+// every CleanupInterval seconds. A TTL of 0 keeps them forever.
 type Report struct {
-	FilePrefix string `yaml:"file_prefix"`
-	FileExt    string `yaml:"file_ext"`
-	StorageDir string `env-required:"true"  env:"REPORTS_STORAGE"`
+	FilePrefix      string `yaml:"file_prefix"`
+	FileExt         string `yaml:"file_ext"`
+	TTL             int    `yaml:"ttl"`
+	CleanupInterval int    `yaml:"cleanup_interval"`
+	StorageDir      string `env-required:"true"  env:"REPORTS_STORAGE"`
 }
 
+// Segment: the TTL worker expires memberships every TTLCheckInterval seconds
+// in transactions of at most TTLBatchSize memberships.
 type Segment struct {
 	TTLCheckInterval int `yaml:"ttl_check_interval"`
+	TTLBatchSize     int `yaml:"ttl_batch_size"`
+	SnapshotTTL      int `yaml:"snapshot_ttl"`
+}
+
+type Events struct {
+	BufferSize        int `yaml:"buffer_size"`
+	HeartbeatInterval int `yaml:"heartbeat_interval"`
+}
+
+type Webhooks struct {
+	Workers          int `yaml:"workers"`
+	MaxAttempts      int `yaml:"max_attempts"`
+	InitialBackoff   int `yaml:"initial_backoff"`
+	MaxBackoff       int `yaml:"max_backoff"`
+	DeliveryTimeout  int `yaml:"delivery_timeout"`
+	PollInterval     int `yaml:"poll_interval"`
+	BatchSize        int `yaml:"batch_size"`
+	SubscriptionsTTL int `yaml:"subscriptions_ttl"`
+}
+
+type Outbox struct {
+	Publisher      string `yaml:"publisher"`
+	KafkaRESTURL   string `yaml:"kafka_rest_url"`
+	Topic          string `yaml:"topic"`
+	BatchSize      int    `yaml:"batch_size"`
+	PollInterval   int    `yaml:"poll_interval"`
+	PublishTimeout int    `yaml:"publish_timeout"`
+	Retention      int    `yaml:"retention"`
+	PurgeInterval  int    `yaml:"purge_interval"`
+}
+
+type Auth struct {
+	Enabled      bool   `yaml:"enabled"`
+	BootstrapKey string `env:"AUTH_BOOTSTRAP_KEY"`
+	JWT          bool   `yaml:"jwt"`
+	JWKSURL      string `yaml:"jwks_url"`
+	JWKSFile     string `yaml:"jwks_file"`
+	Issuer       string `yaml:"issuer"`
+	Audience     string `yaml:"audience"`
+	TeamClaim    string `yaml:"team_claim"`
+	RolesClaim   string `yaml:"roles_claim"`
+}
+
+// RateLimit applies PerIP to each IP address before authentication, then
+// Default or the endpoint's own rule to each client and endpoint.
+type RateLimit struct {
+	Enabled       bool                     `yaml:"enabled"`
+	Backend       string                   `yaml:"backend"`
+	RedisAddr     string                   `yaml:"redis_addr"`
+	RedisPassword string                   `env:"REDIS_PASSWORD"`
+	PerIP         RateLimitRule            `yaml:"per_ip"`
+	Default       RateLimitRule            `yaml:"default"`
+	Endpoints     map[string]RateLimitRule `yaml:"endpoints"`
+}
+
+// RateLimitRule allows Burst requests at once, refilled at Rate requests per second.
+type RateLimitRule struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// Tracing selects where spans are exported: "none", "stdout" or "otlp".
+type Tracing struct {
+	Exporter     string  `yaml:"exporter"`
+	OTLPEndpoint string  `yaml:"otlp_endpoint"`
+	OTLPInsecure bool    `yaml:"otlp_insecure"`
+	SampleRatio  float64 `yaml:"sample_ratio"`
+}
+
+// Log sets the minimum level logged: "debug", "info", "warn" or "error".
+type Log struct {
+	Level string `yaml:"level" env:"LOG_LEVEL" env-default:"info"`
+}
+
+type Health struct {
+	CheckTimeout int `yaml:"check_timeout"`
+}
+
+// Migrations: with AutoMigrate the server applies pending migrations on start.
+type Migrations struct {
+	AutoMigrate bool `yaml:"auto_migrate"`
+	LockTimeout int  `yaml:"lock_timeout"`
+}
+
+// SQLite: Path is the database file, created if missing.
+type SQLite struct {
+	Path string `yaml:"path" env:"SQLITE_PATH"`
+}
+
+// Cache: user segments are cached for TTL seconds in a "memory" LRU of Size
+// entries per replica or in a "redis" shared between replicas.
+type Cache struct {
+	Enabled       bool   `yaml:"enabled"`
+	Backend       string `yaml:"backend"`
+	Size          int    `yaml:"size"`
+	TTL           int    `yaml:"ttl"`
+	RedisAddr     string `yaml:"redis_addr"`
+	RedisPassword string `env:"CACHE_REDIS_PASSWORD"`
+}
+
+// Leader: replicas elect the one running background jobs through a lease of
+// LeaseDuration seconds, renewed every RenewInterval seconds.
+type Leader struct {
+	Enabled       bool `yaml:"enabled"`
+	LeaseDuration int  `yaml:"lease_duration"`
+	RenewInterval int  `yaml:"renew_interval"`
+}
+
+// Jobs configures the background job scheduler. HistorySize runs are kept
+// per job for the admin API.
+type Jobs struct {
+	HistorySize int `yaml:"history_size"`
+}
+
+// Idempotency: responses to mutating requests with an Idempotency-Key header
+// are kept for TTL seconds and purged every PurgeInterval seconds.
+type Idempotency struct {
+	Enabled       bool `yaml:"enabled"`
+	TTL           int  `yaml:"ttl"`
+	PurgeInterval int  `yaml:"purge_interval"`
+}
+
+// Ramp: the ramp plans are advanced every CheckInterval seconds.
+type Ramp struct {
+	CheckInterval int `yaml:"check_interval"`
 }
 
 func NewConfig() (*Config, error) {
+	return ReadConfig("./config/config.yml")
+}
+
+// ReadConfig reads the configuration from the file at path, overridden by the
+// environment.
+func ReadConfig(path string) (*Config, error) {
 	cfg := &Config{}
 
-	err := cleanenv.ReadConfig("./config/config.yml", cfg)
+	err := cleanenv.ReadConfig(path, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("config error: %w", err)
 	}
@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"time"
+)
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// Entry is a single recorded API call.
+type Entry struct {
+	ID            int64     `json:"id"`
+	Time          time.Time `json:"time"`
+	Actor         string    `json:"actor"`
+	IP            string    `json:"ip"`
+	Method        string    `json:"method"`
+	Endpoint      string    `json:"endpoint"`
+	PayloadDigest string    `json:"payload_digest"`
+	Segments      []string  `json:"segments"`
+	UserIDs       []int     `json:"user_ids"`
+	Status        int       `json:"status"`
+	Result        string    `json:"result"`
+}
+
+// Request filters the audit log. Zero values match everything,
+// times are RFC3339.
+type Request struct {
+	Actor       string `json:"actor"`
+	SegmentSlug string `json:"segment_slug"`
+	UserID      int    `json:"user_id"`
+	StartTime   string `json:"start_time"`
+	EndTime     string `json:"end_time"`
+	Limit       int    `json:"limit"`
+}
+
+type Query struct {
+	Actor       string
+	SegmentSlug string
+	UserID      int
+	StartTime   time.Time
+	EndTime     time.Time
+	Limit       int
+}
+
+// ParseRequest validates the request and turns it into a query.
+func ParseRequest(req *Request) (*Query, error) {
+	query := &Query{
+		Actor:       req.Actor,
+		SegmentSlug: req.SegmentSlug,
+		UserID:      req.UserID,
+		Limit:       req.Limit,
+	}
+
+	var err error
+	if req.StartTime != "" {
+		query.StartTime, err = time.Parse(time.RFC3339, req.StartTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if req.EndTime != "" {
+		query.EndTime, err = time.Parse(time.RFC3339, req.EndTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = defaultLimit
+	}
+	if query.Limit > maxLimit {
+		query.Limit = maxLimit
+	}
+	return query, nil
+}
+
+func resultOf(status int) string {
+	if status < 400 { //nolint:gomnd // 4xx and 5xx are failures
+		return ResultSuccess
+	}
+	return ResultFailure
+}
@@ -0,0 +1,141 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+	"usersegmentator/pkg/auth"
+	"usersegmentator/pkg/httputil"
+	"usersegmentator/pkg/logging"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	anonymousActor = "anonymous"
+	// maxBodyBytes caps the request bodies read into memory for the digest
+	maxBodyBytes = 1 << 20
+)
+
+// Auditor is the router middleware recording every mutating call,
+// plus the read routes explicitly registered with Audit.
+type Auditor struct {
+	repo   Repository
+	routes map[*mux.Route]bool
+	Logger *slog.Logger
+}
+
+// targets picks the affected segments and users out of any request body.
+type targets struct {
+	SegmentSlug      string   `json:"segment_slug"`
+	Segments         []string `json:"segments"`
+	AssignSegments   []string `json:"assign_segments"`
+	UnassignSegments []string `json:"unassign_segments"`
+	UserID           int      `json:"user_id"`
+	UserIDs          []int    `json:"user_ids"`
+}
+
+func NewAuditor(repo Repository) *Auditor {
+	return &Auditor{
+		repo:   repo,
+		routes: make(map[*mux.Route]bool),
+		Logger: logging.For("audit"),
+	}
+}
+
+// Audit makes a non-mutating route audited as well and returns the route.
+func (a *Auditor) Audit(route *mux.Route) *mux.Route {
+	a.routes[route] = true
+	return route
+}
+
+func (a *Auditor) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutating := r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions
+		if !mutating && !a.routes[mux.CurrentRoute(r)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+		if err != nil {
+			status := http.StatusBadRequest
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			a.Logger.ErrorContext(r.Context(), "error reading request body", logging.Err(err))
+			w.WriteHeader(status)
+			a.record(r, newEntry(r, nil, status, nil))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// the auditor runs before the authenticator, so that rejected calls are recorded too
+		ctx, principal := auth.TrackPrincipal(r.Context())
+		recorder, r := httputil.Record(w, r.WithContext(ctx))
+		next.ServeHTTP(recorder, r)
+
+		actor, _ := principal()
+		a.record(r, newEntry(r, body, recorder.Status, actor))
+	})
+}
+
+func (a *Auditor) record(r *http.Request, entry *Entry) {
+	// the request context is cancelled once the client is gone, the entry must be kept anyway
+	err := a.repo.InsertEntry(context.Background(), entry)
+	if err != nil {
+		a.Logger.ErrorContext(r.Context(), "error recording audit entry", "method", entry.Method,
+			"endpoint", entry.Endpoint, "actor", entry.Actor, logging.Err(err))
+	}
+}
+
+// newEntry describes the call; actor is nil when the caller was not authenticated.
+func newEntry(r *http.Request, body []byte, status int, actor *auth.Principal) *Entry {
+	digest := sha256.Sum256(body)
+
+	entry := &Entry{
+		Time:          time.Now().UTC(),
+		Actor:         anonymousActor,
+		IP:            r.RemoteAddr,
+		Method:        r.Method,
+		Endpoint:      r.URL.Path,
+		PayloadDigest: hex.EncodeToString(digest[:]),
+		Segments:      []string{},
+		UserIDs:       []int{},
+		Status:        status,
+		Result:        resultOf(status),
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.IP = host
+	}
+	if actor != nil {
+		entry.Actor = actor.Name
+	}
+
+	t := &targets{}
+	if json.Unmarshal(body, t) == nil {
+		if t.SegmentSlug != "" {
+			entry.Segments = append(entry.Segments, t.SegmentSlug)
+		}
+		entry.Segments = append(entry.Segments, t.Segments...)
+		entry.Segments = append(entry.Segments, t.AssignSegments...)
+		entry.Segments = append(entry.Segments, t.UnassignSegments...)
+
+		if t.UserID != 0 {
+			entry.UserIDs = append(entry.UserIDs, t.UserID)
+		}
+		entry.UserIDs = append(entry.UserIDs, t.UserIDs...)
+	}
+
+	return entry
+}
@@ -0,0 +1,269 @@
+package audit_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"usersegmentator/config"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/auth"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/migrate"
+
+	"github.com/gorilla/mux"
+)
+
+const testBootstrapKey = "audit-test-bootstrap-secret"
+
+type testEnv struct {
+	router http.Handler
+	repo   audit.Repository
+	// bodies holds the request bodies the handlers received
+	bodies []string
+	// keys are API keys by name
+	keys map[string]string
+}
+
+// newTestEnv serves routes behind the auditor and the authenticator, in the
+// order the service uses, on a new SQLite database.
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	ctx := context.Background()
+
+	cfg := &config.Config{}
+	cfg.Database.Backend = dialect.SQLite
+	cfg.Database.Timeout = 5
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "audit.db")
+	cfg.Auth.Enabled = true
+	cfg.Auth.BootstrapKey = testBootstrapKey
+
+	db, err := dialect.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	migrator, err := migrate.NewMigrator(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	keysRepo := auth.NewAPIKeysRepo(db, cfg)
+	env := &testEnv{repo: audit.NewAuditRepo(db, cfg), keys: map[string]string{}}
+	for name, scopes := range map[string][]string{
+		"reader": {auth.ScopeSegmentsRead},
+		"writer": {auth.ScopeSegmentsRead, auth.ScopeSegmentsWrite},
+	} {
+		created, err := keysRepo.InsertKey(ctx, name, scopes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.keys[name] = created.Key
+	}
+
+	authenticator, err := auth.NewAuthenticator(keysRepo, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor := audit.NewAuditor(env.repo)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		env.bodies = append(env.bodies, string(body))
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	r := mux.NewRouter()
+	r.Use(auditor.Middleware, authenticator.Middleware)
+	authenticator.Require(auth.ScopeSegmentsWrite, r.HandleFunc("/api/update_user_segments", handler).Methods("POST"))
+	authenticator.Require(auth.ScopeSegmentsRead, r.HandleFunc("/api/get_user_segments", handler).Methods("GET"))
+	auditor.Audit(authenticator.Require(auth.ScopeSegmentsRead,
+		r.HandleFunc("/api/get_user_history", handler).Methods("GET")))
+	env.router = r
+	return env
+}
+
+func (env *testEnv) serve(method, path, body, key string) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.RemoteAddr = "10.0.0.1:1234"
+	if key != "" {
+		req.Header.Set(auth.APIKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	env.router.ServeHTTP(w, req)
+	return w.Code
+}
+
+// entries returns the recorded entries, oldest first.
+func (env *testEnv) entries(t *testing.T) []audit.Entry {
+	t.Helper()
+
+	entries, err := env.repo.GetEntries(context.Background(), &audit.Query{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+func (env *testEnv) onlyEntry(t *testing.T) audit.Entry {
+	t.Helper()
+
+	entries := env.entries(t)
+	if len(entries) != 1 {
+		t.Fatalf("%d entries recorded, expected 1", len(entries))
+	}
+	return entries[0]
+}
+
+func TestMiddlewareRecordsActor(t *testing.T) {
+	const body = `{"user_id": 1000}`
+
+	tests := []struct {
+		name   string
+		key    func(env *testEnv) string
+		status int
+		actor  string
+		result string
+	}{
+		{"without a key", func(*testEnv) string { return "" }, http.StatusUnauthorized, "anonymous",
+			audit.ResultFailure},
+		{"with an invalid key", func(*testEnv) string { return "us_invalid" }, http.StatusUnauthorized, "anonymous",
+			audit.ResultFailure},
+		{"without the scope", func(env *testEnv) string { return env.keys["reader"] }, http.StatusForbidden, "reader",
+			audit.ResultFailure},
+		{"authenticated", func(env *testEnv) string { return env.keys["writer"] }, http.StatusCreated, "writer",
+			audit.ResultSuccess},
+		{"bootstrap key", func(*testEnv) string { return testBootstrapKey }, http.StatusCreated, "bootstrap",
+			audit.ResultSuccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+
+			if status := env.serve(http.MethodPost, "/api/update_user_segments", body, tt.key(env)); status != tt.status {
+				t.Fatalf("status %d, expected %d", status, tt.status)
+			}
+
+			entry := env.onlyEntry(t)
+			digest := sha256.Sum256([]byte(body))
+			if entry.Actor != tt.actor || entry.Status != tt.status || entry.Result != tt.result {
+				t.Fatalf("entry by %s with status %d and result %s, expected %s, %d and %s",
+					entry.Actor, entry.Status, entry.Result, tt.actor, tt.status, tt.result)
+			}
+			if entry.Method != http.MethodPost || entry.Endpoint != "/api/update_user_segments" ||
+				entry.IP != "10.0.0.1" || entry.PayloadDigest != hex.EncodeToString(digest[:]) {
+				t.Fatalf("unexpected entry %+v", entry)
+			}
+		})
+	}
+}
+
+func TestMiddlewarePassesBodyOn(t *testing.T) {
+	env := newTestEnv(t)
+	body := `{"user_id": 1000, "assign_segments": ["AVITO_VOICE_MESSAGES"]}`
+
+	if status := env.serve(http.MethodPost, "/api/update_user_segments", body, env.keys["writer"]); status != http.StatusCreated {
+		t.Fatalf("status %d, expected %d", status, http.StatusCreated)
+	}
+	if len(env.bodies) != 1 || env.bodies[0] != body {
+		t.Fatalf("handler read %q, expected the whole body", env.bodies)
+	}
+}
+
+func TestMiddlewareRejectsLargeBodies(t *testing.T) {
+	env := newTestEnv(t)
+	body := `{"user_ids": [` + strings.Repeat("1000, ", 1<<20/6) + `1000]}`
+
+	status := env.serve(http.MethodPost, "/api/update_user_segments", body, env.keys["writer"])
+	if status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, expected %d", status, http.StatusRequestEntityTooLarge)
+	}
+	if len(env.bodies) != 0 {
+		t.Fatal("handler called with a body over the limit")
+	}
+
+	// the body is not read, so neither the caller nor the targets are known
+	entry := env.onlyEntry(t)
+	if entry.Status != http.StatusRequestEntityTooLarge || entry.Result != audit.ResultFailure ||
+		entry.Actor != "anonymous" || len(entry.UserIDs) != 0 {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+}
+
+func TestMiddlewareRecordsTargets(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		segments []string
+		userIDs  []int
+	}{
+		{
+			"change set",
+			`{"user_id": 1000, "assign_segments": ["A", "B"], "unassign_segments": ["C"]}`,
+			[]string{"A", "B", "C"},
+			[]int{1000},
+		},
+		{"segment", `{"segment_slug": "A", "fraction": 10}`, []string{"A"}, nil},
+		{"users", `{"user_ids": [1000, 1001], "segments": ["A"]}`, []string{"A"}, []int{1000, 1001}},
+		{"not json", `user_id=1000`, nil, nil},
+		{"other fields", `{"name": "ci", "scopes": ["admin"]}`, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.serve(http.MethodPost, "/api/update_user_segments", tt.body, env.keys["writer"])
+
+			entry := env.onlyEntry(t)
+			sort.Strings(entry.Segments)
+			sort.Ints(entry.UserIDs)
+			if strings.Join(entry.Segments, ",") != strings.Join(tt.segments, ",") {
+				t.Fatalf("segments %v recorded, expected %v", entry.Segments, tt.segments)
+			}
+			if len(entry.UserIDs) != len(tt.userIDs) {
+				t.Fatalf("users %v recorded, expected %v", entry.UserIDs, tt.userIDs)
+			}
+			for i := range tt.userIDs {
+				if entry.UserIDs[i] != tt.userIDs[i] {
+					t.Fatalf("users %v recorded, expected %v", entry.UserIDs, tt.userIDs)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareRecordsAuditedReads(t *testing.T) {
+	env := newTestEnv(t)
+
+	env.serve(http.MethodGet, "/api/get_user_segments", `{"user_id": 1000}`, env.keys["reader"])
+	if entries := env.entries(t); len(entries) != 0 {
+		t.Fatalf("read recorded: %+v", entries)
+	}
+
+	env.serve(http.MethodGet, "/api/get_user_history", `{"user_id": 1000}`, env.keys["reader"])
+	entry := env.onlyEntry(t)
+	if entry.Method != http.MethodGet || entry.Endpoint != "/api/get_user_history" || entry.Actor != "reader" {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+	if len(entry.UserIDs) != 1 || entry.UserIDs[0] != 1000 {
+		t.Fatalf("users %v recorded, expected [1000]", entry.UserIDs)
+	}
+	if len(env.bodies) != 2 || env.bodies[1] != `{"user_id": 1000}` {
+		t.Fatalf("handler read %q", env.bodies)
+	}
+}
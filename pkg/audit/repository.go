@@ -0,0 +1,220 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/logging"
+)
+
+type Repository interface {
+	InsertEntry(ctx context.Context, entry *Entry) error
+	GetEntries(ctx context.Context, query *Query) ([]Entry, error)
+}
+
+type auditRepository struct {
+	db      *sql.DB
+	dialect dialect.Dialect
+	cfg     *config.Config
+	Logger  *slog.Logger
+}
+
+func NewAuditRepo(db *sql.DB, cfg *config.Config) Repository {
+	return &auditRepository{
+		db:      db,
+		dialect: dialect.For(cfg),
+		cfg:     cfg,
+		Logger:  logging.For("audit_repo"),
+	}
+}
+
+func (ar *auditRepository) InsertEntry(ctx context.Context, entry *Entry) error {
+	tx, err := ar.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", errors.ErrorBeginTransaction, err)
+	}
+
+	entry.ID, err = ar.dialect.InsertID(
+		ctx,
+		tx,
+		ar.dialect.Rebind("INSERT INTO audit_log (created_at, actor, ip, method, endpoint, payload_digest, status) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?)"),
+		entry.Time,
+		entry.Actor,
+		entry.IP,
+		entry.Method,
+		entry.Endpoint,
+		entry.PayloadDigest,
+		entry.Status,
+	)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return err
+	}
+
+	for _, slug := range entry.Segments {
+		_, err = tx.ExecContext(
+			ctx,
+			ar.dialect.Rebind(ar.dialect.InsertIgnore("INSERT INTO audit_log_segments (audit_id, segment_slug) VALUES (?, ?)")),
+			entry.ID,
+			slug,
+		)
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+			}
+			return err
+		}
+	}
+
+	for _, userID := range entry.UserIDs {
+		_, err = tx.ExecContext(
+			ctx,
+			ar.dialect.Rebind(ar.dialect.InsertIgnore("INSERT INTO audit_log_users (audit_id, user_id) VALUES (?, ?)")),
+			entry.ID,
+			userID,
+		)
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+			}
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("%s: %w", errors.ErrorCommittingTransaction, err)
+	}
+	return nil
+}
+
+func (ar *auditRepository) GetEntries(ctx context.Context, query *Query) ([]Entry, error) {
+	conditions := []string{"TRUE"}
+	args := []interface{}{}
+
+	if query.Actor != "" {
+		conditions = append(conditions, "a.actor = ?")
+		args = append(args, query.Actor)
+	}
+	if query.SegmentSlug != "" {
+		conditions = append(conditions, "a.id IN (SELECT audit_id FROM audit_log_segments WHERE segment_slug = ?)")
+		args = append(args, query.SegmentSlug)
+	}
+	if query.UserID != 0 {
+		conditions = append(conditions, "a.id IN (SELECT audit_id FROM audit_log_users WHERE user_id = ?)")
+		args = append(args, query.UserID)
+	}
+	if !query.StartTime.IsZero() {
+		conditions = append(conditions, "a.created_at >= ?")
+		args = append(args, query.StartTime.UTC())
+	}
+	if !query.EndTime.IsZero() {
+		conditions = append(conditions, "a.created_at < ?")
+		args = append(args, query.EndTime.UTC())
+	}
+	args = append(args, query.Limit)
+
+	rows, err := ar.db.QueryContext(
+		ctx,
+		ar.dialect.Rebind("SELECT a.id, a.created_at, a.actor, a.ip, a.method, a.endpoint, a.payload_digest, a.status "+
+			"FROM audit_log a WHERE "+strings.Join(conditions, " AND ")+
+			" ORDER BY a.id DESC LIMIT ?"),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	byID := map[int64]int{}
+	for rows.Next() {
+		entry := Entry{Segments: []string{}, UserIDs: []int{}}
+		err = rows.Scan(
+			&entry.ID,
+			&entry.Time,
+			&entry.Actor,
+			&entry.IP,
+			&entry.Method,
+			&entry.Endpoint,
+			&entry.PayloadDigest,
+			&entry.Status,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entry.Result = resultOf(entry.Status)
+		byID[entry.ID] = len(entries)
+		entries = append(entries, entry)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return entries, nil
+	}
+
+	ids := make([]interface{}, 0, len(entries))
+	for i := range entries {
+		ids = append(ids, entries[i].ID)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+
+	rows, err = ar.db.QueryContext(
+		ctx,
+		ar.dialect.Rebind("SELECT audit_id, segment_slug FROM audit_log_segments WHERE audit_id IN ("+placeholders+")"),
+		ids...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var slug string
+		err = rows.Scan(&id, &slug)
+		if err != nil {
+			return nil, err
+		}
+		entries[byID[id]].Segments = append(entries[byID[id]].Segments, slug)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = ar.db.QueryContext(
+		ctx,
+		ar.dialect.Rebind("SELECT audit_id, user_id FROM audit_log_users WHERE audit_id IN ("+placeholders+")"),
+		ids...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var userID int
+		err = rows.Scan(&id, &userID)
+		if err != nil {
+			return nil, err
+		}
+		entries[byID[id]].UserIDs = append(entries[byID[id]].UserIDs, userID)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
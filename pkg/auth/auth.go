@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	ScopeSegmentsRead  = "segments:read"
+	ScopeSegmentsWrite = "segments:write"
+	ScopeHistoryRead   = "history:read"
+	ScopeAdmin         = "admin"
+
+	APIKeyHeader = "X-API-Key"
+)
+
+type principalKey struct{}
+
+// Principal is the authenticated caller of a request: an API key or
+// an identity provider user, who belongs to Team.
+type Principal struct {
+	Name   string   `json:"name"`
+	KeyID  int      `json:"key_id,omitempty"`
+	Team   string   `json:"team,omitempty"`
+	Scopes []string `json:"scopes"`
+}
+
+// HasScope reports whether the principal is granted scope. Admin implies every scope.
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// CanModifySegment reports whether the principal may change a segment owned
+// by ownerTeam. Only users are bound to teams: API keys, admins and
+// segments without an owner are governed by scopes alone.
+func (p *Principal) CanModifySegment(ownerTeam string) bool {
+	if !p.HasScope(ScopeSegmentsWrite) {
+		return false
+	}
+	if p.KeyID != 0 || p.Name == bootstrapPrincipal || p.HasScope(ScopeAdmin) || ownerTeam == "" {
+		return true
+	}
+	return p.Team == ownerTeam
+}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	if slot, ok := ctx.Value(principalSlotKey{}).(*principalSlot); ok {
+		slot.principal = p
+	}
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalSlot is where WithPrincipal leaves the principal for the
+// middlewares running before the authenticator.
+type principalSlot struct {
+	principal *Principal
+}
+
+type principalSlotKey struct{}
+
+// TrackPrincipal lets a middleware running before the authenticator learn who
+// the caller was: once the request has been served, the returned function
+// reports the principal authenticated further down, if any.
+func TrackPrincipal(ctx context.Context) (context.Context, func() (*Principal, bool)) {
+	slot := &principalSlot{}
+	return context.WithValue(ctx, principalSlotKey{}, slot), func() (*Principal, bool) {
+		return slot.principal, slot.principal != nil
+	}
+}
+
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// ClientKey identifies the caller of r by API key or user, an anonymous one
+// by IP address.
+func ClientKey(r *http.Request) string {
+	if principal, ok := PrincipalFromContext(r.Context()); ok {
+		if principal.KeyID != 0 {
+			return "key:" + strconv.Itoa(principal.KeyID)
+		}
+		return "principal:" + principal.Name
+	}
+	return IPKey(r)
+}
+
+// IPKey identifies the caller of r by IP address alone.
+func IPKey(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
+
+func IsValidScope(scope string) bool {
+	switch scope {
+	case ScopeSegmentsRead, ScopeSegmentsWrite, ScopeHistoryRead, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+type APIKey struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type RequestCreateKey struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type RequestKeyID struct {
+	ID int `json:"id"`
+}
+
+// ResponseCreatedKey is the only place where the plaintext key is ever returned.
+type ResponseCreatedKey struct {
+	APIKey
+	Key string `json:"key"`
+}
@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"usersegmentator/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	RoleAdmin = "admin"
+
+	jwksFetchTimeout   = 10 * time.Second
+	jwksMinRefetchWait = time.Minute
+)
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// JWTVerifier validates identity provider tokens against a JWKS read from
+// a local file or fetched from a URL. Keys are refetched when a token
+// names an unknown key ID, so provider key rotation needs no restart.
+type JWTVerifier struct {
+	jwksURL    string
+	jwksFile   string
+	issuer     string
+	audience   string
+	teamClaim  string
+	rolesClaim string
+	client     *http.Client
+
+	mu          sync.RWMutex
+	keys        map[string]interface{}
+	lastFetched time.Time
+}
+
+func NewJWTVerifier(ctx context.Context, cfg *config.Config) (*JWTVerifier, error) {
+	v := &JWTVerifier{
+		jwksURL:    cfg.Auth.JWKSURL,
+		jwksFile:   cfg.Auth.JWKSFile,
+		issuer:     cfg.Auth.Issuer,
+		audience:   cfg.Auth.Audience,
+		teamClaim:  cfg.Auth.TeamClaim,
+		rolesClaim: cfg.Auth.RolesClaim,
+		client:     &http.Client{Timeout: jwksFetchTimeout},
+		keys:       map[string]interface{}{},
+	}
+
+	err := v.loadKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// LooksLikeJWT tells JWTs apart from API keys presented as bearer tokens.
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify checks the token signature and standard claims and maps the
+// token to a principal. Callers with the admin role get the admin scope,
+// everyone else may read and write, subject to segment ownership.
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (*Principal, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if v.issuer != "" {
+		options = append(options, jwt.WithIssuer(v.issuer))
+	}
+	if v.audience != "" {
+		options = append(options, jwt.WithAudience(v.audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.key(ctx, kid)
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+
+	principal := &Principal{
+		Name:   subject,
+		Scopes: []string{ScopeSegmentsRead, ScopeSegmentsWrite, ScopeHistoryRead},
+	}
+	principal.Team, _ = claims[v.teamClaim].(string)
+
+	roles, _ := claims[v.rolesClaim].([]interface{})
+	for _, role := range roles {
+		if role == RoleAdmin {
+			principal.Scopes = []string{ScopeAdmin}
+		}
+	}
+
+	return principal, nil
+}
+
+func (v *JWTVerifier) key(ctx context.Context, kid string) (interface{}, error) {
+	v.mu.RLock()
+	key, ok := v.keys[kid]
+	canRefetch := v.jwksURL != "" && time.Since(v.lastFetched) > jwksMinRefetchWait
+	v.mu.RUnlock()
+
+	if ok {
+		return key, nil
+	}
+	if !canRefetch {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	err := v.loadKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if key, ok = v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+func (v *JWTVerifier) loadKeys(ctx context.Context) error {
+	var raw []byte
+	var err error
+
+	switch {
+	case v.jwksFile != "":
+		raw, err = os.ReadFile(v.jwksFile)
+	case v.jwksURL != "":
+		raw, err = v.fetchJWKS(ctx)
+	default:
+		return fmt.Errorf("neither jwks file nor jwks url is configured")
+	}
+	if err != nil {
+		return fmt.Errorf("error loading jwks: %w", err)
+	}
+
+	set := &jwks{}
+	err = json.Unmarshal(raw, set)
+	if err != nil {
+		return fmt.Errorf("error parsing jwks: %w", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for i := range set.Keys {
+		key, err := set.Keys[i].publicKey()
+		if err != nil {
+			return fmt.Errorf("jwks key %q: %w", set.Keys[i].Kid, err)
+		}
+		keys[set.Keys[i].Kid] = key
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.lastFetched = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *JWTVerifier) fetchJWKS(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,301 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"usersegmentator/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer   = "https://idp.example.com"
+	testAudience = "usersegmentator"
+)
+
+// signingKey is a key of the test identity provider.
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	key    crypto.Signer
+}
+
+func newRSAKey(t *testing.T, kid string) *signingKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signingKey{kid: kid, method: jwt.SigningMethodRS256, key: key}
+}
+
+func newECKey(t *testing.T, kid string) *signingKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signingKey{kid: kid, method: jwt.SigningMethodES256, key: key}
+}
+
+func (sk *signingKey) jwk() jwk {
+	encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+
+	switch public := sk.key.Public().(type) {
+	case *rsa.PublicKey:
+		return jwk{Kid: sk.kid, Kty: "RSA", N: encode(public.N), E: encode(big.NewInt(int64(public.E)))}
+	case *ecdsa.PublicKey:
+		// P-256 coordinates are 32 bytes long, the encoding must keep leading zeros
+		x, y := make([]byte, 32), make([]byte, 32)
+		public.X.FillBytes(x)
+		public.Y.FillBytes(y)
+		return jwk{Kid: sk.kid, Kty: "EC", Crv: "P-256",
+			X: base64.RawURLEncoding.EncodeToString(x), Y: base64.RawURLEncoding.EncodeToString(y)}
+	}
+	panic("unsupported key")
+}
+
+func (sk *signingKey) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(sk.method, claims)
+	token.Header["kid"] = sk.kid
+	signed, err := token.SignedString(sk.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func encodeJWKS(t *testing.T, keys ...*signingKey) []byte {
+	t.Helper()
+
+	set := jwks{}
+	for _, key := range keys {
+		set.Keys = append(set.Keys, key.jwk())
+	}
+	raw, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func jwtConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.Auth.Issuer = testIssuer
+	cfg.Auth.Audience = testAudience
+	cfg.Auth.TeamClaim = "team"
+	cfg.Auth.RolesClaim = "roles"
+	return cfg
+}
+
+// newFileVerifier reads the keys from a local JWKS file.
+func newFileVerifier(t *testing.T, keys ...*signingKey) *JWTVerifier {
+	t.Helper()
+
+	cfg := jwtConfig()
+	cfg.Auth.JWKSFile = filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(cfg.Auth.JWKSFile, encodeJWKS(t, keys...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewJWTVerifier(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// userClaims are valid claims of a user, changed by the test cases.
+func userClaims(changes func(jwt.MapClaims)) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"sub":  "alice",
+		"iss":  testIssuer,
+		"aud":  testAudience,
+		"exp":  time.Now().Add(time.Hour).Unix(),
+		"team": "growth",
+	}
+	if changes != nil {
+		changes(claims)
+	}
+	return claims
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey := newRSAKey(t, "rsa")
+	ecKey := newECKey(t, "ec")
+	unknownKey := newRSAKey(t, "unknown")
+	// a key claiming the kid of a trusted one
+	forgedKey := newRSAKey(t, "rsa")
+	v := newFileVerifier(t, rsaKey, ecKey)
+
+	hmacToken := jwt.NewWithClaims(jwt.SigningMethodHS256, userClaims(nil))
+	hmacToken.Header["kid"] = "rsa"
+	hmacSigned, err := hmacToken.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		team   string
+		scopes []string
+		ok     bool
+	}{
+		{"rsa user", rsaKey.sign(t, userClaims(nil)), "growth",
+			[]string{ScopeSegmentsRead, ScopeSegmentsWrite, ScopeHistoryRead}, true},
+		{"ec user", ecKey.sign(t, userClaims(nil)), "growth",
+			[]string{ScopeSegmentsRead, ScopeSegmentsWrite, ScopeHistoryRead}, true},
+		{"admin", rsaKey.sign(t, userClaims(func(c jwt.MapClaims) { c["roles"] = []string{"viewer", RoleAdmin} })),
+			"growth", []string{ScopeAdmin}, true},
+		{"without team", rsaKey.sign(t, userClaims(func(c jwt.MapClaims) { delete(c, "team") })), "",
+			[]string{ScopeSegmentsRead, ScopeSegmentsWrite, ScopeHistoryRead}, true},
+		{"expired", rsaKey.sign(t, userClaims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() })),
+			"", nil, false},
+		{"without expiry", rsaKey.sign(t, userClaims(func(c jwt.MapClaims) { delete(c, "exp") })), "", nil, false},
+		{"not valid yet", rsaKey.sign(t, userClaims(func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(time.Hour).Unix() })),
+			"", nil, false},
+		{"other issuer", rsaKey.sign(t, userClaims(func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" })),
+			"", nil, false},
+		{"other audience", rsaKey.sign(t, userClaims(func(c jwt.MapClaims) { c["aud"] = "billing" })), "", nil, false},
+		{"without subject", rsaKey.sign(t, userClaims(func(c jwt.MapClaims) { delete(c, "sub") })), "", nil, false},
+		{"unknown key", unknownKey.sign(t, userClaims(nil)), "", nil, false},
+		{"forged signature", forgedKey.sign(t, userClaims(nil)), "", nil, false},
+		{"hmac", hmacSigned, "", nil, false},
+		{"garbage", "a.b.c", "", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := v.Verify(context.Background(), tt.token)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("token accepted as %+v", principal)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if principal.Name != "alice" || principal.Team != tt.team || principal.KeyID != 0 {
+				t.Fatalf("unexpected principal %+v", principal)
+			}
+			if len(principal.Scopes) != len(tt.scopes) {
+				t.Fatalf("scopes %v, expected %v", principal.Scopes, tt.scopes)
+			}
+			for i := range tt.scopes {
+				if principal.Scopes[i] != tt.scopes[i] {
+					t.Fatalf("scopes %v, expected %v", principal.Scopes, tt.scopes)
+				}
+			}
+		})
+	}
+}
+
+// jwksServer is an identity provider serving its current keys.
+type jwksServer struct {
+	mu      sync.Mutex
+	keys    []*signingKey
+	fetches int
+}
+
+func (s *jwksServer) rotate(keys ...*signingKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func newJWKSServer(t *testing.T, keys ...*signingKey) (*jwksServer, string) {
+	s := &jwksServer{keys: keys}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+		_, _ = w.Write(encodeJWKS(t, s.keys...))
+	}))
+	t.Cleanup(server.Close)
+	return s, server.URL
+}
+
+func TestVerifyFetchesRotatedKeys(t *testing.T) {
+	oldKey := newRSAKey(t, "old")
+	newKey := newECKey(t, "new")
+	idp, url := newJWKSServer(t, oldKey)
+
+	cfg := jwtConfig()
+	cfg.Auth.JWKSURL = url
+	v, err := NewJWTVerifier(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err = v.Verify(ctx, oldKey.sign(t, userClaims(nil))); err != nil {
+		t.Fatal(err)
+	}
+
+	idp.rotate(oldKey, newKey)
+	newToken := newKey.sign(t, userClaims(nil))
+
+	// unknown key IDs do not refetch the keys more than once a minute
+	if _, err = v.Verify(ctx, newToken); err == nil {
+		t.Fatal("token verified without refetching the keys")
+	}
+	if idp.fetches != 1 {
+		t.Fatalf("keys fetched %d times, expected 1", idp.fetches)
+	}
+
+	v.mu.Lock()
+	v.lastFetched = time.Now().Add(-2 * jwksMinRefetchWait)
+	v.mu.Unlock()
+
+	if _, err = v.Verify(ctx, newToken); err != nil {
+		t.Fatal(err)
+	}
+	if idp.fetches != 2 {
+		t.Fatalf("keys fetched %d times, expected 2", idp.fetches)
+	}
+
+	// keys that are known do not refetch anything
+	if _, err = v.Verify(ctx, oldKey.sign(t, userClaims(nil))); err != nil {
+		t.Fatal(err)
+	}
+	if idp.fetches != 2 {
+		t.Fatalf("keys fetched %d times, expected 2", idp.fetches)
+	}
+}
+
+func TestNewJWTVerifierRejectsBadJWKS(t *testing.T) {
+	cfg := jwtConfig()
+	if _, err := NewJWTVerifier(context.Background(), cfg); err == nil {
+		t.Fatal("verifier created without keys")
+	}
+
+	cfg.Auth.JWKSFile = filepath.Join(t.TempDir(), "jwks.json")
+	err := os.WriteFile(cfg.Auth.JWKSFile, []byte(`{"keys": [{"kid": "k", "kty": "oct"}]}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewJWTVerifier(context.Background(), cfg); err == nil {
+		t.Fatal("verifier created with an unsupported key")
+	}
+}
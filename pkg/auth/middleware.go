@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"usersegmentator/config"
+	"usersegmentator/pkg/logging"
+
+	"github.com/gorilla/mux"
+)
+
+const bootstrapPrincipal = "bootstrap"
+
+// placeholderBootstrapKeys are example values that must not guard a deployment.
+var placeholderBootstrapKeys = map[string]bool{
+	"us_bootstrap_admin": true,
+	"bootstrap":          true,
+	"changeme":           true,
+	"change_me":          true,
+	"secret":             true,
+}
+
+// Authenticator is the router middleware checking API keys against
+// the scope each route requires. Routes without a registered scope are admin-only,
+// routes marked public skip authentication altogether.
+type Authenticator struct {
+	repo             Repository
+	jwt              *JWTVerifier
+	enabled          bool
+	bootstrapKeyHash string
+	routeScopes      map[*mux.Route]string
+	publicRoutes     map[*mux.Route]bool
+	Logger           *slog.Logger
+}
+
+// NewAuthenticator creates the middleware; jwtVerifier may be nil
+// when identity provider tokens are not accepted. With authentication enabled
+// it refuses a missing or placeholder bootstrap key, as anyone knowing it is
+// an administrator.
+func NewAuthenticator(repo Repository, jwtVerifier *JWTVerifier, cfg *config.Config) (*Authenticator, error) {
+	key := strings.TrimSpace(cfg.Auth.BootstrapKey)
+	if cfg.Auth.Enabled && (key == "" || placeholderBootstrapKeys[strings.ToLower(key)]) {
+		return nil, fmt.Errorf("AUTH_BOOTSTRAP_KEY must be set to a secret value when authentication is enabled")
+	}
+
+	a := &Authenticator{
+		repo:         repo,
+		jwt:          jwtVerifier,
+		enabled:      cfg.Auth.Enabled,
+		routeScopes:  make(map[*mux.Route]string),
+		publicRoutes: make(map[*mux.Route]bool),
+		Logger:       logging.For("auth"),
+	}
+	if cfg.Auth.BootstrapKey != "" {
+		a.bootstrapKeyHash = HashKey(cfg.Auth.BootstrapKey)
+	}
+	return a, nil
+}
+
+// Require registers the scope needed to call route and returns the route.
+func (a *Authenticator) Require(scope string, route *mux.Route) *mux.Route {
+	a.routeScopes[route] = scope
+	return route
+}
+
+// Public lets route be called without credentials and returns the route.
+func (a *Authenticator) Public(route *mux.Route) *mux.Route {
+	a.publicRoutes[route] = true
+	return route
+}
+
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.enabled || a.publicRoutes[mux.CurrentRoute(r)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := ExtractKey(r)
+		if key == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		principal, err := a.authenticate(r, key)
+		if err != nil {
+			a.Logger.WarnContext(r.Context(), "rejected credentials", "remote_addr", r.RemoteAddr, logging.Err(err))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// set before the scope check, so that a forbidden call is audited with its caller
+		ctx := WithPrincipal(r.Context(), principal)
+
+		scope, ok := a.routeScopes[mux.CurrentRoute(r)]
+		if !ok {
+			scope = ScopeAdmin
+		}
+		if !principal.HasScope(scope) {
+			a.Logger.WarnContext(ctx, "missing scope", "principal", principal.Name, "scope", scope,
+				"method", r.Method, "path", r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (a *Authenticator) authenticate(r *http.Request, key string) (*Principal, error) {
+	if a.jwt != nil && LooksLikeJWT(key) {
+		return a.jwt.Verify(r.Context(), key)
+	}
+	if a.bootstrapKeyHash != "" &&
+		subtle.ConstantTimeCompare([]byte(HashKey(key)), []byte(a.bootstrapKeyHash)) == 1 {
+		return &Principal{Name: bootstrapPrincipal, Scopes: []string{ScopeAdmin}}, nil
+	}
+	return a.repo.Authenticate(r.Context(), key)
+}
+
+// ExtractKey reads the key from the X-API-Key header or a bearer token.
+func ExtractKey(r *http.Request) string {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+
+	const bearer = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) > len(bearer) && strings.EqualFold(header[:len(bearer)], bearer) {
+		return header[len(bearer):]
+	}
+	return ""
+}
@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+const testBootstrapKey = "bootstrap-secret"
+
+// keysRepo is a stand-in for the API keys table.
+type keysRepo struct {
+	keys map[string]*Principal
+}
+
+func (kr *keysRepo) InsertKey(context.Context, string, []string) (*ResponseCreatedKey, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (kr *keysRepo) GetKeys(context.Context) ([]APIKey, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (kr *keysRepo) RevokeKey(context.Context, int) error {
+	return errors.New("not implemented")
+}
+
+func (kr *keysRepo) Authenticate(_ context.Context, key string) (*Principal, error) {
+	if principal, ok := kr.keys[key]; ok {
+		return principal, nil
+	}
+	return nil, errors.New("invalid api key")
+}
+
+// newTestRouter serves one route per scope, plus an admin-only route
+// registered without a scope and a public one. Every route answers with
+// the name of the authenticated principal.
+func newTestRouter(t *testing.T, verifier *JWTVerifier, enabled bool) http.Handler {
+	t.Helper()
+
+	cfg := jwtConfig()
+	cfg.Auth.Enabled = enabled
+	cfg.Auth.BootstrapKey = testBootstrapKey
+	a, err := NewAuthenticator(&keysRepo{keys: map[string]*Principal{
+		"reader":  {Name: "reader", KeyID: 1, Scopes: []string{ScopeSegmentsRead}},
+		"writer":  {Name: "writer", KeyID: 2, Scopes: []string{ScopeSegmentsRead, ScopeSegmentsWrite}},
+		"auditor": {Name: "auditor", KeyID: 3, Scopes: []string{ScopeHistoryRead}},
+		"admin":   {Name: "admin", KeyID: 4, Scopes: []string{ScopeAdmin}},
+	}}, verifier, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := PrincipalFromContext(r.Context())
+		if ok {
+			_, _ = w.Write([]byte(principal.Name))
+		}
+	}
+
+	r := mux.NewRouter()
+	r.Use(a.Middleware)
+	a.Require(ScopeSegmentsRead, r.HandleFunc("/read", handler))
+	a.Require(ScopeSegmentsWrite, r.HandleFunc("/write", handler))
+	a.Require(ScopeHistoryRead, r.HandleFunc("/history", handler))
+	r.HandleFunc("/admin", handler)
+	a.Public(r.HandleFunc("/public", handler))
+	return r
+}
+
+func serve(h http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func apiKey(key string) http.Header {
+	header := http.Header{}
+	header.Set(APIKeyHeader, key)
+	return header
+}
+
+func bearer(token string) http.Header {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	return header
+}
+
+func TestMiddlewareScopes(t *testing.T) {
+	idpKey := newRSAKey(t, "idp")
+	h := newTestRouter(t, newFileVerifier(t, idpKey), true)
+
+	userToken := idpKey.sign(t, userClaims(nil))
+	adminToken := idpKey.sign(t, userClaims(func(c jwt.MapClaims) { c["roles"] = []string{RoleAdmin} }))
+
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+	}{
+		{"no credentials", "/read", nil, http.StatusUnauthorized},
+		{"unknown key", "/read", apiKey("nope"), http.StatusUnauthorized},
+		{"invalid token", "/read", bearer("a.b.c"), http.StatusUnauthorized},
+		{"public without credentials", "/public", nil, http.StatusOK},
+
+		{"reader reads", "/read", apiKey("reader"), http.StatusOK},
+		{"reader writes", "/write", apiKey("reader"), http.StatusForbidden},
+		{"reader reads history", "/history", apiKey("reader"), http.StatusForbidden},
+		{"writer writes", "/write", apiKey("writer"), http.StatusOK},
+		{"writer as bearer", "/write", bearer("writer"), http.StatusOK},
+		{"writer administers", "/admin", apiKey("writer"), http.StatusForbidden},
+		{"auditor reads history", "/history", apiKey("auditor"), http.StatusOK},
+		{"auditor reads", "/read", apiKey("auditor"), http.StatusForbidden},
+		{"admin reads", "/read", apiKey("admin"), http.StatusOK},
+		{"admin writes", "/write", apiKey("admin"), http.StatusOK},
+		{"admin administers", "/admin", apiKey("admin"), http.StatusOK},
+		{"bootstrap administers", "/admin", apiKey(testBootstrapKey), http.StatusOK},
+
+		{"user reads", "/read", bearer(userToken), http.StatusOK},
+		{"user writes", "/write", bearer(userToken), http.StatusOK},
+		{"user reads history", "/history", bearer(userToken), http.StatusOK},
+		{"user administers", "/admin", bearer(userToken), http.StatusForbidden},
+		{"admin user administers", "/admin", bearer(adminToken), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(h, tt.path, tt.header)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, expected %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestMiddlewareSetsPrincipal(t *testing.T) {
+	idpKey := newRSAKey(t, "idp")
+	h := newTestRouter(t, newFileVerifier(t, idpKey), true)
+
+	if body := serve(h, "/read", apiKey("reader")).Body.String(); body != "reader" {
+		t.Fatalf("principal %q, expected the api key", body)
+	}
+	if body := serve(h, "/read", bearer(idpKey.sign(t, userClaims(nil)))).Body.String(); body != "alice" {
+		t.Fatalf("principal %q, expected the token subject", body)
+	}
+}
+
+func TestMiddlewareWithoutJWT(t *testing.T) {
+	idpKey := newRSAKey(t, "idp")
+	h := newTestRouter(t, nil, true)
+
+	// without a verifier, tokens are looked up as api keys
+	if w := serve(h, "/read", bearer(idpKey.sign(t, userClaims(nil)))); w.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, expected %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestMiddlewareDisabled(t *testing.T) {
+	h := newTestRouter(t, nil, false)
+
+	if w := serve(h, "/admin", nil); w.Code != http.StatusOK {
+		t.Fatalf("status %d, expected %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestCanModifySegment(t *testing.T) {
+	user := &Principal{Name: "alice", Team: "growth", Scopes: []string{ScopeSegmentsRead, ScopeSegmentsWrite}}
+	reader := &Principal{Name: "bob", Team: "growth", Scopes: []string{ScopeSegmentsRead}}
+	admin := &Principal{Name: "carol", Team: "growth", Scopes: []string{ScopeAdmin}}
+	key := &Principal{Name: "ci", KeyID: 1, Scopes: []string{ScopeSegmentsWrite}}
+	bootstrap := &Principal{Name: bootstrapPrincipal, Scopes: []string{ScopeAdmin}}
+
+	tests := []struct {
+		name      string
+		principal *Principal
+		owner     string
+		ok        bool
+	}{
+		{"own team", user, "growth", true},
+		{"other team", user, "billing", false},
+		{"unowned segment", user, "", true},
+		{"reader", reader, "growth", false},
+		{"reader of unowned segment", reader, "", false},
+		{"admin of other team", admin, "billing", true},
+		{"api key", key, "billing", true},
+		{"bootstrap", bootstrap, "billing", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.principal.CanModifySegment(tt.owner); got != tt.ok {
+				t.Fatalf("CanModifySegment(%q) = %v, expected %v", tt.owner, got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNewAuthenticatorRequiresBootstrapKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		key     string
+		valid   bool
+	}{
+		{"secret", true, testBootstrapKey, true},
+		{"empty", true, "", false},
+		{"blank", true, "  ", false},
+		{"shipped example", true, "us_bootstrap_admin", false},
+		{"placeholder", true, "CHANGEME", false},
+		{"auth disabled", false, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := jwtConfig()
+			cfg.Auth.Enabled = tt.enabled
+			cfg.Auth.BootstrapKey = tt.key
+
+			_, err := NewAuthenticator(&keysRepo{}, nil, cfg)
+			if (err == nil) != tt.valid {
+				t.Fatalf("NewAuthenticator returned %v, expected valid %t", err, tt.valid)
+			}
+		})
+	}
+}
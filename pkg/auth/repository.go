@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/logging"
+)
+
+const (
+	keyPrefix      = "us_"
+	keyRandomBytes = 32
+	keyPrefixLen   = 10
+)
+
+type Repository interface {
+	InsertKey(ctx context.Context, name string, scopes []string) (*ResponseCreatedKey, error)
+	GetKeys(ctx context.Context) ([]APIKey, error)
+	RevokeKey(ctx context.Context, id int) error
+	Authenticate(ctx context.Context, key string) (*Principal, error)
+}
+
+type apiKeysRepository struct {
+	db      *sql.DB
+	dialect dialect.Dialect
+	cfg     *config.Config
+	Logger  *slog.Logger
+}
+
+func NewAPIKeysRepo(db *sql.DB, cfg *config.Config) Repository {
+	return &apiKeysRepository{
+		db:      db,
+		dialect: dialect.For(cfg),
+		cfg:     cfg,
+		Logger:  logging.For("api_keys_repo"),
+	}
+}
+
+// HashKey returns the digest stored instead of the key itself. Keys are
+// random and long, so a plain SHA-256 is enough to make a leaked table useless.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (kr *apiKeysRepository) InsertKey(ctx context.Context, name string, scopes []string) (*ResponseCreatedKey, error) {
+	if name == "" {
+		return nil, fmt.Errorf("empty api key name")
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("api key must have at least one scope")
+	}
+	for _, scope := range scopes {
+		if !IsValidScope(scope) {
+			return nil, fmt.Errorf("unknown scope: %s", scope)
+		}
+	}
+
+	random := make([]byte, keyRandomBytes)
+	_, err := rand.Read(random)
+	if err != nil {
+		return nil, err
+	}
+	key := keyPrefix + hex.EncodeToString(random)
+
+	created := &ResponseCreatedKey{
+		APIKey: APIKey{
+			Name:      name,
+			Prefix:    key[:keyPrefixLen],
+			Scopes:    scopes,
+			CreatedAt: time.Now().UTC(),
+		},
+		Key: key,
+	}
+
+	id, err := kr.dialect.InsertID(
+		ctx,
+		kr.db,
+		kr.dialect.Rebind("INSERT INTO api_keys (name, key_prefix, key_hash, scopes, created_at) VALUES (?, ?, ?, ?, ?)"),
+		name,
+		created.Prefix,
+		HashKey(key),
+		strings.Join(scopes, ","),
+		created.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	created.ID = int(id)
+
+	kr.Logger.InfoContext(ctx, "InsertKey", "key_id", created.ID, "name", name)
+	return created, nil
+}
+
+func (kr *apiKeysRepository) GetKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := kr.db.QueryContext(
+		ctx,
+		"SELECT id, name, key_prefix, scopes, created_at, revoked_at FROM api_keys ORDER BY id",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		var scopes string
+		var revokedAt sql.NullTime
+		err = rows.Scan(&key.ID, &key.Name, &key.Prefix, &scopes, &key.CreatedAt, &revokedAt)
+		if err != nil {
+			return nil, err
+		}
+		key.Scopes = strings.Split(scopes, ",")
+		if revokedAt.Valid {
+			key.RevokedAt = &revokedAt.Time
+		}
+		keys = append(keys, key)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (kr *apiKeysRepository) RevokeKey(ctx context.Context, id int) error {
+	result, err := kr.db.ExecContext(
+		ctx,
+		kr.dialect.Rebind("UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL"),
+		id,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", errors.ErrorGettingAffectedRows, err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("api key %d not found or already revoked", id)
+	}
+
+	kr.Logger.InfoContext(ctx, "RevokeKey", "key_id", id)
+	return nil
+}
+
+// Authenticate resolves a presented key to its principal.
+// It returns an error for unknown and revoked keys.
+func (kr *apiKeysRepository) Authenticate(ctx context.Context, key string) (*Principal, error) {
+	principal := &Principal{}
+	var scopes string
+
+	err := kr.db.QueryRowContext(
+		ctx,
+		kr.dialect.Rebind("SELECT id, name, scopes FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL"),
+		HashKey(key),
+	).Scan(&principal.KeyID, &principal.Name, &scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	principal.Scopes = strings.Split(scopes, ",")
+	return principal, nil
+}
@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"usersegmentator/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	BackendMemory = "memory"
+	BackendRedis  = "redis"
+)
+
+// Cache keeps values for a limited time. A missing or expired key is
+// reported as not found rather than as an error.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+func New(cfg *config.Config) (Cache, error) {
+	switch cfg.Cache.Backend {
+	case BackendMemory:
+		return NewMemoryCache(cfg.Cache.Size), nil
+	case BackendRedis:
+		return NewRedisCache(redis.NewClient(&redis.Options{
+			Addr:     cfg.Cache.RedisAddr,
+			Password: cfg.Cache.RedisPassword,
+		})), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %s", cfg.Cache.Backend)
+	}
+}
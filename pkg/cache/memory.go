@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// MemoryCache is a least recently used cache of a single replica holding up
+// to size entries.
+type MemoryCache struct {
+	mu      sync.Mutex
+	size    int
+	entries *list.List
+	byKey   map[string]*list.Element
+	now     func() time.Time
+}
+
+func NewMemoryCache(size int) *MemoryCache {
+	if size < 1 {
+		size = 1
+	}
+
+	return &MemoryCache{
+		size:    size,
+		entries: list.New(),
+		byKey:   make(map[string]*list.Element),
+		now:     time.Now,
+	}
+}
+
+func (mc *MemoryCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	element, ok := mc.byKey[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	e := element.Value.(*entry)
+	if !mc.now().Before(e.expiresAt) {
+		mc.remove(element)
+		return nil, false, nil
+	}
+
+	mc.entries.MoveToFront(element)
+	return e.value, true, nil
+}
+
+func (mc *MemoryCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	expiresAt := mc.now().Add(ttl)
+	if element, ok := mc.byKey[key]; ok {
+		e := element.Value.(*entry)
+		e.value = value
+		e.expiresAt = expiresAt
+		mc.entries.MoveToFront(element)
+		return nil
+	}
+
+	mc.byKey[key] = mc.entries.PushFront(&entry{key: key, value: value, expiresAt: expiresAt})
+	for mc.entries.Len() > mc.size {
+		mc.remove(mc.entries.Back())
+	}
+	return nil
+}
+
+func (mc *MemoryCache) Delete(_ context.Context, keys ...string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for _, key := range keys {
+		if element, ok := mc.byKey[key]; ok {
+			mc.remove(element)
+		}
+	}
+	return nil
+}
+
+func (mc *MemoryCache) remove(element *list.Element) {
+	mc.entries.Remove(element)
+	delete(mc.byKey, element.Value.(*entry).key)
+}
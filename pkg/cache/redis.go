@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const keyPrefix = "cache:"
+
+// RedisCache shares entries between replicas through Redis, so an entry
+// dropped by one replica is dropped for all of them.
+type RedisCache struct {
+	client *redis.Client
+}
+
+func NewRedisCache(client *redis.Client) *RedisCache {
+	return &RedisCache{client: client}
+}
+
+func (rc *RedisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := rc.client.Get(ctx, keyPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (rc *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return rc.client.Set(ctx, keyPrefix+key, value, ttl).Err()
+}
+
+func (rc *RedisCache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	prefixed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		prefixed = append(prefixed, keyPrefix+key)
+	}
+	return rc.client.Del(ctx, prefixed...).Err()
+}
@@ -0,0 +1,99 @@
+package dialect
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/errors"
+)
+
+const (
+	MySQL    = "mysql"
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+)
+
+// Querier is implemented by both *sql.DB and *sql.Tx.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Dialect hides the SQL differences between the supported databases.
+// Repositories write queries with ? placeholders and unquoted identifiers
+// and pass them through Rebind before executing them.
+type Dialect interface {
+	// Name is the backend name used in config and as the migrations directory.
+	Name() string
+	DriverName() string
+	DSN(cfg *config.Config) (string, error)
+	// DatabaseName is the configured database, used to label metrics.
+	DatabaseName(cfg *config.Config) string
+
+	// Rebind replaces ? placeholders with the ones the driver expects.
+	Rebind(query string) string
+	// Random is an ORDER BY expression shuffling the rows.
+	Random() string
+	// InsertIgnore turns an INSERT into one skipping rows that violate a unique key.
+	InsertIgnore(insert string) string
+	// Upsert turns an INSERT into one applying set to the row conflicting on key.
+	Upsert(insert string, key []string, set string) string
+	// Excluded refers to a column of the row being inserted inside an Upsert set.
+	Excluded(column string) string
+	// ForUpdate is appended to a SELECT to lock the selected rows until commit.
+	ForUpdate() string
+	// InsertID runs an INSERT into a table with an id column and returns the new id.
+	InsertID(ctx context.Context, q Querier, insert string, args ...interface{}) (int64, error)
+
+	// TryLock takes the named lock for the session of conn without waiting
+	// and reports whether it was acquired.
+	TryLock(ctx context.Context, conn *sql.Conn, name string) (bool, error)
+	Unlock(ctx context.Context, conn *sql.Conn, name string) error
+}
+
+func New(backend string) (Dialect, error) {
+	switch backend {
+	case MySQL:
+		return mysqlDialect{}, nil
+	case Postgres:
+		return postgresDialect{}, nil
+	case SQLite:
+		return sqliteDialect{}, nil
+	default:
+		return nil, fmt.Errorf("unknown database backend: %s", backend)
+	}
+}
+
+// For returns the dialect of the configured backend. Open rejects unknown
+// backends before any repository is created, so For falls back to MySQL.
+func For(cfg *config.Config) Dialect {
+	d, err := New(cfg.Database.Backend)
+	if err != nil {
+		return mysqlDialect{}
+	}
+	return d
+}
+
+// Open connects to the configured database, waiting for it to come up.
+func Open(cfg *config.Config) (*sql.DB, error) {
+	d, err := New(cfg.Database.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	dsn, err := d.DSN(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := errors.DBConnectLoop(d.DriverName(), dsn, time.Duration(cfg.Database.Timeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.Database.MaxConnections)
+
+	return db, nil
+}
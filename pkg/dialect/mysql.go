@@ -0,0 +1,84 @@
+package dialect
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"usersegmentator/config"
+	"usersegmentator/pkg/errors"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string { return MySQL }
+
+func (mysqlDialect) DriverName() string { return "mysql" }
+
+func (mysqlDialect) DSN(cfg *config.Config) (string, error) {
+	if cfg.MySQL.Name == "" || cfg.MySQL.Password == "" {
+		return "", fmt.Errorf("MYSQL_DATABASE and MYSQL_ROOT_PASSWORD must be set")
+	}
+
+	dsn := mysql.NewConfig()
+	dsn.User = "root"
+	dsn.Passwd = cfg.MySQL.Password
+	dsn.Net = "tcp"
+	dsn.Addr = cfg.MySQL.Host + ":" + cfg.MySQL.Port
+	dsn.DBName = cfg.MySQL.Name
+	dsn.MultiStatements = true
+	dsn.InterpolateParams = true
+	dsn.ParseTime = true
+	// times are written in UTC and compared with CURRENT_TIMESTAMP, which
+	// follows the session time zone
+	dsn.Params = map[string]string{"charset": "utf8", "time_zone": "'+00:00'"}
+
+	return dsn.FormatDSN(), nil
+}
+
+func (mysqlDialect) DatabaseName(cfg *config.Config) string { return cfg.MySQL.Name }
+
+func (mysqlDialect) Rebind(query string) string { return query }
+
+func (mysqlDialect) Random() string { return "RAND()" }
+
+func (mysqlDialect) InsertIgnore(insert string) string {
+	return strings.Replace(insert, "INSERT", "INSERT IGNORE", 1)
+}
+
+func (mysqlDialect) Upsert(insert string, _ []string, set string) string {
+	return insert + " ON DUPLICATE KEY UPDATE " + set
+}
+
+func (mysqlDialect) Excluded(column string) string { return "VALUES(" + column + ")" }
+
+func (mysqlDialect) ForUpdate() string { return " FOR UPDATE" }
+
+func (mysqlDialect) InsertID(ctx context.Context, q Querier, insert string, args ...interface{}) (int64, error) {
+	result, err := q.ExecContext(ctx, insert, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", errors.ErrorGettingLastID, err)
+	}
+	return id, nil
+}
+
+func (mysqlDialect) TryLock(ctx context.Context, conn *sql.Conn, name string) (bool, error) {
+	var acquired sql.NullInt64
+	err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", name).Scan(&acquired)
+	if err != nil {
+		return false, err
+	}
+	return acquired.Int64 == 1, nil
+}
+
+func (mysqlDialect) Unlock(ctx context.Context, conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(ctx, "DO RELEASE_LOCK(?)", name)
+	return err
+}
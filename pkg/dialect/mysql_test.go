@@ -0,0 +1,31 @@
+package dialect
+
+import (
+	"testing"
+	"usersegmentator/config"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestMySQLDSNPinsTimeZone(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.MySQL.Name = "segments"
+	cfg.MySQL.Password = "secret"
+	cfg.MySQL.Host = "db"
+	cfg.MySQL.Port = "3306"
+
+	dsn, err := mysqlDialect{}.DSN(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tz := parsed.Params["time_zone"]; tz != "'+00:00'" {
+		t.Fatalf("session time zone %q, expected UTC", tz)
+	}
+	if parsed.Loc.String() != "UTC" {
+		t.Fatalf("times parsed in %s, expected UTC", parsed.Loc)
+	}
+}
@@ -0,0 +1,100 @@
+package dialect
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strconv"
+	"strings"
+	"usersegmentator/config"
+
+	_ "github.com/lib/pq"
+)
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string { return Postgres }
+
+func (postgresDialect) DriverName() string { return "postgres" }
+
+func (postgresDialect) DSN(cfg *config.Config) (string, error) {
+	if cfg.Postgres.Name == "" || cfg.Postgres.Password == "" {
+		return "", fmt.Errorf("POSTGRES_DB and POSTGRES_PASSWORD must be set")
+	}
+
+	dsn := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(cfg.Postgres.User, cfg.Postgres.Password),
+		Host:   cfg.Postgres.Host + ":" + cfg.Postgres.Port,
+		Path:   cfg.Postgres.Name,
+	}
+	if cfg.Postgres.SSLMode != "" {
+		dsn.RawQuery = url.Values{"sslmode": {cfg.Postgres.SSLMode}}.Encode()
+	}
+
+	return dsn.String(), nil
+}
+
+func (postgresDialect) DatabaseName(cfg *config.Config) string { return cfg.Postgres.Name }
+
+// Rebind numbers the placeholders, leaving question marks inside string literals alone.
+func (postgresDialect) Rebind(query string) string {
+	var b strings.Builder
+	b.Grow(len(query) + 10) //nolint:gomnd // room for the placeholder numbers
+
+	n := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (postgresDialect) Random() string { return "random()" }
+
+func (postgresDialect) InsertIgnore(insert string) string {
+	return insert + " ON CONFLICT DO NOTHING"
+}
+
+func (postgresDialect) Upsert(insert string, key []string, set string) string {
+	return insert + " ON CONFLICT (" + strings.Join(key, ", ") + ") DO UPDATE SET " + set
+}
+
+func (postgresDialect) Excluded(column string) string { return "EXCLUDED." + column }
+
+func (postgresDialect) ForUpdate() string { return " FOR UPDATE" }
+
+func (postgresDialect) InsertID(ctx context.Context, q Querier, insert string, args ...interface{}) (int64, error) {
+	var id int64
+	err := q.QueryRowContext(ctx, insert+" RETURNING id", args...).Scan(&id)
+	return id, err
+}
+
+func (postgresDialect) TryLock(ctx context.Context, conn *sql.Conn, name string) (bool, error) {
+	var acquired bool
+	err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockKey(name)).Scan(&acquired)
+	return acquired, err
+}
+
+func (postgresDialect) Unlock(ctx context.Context, conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", lockKey(name))
+	return err
+}
+
+// lockKey maps a lock name to the integer key of a Postgres advisory lock.
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return int64(h.Sum64())
+}
@@ -0,0 +1,78 @@
+package dialect
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"usersegmentator/config"
+	"usersegmentator/pkg/errors"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteBusyTimeout is how long, in milliseconds, a connection waits for
+// another one to release the database file.
+const sqliteBusyTimeout = "5000"
+
+// sqliteDialect is meant for tests and local development: it needs a cgo
+// build and serializes every write transaction on the database file.
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string { return SQLite }
+
+func (sqliteDialect) DriverName() string { return "sqlite3" }
+
+func (sqliteDialect) DSN(cfg *config.Config) (string, error) {
+	if cfg.SQLite.Path == "" {
+		return "", fmt.Errorf("sqlite path must be set")
+	}
+
+	params := url.Values{
+		"_busy_timeout": {sqliteBusyTimeout},
+		"_foreign_keys": {"on"},
+		// write transactions take the file lock upfront instead of
+		// failing when they upgrade from a read
+		"_txlock": {"immediate"},
+	}
+	return "file:" + cfg.SQLite.Path + "?" + params.Encode(), nil
+}
+
+func (sqliteDialect) DatabaseName(cfg *config.Config) string { return cfg.SQLite.Path }
+
+func (sqliteDialect) Rebind(query string) string { return query }
+
+func (sqliteDialect) Random() string { return "RANDOM()" }
+
+func (sqliteDialect) InsertIgnore(insert string) string {
+	return strings.Replace(insert, "INSERT", "INSERT OR IGNORE", 1)
+}
+
+func (sqliteDialect) Upsert(insert string, key []string, set string) string {
+	return insert + " ON CONFLICT (" + strings.Join(key, ", ") + ") DO UPDATE SET " + set
+}
+
+func (sqliteDialect) Excluded(column string) string { return "excluded." + column }
+
+// ForUpdate is empty: an immediate transaction already holds the write lock.
+func (sqliteDialect) ForUpdate() string { return "" }
+
+func (sqliteDialect) InsertID(ctx context.Context, q Querier, insert string, args ...interface{}) (int64, error) {
+	result, err := q.ExecContext(ctx, insert, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", errors.ErrorGettingLastID, err)
+	}
+	return id, nil
+}
+
+// TryLock always succeeds: the database is a local file, and concurrent
+// writers are serialized by SQLite itself.
+func (sqliteDialect) TryLock(context.Context, *sql.Conn, string) (bool, error) { return true, nil }
+
+func (sqliteDialect) Unlock(context.Context, *sql.Conn, string) error { return nil }
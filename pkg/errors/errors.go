@@ -1,6 +1,7 @@
 package errors
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -17,23 +18,39 @@ const (
 	ErrorCommittingTransaction = "error committing transaction"
 )
 
-func DBConnectLoop(dsn string, timeout time.Duration) (*sql.DB, error) {
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+const (
+	initialConnectBackoff = 250 * time.Millisecond
+	maxConnectBackoff     = 5 * time.Second
+)
+
+// DBConnectLoop opens the database and pings it until it answers, doubling
+// the pause between attempts, and gives up once timeout has passed.
+func DBConnectLoop(driver, dsn string, timeout time.Duration) (*sql.DB, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db: %w", err)
+	}
 
-	timeoutExceeded := time.After(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	backoff := initialConnectBackoff
 	for {
-		select {
-		case <-timeoutExceeded:
-			return nil, fmt.Errorf("db connection failed after %s timeout", timeout)
+		err = db.PingContext(ctx)
+		if err == nil {
+			return db, nil
+		}
 
-		case <-ticker.C:
-			db, err := sql.Open("mysql", dsn)
-			if err == nil {
-				return db, nil
+		select {
+		case <-ctx.Done():
+			if closeErr := db.Close(); closeErr != nil {
+				return nil, fmt.Errorf("db connection failed after %s timeout: %w, close error: %s", timeout, err, closeErr)
 			}
-			return nil, fmt.Errorf("%s: failed to connect to db %w", dsn, err)
+			return nil, fmt.Errorf("db connection failed after %s timeout: %w", timeout, err)
+		case <-time.After(backoff):
 		}
+
+		backoff = min(backoff*2, maxConnectBackoff) //nolint:gomnd // exponential backoff
 	}
 }
 
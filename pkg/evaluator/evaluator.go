@@ -0,0 +1,123 @@
+package evaluator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/segment"
+)
+
+// Evaluator keeps a local copy of the service snapshot and answers
+// GetUserSegments without a network round trip.
+type Evaluator struct {
+	snapshotURL string
+	interval    time.Duration
+	client      *http.Client
+
+	mu       sync.RWMutex
+	snapshot *segment.Snapshot
+
+	Logger *slog.Logger
+}
+
+// NewEvaluator creates an evaluator polling snapshotURL
+// (e.g. http://host:8000/api/get_segments_snapshot) every interval.
+func NewEvaluator(snapshotURL string, interval time.Duration) *Evaluator {
+	return &Evaluator{
+		snapshotURL: snapshotURL,
+		interval:    interval,
+		client:      &http.Client{Timeout: interval},
+		Logger:      logging.For("evaluator"),
+	}
+}
+
+// Run syncs the snapshot immediately and then every interval until ctx is done.
+func (e *Evaluator) Run(ctx context.Context) {
+	if err := e.Sync(ctx); err != nil {
+		e.Logger.ErrorContext(ctx, "snapshot sync failed", logging.Err(err))
+	}
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.Sync(ctx); err != nil {
+				e.Logger.ErrorContext(ctx, "snapshot sync failed", logging.Err(err))
+			}
+		}
+	}
+}
+
+// Sync fetches the snapshot once. The request is conditional on the version
+// already held, so an unchanged snapshot is not transferred again.
+func (e *Evaluator) Sync(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.snapshotURL, http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	if version := e.Version(); version != "" {
+		req.Header.Set("If-None-Match", `"`+version+`"`)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching snapshot: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("error fetching snapshot: unexpected status %d", resp.StatusCode)
+	}
+
+	snapshot := &segment.Snapshot{}
+	err = json.NewDecoder(resp.Body).Decode(snapshot)
+	if err != nil {
+		return fmt.Errorf("error decoding snapshot: %w", err)
+	}
+	snapshot.Index()
+
+	e.mu.Lock()
+	e.snapshot = snapshot
+	e.mu.Unlock()
+
+	e.Logger.InfoContext(ctx, "Snapshot synced", "version", snapshot.Version)
+	return nil
+}
+
+// Version returns the version of the snapshot held, or an empty string
+// before the first successful sync.
+func (e *Evaluator) Version() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.snapshot == nil {
+		return ""
+	}
+	return e.snapshot.Version
+}
+
+// GetUserSegments computes the user's segments from the local snapshot.
+// It returns false if no snapshot has been synced yet.
+func (e *Evaluator) GetUserSegments(userID int) (*segment.UserSegments, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.snapshot == nil {
+		return nil, false
+	}
+	return e.snapshot.UserSegments(userID, time.Now()), true
+}
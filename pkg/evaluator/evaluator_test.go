@@ -0,0 +1,352 @@
+package evaluator_test
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/evaluator"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/handlers"
+	"usersegmentator/pkg/migrate"
+	"usersegmentator/pkg/segment"
+)
+
+type testEnv struct {
+	cfg    *config.Config
+	db     *sql.DB
+	broker *events.Broker
+	repo   segment.Repository
+}
+
+// newTestEnv migrates a new SQLite database with users 1 to 10.
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	ctx := context.Background()
+
+	cfg := &config.Config{}
+	cfg.Database.Backend = dialect.SQLite
+	cfg.Database.Timeout = 5
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "evaluator.db")
+	cfg.Segment.SnapshotTTL = 60
+
+	db, err := dialect.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	migrator, err := migrate.NewMigrator(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrate.SeedUsers(ctx, db, cfg, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	broker := events.NewBroker(cfg)
+	t.Cleanup(broker.Close)
+	return &testEnv{cfg: cfg, db: db, broker: broker, repo: segment.NewSegmentsRepo(db, cfg, broker, nil)}
+}
+
+// addMembership inserts a membership directly, as duplicates and memberships
+// past their expiry cannot be created through the repository.
+func (env *testEnv) addMembership(t *testing.T, userID int, slug string, expiresAt *time.Time) {
+	t.Helper()
+
+	_, err := env.db.Exec(
+		"INSERT INTO user_segment_relation (user_id, segment_id, date_unassigned) "+
+			"VALUES (?, (SELECT id FROM segments WHERE slug = ?), ?)",
+		userID, slug, expiresAt,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func at(now time.Time, d time.Duration) *time.Time {
+	t := now.UTC().Add(d).Truncate(time.Second)
+	return &t
+}
+
+func expectSameSegments(t *testing.T, got, expected *segment.UserSegments) {
+	t.Helper()
+
+	if len(got.Segments) != len(expected.Segments) {
+		t.Fatalf("segments %v, expected %v", got.Segments, expected.Segments)
+	}
+	for i := range expected.Segments {
+		if got.Segments[i] != expected.Segments[i] {
+			t.Fatalf("segments %v, expected %v", got.Segments, expected.Segments)
+		}
+	}
+	if len(got.ExpiresAt) != len(expected.ExpiresAt) {
+		t.Fatalf("expiries %v, expected %v", got.ExpiresAt, expected.ExpiresAt)
+	}
+	for slug, expiresAt := range expected.ExpiresAt {
+		if !got.ExpiresAt[slug].Equal(expiresAt) {
+			t.Fatalf("expiries %v, expected %v", got.ExpiresAt, expected.ExpiresAt)
+		}
+	}
+}
+
+func TestSnapshotMatchesRepository(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	for _, slug := range []string{"ALPHA", "BETA", "GAMMA"} {
+		if err := env.repo.InsertSegment(ctx, slug, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	hourAgo, inHour, inTwoHours := at(now, -time.Hour), at(now, time.Hour), at(now, 2*time.Hour)
+
+	tests := []struct {
+		name        string
+		userID      int
+		memberships func(t *testing.T, userID int)
+		expected    []string
+	}{
+		{"plain", 1, func(t *testing.T, userID int) {
+			env.addMembership(t, userID, "ALPHA", nil)
+			env.addMembership(t, userID, "BETA", inHour)
+		}, []string{"ALPHA", "BETA"}},
+		{"expired", 2, func(t *testing.T, userID int) {
+			env.addMembership(t, userID, "ALPHA", hourAgo)
+			env.addMembership(t, userID, "BETA", nil)
+		}, []string{"BETA"}},
+		{"duplicate without expiry", 3, func(t *testing.T, userID int) {
+			env.addMembership(t, userID, "ALPHA", inHour)
+			env.addMembership(t, userID, "ALPHA", nil)
+			env.addMembership(t, userID, "ALPHA", inTwoHours)
+		}, []string{"ALPHA"}},
+		{"duplicate with expiries", 4, func(t *testing.T, userID int) {
+			env.addMembership(t, userID, "BETA", inTwoHours)
+			env.addMembership(t, userID, "BETA", inHour)
+			env.addMembership(t, userID, "GAMMA", inHour)
+		}, []string{"BETA", "GAMMA"}},
+		{"duplicate expired", 5, func(t *testing.T, userID int) {
+			env.addMembership(t, userID, "ALPHA", hourAgo)
+			env.addMembership(t, userID, "ALPHA", inHour)
+		}, []string{"ALPHA"}},
+		{"unassigned", 6, func(t *testing.T, userID int) {
+			env.addMembership(t, userID, "GAMMA", nil)
+			if err := env.repo.UnassignSegments(ctx, []int{userID}, []string{"GAMMA"}); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{}},
+		{"without segments", 7, func(*testing.T, int) {}, []string{}},
+	}
+
+	for _, tt := range tests {
+		tt.memberships(t, tt.userID)
+	}
+	snapshot, err := env.repo.GetSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected, err := env.repo.GetUserSegments(ctx, tt.userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := snapshot.UserSegments(tt.userID, now)
+			expectSameSegments(t, got, expected)
+
+			if len(got.Segments) != len(tt.expected) {
+				t.Fatalf("segments %v, expected %v", got.Segments, tt.expected)
+			}
+			for i := range tt.expected {
+				if got.Segments[i] != tt.expected[i] {
+					t.Fatalf("segments %v, expected %v", got.Segments, tt.expected)
+				}
+			}
+		})
+	}
+
+	t.Run("longest expiry", func(t *testing.T) {
+		got := snapshot.UserSegments(4, now)
+		if expiresAt := got.ExpiresAt["BETA"]; !expiresAt.Equal(*inTwoHours) {
+			t.Fatalf("BETA expires at %s, expected the later expiry", expiresAt)
+		}
+		if _, ok := snapshot.UserSegments(3, now).ExpiresAt["ALPHA"]; ok {
+			t.Fatal("membership without expiry reported as expiring")
+		}
+	})
+
+	t.Run("deleted segment", func(t *testing.T) {
+		if err := env.repo.DeleteSegment(ctx, "BETA"); err != nil {
+			t.Fatal(err)
+		}
+		snapshot, err := env.repo.GetSnapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			expected, err := env.repo.GetUserSegments(ctx, tt.userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectSameSegments(t, snapshot.UserSegments(tt.userID, now), expected)
+		}
+	})
+
+	t.Run("expired after export", func(t *testing.T) {
+		got := snapshot.UserSegments(1, now.Add(90*time.Minute))
+		if len(got.Segments) != 1 || got.Segments[0] != "ALPHA" {
+			t.Fatalf("segments %v, expected the membership without expiry only", got.Segments)
+		}
+	})
+}
+
+// snapshotServer serves the snapshot endpoint, recording the response
+// statuses, or fails every request while failing is set.
+type snapshotServer struct {
+	mu       sync.Mutex
+	statuses []int
+	failing  bool
+}
+
+func (s *snapshotServer) fail(failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = failing
+}
+
+func (s *snapshotServer) last() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.statuses[len(s.statuses)-1]
+}
+
+func newSnapshotServer(t *testing.T, env *testEnv) (*snapshotServer, string) {
+	t.Helper()
+
+	handler := handlers.NewSegmentsHandler(env.db, env.cfg, env.broker, nil, nil)
+	s := &snapshotServer{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		failing := s.failing
+		s.mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.GetSnapshot(recorder, r)
+
+		s.mu.Lock()
+		s.statuses = append(s.statuses, recorder.Code)
+		s.mu.Unlock()
+
+		for name, values := range recorder.Header() {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(recorder.Code)
+		_, _ = w.Write(recorder.Body.Bytes())
+	}))
+	t.Cleanup(server.Close)
+	return s, server.URL
+}
+
+func TestEvaluatorPollsWithETag(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	if err := env.repo.InsertSegment(ctx, "ALPHA", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.repo.AssignSegments(ctx, []int{1}, []string{"ALPHA"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	server, url := newSnapshotServer(t, env)
+	e := evaluator.NewEvaluator(url, time.Second)
+
+	if _, ok := e.GetUserSegments(1); ok {
+		t.Fatal("segments evaluated before the first sync")
+	}
+	if err := e.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if status := server.last(); status != http.StatusOK {
+		t.Fatalf("first sync answered %d, expected %d", status, http.StatusOK)
+	}
+	version := e.Version()
+	if version == "" {
+		t.Fatal("no snapshot version after the first sync")
+	}
+
+	// an unchanged snapshot is not transferred again
+	if err := e.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if status := server.last(); status != http.StatusNotModified {
+		t.Fatalf("unchanged snapshot answered %d, expected %d", status, http.StatusNotModified)
+	}
+	if e.Version() != version {
+		t.Fatalf("version changed to %s without changes", e.Version())
+	}
+	userSegments, ok := e.GetUserSegments(1)
+	if !ok || len(userSegments.Segments) != 1 || userSegments.Segments[0] != "ALPHA" {
+		t.Fatalf("segments %+v after a 304, expected the synced ones", userSegments)
+	}
+
+	if err := env.repo.AssignSegments(ctx, []int{2}, []string{"ALPHA"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if status := server.last(); status != http.StatusOK {
+		t.Fatalf("changed snapshot answered %d, expected %d", status, http.StatusOK)
+	}
+	if e.Version() == version {
+		t.Fatal("version unchanged after an assignment")
+	}
+	if userSegments, ok = e.GetUserSegments(2); !ok || len(userSegments.Segments) != 1 {
+		t.Fatalf("segments %+v, expected the new assignment", userSegments)
+	}
+}
+
+func TestEvaluatorKeepsSnapshotOnError(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	if err := env.repo.InsertSegment(ctx, "ALPHA", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.repo.AssignSegments(ctx, []int{1}, []string{"ALPHA"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	server, url := newSnapshotServer(t, env)
+	e := evaluator.NewEvaluator(url, time.Second)
+	if err := e.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	version := e.Version()
+
+	server.fail(true)
+	if err := e.Sync(ctx); err == nil {
+		t.Fatal("failed sync not reported")
+	}
+	if e.Version() != version {
+		t.Fatalf("version changed to %q by a failed sync", e.Version())
+	}
+	if userSegments, ok := e.GetUserSegments(1); !ok || len(userSegments.Segments) != 1 {
+		t.Fatalf("segments %+v, expected the last synced ones", userSegments)
+	}
+}
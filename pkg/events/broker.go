@@ -0,0 +1,152 @@
+package events
+
+import (
+	"sync"
+	"time"
+	"usersegmentator/config"
+)
+
+const subscriptionBufferSize = 256
+
+// Broker is an in-process pub/sub of membership changes. It keeps the
+// latest events in a ring buffer so that subscribers can resume from an event ID.
+type Broker struct {
+	mu          sync.Mutex
+	nextID      uint64
+	buffer      []Event
+	start       int
+	size        int
+	subscribers map[*Subscription]struct{}
+	listeners   []func(events []Event)
+	closed      bool
+}
+
+type Subscription struct {
+	C      chan Event
+	filter Filter
+	broker *Broker
+}
+
+func NewBroker(cfg *config.Config) *Broker {
+	bufferSize := cfg.Events.BufferSize
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+
+	return &Broker{
+		// IDs are seeded from the clock so that they keep growing across
+		// restarts and a stale Last-Event-ID does not shadow new events.
+		nextID:      uint64(time.Now().UnixMicro()),
+		buffer:      make([]Event, bufferSize),
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// OnPublish registers fn to be called with every batch of published events.
+// Listeners run synchronously in the publishing goroutine, outside the broker lock.
+func (b *Broker) OnPublish(fn func(events []Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.listeners = append(b.listeners, fn)
+}
+
+// Publish assigns IDs to the events, stores them and fans them out.
+// A subscriber that cannot keep up is disconnected and has to resume.
+// Listeners are still notified once the broker is closed.
+func (b *Broker) Publish(events ...Event) {
+	b.mu.Lock()
+	for i := 0; i < len(events) && !b.closed; i++ {
+		b.nextID++
+		events[i].ID = b.nextID
+		if events[i].Time.IsZero() {
+			events[i].Time = time.Now().UTC()
+		}
+		b.store(events[i])
+
+		for sub := range b.subscribers {
+			if !sub.filter.Match(&events[i]) {
+				continue
+			}
+			select {
+			case sub.C <- events[i]:
+			default:
+				b.unsubscribe(sub)
+			}
+		}
+	}
+
+	listeners := b.listeners
+	b.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(events)
+	}
+}
+
+// Subscribe registers a subscriber and returns the buffered events published
+// after lastID, so that nothing is lost between the backlog and the live feed.
+func (b *Broker) Subscribe(filter Filter, lastID uint64) (*Subscription, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := &Subscription{
+		C:      make(chan Event, subscriptionBufferSize),
+		filter: filter,
+		broker: b,
+	}
+
+	if b.closed {
+		close(sub.C)
+		return sub, nil
+	}
+
+	backlog := []Event{}
+	if lastID != 0 {
+		for i := 0; i < b.size; i++ {
+			e := b.buffer[(b.start+i)%len(b.buffer)]
+			if e.ID > lastID && filter.Match(&e) {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	b.subscribers[sub] = struct{}{}
+	return sub, backlog
+}
+
+// Close disconnects every subscriber and stops accepting events.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for sub := range b.subscribers {
+		b.unsubscribe(sub)
+	}
+}
+
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	s.broker.unsubscribe(s)
+}
+
+func (b *Broker) store(e Event) {
+	if b.size < len(b.buffer) {
+		b.buffer[(b.start+b.size)%len(b.buffer)] = e
+		b.size++
+		return
+	}
+	b.buffer[b.start] = e
+	b.start = (b.start + 1) % len(b.buffer)
+}
+
+func (b *Broker) unsubscribe(sub *Subscription) {
+	if _, ok := b.subscribers[sub]; !ok {
+		return
+	}
+	delete(b.subscribers, sub)
+	close(sub.C)
+}
@@ -0,0 +1,181 @@
+package events
+
+import (
+	"testing"
+	"usersegmentator/config"
+)
+
+func newTestBroker(t *testing.T, bufferSize int) *Broker {
+	t.Helper()
+
+	cfg := &config.Config{}
+	cfg.Events.BufferSize = bufferSize
+	b := NewBroker(cfg)
+	t.Cleanup(b.Close)
+	return b
+}
+
+// publish publishes n assignments of user to segment and returns their IDs.
+func publish(b *Broker, n int, user int, segment string) []uint64 {
+	ids := make([]uint64, n)
+	for i := range ids {
+		e := []Event{{Type: TypeAssigned, UserID: user, Segment: segment}}
+		b.Publish(e...)
+		ids[i] = e[0].ID
+	}
+	return ids
+}
+
+func eventIDs(events []Event) []uint64 {
+	ids := make([]uint64, len(events))
+	for i := range events {
+		ids[i] = events[i].ID
+	}
+	return ids
+}
+
+func expectIDs(t *testing.T, got, expected []uint64) {
+	t.Helper()
+
+	if len(got) != len(expected) {
+		t.Fatalf("events %v, expected %v", got, expected)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("events %v, expected %v", got, expected)
+		}
+	}
+}
+
+func TestPublishDelivers(t *testing.T) {
+	b := newTestBroker(t, 10)
+
+	all, _ := b.Subscribe(Filter{}, 0)
+	user, _ := b.Subscribe(Filter{UserID: 2}, 0)
+	segment, _ := b.Subscribe(Filter{Segment: "B"}, 0)
+
+	var published []uint64
+	published = append(published, publish(b, 1, 1, "A")...)
+	published = append(published, publish(b, 1, 2, "A")...)
+	published = append(published, publish(b, 1, 2, "B")...)
+
+	if published[0] >= published[1] || published[1] >= published[2] {
+		t.Fatalf("event IDs %v not increasing", published)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		sub      *Subscription
+		expected []uint64
+	}{
+		{"all", all, published},
+		{"user", user, published[1:]},
+		{"segment", segment, published[2:]},
+	} {
+		got := make([]uint64, 0, len(tt.expected))
+		for len(tt.sub.C) > 0 {
+			e := <-tt.sub.C
+			got = append(got, e.ID)
+		}
+		expectIDs(t, got, tt.expected)
+	}
+}
+
+func TestSubscribeResumesFromBuffer(t *testing.T) {
+	b := newTestBroker(t, 10)
+	ids := publish(b, 5, 1, "A")
+	publish(b, 1, 2, "B")
+
+	_, backlog := b.Subscribe(Filter{}, ids[1])
+	expectIDs(t, eventIDs(backlog)[:3], ids[2:])
+	if len(backlog) != 4 {
+		t.Fatalf("backlog of %d events, expected 4", len(backlog))
+	}
+
+	_, backlog = b.Subscribe(Filter{Segment: "A"}, ids[1])
+	expectIDs(t, eventIDs(backlog), ids[2:])
+
+	// the latest event is up to date
+	_, backlog = b.Subscribe(Filter{}, ids[4]+1)
+	if len(backlog) != 0 {
+		t.Fatalf("backlog %v after the latest event", eventIDs(backlog))
+	}
+
+	// a new subscriber starts from the live feed
+	_, backlog = b.Subscribe(Filter{}, 0)
+	if len(backlog) != 0 {
+		t.Fatalf("backlog %v without a last event ID", eventIDs(backlog))
+	}
+}
+
+func TestSubscribeResumesAfterBufferWrapped(t *testing.T) {
+	b := newTestBroker(t, 4)
+	ids := publish(b, 10, 1, "A")
+
+	// the events after ids[2] up to ids[5] were overwritten, the rest is replayed
+	_, backlog := b.Subscribe(Filter{}, ids[2])
+	expectIDs(t, eventIDs(backlog), ids[6:])
+
+	_, backlog = b.Subscribe(Filter{}, ids[7])
+	expectIDs(t, eventIDs(backlog), ids[8:])
+}
+
+func TestPublishDropsSlowSubscribers(t *testing.T) {
+	b := newTestBroker(t, 1)
+
+	slow, _ := b.Subscribe(Filter{}, 0)
+	fast, _ := b.Subscribe(Filter{}, 0)
+	// filtered out events do not fill the subscription up
+	other, _ := b.Subscribe(Filter{Segment: "B"}, 0)
+
+	var ids []uint64
+	for i := 0; i < subscriptionBufferSize+1; i++ {
+		ids = append(ids, publish(b, 1, 1, "A")...)
+		<-fast.C
+	}
+
+	received := 0
+	for range slow.C {
+		received++
+	}
+	if received != subscriptionBufferSize {
+		t.Fatalf("slow subscriber received %d events before being dropped, expected %d",
+			received, subscriptionBufferSize)
+	}
+
+	// the dropped subscriber resumes from the last event it received
+	_, backlog := b.Subscribe(Filter{}, ids[received-1])
+	expectIDs(t, eventIDs(backlog), ids[received:])
+
+	publish(b, 1, 1, "B")
+	if e := <-other.C; e.Segment != "B" {
+		t.Fatalf("event of segment %s, expected B", e.Segment)
+	}
+	if e := <-fast.C; e.Segment != "B" {
+		t.Fatalf("event of segment %s, expected B", e.Segment)
+	}
+}
+
+func TestCloseDisconnectsSubscribers(t *testing.T) {
+	b := newTestBroker(t, 4)
+	sub, _ := b.Subscribe(Filter{}, 0)
+
+	var notified []Event
+	b.OnPublish(func(events []Event) { notified = append(notified, events...) })
+
+	b.Close()
+	if _, ok := <-sub.C; ok {
+		t.Fatal("subscription open after Close")
+	}
+	sub.Close()
+
+	late, _ := b.Subscribe(Filter{}, 0)
+	if _, ok := <-late.C; ok {
+		t.Fatal("subscribed to a closed broker")
+	}
+
+	publish(b, 1, 1, "A")
+	if len(notified) != 1 || notified[0].ID != 0 {
+		t.Fatalf("listeners notified of %+v, expected the unstored event", notified)
+	}
+}
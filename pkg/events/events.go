@@ -0,0 +1,55 @@
+package events
+
+import (
+	"time"
+)
+
+const (
+	TypeAssigned         = "assigned"
+	TypeUnassigned       = "unassigned"
+	TypeExpired          = "expired"
+	TypeExpiredBulk      = "expired_bulk"
+	TypeSegmentDeleted   = "segment_deleted"
+	TypeRolloutCompleted = "rollout_completed"
+	TypeExpiryChanged    = "expiry_changed"
+)
+
+// Event describes a single change of segment membership.
+// UserID is zero for events concerning the segment as a whole,
+// Count is set by the events summarizing several memberships.
+// ExpiresAt is the expiry of an assigned or changed membership, if it has one.
+type Event struct {
+	ID        uint64     `json:"id"`
+	Type      string     `json:"type"`
+	UserID    int        `json:"user_id,omitempty"`
+	Segment   string     `json:"segment"`
+	Count     int        `json:"count,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Time      time.Time  `json:"time"`
+}
+
+func IsValidType(eventType string) bool {
+	switch eventType {
+	case TypeAssigned, TypeUnassigned, TypeExpired, TypeExpiredBulk, TypeSegmentDeleted, TypeRolloutCompleted,
+		TypeExpiryChanged:
+		return true
+	}
+	return false
+}
+
+// Filter narrows a subscription down to a single user and/or segment.
+// Zero values match everything.
+type Filter struct {
+	UserID  int
+	Segment string
+}
+
+func (f Filter) Match(e *Event) bool {
+	if f.UserID != 0 && f.UserID != e.UserID {
+		return false
+	}
+	if f.Segment != "" && f.Segment != e.Segment {
+		return false
+	}
+	return true
+}
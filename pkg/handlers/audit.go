@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"usersegmentator/config"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/logging"
+)
+
+type AuditHandler struct {
+	AuditRepo audit.Repository
+	Logger    *slog.Logger
+}
+
+func NewAuditHandler(db *sql.DB, cfg *config.Config) *AuditHandler {
+	return &AuditHandler{
+		AuditRepo: audit.NewAuditRepo(db, cfg),
+		Logger:    logging.For("audit_handler"),
+	}
+}
+
+// GetAuditLog godoc
+//
+//	@Summary		receive audit log
+//	@Description	receive recorded API calls, newest first, filtered by actor, segment, user and time range (RFC3339)
+//	@Tags         	Admin
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Param 			request		body 	audit.Request true "every field is optional"
+//	@Success		200	{array} audit.Entry
+//	@Failure		400	{string} string "bad input"
+//	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/admin/get_audit_log [get]
+func (ah *AuditHandler) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	receivedRequest := &audit.Request{}
+
+	err := errors.ValidateAndParseJSON(r, receivedRequest)
+	if err != nil {
+		ah.Logger.ErrorContext(r.Context(), "GetAuditLog failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	query, err := audit.ParseRequest(receivedRequest)
+	if err != nil {
+		ah.Logger.ErrorContext(r.Context(), "GetAuditLog failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	entries, err := ah.AuditRepo.GetEntries(r.Context(), query)
+	if err != nil {
+		ah.Logger.ErrorContext(r.Context(), "GetAuditLog failed", logging.Err(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := json.Marshal(entries)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(resp)
+	if err != nil {
+		ah.Logger.ErrorContext(r.Context(), "GetAuditLog failed", logging.Err(err))
+		return
+	}
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"usersegmentator/config"
+	"usersegmentator/pkg/auth"
+	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/logging"
+)
+
+type AuthHandler struct {
+	APIKeysRepo auth.Repository
+	Logger      *slog.Logger
+}
+
+func NewAuthHandler(db *sql.DB, cfg *config.Config) *AuthHandler {
+	return &AuthHandler{
+		APIKeysRepo: auth.NewAPIKeysRepo(db, cfg),
+		Logger:      logging.For("auth_handler"),
+	}
+}
+
+// CreateAPIKey godoc
+//
+//	@Summary		issues new api key
+//	@Description	issues new api key with the given scopes: segments:read, segments:write, history:read, admin.
+//	@Description	The key is returned only once, the service stores its hash.
+//	@Tags         	Admin
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Param 			request		body 	auth.RequestCreateKey true "The input struct"
+//	@Success		201	{object} auth.ResponseCreatedKey
+//	@Failure		400	{string} string "bad input"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/admin/create_api_key [post]
+func (ah *AuthHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	receivedRequest := &auth.RequestCreateKey{}
+
+	err := errors.ValidateAndParseJSON(r, receivedRequest)
+	if err != nil {
+		ah.Logger.ErrorContext(r.Context(), "CreateAPIKey failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	created, err := ah.APIKeysRepo.InsertKey(r.Context(), receivedRequest.Name, receivedRequest.Scopes)
+	if err != nil {
+		ah.Logger.ErrorContext(r.Context(), "CreateAPIKey failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp, err := json.Marshal(created)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	_, err = w.Write(resp)
+	if err != nil {
+		ah.Logger.ErrorContext(r.Context(), "CreateAPIKey failed", logging.Err(err))
+		return
+	}
+}
+
+// GetAPIKeys godoc
+//
+//	@Summary		receive api keys
+//	@Description	receive every issued api key, including revoked ones, without the keys themselves
+//	@Tags         	Admin
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Success		200	{array} auth.APIKey
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/admin/get_api_keys [get]
+func (ah *AuthHandler) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := ah.APIKeysRepo.GetKeys(r.Context())
+	if err != nil {
+		ah.Logger.ErrorContext(r.Context(), "GetAPIKeys failed", logging.Err(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := json.Marshal(keys)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(resp)
+	if err != nil {
+		ah.Logger.ErrorContext(r.Context(), "GetAPIKeys failed", logging.Err(err))
+		return
+	}
+}
+
+// RevokeAPIKey godoc
+//
+//	@Summary		revokes api key
+//	@Description	revokes api key
+//	@Tags         	Admin
+//	@Accept			json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Param 			request		body 	auth.RequestKeyID true "The input struct"
+//	@Success		200	{string} string "revoked"
+//	@Failure		400	{string} string "bad input"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/admin/revoke_api_key [delete]
+func (ah *AuthHandler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	receivedRequest := &auth.RequestKeyID{}
+
+	err := errors.ValidateAndParseJSON(r, receivedRequest)
+	if err != nil {
+		ah.Logger.ErrorContext(r.Context(), "RevokeAPIKey failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = ah.APIKeysRepo.RevokeKey(r.Context(), receivedRequest.ID)
+	if err != nil {
+		ah.Logger.ErrorContext(r.Context(), "RevokeAPIKey failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/logging"
+)
+
+const defaultHeartbeatInterval = 15 * time.Second
+
+type EventsHandler struct {
+	Broker            *events.Broker
+	HeartbeatInterval time.Duration
+	Logger            *slog.Logger
+}
+
+func NewEventsHandler(broker *events.Broker, cfg *config.Config) *EventsHandler {
+	heartbeat := time.Duration(cfg.Events.HeartbeatInterval) * time.Second
+	if heartbeat <= 0 {
+		heartbeat = defaultHeartbeatInterval
+	}
+
+	return &EventsHandler{
+		Broker:            broker,
+		HeartbeatInterval: heartbeat,
+		Logger:            logging.For("events_handler"),
+	}
+}
+
+// StreamEvents godoc
+//
+//	@Summary		stream segment membership changes
+//	@Description	Server-Sent Events stream of assignments, unassignments, TTL expirations and segment deletions.
+//	@Description	Resumes after the Last-Event-ID header (or last_event_id query parameter) while the event is still buffered.
+//	@Tags         	Events
+//	@Produce		text/event-stream
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Param			user_id			query	int		false	"only events of this user"
+//	@Param			segment			query	string	false	"only events of this segment"
+//	@Param			last_event_id	query	int		false	"resume after this event ID"
+//	@Param			Last-Event-ID	header	int		false	"resume after this event ID"
+//	@Success		200	{object} events.Event
+//	@Failure		400	{string} string "bad input"
+//	@Failure		500	{string} string "streaming unsupported"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/events [get]
+func (eh *EventsHandler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		eh.Logger.ErrorContext(r.Context(), "streaming unsupported")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	filter := events.Filter{Segment: r.URL.Query().Get("segment")}
+	var err error
+
+	if userID := r.URL.Query().Get("user_id"); userID != "" {
+		filter.UserID, err = strconv.Atoi(userID)
+		if err != nil {
+			eh.Logger.ErrorContext(r.Context(), "StreamEvents failed", logging.Err(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	var lastID uint64
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID != "" {
+		lastID, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			eh.Logger.ErrorContext(r.Context(), "StreamEvents failed", logging.Err(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	sub, backlog := eh.Broker.Subscribe(filter, lastID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for i := range backlog {
+		if err = writeEvent(w, &backlog[i]); err != nil {
+			eh.Logger.ErrorContext(r.Context(), "StreamEvents failed", logging.Err(err))
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eh.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			if _, err = fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err = writeEvent(w, &e); err != nil {
+				eh.Logger.ErrorContext(r.Context(), "StreamEvents failed", logging.Err(err))
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e *events.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
@@ -0,0 +1,242 @@
+package handlers_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/handlers"
+)
+
+const streamTimeout = 5 * time.Second
+
+// stream is an open /api/events response read frame by frame.
+type stream struct {
+	resp   *http.Response
+	frames chan string
+}
+
+func newEventsServer(t *testing.T, heartbeat time.Duration) (*httptest.Server, *events.Broker) {
+	t.Helper()
+
+	cfg := &config.Config{}
+	cfg.Events.BufferSize = 16
+	broker := events.NewBroker(cfg)
+
+	eh := handlers.NewEventsHandler(broker, cfg)
+	eh.HeartbeatInterval = heartbeat
+	server := httptest.NewServer(http.HandlerFunc(eh.StreamEvents))
+	t.Cleanup(func() {
+		// closing the broker ends the open streams
+		broker.Close()
+		server.Close()
+	})
+	return server, broker
+}
+
+func openStream(t *testing.T, server *httptest.Server, query, lastEventID string) *stream {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?"+query, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	s := &stream{resp: resp, frames: make(chan string, 16)}
+	go func() {
+		defer close(s.frames)
+		scanner := bufio.NewScanner(resp.Body)
+		var frame []string
+		for scanner.Scan() {
+			if scanner.Text() != "" {
+				frame = append(frame, scanner.Text())
+				continue
+			}
+			s.frames <- strings.Join(frame, "\n")
+			frame = nil
+		}
+	}()
+	return s
+}
+
+// next returns the next frame of the stream, skipping heartbeats unless
+// heartbeats is set.
+func (s *stream) next(t *testing.T, heartbeats bool) string {
+	t.Helper()
+
+	timeout := time.After(streamTimeout)
+	for {
+		select {
+		case frame, ok := <-s.frames:
+			if !ok {
+				t.Fatal("stream closed")
+			}
+			if !heartbeats && strings.HasPrefix(frame, ":") {
+				continue
+			}
+			return frame
+		case <-timeout:
+			t.Fatal("no frame received")
+		}
+	}
+}
+
+// nextEvent reads the next event frame and checks its fields match the data.
+func (s *stream) nextEvent(t *testing.T) events.Event {
+	t.Helper()
+
+	lines := strings.Split(s.next(t, false), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("frame %q, expected id, event and data", lines)
+	}
+
+	var e events.Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &e); err != nil {
+		t.Fatal(err)
+	}
+	if lines[0] != "id: "+strconv.FormatUint(e.ID, 10) || lines[1] != "event: "+e.Type {
+		t.Fatalf("frame %q does not match its data", lines)
+	}
+	return e
+}
+
+func publishAssigned(broker *events.Broker, user int, segment string) uint64 {
+	e := []events.Event{{Type: events.TypeAssigned, UserID: user, Segment: segment}}
+	broker.Publish(e...)
+	return e[0].ID
+}
+
+func TestStreamEvents(t *testing.T) {
+	server, broker := newEventsServer(t, time.Hour)
+	s := openStream(t, server, "user_id=7", "")
+
+	if s.resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, expected %d", s.resp.StatusCode, http.StatusOK)
+	}
+	if ct := s.resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+
+	publishAssigned(broker, 8, "A")
+	id := publishAssigned(broker, 7, "A")
+
+	e := s.nextEvent(t)
+	if e.ID != id || e.UserID != 7 || e.Segment != "A" || e.Type != events.TypeAssigned {
+		t.Fatalf("event %+v, expected the assignment of user 7", e)
+	}
+}
+
+func TestStreamEventsResumes(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  func(ids []uint64) string
+		header func(ids []uint64) string
+		// expected indexes the published events
+		expected []int
+	}{
+		{"header", nil, func(ids []uint64) string { return strconv.FormatUint(ids[0], 10) }, []int{1, 2}},
+		{"query", func(ids []uint64) string { return "last_event_id=" + strconv.FormatUint(ids[1], 10) }, nil,
+			[]int{2}},
+		{
+			"header over query",
+			func(ids []uint64) string { return "last_event_id=" + strconv.FormatUint(ids[0], 10) },
+			func(ids []uint64) string { return strconv.FormatUint(ids[1], 10) },
+			[]int{2},
+		},
+		{
+			"filtered",
+			func(ids []uint64) string { return "segment=A&last_event_id=" + strconv.FormatUint(ids[0]-1, 10) },
+			nil,
+			[]int{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, broker := newEventsServer(t, time.Hour)
+			ids := []uint64{
+				publishAssigned(broker, 1, "A"),
+				publishAssigned(broker, 1, "B"),
+				publishAssigned(broker, 2, "B"),
+			}
+
+			var query, header string
+			if tt.query != nil {
+				query = tt.query(ids)
+			}
+			if tt.header != nil {
+				header = tt.header(ids)
+			}
+			s := openStream(t, server, query, header)
+			for _, i := range tt.expected {
+				if e := s.nextEvent(t); e.ID != ids[i] {
+					t.Fatalf("event %d, expected %d", e.ID, ids[i])
+				}
+			}
+
+			// the backlog is followed by the live feed
+			live := publishAssigned(broker, 1, "A")
+			if e := s.nextEvent(t); e.ID != live {
+				t.Fatalf("event %d, expected the live event %d", e.ID, live)
+			}
+		})
+	}
+}
+
+func TestStreamEventsHeartbeat(t *testing.T) {
+	server, _ := newEventsServer(t, 10*time.Millisecond)
+	s := openStream(t, server, "", "")
+
+	for i := 0; i < 2; i++ {
+		if frame := s.next(t, true); frame != ": heartbeat" {
+			t.Fatalf("frame %q, expected a heartbeat", frame)
+		}
+	}
+}
+
+func TestStreamEventsEndsWithBroker(t *testing.T) {
+	server, broker := newEventsServer(t, time.Hour)
+	s := openStream(t, server, "", "")
+
+	broker.Close()
+	select {
+	case _, ok := <-s.frames:
+		if ok {
+			t.Fatal("frame received after the broker closed")
+		}
+	case <-time.After(streamTimeout):
+		t.Fatal("stream open after the broker closed")
+	}
+}
+
+func TestStreamEventsBadInput(t *testing.T) {
+	server, _ := newEventsServer(t, time.Hour)
+
+	for _, query := range []string{"user_id=seven", "last_event_id=-1"} {
+		resp, err := http.Get(server.URL + "?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("status %d for %s, expected %d", resp.StatusCode, query, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/health"
+	"usersegmentator/pkg/leader"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/segment"
+)
+
+// ttlHeartbeatMaxAge is how many TTL checker intervals may pass without a run
+// before the service is reported as not ready.
+const ttlHeartbeatMaxAge = 3
+
+type HealthHandler struct {
+	Checker *health.Checker
+	Version health.Version
+	Logger  *slog.Logger
+}
+
+// NewHealthHandler checks the TTL worker heartbeat only on the leader.
+func NewHealthHandler(
+	db *sql.DB,
+	cfg *config.Config,
+	ttlWorker *segment.TTLWorker,
+	elector *leader.Elector,
+) *HealthHandler {
+	readiness := health.NewChecker(time.Duration(cfg.Health.CheckTimeout) * time.Second)
+	readiness.Add("database", health.DBCheck(db))
+	readiness.Add("report_storage", health.StorageCheck(cfg.StorageDir))
+	readiness.Add("ttl_checker", health.LeaderOnly(elector.IsLeader, health.HeartbeatCheck(
+		ttlWorker.Heartbeat,
+		ttlHeartbeatMaxAge*ttlWorker.Interval(),
+	)))
+
+	return &HealthHandler{
+		Checker: readiness,
+		Version: health.Version{
+			Name:    cfg.UserSegmentator.Name,
+			Version: cfg.UserSegmentator.Version,
+		},
+		Logger: logging.For("health_handler"),
+	}
+}
+
+// Liveness godoc
+//
+//	@Summary		liveness probe
+//	@Description	reports that the process is up, without checking dependencies
+//	@Tags         	Health
+//	@Produce		json
+//	@Success		200	{object} health.Report
+//	@Router			/healthz [get]
+func (hh *HealthHandler) Liveness(w http.ResponseWriter, r *http.Request) {
+	hh.writeJSON(w, r, http.StatusOK, &health.Report{Status: health.StatusOK})
+}
+
+// Readiness godoc
+//
+//	@Summary		readiness probe
+//	@Description	checks the database, the report storage and the TTL checker heartbeat
+//	@Tags         	Health
+//	@Produce		json
+//	@Success		200	{object} health.Report
+//	@Failure		503	{object} health.Report
+//	@Router			/readyz [get]
+func (hh *HealthHandler) Readiness(w http.ResponseWriter, r *http.Request) {
+	report := hh.Checker.Run(r.Context())
+
+	status := http.StatusOK
+	if report.Status != health.StatusOK {
+		hh.Logger.WarnContext(r.Context(), "not ready", "components", report.Components)
+		status = http.StatusServiceUnavailable
+	}
+
+	hh.writeJSON(w, r, status, report)
+}
+
+// GetVersion godoc
+//
+//	@Summary		service version
+//	@Description	returns the service name and version
+//	@Tags         	Health
+//	@Produce		json
+//	@Success		200	{object} health.Version
+//	@Router			/version [get]
+func (hh *HealthHandler) GetVersion(w http.ResponseWriter, r *http.Request) {
+	hh.writeJSON(w, r, http.StatusOK, &hh.Version)
+}
+
+func (hh *HealthHandler) writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(resp)
+	if err != nil {
+		hh.Logger.ErrorContext(r.Context(), "error writing response", logging.Err(err))
+	}
+}
@@ -3,25 +3,25 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 	"usersegmentator/config"
 	"usersegmentator/pkg/errors"
 	"usersegmentator/pkg/history"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/metrics"
+	"usersegmentator/pkg/tracing"
 )
 
 type HistoryHandler struct {
 	HistoryRepo history.Repository
-	InfoLog     *log.Logger
-	ErrLog      *log.Logger
+	Logger      *slog.Logger
 }
 
-func NewHistoryHandler(db *sql.DB, cfg *config.Config) *HistoryHandler {
+func NewHistoryHandler(db *sql.DB, cfg *config.Config, m *metrics.Metrics) *HistoryHandler {
 	return &HistoryHandler{
-		HistoryRepo: history.NewHistoryRepo(db, cfg),
-		InfoLog:     log.New(os.Stdout, "INFO\tHistory HANDLER\t", log.Ldate|log.Ltime),
-		ErrLog:      log.New(os.Stdout, "ERROR\tHistory HANDLER\t", log.Ldate|log.Ltime),
+		HistoryRepo: history.NewHistoryRepo(db, cfg, m),
+		Logger:      logging.For("history_handler"),
 	}
 }
 
@@ -32,38 +32,48 @@ func NewHistoryHandler(db *sql.DB, cfg *config.Config) *HistoryHandler {
 //	@Tags         	History
 //	@Accept			json
 //	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
 //	@Param 			request		body 	history.Request true "The input struct"
 //	@Success		200	{object} history.ReportResponse
 //	@Failure		400	{string} string "bad input"
 //	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
 //	@Router			/api/get_user_history [get]
 func (rh *HistoryHandler) GetUserHistory(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(r.Context(), "HistoryHandler.GetUserHistory")
+	defer span.End()
+	r = r.WithContext(ctx)
+
 	receivedRequest := &history.Request{}
 
 	err := errors.ValidateAndParseJSON(r, receivedRequest)
 	if err != nil {
-		rh.ErrLog.Printf("%s", err)
+		rh.Logger.ErrorContext(r.Context(), "GetUserHistory failed", logging.Err(err))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	span.SetAttributes(tracing.AttrUserID.Int(receivedRequest.UserID))
+	r = r.WithContext(logging.WithUserID(r.Context(), receivedRequest.UserID))
 
 	dates, err := rh.HistoryRepo.ParseAndValidateDates(receivedRequest.StartDate, receivedRequest.EndDate)
 	if err != nil {
-		rh.ErrLog.Printf("%s", err)
+		rh.Logger.ErrorContext(r.Context(), "GetUserHistory failed", logging.Err(err))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	userHistory, err := rh.HistoryRepo.GetUserHistory(r.Context(), receivedRequest.UserID, dates)
 	if err != nil {
-		rh.ErrLog.Printf("%s", err)
+		rh.Logger.ErrorContext(r.Context(), "GetUserHistory failed", logging.Err(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	url, err := rh.HistoryRepo.CreateCSV(userHistory)
+	url, err := rh.HistoryRepo.CreateCSV(r.Context(), userHistory)
 	if err != nil {
-		rh.ErrLog.Printf("%s", err)
+		rh.Logger.ErrorContext(r.Context(), "GetUserHistory failed", logging.Err(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -77,7 +87,7 @@ func (rh *HistoryHandler) GetUserHistory(w http.ResponseWriter, r *http.Request)
 
 	_, err = w.Write(resp)
 	if err != nil {
-		rh.ErrLog.Printf("%s", err)
+		rh.Logger.ErrorContext(r.Context(), "GetUserHistory failed", logging.Err(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
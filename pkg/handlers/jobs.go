@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/jobs"
+	"usersegmentator/pkg/logging"
+)
+
+type JobsHandler struct {
+	Scheduler *jobs.Scheduler
+	Logger    *slog.Logger
+}
+
+func NewJobsHandler(scheduler *jobs.Scheduler) *JobsHandler {
+	return &JobsHandler{
+		Scheduler: scheduler,
+		Logger:    logging.For("jobs_handler"),
+	}
+}
+
+// GetJobRuns godoc
+//
+//	@Summary		receive background job runs
+//	@Description	receive the last runs of a background job, or of every job if none is given, newest first. Each replica keeps its own history in memory, so the runs of leader-only jobs are returned by the leader only
+//	@Tags         	Admin
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Param 			request		body 	jobs.Request true "every field is optional"
+//	@Success		200	{array} jobs.Run
+//	@Failure		400	{string} string "bad input"
+//	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/admin/get_job_runs [get]
+func (jh *JobsHandler) GetJobRuns(w http.ResponseWriter, r *http.Request) {
+	receivedRequest := &jobs.Request{}
+
+	err := errors.ValidateAndParseJSON(r, receivedRequest)
+	if err != nil {
+		jh.Logger.ErrorContext(r.Context(), "GetJobRuns failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	runs, err := jh.Scheduler.History(receivedRequest.Job, receivedRequest.Limit)
+	if err != nil {
+		jh.Logger.ErrorContext(r.Context(), "GetJobRuns failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp, err := json.Marshal(runs)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(resp)
+	if err != nil {
+		jh.Logger.ErrorContext(r.Context(), "GetJobRuns failed", logging.Err(err))
+		return
+	}
+}
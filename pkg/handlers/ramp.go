@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/ramp"
+	"usersegmentator/pkg/tracing"
+)
+
+// SetRampPlan godoc
+//
+//	@Summary		set the ramp plan of a segment
+//	@Description	replaces the ramp plan of the segment with an active one: when the time of a step comes, random users are added once until target_percent of the active users are in the segment. The users added by the plan count towards the targets even once removed, so they are not replaced. The targets may not go down; the plan of a deleted segment is cancelled
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Param 			request		body 	ramp.RequestPlan true "The input struct"
+//	@Success		200	{object} ramp.Plan
+//	@Failure		400	{string} string "bad input"
+//	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/set_ramp_plan [post]
+func (sh *SegmentsHandler) SetRampPlan(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(r.Context(), "SegmentsHandler.SetRampPlan")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	f := &ramp.RequestPlan{}
+
+	err := errors.ValidateAndParseJSON(r, f)
+	if err == nil {
+		err = ramp.ValidateSteps(f.Steps)
+	}
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "SetRampPlan failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	span.SetAttributes(tracing.AttrSegment.String(f.SegmentSlug))
+	r = r.WithContext(logging.WithSegments(r.Context(), f.SegmentSlug))
+
+	status, ok := sh.authorizeSegments(r, []string{f.SegmentSlug})
+	if !ok {
+		w.WriteHeader(status)
+		return
+	}
+
+	plan, err := sh.RampRepo.SetPlan(r.Context(), f.SegmentSlug, f.Steps)
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "SetRampPlan failed", logging.Err(err))
+		w.WriteHeader(rampStatus(err))
+		return
+	}
+
+	sh.writePlan(w, r, "SetRampPlan", plan)
+}
+
+// GetRampPlan godoc
+//
+//	@Summary		receive the ramp plan of a segment
+//	@Description	receive the ramp plan of the segment with its status, the number of steps reached (stage), the current target and the next step
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Param 			request		body 	ramp.RequestStatus true "only segment_slug is used"
+//	@Success		200	{object} ramp.Plan
+//	@Failure		400	{string} string "bad input"
+//	@Failure		404	{string} string "no ramp plan"
+//	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/get_ramp_plan [get]
+func (sh *SegmentsHandler) GetRampPlan(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(r.Context(), "SegmentsHandler.GetRampPlan")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	f := &ramp.RequestStatus{}
+
+	err := errors.ValidateAndParseJSON(r, f)
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "GetRampPlan failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	span.SetAttributes(tracing.AttrSegment.String(f.SegmentSlug))
+
+	plan, err := sh.RampRepo.GetPlan(r.Context(), f.SegmentSlug)
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "GetRampPlan failed", logging.Err(err))
+		w.WriteHeader(rampStatus(err))
+		return
+	}
+
+	sh.writePlan(w, r, "GetRampPlan", plan)
+}
+
+// UpdateRampPlan godoc
+//
+//	@Summary		pause, resume or roll back the ramp plan of a segment
+//	@Description	status "paused" stops adding users, "active" resumes a paused plan, "rolled_back" stops the plan for good and has the next run of the ramp job unassign random members until target_percent of the active users are left in the segment, none by default. rollback_percent is returned until then
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Param 			request		body 	ramp.RequestStatus true "target_percent — optional, for a rollback only"
+//	@Success		200	{object} ramp.Plan
+//	@Failure		400	{string} string "bad input"
+//	@Failure		404	{string} string "no ramp plan"
+//	@Failure		409	{string} string "not allowed from the current status"
+//	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/update_ramp_plan [post]
+func (sh *SegmentsHandler) UpdateRampPlan(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(r.Context(), "SegmentsHandler.UpdateRampPlan")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	f := &ramp.RequestStatus{}
+
+	err := errors.ValidateAndParseJSON(r, f)
+	if err == nil {
+		err = ramp.ValidateStatus(f.Status)
+	}
+	if err == nil && (f.TargetPercent < 0 || f.TargetPercent > 100) {
+		err = fmt.Errorf("invalid target percentage: %d", f.TargetPercent)
+	}
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "UpdateRampPlan failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	span.SetAttributes(tracing.AttrSegment.String(f.SegmentSlug))
+	r = r.WithContext(logging.WithSegments(r.Context(), f.SegmentSlug))
+
+	status, ok := sh.authorizeSegments(r, []string{f.SegmentSlug})
+	if !ok {
+		w.WriteHeader(status)
+		return
+	}
+
+	// the members are unassigned by the ramp runner, which no top-up can overlap
+	plan, err := sh.RampRepo.SetStatus(r.Context(), f.SegmentSlug, f.Status, f.TargetPercent)
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "UpdateRampPlan failed", logging.Err(err))
+		w.WriteHeader(rampStatus(err))
+		return
+	}
+
+	sh.writePlan(w, r, "UpdateRampPlan", plan)
+}
+
+func (sh *SegmentsHandler) writePlan(w http.ResponseWriter, r *http.Request, name string, plan *ramp.Plan) {
+	resp, err := json.Marshal(plan)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(resp)
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), name+" failed", logging.Err(err))
+	}
+}
+
+// rampStatus is the response status for an error of the ramp repository.
+func rampStatus(err error) int {
+	switch {
+	case stderrors.Is(err, ramp.ErrSegmentNotFound):
+		return http.StatusBadRequest
+	case stderrors.Is(err, ramp.ErrPlanNotFound):
+		return http.StatusNotFound
+	case stderrors.Is(err, ramp.ErrInvalidTransition):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -3,58 +3,115 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
+	"time"
 	"usersegmentator/config"
+	"usersegmentator/pkg/auth"
+	"usersegmentator/pkg/cache"
 	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/metrics"
+	"usersegmentator/pkg/ramp"
 	"usersegmentator/pkg/segment"
+	"usersegmentator/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// maxBatchUsers caps the users of a single batch lookup or change.
+const maxBatchUsers = 1000
+
 type SegmentsHandler struct {
 	SegmentsRepo segment.Repository
-	InfoLog      *log.Logger
-	ErrLog       *log.Logger
+	RampRepo     ramp.Repository
+	Snapshots    *segment.SnapshotCache
+	Logger       *slog.Logger
 }
 
-func NewSegmentsHandler(db *sql.DB, cfg *config.Config) *SegmentsHandler {
+// NewSegmentsHandler reads user segments through userCache unless it is nil.
+func NewSegmentsHandler(db *sql.DB, cfg *config.Config, broker *events.Broker, m *metrics.Metrics,
+	userCache cache.Cache) *SegmentsHandler {
+	repo := segment.NewSegmentsRepo(db, cfg, broker, m)
+	if userCache != nil {
+		repo = segment.NewCachedRepo(repo, userCache, cfg, broker, m)
+	}
+
 	return &SegmentsHandler{
-		SegmentsRepo: segment.NewSegmentsRepo(db, cfg),
-		InfoLog:      log.New(os.Stdout, "INFO\tSEGMENTS HANDLER\t", log.Ldate|log.Ltime),
-		ErrLog:       log.New(os.Stdout, "ERROR\tSEGMENTS HANDLER\t", log.Ldate|log.Ltime),
+		SegmentsRepo: repo,
+		RampRepo:     ramp.NewRampRepo(db, cfg),
+		Snapshots:    segment.NewSnapshotCache(repo, cfg, broker, m),
+		Logger:       logging.For("segments_handler"),
 	}
 }
 
 // AddSegment godoc
 //
 //	@Summary		creates new segment
-//	@Description	creates new segment
+//	@Description	creates new segment; with dry_run nothing is changed and the changes that would be made are returned
 //	@Tags         	Segments
 //	@Accept			json
-//	@Param 			request		body 	segment.RequestSegmentSlug true "fraction — optional"
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Param 			request		body 	segment.RequestSegmentSlug true "fraction, dry_run — optional"
 //	@Success		201	{string} string "created"
+//	@Success		200	{object} segment.Diff "dry run"
 //	@Failure		400	{string} string "bad input"
 //	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
 //	@Router			/api/create_segment [post]
 func (sh *SegmentsHandler) AddSegment(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(r.Context(), "SegmentsHandler.AddSegment")
+	defer span.End()
+	r = r.WithContext(ctx)
+
 	f := &segment.Template{}
 
 	err := errors.ValidateAndParseJSON(r, f)
 	if err != nil {
-		sh.ErrLog.Printf("%s", err)
+		sh.Logger.ErrorContext(r.Context(), "AddSegment failed", logging.Err(err))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	span.SetAttributes(tracing.AttrSegment.String(f.SegmentSlug), tracing.AttrDryRun.Bool(f.DryRun))
+	r = r.WithContext(logging.WithSegments(r.Context(), f.SegmentSlug))
 
-	err = sh.SegmentsRepo.InsertSegment(r.Context(), f.SegmentSlug)
+	status, ok := sh.authorizeSegments(r, []string{f.SegmentSlug})
+	if !ok {
+		w.WriteHeader(status)
+		return
+	}
+
+	var ownerTeam string
+	if principal, ok := auth.PrincipalFromContext(r.Context()); ok {
+		ownerTeam = principal.Team
+	}
+
+	if f.DryRun {
+		sh.dryRun(w, r, "AddSegment", func(repo segment.Repository) error {
+			err := repo.InsertSegment(r.Context(), f.SegmentSlug, ownerTeam)
+			if err != nil || f.Fraction == 0 {
+				return err
+			}
+			_, err = repo.TopUpSegment(r.Context(), f.Fraction, f.SegmentSlug, nil, 0)
+			return err
+		})
+		return
+	}
+
+	err = sh.SegmentsRepo.InsertSegment(r.Context(), f.SegmentSlug, ownerTeam)
 	if err != nil {
-		sh.ErrLog.Printf("%s", err)
+		sh.Logger.ErrorContext(r.Context(), "AddSegment failed", logging.Err(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	// the existing members count towards the fraction, so a repeated call does not overshoot it
 	if f.Fraction != 0 {
-		err = sh.SegmentsRepo.AutoAssignSegment(r.Context(), f.Fraction, f.SegmentSlug, 0)
+		_, err = sh.SegmentsRepo.TopUpSegment(r.Context(), f.Fraction, f.SegmentSlug, nil, 0)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
@@ -67,27 +124,51 @@ func (sh *SegmentsHandler) AddSegment(w http.ResponseWriter, r *http.Request) {
 // DeleteSegment godoc
 //
 //	@Summary		deletes existing segment
-//	@Description	deletes existing segment
+//	@Description	deletes existing segment; with dry_run nothing is changed and the changes that would be made are returned
 //	@Tags         	Segments
 //	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
 //	@Param 			request		body 	segment.RequestSegmentSlug true "The input struct"
-//	@Success		200	{string} string "deleted"
+//	@Success		200	{object} segment.Diff "deleted; the body is returned for a dry run only"
 //	@Failure		400	{string} string "bad input"
 //	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
 //	@Router			/api/delete_segment [delete]
 func (sh *SegmentsHandler) DeleteSegment(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(r.Context(), "SegmentsHandler.DeleteSegment")
+	defer span.End()
+	r = r.WithContext(ctx)
+
 	f := &segment.Template{}
 
 	err := errors.ValidateAndParseJSON(r, f)
 	if err != nil {
-		sh.ErrLog.Printf("%s", err)
+		sh.Logger.ErrorContext(r.Context(), "DeleteSegment failed", logging.Err(err))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	span.SetAttributes(tracing.AttrSegment.String(f.SegmentSlug), tracing.AttrDryRun.Bool(f.DryRun))
+	r = r.WithContext(logging.WithSegments(r.Context(), f.SegmentSlug))
+
+	status, ok := sh.authorizeSegments(r, []string{f.SegmentSlug})
+	if !ok {
+		w.WriteHeader(status)
+		return
+	}
+
+	if f.DryRun {
+		sh.dryRun(w, r, "DeleteSegment", func(repo segment.Repository) error {
+			return repo.DeleteSegment(r.Context(), f.SegmentSlug)
+		})
+		return
+	}
 
 	err = sh.SegmentsRepo.DeleteSegment(r.Context(), f.SegmentSlug)
 	if err != nil {
-		sh.ErrLog.Printf("%s", err)
+		sh.Logger.ErrorContext(r.Context(), "DeleteSegment failed", logging.Err(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -98,39 +179,215 @@ func (sh *SegmentsHandler) DeleteSegment(w http.ResponseWriter, r *http.Request)
 // UpdateUserSegments godoc
 //
 //	@Summary		assign and unassign segments from user
-//	@Description	assign and unassign segments from user
+//	@Description	assign and unassign segments from user in a single transaction and return the outcome for every segment: assigned, already_member, unassigned, not_member or unknown_segment; expires_at is an RFC3339 timestamp or an ISO-8601 duration, ttl in days is deprecated; with dry_run nothing is changed and the changes that would be made are returned
 //	@Tags         	Segments
 //	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
 //	@Param 			request		body 	segment.RequestUpdateSegments true "The input struct"
-//	@Success		200	{string} string "assigned and unassigned"
+//	@Success		200	{object} segment.AppliedChanges "segment.Diff for a dry run"
 //	@Failure		400	{string} string "bad input"
 //	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
 //	@Router			/api/update_user_segments [post]
 func (sh *SegmentsHandler) UpdateUserSegments(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(r.Context(), "SegmentsHandler.UpdateUserSegments")
+	defer span.End()
+	r = r.WithContext(ctx)
+
 	f := &segment.Template{}
 
 	err := errors.ValidateAndParseJSON(r, f)
 	if err != nil {
-		sh.ErrLog.Printf("%s", err)
+		sh.Logger.ErrorContext(r.Context(), "UpdateUserSegments failed", logging.Err(err))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	span.SetAttributes(
+		tracing.AttrUserID.Int(f.UserID),
+		attribute.StringSlice("segment.assign", f.AssignSegments),
+		attribute.StringSlice("segment.unassign", f.UnassignSegments),
+		tracing.AttrDryRun.Bool(f.DryRun),
+	)
+	slugs := append(append([]string{}, f.AssignSegments...), f.UnassignSegments...)
+	ctx = logging.WithUserID(r.Context(), f.UserID)
+	r = r.WithContext(logging.WithSegments(ctx, slugs...))
 
-	err = sh.SegmentsRepo.AssignSegments(r.Context(), []int{f.UserID}, f.AssignSegments, f.TTL)
+	status, ok := sh.authorizeSegments(r, slugs)
+	if !ok {
+		w.WriteHeader(status)
+		return
+	}
+
+	expiresAt, err := segment.ParseExpiry(f.ExpiresAt, f.TTL, time.Now().UTC())
 	if err != nil {
-		sh.ErrLog.Printf("%s", err)
+		sh.Logger.ErrorContext(r.Context(), "UpdateUserSegments failed", logging.Err(err))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	err = sh.SegmentsRepo.UnassignSegments(r.Context(), []int{f.UserID}, f.UnassignSegments)
+	changeSets := []segment.ChangeSet{{
+		UserID:    f.UserID,
+		Assign:    f.AssignSegments,
+		Unassign:  f.UnassignSegments,
+		ExpiresAt: expiresAt,
+	}}
+	sh.applyChangeSets(w, r, "UpdateUserSegments", changeSets, f.DryRun)
+}
+
+// UpdateUsersSegments godoc
+//
+//	@Summary		assign and unassign segments of many users at once
+//	@Description	apply the same change to up to 1000 users in a single transaction and return the outcome for every user and segment, as update_user_segments does; with dry_run nothing is changed and the changes that would be made are returned
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Param 			request		body 	segment.RequestUpdateUsersSegments true "The input struct"
+//	@Success		200	{object} segment.AppliedChanges "segment.Diff for a dry run"
+//	@Failure		400	{string} string "bad input"
+//	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/update_users_segments [post]
+func (sh *SegmentsHandler) UpdateUsersSegments(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(r.Context(), "SegmentsHandler.UpdateUsersSegments")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	f := &segment.Template{}
+
+	err := errors.ValidateAndParseJSON(r, f)
 	if err != nil {
-		sh.ErrLog.Printf("%s", err)
+		sh.Logger.ErrorContext(r.Context(), "UpdateUsersSegments failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(f.UserIDs) == 0 || len(f.UserIDs) > maxBatchUsers {
+		sh.Logger.ErrorContext(r.Context(), "UpdateUsersSegments failed: bad number of users",
+			"users", len(f.UserIDs), "max", maxBatchUsers)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	span.SetAttributes(
+		tracing.AttrUserIDs.IntSlice(f.UserIDs),
+		attribute.StringSlice("segment.assign", f.AssignSegments),
+		attribute.StringSlice("segment.unassign", f.UnassignSegments),
+		tracing.AttrDryRun.Bool(f.DryRun),
+	)
+	slugs := append(append([]string{}, f.AssignSegments...), f.UnassignSegments...)
+	r = r.WithContext(logging.WithSegments(r.Context(), slugs...))
 
-	w.WriteHeader(http.StatusOK)
+	status, ok := sh.authorizeSegments(r, slugs)
+	if !ok {
+		w.WriteHeader(status)
+		return
+	}
+
+	expiresAt, err := segment.ParseExpiry(f.ExpiresAt, f.TTL, time.Now().UTC())
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "UpdateUsersSegments failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// a user listed twice is changed once
+	changeSets := make([]segment.ChangeSet, 0, len(f.UserIDs))
+	seen := make(map[int]bool, len(f.UserIDs))
+	for _, userID := range f.UserIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		changeSets = append(changeSets, segment.ChangeSet{
+			UserID:    userID,
+			Assign:    f.AssignSegments,
+			Unassign:  f.UnassignSegments,
+			ExpiresAt: expiresAt,
+		})
+	}
+	sh.applyChangeSets(w, r, "UpdateUsersSegments", changeSets, f.DryRun)
+}
+
+// UpdateSegmentsExpiry godoc
+//
+//	@Summary		change the expiry of user memberships
+//	@Description	moves the expiry of the user's active memberships; expires_at is an RFC3339 timestamp or an ISO-8601 duration, empty makes the memberships permanent; with dry_run nothing is changed and the changes that would be made are returned
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Param 			request		body 	segment.RequestUpdateExpiry true "The input struct"
+//	@Success		200	{object} segment.UpdatedMemberships "segment.Diff for a dry run"
+//	@Failure		400	{string} string "bad input"
+//	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/update_segments_expiry [post]
+func (sh *SegmentsHandler) UpdateSegmentsExpiry(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(r.Context(), "SegmentsHandler.UpdateSegmentsExpiry")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	f := &segment.Template{}
+
+	err := errors.ValidateAndParseJSON(r, f)
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "UpdateSegmentsExpiry failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	span.SetAttributes(
+		tracing.AttrUserID.Int(f.UserID),
+		tracing.AttrSegments.StringSlice(f.Segments),
+		tracing.AttrDryRun.Bool(f.DryRun),
+	)
+	ctx = logging.WithUserID(r.Context(), f.UserID)
+	r = r.WithContext(logging.WithSegments(ctx, f.Segments...))
+
+	status, ok := sh.authorizeSegments(r, f.Segments)
+	if !ok {
+		w.WriteHeader(status)
+		return
+	}
+
+	expiresAt, err := segment.ParseExpiry(f.ExpiresAt, 0, time.Now().UTC())
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "UpdateSegmentsExpiry failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if f.DryRun {
+		sh.dryRun(w, r, "UpdateSegmentsExpiry", func(repo segment.Repository) error {
+			_, err := repo.UpdateSegmentsExpiry(r.Context(), f.UserID, f.Segments, expiresAt)
+			return err
+		})
+		return
+	}
+
+	updated, err := sh.SegmentsRepo.UpdateSegmentsExpiry(r.Context(), f.UserID, f.Segments, expiresAt)
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "UpdateSegmentsExpiry failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp, err := json.Marshal(&segment.UpdatedMemberships{Updated: updated})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 }
 
 // GetUserSegments godoc
@@ -140,24 +397,34 @@ func (sh *SegmentsHandler) UpdateUserSegments(w http.ResponseWriter, r *http.Req
 //	@Tags         	Segments
 //	@Accept			json
 //	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
 //	@Param 			request		body 	segment.RequestUserID true "The input struct"
 //	@Success		200	{object} segment.UserSegments
 //	@Failure		400	{string} string "bad input"
 //	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
 //	@Router			/api/get_user_segments [get]
 func (sh *SegmentsHandler) GetUserSegments(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(r.Context(), "SegmentsHandler.GetUserSegments")
+	defer span.End()
+	r = r.WithContext(ctx)
+
 	receivedUserID := &segment.Template{}
 
 	err := errors.ValidateAndParseJSON(r, receivedUserID)
 	if err != nil {
-		sh.ErrLog.Printf("%s", err)
+		sh.Logger.ErrorContext(r.Context(), "GetUserSegments failed", logging.Err(err))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	span.SetAttributes(tracing.AttrUserID.Int(receivedUserID.UserID))
+	r = r.WithContext(logging.WithUserID(r.Context(), receivedUserID.UserID))
 
 	userSegments, err := sh.SegmentsRepo.GetUserSegments(r.Context(), receivedUserID.UserID)
 	if err != nil {
-		sh.ErrLog.Printf("%s", err)
+		sh.Logger.ErrorContext(r.Context(), "GetUserSegments failed", logging.Err(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -174,3 +441,185 @@ func (sh *SegmentsHandler) GetUserSegments(w http.ResponseWriter, r *http.Reques
 		return
 	}
 }
+
+// GetUsersSegments godoc
+//
+//	@Summary		receive segments of many users at once
+//	@Description	receive segments of up to 1000 users in one query; users that do not exist are listed in unknown_users
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Param 			request		body 	segment.RequestUserIDs true "The input struct"
+//	@Success		200	{object} segment.BatchUserSegments
+//	@Failure		400	{string} string "bad input"
+//	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/get_users_segments [get]
+func (sh *SegmentsHandler) GetUsersSegments(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(r.Context(), "SegmentsHandler.GetUsersSegments")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	f := &segment.Template{}
+
+	err := errors.ValidateAndParseJSON(r, f)
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "GetUsersSegments failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(f.UserIDs) == 0 || len(f.UserIDs) > maxBatchUsers {
+		sh.Logger.ErrorContext(r.Context(), "GetUsersSegments failed: bad number of users",
+			"users", len(f.UserIDs), "max", maxBatchUsers)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	span.SetAttributes(tracing.AttrUserIDs.IntSlice(f.UserIDs))
+
+	batch, err := sh.SegmentsRepo.GetUsersSegments(r.Context(), f.UserIDs)
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "GetUsersSegments failed", logging.Err(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := json.Marshal(batch)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetSnapshot godoc
+//
+//	@Summary		export segments snapshot for local evaluation
+//	@Description	export every active segment and membership with a content version; supports If-None-Match. The snapshot is rebuilt at most once per snapshot_ttl unless this instance publishes a change
+//	@Tags         	Segments
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Success		200	{object} segment.Snapshot
+//	@Success		304	{string} string "snapshot not modified"
+//	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/get_segments_snapshot [get]
+func (sh *SegmentsHandler) GetSnapshot(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(r.Context(), "SegmentsHandler.GetSnapshot")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	snapshot, resp, err := sh.Snapshots.Get(r.Context())
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "GetSnapshot failed", logging.Err(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	etag := `"` + snapshot.Version + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(resp)
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "GetSnapshot failed", logging.Err(err))
+		return
+	}
+}
+
+// authorizeSegments checks that the caller's team may modify every segment
+// in slugs. Without an authenticated principal, e.g. with auth disabled, it allows everything.
+func (sh *SegmentsHandler) authorizeSegments(r *http.Request, slugs []string) (int, bool) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		return http.StatusOK, true
+	}
+
+	owners, err := sh.SegmentsRepo.GetSegmentsOwners(r.Context(), slugs)
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), "authorizeSegments failed", logging.Err(err))
+		return http.StatusInternalServerError, false
+	}
+
+	for _, slug := range slugs {
+		if !principal.CanModifySegment(owners[slug]) {
+			sh.Logger.WarnContext(r.Context(), "segment owned by another team", "principal", principal.Name,
+				"team", principal.Team, logging.KeySegment, slug, "owner_team", owners[slug])
+			return http.StatusForbidden, false
+		}
+	}
+	return http.StatusOK, true
+}
+
+// applyChangeSets applies the change sets and responds with their outcomes,
+// or with the diff of what they would change on a dry run.
+func (sh *SegmentsHandler) applyChangeSets(
+	w http.ResponseWriter,
+	r *http.Request,
+	name string,
+	changeSets []segment.ChangeSet,
+	dryRun bool,
+) {
+	if dryRun {
+		sh.dryRun(w, r, name, func(repo segment.Repository) error {
+			_, err := repo.ApplyChangeSets(r.Context(), changeSets)
+			return err
+		})
+		return
+	}
+
+	outcomes, err := sh.SegmentsRepo.ApplyChangeSets(r.Context(), changeSets)
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), name+" failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp, err := json.Marshal(&segment.AppliedChanges{Outcomes: outcomes})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// dryRun responds with the diff of the changes fn makes, which are rolled
+// back. A call that would fail is a bad request.
+func (sh *SegmentsHandler) dryRun(w http.ResponseWriter, r *http.Request, name string, fn segment.DryRunFunc) {
+	diff, err := sh.SegmentsRepo.DryRun(r.Context(), fn)
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), name+" dry run failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp, err := json.Marshal(diff)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(resp)
+	if err != nil {
+		sh.Logger.ErrorContext(r.Context(), name+" dry run failed", logging.Err(err))
+		return
+	}
+}
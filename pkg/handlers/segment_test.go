@@ -0,0 +1,173 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/handlers"
+	"usersegmentator/pkg/migrate"
+	"usersegmentator/pkg/segment"
+)
+
+// newSegmentsHandler serves the segments of users 1000 to 1009 from a new
+// SQLite database, with user 1001 in AVITO_VOICE_MESSAGES.
+func newSegmentsHandler(t *testing.T) *handlers.SegmentsHandler {
+	t.Helper()
+	ctx := context.Background()
+
+	cfg := &config.Config{}
+	cfg.Database.Backend = dialect.SQLite
+	cfg.Database.Timeout = 5
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "segments.db")
+
+	db, err := dialect.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	migrator, err := migrate.NewMigrator(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrate.SeedUsers(ctx, db, cfg, 1000, 1009); err != nil {
+		t.Fatal(err)
+	}
+
+	broker := events.NewBroker(cfg)
+	t.Cleanup(broker.Close)
+
+	sh := handlers.NewSegmentsHandler(db, cfg, broker, nil, nil)
+	for _, slug := range []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30"} {
+		if err = sh.SegmentsRepo.InsertSegment(ctx, slug, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = sh.SegmentsRepo.AssignSegments(ctx, []int{1001}, []string{"AVITO_VOICE_MESSAGES"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	return sh
+}
+
+func updateUsersSegments(sh *handlers.SegmentsHandler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/update_users_segments", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	sh.UpdateUsersSegments(w, req)
+	return w
+}
+
+// userSegments returns the segments of the user, in no particular order.
+func userSegments(t *testing.T, sh *handlers.SegmentsHandler, userID int) []string {
+	t.Helper()
+
+	segments, err := sh.SegmentsRepo.GetUserSegments(context.Background(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return segments.Segments
+}
+
+func TestUpdateUsersSegments(t *testing.T) {
+	sh := newSegmentsHandler(t)
+
+	w := updateUsersSegments(sh, `{"user_ids": [1000, 1001, 1000],
+		"assign_segments": ["AVITO_VOICE_MESSAGES", "AVITO_UNKNOWN"], "unassign_segments": ["AVITO_DISCOUNT_30"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, expected %d", w.Code, http.StatusOK)
+	}
+
+	var applied segment.AppliedChanges
+	if err := json.Unmarshal(w.Body.Bytes(), &applied); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, o := range applied.Outcomes {
+		got[strconv.Itoa(o.UserID)+" "+o.Segment] = o.Outcome
+	}
+	expected := map[string]string{
+		"1000 AVITO_VOICE_MESSAGES": segment.OutcomeAssigned,
+		"1000 AVITO_UNKNOWN":        segment.OutcomeUnknownSegment,
+		"1000 AVITO_DISCOUNT_30":    segment.OutcomeNotMember,
+		"1001 AVITO_VOICE_MESSAGES": segment.OutcomeAlreadyMember,
+		"1001 AVITO_UNKNOWN":        segment.OutcomeUnknownSegment,
+		"1001 AVITO_DISCOUNT_30":    segment.OutcomeNotMember,
+	}
+	// the user listed twice is changed once
+	if len(applied.Outcomes) != len(expected) {
+		t.Fatalf("outcomes %+v, expected %v", applied.Outcomes, expected)
+	}
+	for key, outcome := range expected {
+		if got[key] != outcome {
+			t.Fatalf("outcome %q for %s, expected %q", got[key], key, outcome)
+		}
+	}
+
+	if segments := userSegments(t, sh, 1000); len(segments) != 1 || segments[0] != "AVITO_VOICE_MESSAGES" {
+		t.Fatalf("user 1000 in %v, expected [AVITO_VOICE_MESSAGES]", segments)
+	}
+}
+
+func TestUpdateUsersSegmentsRejectsBadBatches(t *testing.T) {
+	sh := newSegmentsHandler(t)
+
+	tooMany := make([]string, 1001)
+	for i := range tooMany {
+		tooMany[i] = strconv.Itoa(1000 + i)
+	}
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"no users", `{"user_ids": [], "assign_segments": ["AVITO_DISCOUNT_30"]}`},
+		{"too many users", `{"user_ids": [` + strings.Join(tooMany, ",") + `], "assign_segments": ["AVITO_DISCOUNT_30"]}`},
+		{"conflicting change", `{"user_ids": [1000, 1002],
+			"assign_segments": ["AVITO_DISCOUNT_30"], "unassign_segments": ["AVITO_DISCOUNT_30"]}`},
+		{"bad expiry", `{"user_ids": [1000], "assign_segments": ["AVITO_DISCOUNT_30"], "expires_at": "soon"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := updateUsersSegments(sh, tt.body); w.Code != http.StatusBadRequest {
+				t.Fatalf("status %d, expected %d", w.Code, http.StatusBadRequest)
+			}
+			for _, userID := range []int{1000, 1002} {
+				if segments := userSegments(t, sh, userID); len(segments) != 0 {
+					t.Fatalf("user %d in %v after a rejected batch", userID, segments)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateUsersSegmentsDryRun(t *testing.T) {
+	sh := newSegmentsHandler(t)
+
+	w := updateUsersSegments(sh, `{"user_ids": [1000, 1002], "assign_segments": ["AVITO_DISCOUNT_30"], "dry_run": true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, expected %d", w.Code, http.StatusOK)
+	}
+
+	var diff segment.Diff
+	if err := json.Unmarshal(w.Body.Bytes(), &diff); err != nil {
+		t.Fatal(err)
+	}
+	if diff.Assigned != 2 {
+		t.Fatalf("diff %+v, expected both users assigned", diff)
+	}
+	for _, userID := range []int{1000, 1002} {
+		if segments := userSegments(t, sh, userID); len(segments) != 0 {
+			t.Fatalf("user %d in %v after a dry run", userID, segments)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"usersegmentator/config"
+	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/webhook"
+)
+
+type WebhooksHandler struct {
+	WebhooksRepo webhook.Repository
+	Logger       *slog.Logger
+}
+
+func NewWebhooksHandler(db *sql.DB, cfg *config.Config) *WebhooksHandler {
+	return &WebhooksHandler{
+		WebhooksRepo: webhook.NewWebhooksRepo(db, cfg),
+		Logger:       logging.For("webhooks_handler"),
+	}
+}
+
+// AddWebhook godoc
+//
+//	@Summary		subscribes a webhook to segment events
+//	@Description	subscribes a webhook to the given event types, optionally of a single segment.
+//	@Description	Deliveries are signed with HMAC-SHA256 of the body in the X-Webhook-Signature header.
+//	@Tags         	Webhooks
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Param 			request		body 	webhook.RequestCreateSubscription true "segment_slug — optional"
+//	@Success		201	{object} webhook.ResponseSubscriptionID
+//	@Failure		400	{string} string "bad input"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/create_webhook [post]
+func (wh *WebhooksHandler) AddWebhook(w http.ResponseWriter, r *http.Request) {
+	receivedRequest := &webhook.RequestCreateSubscription{}
+
+	err := errors.ValidateAndParseJSON(r, receivedRequest)
+	if err != nil {
+		wh.Logger.ErrorContext(r.Context(), "AddWebhook failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, err := wh.WebhooksRepo.InsertSubscription(r.Context(), &webhook.Subscription{
+		URL:         receivedRequest.URL,
+		Secret:      receivedRequest.Secret,
+		SegmentSlug: receivedRequest.SegmentSlug,
+		EventTypes:  receivedRequest.EventTypes,
+	})
+	if err != nil {
+		wh.Logger.ErrorContext(r.Context(), "AddWebhook failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp, err := json.Marshal(webhook.ResponseSubscriptionID{ID: id})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	_, err = w.Write(resp)
+	if err != nil {
+		wh.Logger.ErrorContext(r.Context(), "AddWebhook failed", logging.Err(err))
+		return
+	}
+}
+
+// DeleteWebhook godoc
+//
+//	@Summary		deletes webhook subscription
+//	@Description	deletes webhook subscription
+//	@Tags         	Webhooks
+//	@Accept			json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Param 			request		body 	webhook.RequestSubscriptionID true "The input struct"
+//	@Success		200	{string} string "deleted"
+//	@Failure		400	{string} string "bad input"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/delete_webhook [delete]
+func (wh *WebhooksHandler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	receivedRequest := &webhook.RequestSubscriptionID{}
+
+	err := errors.ValidateAndParseJSON(r, receivedRequest)
+	if err != nil {
+		wh.Logger.ErrorContext(r.Context(), "DeleteWebhook failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = wh.WebhooksRepo.DeleteSubscription(r.Context(), receivedRequest.ID)
+	if err != nil {
+		wh.Logger.ErrorContext(r.Context(), "DeleteWebhook failed", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetWebhooks godoc
+//
+//	@Summary		receive webhook subscriptions
+//	@Description	receive active webhook subscriptions
+//	@Tags         	Webhooks
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Success		200	{array} webhook.Subscription
+//	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/get_webhooks [get]
+func (wh *WebhooksHandler) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := wh.WebhooksRepo.GetSubscriptions(r.Context())
+	if err != nil {
+		wh.Logger.ErrorContext(r.Context(), "GetWebhooks failed", logging.Err(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	wh.writeJSON(w, r, subscriptions)
+}
+
+// GetDeadLetters godoc
+//
+//	@Summary		receive undelivered webhook events
+//	@Description	receive webhook events whose delivery attempts were exhausted
+//	@Tags         	Webhooks
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Security		BearerAuth
+//	@Success		200	{array} webhook.DeadLetter
+//	@Failure		500	{string} string "something went wrong"
+//	@Failure		401	{string} string "unauthorized"
+//	@Failure		403	{string} string "forbidden"
+//	@Router			/api/get_webhook_dead_letters [get]
+func (wh *WebhooksHandler) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	deadLetters, err := wh.WebhooksRepo.GetDeadLetters(r.Context())
+	if err != nil {
+		wh.Logger.ErrorContext(r.Context(), "GetDeadLetters failed", logging.Err(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	wh.writeJSON(w, r, deadLetters)
+}
+
+func (wh *WebhooksHandler) writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(resp)
+	if err != nil {
+		wh.Logger.ErrorContext(r.Context(), "error writing response", logging.Err(err))
+		return
+	}
+}
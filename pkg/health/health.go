@@ -0,0 +1,134 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Check reports whether a dependency is usable.
+type Check func(ctx context.Context) error
+
+type Component struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status     string               `json:"status"`
+	Components map[string]Component `json:"components,omitempty"`
+}
+
+type Version struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Checker runs the registered checks concurrently, each bounded by timeout.
+type Checker struct {
+	timeout time.Duration
+	checks  map[string]Check
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		timeout: timeout,
+		checks:  make(map[string]Check),
+	}
+}
+
+func (c *Checker) Add(name string, check Check) {
+	c.checks[name] = check
+}
+
+// Run returns a report that is ok only if every check passed.
+func (c *Checker) Run(ctx context.Context) *Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	report := &Report{
+		Status:     StatusOK,
+		Components: make(map[string]Component, len(c.checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range c.checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+
+			component := Component{Status: StatusOK}
+			if err := check(ctx); err != nil {
+				component = Component{Status: StatusFail, Error: err.Error()}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Components[name] = component
+			if component.Status != StatusOK {
+				report.Status = StatusFail
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	return report
+}
+
+// DBCheck pings the database.
+func DBCheck(db *sql.DB) Check {
+	return func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	}
+}
+
+// StorageCheck creates and removes a file in dir to make sure reports can be written.
+func StorageCheck(dir string) Check {
+	return func(ctx context.Context) error {
+		file, err := os.CreateTemp(dir, ".readyz-*")
+		if err != nil {
+			return err
+		}
+
+		err = file.Close()
+		if rmErr := os.Remove(file.Name()); rmErr != nil && err == nil {
+			err = rmErr
+		}
+		return err
+	}
+}
+
+// LeaderOnly runs check only while isLeader reports true, as followers do
+// not run the background jobs it watches.
+func LeaderOnly(isLeader func() bool, check Check) Check {
+	return func(ctx context.Context) error {
+		if !isLeader() {
+			return nil
+		}
+		return check(ctx)
+	}
+}
+
+// HeartbeatCheck fails if the worker reporting its last run through heartbeat
+// has not run for longer than maxAge.
+func HeartbeatCheck(heartbeat func() time.Time, maxAge time.Duration) Check {
+	return func(ctx context.Context) error {
+		last := heartbeat()
+		if last.IsZero() {
+			return fmt.Errorf("not started")
+		}
+		if age := time.Since(last); age > maxAge {
+			return fmt.Errorf("last run %s ago", age.Round(time.Second))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,83 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/logging"
+)
+
+// ReportCleaner deletes the CSV reports written longer than the report TTL
+// ago. Reports are files in the storage directory of each replica, so every
+// replica cleans its own.
+type ReportCleaner struct {
+	dir      string
+	prefix   string
+	ext      string
+	ttl      time.Duration
+	interval time.Duration
+	Logger   *slog.Logger
+}
+
+func NewReportCleaner(cfg *config.Config) *ReportCleaner {
+	return &ReportCleaner{
+		dir:      cfg.StorageDir,
+		prefix:   cfg.Report.FilePrefix,
+		ext:      cfg.Report.FileExt,
+		ttl:      time.Duration(cfg.Report.TTL) * time.Second,
+		interval: time.Duration(cfg.Report.CleanupInterval) * time.Second,
+		Logger:   logging.For("report_cleaner"),
+	}
+}
+
+func (rc *ReportCleaner) Interval() time.Duration {
+	return rc.interval
+}
+
+// Purge deletes the expired reports. Other files in the directory are left alone.
+func (rc *ReportCleaner) Purge(ctx context.Context) error {
+	entries, err := os.ReadDir(rc.dir)
+	if err != nil {
+		return fmt.Errorf("error listing reports: %w", err)
+	}
+
+	before := time.Now().Add(-rc.ttl)
+	purged := 0
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, rc.prefix) || !strings.HasSuffix(name, rc.ext) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// deleted since the directory was listed
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("error reading report %s: %w", name, err)
+		}
+		if !info.ModTime().Before(before) {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(rc.dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error deleting report %s: %w", name, err)
+		}
+		purged++
+	}
+
+	if purged > 0 {
+		rc.Logger.InfoContext(ctx, "Purged reports", "reports", purged)
+	}
+	return nil
+}
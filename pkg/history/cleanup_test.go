@@ -0,0 +1,49 @@
+package history_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/history"
+)
+
+func TestReportCleanerPurgesExpiredReports(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.StorageDir = dir
+	cfg.Report.FilePrefix = "report_"
+	cfg.Report.FileExt = ".csv"
+	cfg.Report.TTL = 3600
+
+	old := time.Now().Add(-2 * time.Hour)
+	files := map[string]time.Time{
+		"report_expired.csv": old,
+		"report_recent.csv":  time.Now(),
+		"notes_expired.csv":  old,
+		"report_expired.txt": old,
+	}
+	for name, modified := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("1000;AVITO;assigned;2023-08-31\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := history.NewReportCleaner(cfg).Purge(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		purged := os.IsNotExist(err)
+		if purged != (name == "report_expired.csv") {
+			t.Fatalf("%s purged %t", name, purged)
+		}
+	}
+}
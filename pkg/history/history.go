@@ -21,6 +21,37 @@ type DatesRange struct {
 	EndDate   time.Time
 }
 
+// Membership is one stay of a user in a segment, the source of report rows.
+type Membership struct {
+	Segment      string
+	AssignedAt   time.Time
+	UnassignedAt *time.Time
+}
+
+// appendOperations adds a report row for each change of the membership
+// that happened within dates.
+func (dates *DatesRange) appendOperations(history []ReportRow, userID int, membership *Membership) []ReportRow {
+	if dates.StartDate.Before(membership.AssignedAt) && membership.AssignedAt.Before(dates.EndDate) {
+		history = append(history, ReportRow{
+			UserID:    userID,
+			Segment:   membership.Segment,
+			Operation: "assigned",
+			Date:      membership.AssignedAt.String(),
+		})
+	}
+
+	if membership.UnassignedAt != nil && dates.EndDate.After(*membership.UnassignedAt) &&
+		dates.StartDate.Before(*membership.UnassignedAt) {
+		history = append(history, ReportRow{
+			UserID:    userID,
+			Segment:   membership.Segment,
+			Operation: "unassigned",
+			Date:      membership.UnassignedAt.String(),
+		})
+	}
+	return history
+}
+
 type ReportRow struct {
 	UserID    int
 	Segment   string
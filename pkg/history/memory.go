@@ -0,0 +1,49 @@
+package history
+
+import (
+	"context"
+	"usersegmentator/config"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/metrics"
+	"usersegmentator/pkg/tracing"
+)
+
+// MembershipSource lists every membership a user ever had, oldest first.
+type MembershipSource interface {
+	UserMemberships(userID int) []Membership
+}
+
+// memoryHistoryRepository builds reports from memberships kept in memory,
+// writing them like the database-backed repository.
+type memoryHistoryRepository struct {
+	*historyRepository
+	source MembershipSource
+}
+
+func NewMemoryRepo(source MembershipSource, cfg *config.Config, m *metrics.Metrics) Repository {
+	return &memoryHistoryRepository{
+		historyRepository: &historyRepository{
+			cfg:     cfg,
+			metrics: m,
+			Logger:  logging.For("history_repo"),
+		},
+		source: source,
+	}
+}
+
+func (hr *memoryHistoryRepository) GetUserHistory(
+	ctx context.Context,
+	userID int,
+	dates *DatesRange,
+) (_ []ReportRow, err error) {
+	_, span := tracing.Start(ctx, "HistoryRepo.GetUserHistory", tracing.AttrUserID.Int(userID))
+	defer func() { tracing.End(span, err) }()
+
+	history := []ReportRow{}
+	for _, membership := range hr.source.UserMemberships(userID) {
+		history = dates.appendOperations(history, userID, &membership)
+	}
+
+	span.SetAttributes(tracing.AttrRows.Int(len(history)))
+	return history, nil
+}
@@ -4,33 +4,39 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"os"
 	"regexp"
 	"time"
 	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/metrics"
+	"usersegmentator/pkg/tracing"
 )
 
 type Repository interface {
 	GetUserHistory(ctx context.Context, userID int, dates *DatesRange) ([]ReportRow, error)
 	ParseAndValidateDates(dateStart, dateEnd string) (*DatesRange, error)
-	CreateCSV(history []ReportRow) (string, error)
+	CreateCSV(ctx context.Context, history []ReportRow) (string, error)
 }
 
 type historyRepository struct {
 	db      *sql.DB
+	dialect dialect.Dialect
 	cfg     *config.Config
-	InfoLog *log.Logger
-	ErrLog  *log.Logger
+	metrics *metrics.Metrics
+	Logger  *slog.Logger
 }
 
-func NewHistoryRepo(db *sql.DB, cfg *config.Config) Repository {
+func NewHistoryRepo(db *sql.DB, cfg *config.Config, m *metrics.Metrics) Repository {
 	return &historyRepository{
 		db:      db,
+		dialect: dialect.For(cfg),
 		cfg:     cfg,
-		InfoLog: log.New(os.Stdout, "INFO\tREPORT REPO\t", log.Ldate|log.Ltime),
-		ErrLog:  log.New(os.Stdout, "ERROR\tREPORT REPO\t", log.Ldate|log.Ltime),
+		metrics: m,
+		Logger:  logging.For("history_repo"),
 	}
 }
 
@@ -47,14 +53,12 @@ func (hr *historyRepository) ParseAndValidateDates(dateStart, dateEnd string) (*
 		dates.StartDate, err = time.Parse("2006-01", dateStart)
 
 		if err != nil {
-			hr.ErrLog.Printf("Error validating date: %s", err)
 			return nil, err
 		}
 	} else {
 		dates.StartDate, err = time.Parse("2006-1", dateStart)
 
 		if err != nil {
-			hr.ErrLog.Printf("Error validating date: %s", err)
 			return nil, err
 		}
 	}
@@ -63,87 +67,82 @@ func (hr *historyRepository) ParseAndValidateDates(dateStart, dateEnd string) (*
 		dates.EndDate, err = time.Parse("2006-01", dateEnd)
 
 		if err != nil {
-			hr.ErrLog.Printf("Error validating date: %s", err)
 			return nil, err
 		}
 	} else {
 		dates.EndDate, err = time.Parse("2006-1", dateEnd)
 
 		if err != nil {
-			hr.ErrLog.Printf("Error validating date: %s", err)
 			return nil, err
 		}
 	}
 
 	if err != nil {
-		hr.ErrLog.Printf("Error validating date: %s", err)
 		return nil, err
 	}
 	dates.EndDate = dates.EndDate.AddDate(0, 1, 0)
 	return dates, nil
 }
 
-func (hr *historyRepository) GetUserHistory(ctx context.Context, userID int, dates *DatesRange) ([]ReportRow, error) {
+func (hr *historyRepository) GetUserHistory(
+	ctx context.Context,
+	userID int,
+	dates *DatesRange,
+) (_ []ReportRow, err error) {
+	ctx, span := tracing.Start(ctx, "HistoryRepo.GetUserHistory", tracing.AttrUserID.Int(userID))
+	defer func() { tracing.End(span, err) }()
+
 	history := []ReportRow{}
 	rows, err := hr.db.QueryContext(
 		ctx,
-		`SELECT f.slug, ufr.date_assigned, ufr.date_unassigned 
+		hr.dialect.Rebind(`SELECT f.slug, ufr.date_assigned, ufr.date_unassigned 
 		FROM user_segment_relation ufr 
 		JOIN segments f ON ufr.segment_id = f.id 
 		WHERE ufr.user_id = ? AND (
 		ufr.date_assigned >= ? OR 
-		(ufr.date_unassigned < ? OR ufr.date_unassigned IS NULL))`,
+		(ufr.date_unassigned < ? OR ufr.date_unassigned IS NULL))`),
 		userID,
-		dates.StartDate.String(),
-		dates.EndDate.String(),
+		dates.StartDate,
+		dates.EndDate,
 	)
 
 	if err != nil {
-		hr.ErrLog.Println(err.Error())
+		hr.Logger.ErrorContext(ctx, "error building report", logging.Err(err))
 		return nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var slug sql.NullString
 		var dateAssigned, dateUnassigned sql.NullTime
 		err = rows.Scan(&slug, &dateAssigned, &dateUnassigned)
 		if err != nil {
-			hr.ErrLog.Println(err.Error())
+			hr.Logger.ErrorContext(ctx, "error building report", logging.Err(err))
 			return nil, err
 		}
 
-		var historyRowUnassign ReportRow
-
-		if dates.StartDate.Before(dateAssigned.Time) && dateAssigned.Time.Before(dates.EndDate) {
-			historyRowAssign := ReportRow{
-				UserID:    userID,
-				Segment:   slug.String,
-				Operation: "assigned",
-				Date:      dateAssigned.Time.String(),
-			}
-			history = append(history, historyRowAssign)
-		}
-
-		if dateUnassigned.Valid && dates.EndDate.After(dateUnassigned.Time) &&
-			dates.StartDate.Before(dateUnassigned.Time) {
-			historyRowUnassign = ReportRow{
-				UserID:    userID,
-				Segment:   slug.String,
-				Operation: "unassigned",
-				Date:      dateUnassigned.Time.String(),
-			}
-			history = append(history, historyRowUnassign)
+		membership := Membership{Segment: slug.String, AssignedAt: dateAssigned.Time}
+		if dateUnassigned.Valid {
+			membership.UnassignedAt = &dateUnassigned.Time
 		}
+		history = dates.appendOperations(history, userID, &membership)
 	}
-	err = rows.Close()
+	err = rows.Err()
 	if err != nil {
-		hr.ErrLog.Println(err.Error())
+		hr.Logger.ErrorContext(ctx, "error building report", logging.Err(err))
 		return nil, err
 	}
+
+	span.SetAttributes(tracing.AttrRows.Int(len(history)))
 	return history, nil
 }
 
-func (hr *historyRepository) CreateCSV(history []ReportRow) (string, error) {
+func (hr *historyRepository) CreateCSV(ctx context.Context, history []ReportRow) (_ string, err error) {
+	_, span := tracing.Start(ctx, "HistoryRepo.CreateCSV", tracing.AttrRows.Int(len(history)))
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+
 	alpa := "abcdefghijklmnopqrstuvwxyz1234567890"
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 
@@ -157,7 +156,7 @@ func (hr *historyRepository) CreateCSV(history []ReportRow) (string, error) {
 
 	file, err := os.Create(filePath)
 	if err != nil {
-		hr.ErrLog.Println(err.Error())
+		hr.Logger.ErrorContext(ctx, "error building report", logging.Err(err))
 		return "", err
 	}
 	defer file.Close()
@@ -169,10 +168,12 @@ func (hr *historyRepository) CreateCSV(history []ReportRow) (string, error) {
 
 	_, err = file.Write([]byte(fileData))
 	if err != nil {
-		hr.ErrLog.Println(err.Error())
+		hr.Logger.ErrorContext(ctx, "error building report", logging.Err(err))
 		return "", nil
 	}
 
+	hr.metrics.ReportGenerated(time.Since(start), len(fileData))
+
 	fileURL := fmt.Sprintf("%s:%s/reports/%s", hr.cfg.HTTP.Host, hr.cfg.HTTP.Port, fileName)
 	return fileURL, nil
 }
@@ -0,0 +1,61 @@
+// Package httputil holds the pieces shared by the HTTP middlewares.
+package httputil
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+)
+
+// Recorder passes the response through to the wrapped writer, recording its
+// status and, once KeepBody is called, a copy of its body.
+type Recorder struct {
+	http.ResponseWriter
+	Status   int
+	Body     bytes.Buffer
+	keepBody bool
+}
+
+type recorderKey struct{}
+
+// Record returns the recorder of the response and the request carrying it.
+// The first middleware to call it wraps w; the middlewares further down are
+// handed that recorder as w and share it through the request context, so the
+// response is wrapped once however many middlewares look at it.
+func Record(w http.ResponseWriter, r *http.Request) (*Recorder, *http.Request) {
+	if rec, ok := r.Context().Value(recorderKey{}).(*Recorder); ok && http.ResponseWriter(rec) == w {
+		return rec, r
+	}
+
+	rec := &Recorder{ResponseWriter: w, Status: http.StatusOK}
+	return rec, r.WithContext(context.WithValue(r.Context(), recorderKey{}, rec))
+}
+
+// KeepBody makes the recorder keep a copy of the body written from now on.
+func (rec *Recorder) KeepBody() {
+	rec.keepBody = true
+}
+
+func (rec *Recorder) WriteHeader(status int) {
+	rec.Status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *Recorder) Write(b []byte) (int, error) {
+	if rec.keepBody {
+		rec.Body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses working through the middlewares.
+func (rec *Recorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the wrapped writer to http.ResponseController.
+func (rec *Recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,71 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// recordingMiddleware records the response like the service middlewares and
+// reports the recorder it got.
+func recordingMiddleware(got **Recorder) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder, r := Record(w, r)
+			*got = recorder
+			next.ServeHTTP(recorder, r)
+		})
+	}
+}
+
+func TestRecordSharesRecorder(t *testing.T) {
+	var outer, inner *Recorder
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("created"))
+	})
+	h := recordingMiddleware(&outer)(recordingMiddleware(&inner)(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			inner.KeepBody()
+			handler.ServeHTTP(w, r)
+		})))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", http.NoBody))
+
+	if outer == nil || outer != inner {
+		t.Fatal("the middlewares wrapped the response twice")
+	}
+	if outer.Status != http.StatusCreated || outer.Body.String() != "created" {
+		t.Fatalf("recorded %d %q", outer.Status, outer.Body.String())
+	}
+	if w.Code != http.StatusCreated || w.Body.String() != "created" {
+		t.Fatalf("response %d %q not passed through", w.Code, w.Body.String())
+	}
+}
+
+func TestRecordWrapsOtherWriters(t *testing.T) {
+	var outer, inner *Recorder
+	// a middleware in between replaces the writer
+	replacing := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(struct{ http.ResponseWriter }{w}, r)
+		})
+	}
+	h := recordingMiddleware(&outer)(replacing(recordingMiddleware(&inner)(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}))))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+
+	if outer == inner {
+		t.Fatal("recorder reused for another writer")
+	}
+	if outer.Status != http.StatusAccepted || inner.Status != http.StatusAccepted {
+		t.Fatalf("recorded %d and %d", outer.Status, inner.Status)
+	}
+	if outer.Body.Len() != 0 {
+		t.Fatal("body kept without KeepBody")
+	}
+}
@@ -0,0 +1,46 @@
+// Package idempotency makes retries of mutating requests safe. A request
+// carrying an Idempotency-Key header is run once per client and key: its
+// response is stored for a while and replayed to the retries, while a key
+// reused with another payload is rejected.
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+const (
+	Header         = "Idempotency-Key"
+	ReplayedHeader = "Idempotent-Replayed"
+
+	maxKeyLength = 255
+	// staleAfter is how long a request may stay in progress before its key is
+	// taken over, as the replica running it has most likely died
+	staleAfter = 5 * time.Minute
+)
+
+// Record is a request run under an idempotency key. Status is 0 while the
+// request is in progress.
+type Record struct {
+	Client      string
+	Key         string
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+func (rec *Record) inProgress() bool {
+	return rec.Status == 0
+}
+
+// requestHash tells apart the payloads sent under the same key.
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
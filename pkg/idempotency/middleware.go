@@ -0,0 +1,198 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/auth"
+	"usersegmentator/pkg/httputil"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/metrics"
+
+	"github.com/gorilla/mux"
+)
+
+// maxReserveAttempts bounds the retries when the key is released or taken
+// over by a concurrent request in between.
+const maxReserveAttempts = 3
+
+// Middleware runs the mutating requests with an Idempotency-Key header once
+// and replays their response to the retries within TTL. Server errors are
+// not stored, so that they can be retried.
+type Middleware struct {
+	repo    Repository
+	enabled bool
+	ttl     time.Duration
+	// excludedRoutes respond with secrets, which must not be kept for replays
+	excludedRoutes map[*mux.Route]bool
+	// purgeInterval is how often the expired keys are purged
+	purgeInterval time.Duration
+	metrics       *metrics.Metrics
+	Logger        *slog.Logger
+}
+
+func NewMiddleware(repo Repository, cfg *config.Config, m *metrics.Metrics) *Middleware {
+	return &Middleware{
+		repo:           repo,
+		enabled:        cfg.Idempotency.Enabled,
+		ttl:            time.Duration(cfg.Idempotency.TTL) * time.Second,
+		excludedRoutes: map[*mux.Route]bool{},
+		purgeInterval:  time.Duration(cfg.Idempotency.PurgeInterval) * time.Second,
+		metrics:        m,
+		Logger:         logging.For("idempotency"),
+	}
+}
+
+// Exclude runs every request to route as it comes, Idempotency-Key or not,
+// and returns the route. It is meant for the routes whose responses carry
+// credentials, such as new API keys.
+func (m *Middleware) Exclude(route *mux.Route) *mux.Route {
+	m.excludedRoutes[route] = true
+	return route
+}
+
+func (m *Middleware) Interval() time.Duration {
+	return m.purgeInterval
+}
+
+// Purge deletes the keys older than TTL.
+func (m *Middleware) Purge(ctx context.Context) error {
+	purged, err := m.repo.DeleteExpired(ctx, time.Now().UTC().Add(-m.ttl))
+	if err != nil {
+		return fmt.Errorf("error purging idempotency keys: %w", err)
+	}
+	if purged > 0 {
+		m.Logger.InfoContext(ctx, "Purged idempotency keys", "keys", purged)
+	}
+	return nil
+}
+
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		mutating := r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions
+		if !m.enabled || !mutating || key == "" || m.excludedRoutes[mux.CurrentRoute(r)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			m.Logger.ErrorContext(r.Context(), "error reading request body", logging.Err(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		rec := &Record{
+			Client:      auth.ClientKey(r),
+			Key:         key,
+			RequestHash: requestHash(r, body),
+			// the records are matched by creation time, which MySQL keeps to the second
+			CreatedAt: time.Now().UTC().Truncate(time.Second),
+		}
+
+		existing, err := m.reserve(r.Context(), rec)
+		if err != nil {
+			m.Logger.ErrorContext(r.Context(), "error reserving idempotency key", logging.Err(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			m.respondExisting(w, r, rec, existing)
+			return
+		}
+
+		recorder, r := httputil.Record(w, r)
+		recorder.KeepBody()
+		next.ServeHTTP(recorder, r)
+
+		// the request context is cancelled once the client is gone, the outcome must be kept anyway
+		ctx := context.Background()
+		if recorder.Status >= http.StatusInternalServerError {
+			err = m.repo.Release(ctx, rec)
+			if err != nil {
+				m.Logger.ErrorContext(r.Context(), "error releasing idempotency key", logging.Err(err))
+			}
+			return
+		}
+
+		rec.Status = recorder.Status
+		rec.ContentType = recorder.Header().Get("Content-Type")
+		rec.Body = recorder.Body.Bytes()
+		err = m.repo.Complete(ctx, rec)
+		if err != nil {
+			m.Logger.ErrorContext(r.Context(), "error storing idempotent response", logging.Err(err))
+			return
+		}
+		m.metrics.IdempotentRequest(metrics.IdempotencyStored)
+	})
+}
+
+// reserve creates the record for rec, taking over an expired key or one
+// whose request has stalled. It returns the record found if the key is in use.
+func (m *Middleware) reserve(ctx context.Context, rec *Record) (*Record, error) {
+	for attempt := 0; attempt < maxReserveAttempts; attempt++ {
+		reserved, err := m.repo.Reserve(ctx, rec)
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			return nil, nil
+		}
+
+		existing, err := m.repo.Get(ctx, rec.Client, rec.Key)
+		if stderrors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		expired := existing.CreatedAt.Before(rec.CreatedAt.Add(-m.ttl))
+		stalled := existing.inProgress() && existing.CreatedAt.Before(rec.CreatedAt.Add(-staleAfter))
+		if !expired && !stalled {
+			return existing, nil
+		}
+
+		err = m.repo.Release(ctx, existing)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("idempotency key %q is contended", rec.Key)
+}
+
+func (m *Middleware) respondExisting(w http.ResponseWriter, r *http.Request, rec, existing *Record) {
+	switch {
+	case existing.RequestHash != rec.RequestHash:
+		m.metrics.IdempotentRequest(metrics.IdempotencyConflict)
+		w.WriteHeader(http.StatusConflict)
+	case existing.inProgress():
+		m.metrics.IdempotentRequest(metrics.IdempotencyConflict)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusConflict)
+	default:
+		m.metrics.IdempotentRequest(metrics.IdempotencyReplayed)
+		if existing.ContentType != "" {
+			w.Header().Set("Content-Type", existing.ContentType)
+		}
+		w.Header().Set(ReplayedHeader, "true")
+		w.WriteHeader(existing.Status)
+		_, err := w.Write(existing.Body)
+		if err != nil {
+			m.Logger.ErrorContext(r.Context(), "error replaying response", logging.Err(err))
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package idempotency_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"usersegmentator/config"
+	"usersegmentator/pkg/auth"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/handlers"
+	"usersegmentator/pkg/idempotency"
+	"usersegmentator/pkg/migrate"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestRouter serves the API key routes as the service does, plus
+// /api/echo counting its runs, on a new SQLite database.
+func newTestRouter(t *testing.T) (http.Handler, *sql.DB, *int) {
+	t.Helper()
+
+	cfg := &config.Config{}
+	cfg.Database.Backend = dialect.SQLite
+	cfg.Database.Timeout = 5
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "idempotency.db")
+	cfg.Idempotency.Enabled = true
+	cfg.Idempotency.TTL = 86400
+
+	db, err := dialect.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	migrator, err := migrate.NewMigrator(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	idempotent := idempotency.NewMiddleware(idempotency.NewIdempotencyRepo(db, cfg), cfg, nil)
+	authHandler := handlers.NewAuthHandler(db, cfg)
+	runs := 0
+
+	r := mux.NewRouter()
+	r.Use(idempotent.Handler)
+	idempotent.Exclude(r.HandleFunc("/api/admin/create_api_key", authHandler.CreateAPIKey).Methods("POST"))
+	r.HandleFunc("/api/echo", func(w http.ResponseWriter, _ *http.Request) {
+		runs++
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("created"))
+	}).Methods("POST")
+	return r, db, &runs
+}
+
+func post(h http.Handler, path, body, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotency.Header, key)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func countKeys(t *testing.T, db *sql.DB) int {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM idempotency_keys").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestHandlerReplaysResponses(t *testing.T) {
+	h, db, runs := newTestRouter(t)
+
+	for i := 0; i < 2; i++ {
+		w := post(h, "/api/echo", `{}`, "retry")
+		if w.Code != http.StatusCreated || w.Body.String() != "created" {
+			t.Fatalf("response %d %q", w.Code, w.Body.String())
+		}
+	}
+	if *runs != 1 {
+		t.Fatalf("request run %d times, expected once", *runs)
+	}
+	if n := countKeys(t, db); n != 1 {
+		t.Fatalf("%d idempotency keys stored, expected 1", n)
+	}
+
+	if w := post(h, "/api/echo", `{"other": true}`, "retry"); w.Code != http.StatusConflict {
+		t.Fatalf("status %d for another payload, expected %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestHandlerDoesNotStoreAPIKeys(t *testing.T) {
+	h, db, _ := newTestRouter(t)
+
+	var keys []string
+	for i := 0; i < 2; i++ {
+		w := post(h, "/api/admin/create_api_key", `{"name": "ci", "scopes": ["segments:read"]}`, "retry")
+		if w.Code != http.StatusCreated {
+			t.Fatalf("status %d, expected %d", w.Code, http.StatusCreated)
+		}
+		if w.Header().Get(idempotency.ReplayedHeader) != "" {
+			t.Fatal("issued key replayed")
+		}
+
+		created := auth.ResponseCreatedKey{}
+		if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+			t.Fatal(err)
+		}
+		if created.Key == "" {
+			t.Fatal("no key issued")
+		}
+		keys = append(keys, created.Key)
+	}
+	if keys[0] == keys[1] {
+		t.Fatal("the same key issued twice")
+	}
+
+	if n := countKeys(t, db); n != 0 {
+		t.Fatalf("%d idempotency keys stored for key issuing", n)
+	}
+	for _, key := range keys {
+		var n int
+		err := db.QueryRow("SELECT COUNT(*) FROM idempotency_keys WHERE body LIKE ?", "%"+key+"%").Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Fatal("plaintext api key stored in idempotency_keys")
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/logging"
+)
+
+// Repository keeps the records by client and key. A record is changed only
+// by the request that created it, which is matched by its creation time.
+type Repository interface {
+	// Reserve creates rec unless the client has already used its key.
+	Reserve(ctx context.Context, rec *Record) (bool, error)
+	// Get returns sql.ErrNoRows if there is no record for the key.
+	Get(ctx context.Context, client, key string) (*Record, error)
+	Complete(ctx context.Context, rec *Record) error
+	// Release deletes rec, so that the key can be used again.
+	Release(ctx context.Context, rec *Record) error
+	DeleteExpired(ctx context.Context, before time.Time) (int64, error)
+}
+
+type idempotencyRepository struct {
+	db      *sql.DB
+	dialect dialect.Dialect
+	Logger  *slog.Logger
+}
+
+func NewIdempotencyRepo(db *sql.DB, cfg *config.Config) Repository {
+	return &idempotencyRepository{
+		db:      db,
+		dialect: dialect.For(cfg),
+		Logger:  logging.For("idempotency_repo"),
+	}
+}
+
+func (ir *idempotencyRepository) Reserve(ctx context.Context, rec *Record) (bool, error) {
+	res, err := ir.db.ExecContext(
+		ctx,
+		ir.dialect.Rebind(ir.dialect.InsertIgnore("INSERT INTO idempotency_keys "+
+			"(client, idempotency_key, request_hash, status, content_type, created_at) VALUES (?, ?, ?, 0, '', ?)")),
+		rec.Client,
+		rec.Key,
+		rec.RequestHash,
+		rec.CreatedAt,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", errors.ErrorGettingAffectedRows, err)
+	}
+	return rows == 1, nil
+}
+
+func (ir *idempotencyRepository) Get(ctx context.Context, client, key string) (*Record, error) {
+	rec := &Record{Client: client, Key: key}
+	err := ir.db.QueryRowContext(
+		ctx,
+		ir.dialect.Rebind("SELECT request_hash, status, content_type, body, created_at FROM idempotency_keys "+
+			"WHERE client = ? AND idempotency_key = ?"),
+		client,
+		key,
+	).Scan(&rec.RequestHash, &rec.Status, &rec.ContentType, &rec.Body, &rec.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	rec.CreatedAt = rec.CreatedAt.UTC()
+	return rec, nil
+}
+
+func (ir *idempotencyRepository) Complete(ctx context.Context, rec *Record) error {
+	_, err := ir.db.ExecContext(
+		ctx,
+		ir.dialect.Rebind("UPDATE idempotency_keys SET status = ?, content_type = ?, body = ? "+
+			"WHERE client = ? AND idempotency_key = ? AND created_at = ?"),
+		rec.Status,
+		rec.ContentType,
+		rec.Body,
+		rec.Client,
+		rec.Key,
+		rec.CreatedAt,
+	)
+	return err
+}
+
+func (ir *idempotencyRepository) Release(ctx context.Context, rec *Record) error {
+	_, err := ir.db.ExecContext(
+		ctx,
+		ir.dialect.Rebind("DELETE FROM idempotency_keys WHERE client = ? AND idempotency_key = ? AND created_at = ?"),
+		rec.Client,
+		rec.Key,
+		rec.CreatedAt,
+	)
+	return err
+}
+
+func (ir *idempotencyRepository) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	res, err := ir.db.ExecContext(
+		ctx,
+		ir.dialect.Rebind("DELETE FROM idempotency_keys WHERE created_at < ?"),
+		before,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", errors.ErrorGettingAffectedRows, err)
+	}
+	return rows, nil
+}
@@ -0,0 +1,305 @@
+// Package jobs runs the background jobs of the service. Jobs are registered
+// explicitly before the scheduler starts; every run is recovered from panics
+// and recorded in a bounded history per job.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/leader"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/metrics"
+	"usersegmentator/pkg/tracing"
+)
+
+const (
+	StatusOK       = "ok"
+	StatusFailed   = "failed"
+	StatusPanicked = "panicked"
+)
+
+var ErrUnknownJob = errors.New("unknown job")
+
+// Func does the work of a job. It must return soon after ctx is done.
+type Func func(ctx context.Context) error
+
+// Job is a unit of background work. A periodic job runs every Interval,
+// counted from the end of the previous run, so its runs never overlap; a job
+// without an Interval runs once. The first run waits for Delay.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Delay    time.Duration
+	// LeaderOnly jobs run only on the replica holding the background jobs
+	// lease and are cancelled as soon as it is lost
+	LeaderOnly bool
+	Run        Func
+}
+
+// Run is a finished run of a job.
+type Run struct {
+	Job        string    `json:"job"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type Request struct {
+	Job   string `json:"job"`
+	Limit int    `json:"limit"`
+}
+
+type Scheduler struct {
+	elector     *leader.Elector
+	historySize int
+	metrics     *metrics.Metrics
+	Logger      *slog.Logger
+
+	jobs    []Job
+	cancel  context.CancelFunc
+	stopped chan struct{}
+
+	mu sync.Mutex
+	// history holds the last runs of every job, oldest first
+	history map[string][]Run
+	// completed holds the one-off jobs that have run to the end
+	completed map[string]bool
+}
+
+func NewScheduler(cfg *config.Config, elector *leader.Elector, m *metrics.Metrics) *Scheduler {
+	historySize := cfg.Jobs.HistorySize
+	if historySize < 1 {
+		historySize = 1
+	}
+
+	return &Scheduler{
+		elector:     elector,
+		historySize: historySize,
+		metrics:     m,
+		Logger:      logging.For("jobs"),
+		history:     make(map[string][]Run),
+		completed:   make(map[string]bool),
+	}
+}
+
+// Register adds a job to the scheduler. Jobs must be registered before Start.
+func (s *Scheduler) Register(job Job) error {
+	switch {
+	case s.cancel != nil:
+		return fmt.Errorf("job %q registered after the scheduler has started", job.Name)
+	case job.Name == "":
+		return fmt.Errorf("job name is empty")
+	case job.Run == nil:
+		return fmt.Errorf("job %q has nothing to run", job.Name)
+	case job.Interval < 0 || job.Delay < 0:
+		return fmt.Errorf("job %q has a negative interval or delay", job.Name)
+	}
+	for _, registered := range s.jobs {
+		if registered.Name == job.Name {
+			return fmt.Errorf("job %q is already registered", job.Name)
+		}
+	}
+
+	s.jobs = append(s.jobs, job)
+	return nil
+}
+
+// Start runs the registered jobs in the background until ctx is done or Stop
+// is called. The leader-only jobs run while this replica is the leader.
+func (s *Scheduler) Start(ctx context.Context) {
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.stopped = make(chan struct{})
+
+	var local, leaderOnly []Job
+	for _, job := range s.jobs {
+		if job.LeaderOnly {
+			leaderOnly = append(leaderOnly, job)
+		} else {
+			local = append(local, job)
+		}
+	}
+	s.Logger.Info("Scheduler is running", "jobs", len(local), "leader_only_jobs", len(leaderOnly))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.runAll(ctx, local)
+	}()
+	if len(leaderOnly) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.elector.Lead(ctx, func(ctx context.Context) {
+				s.runAll(ctx, leaderOnly)
+			})
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(s.stopped)
+	}()
+}
+
+// Stop cancels the jobs and waits until they return or ctx is done.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	if s.cancel == nil {
+		return nil
+	}
+	s.cancel()
+
+	select {
+	case <-s.stopped:
+		s.Logger.Info("Scheduler has stopped")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("background jobs did not stop: %w", ctx.Err())
+	}
+}
+
+func (s *Scheduler) runAll(ctx context.Context, jobs []Job) {
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job Job) {
+			defer wg.Done()
+			s.schedule(ctx, job)
+		}(job)
+	}
+	wg.Wait()
+}
+
+func (s *Scheduler) schedule(ctx context.Context, job Job) {
+	// a one-off leader-only job is scheduled again whenever the lease is
+	// regained, but runs only once
+	if s.isCompleted(job.Name) {
+		return
+	}
+
+	wait := job.Delay
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		s.execute(ctx, job)
+		if job.Interval == 0 {
+			if ctx.Err() == nil {
+				s.markCompleted(job.Name)
+			}
+			return
+		}
+		wait = job.Interval
+	}
+}
+
+// execute runs the job once and records the run.
+func (s *Scheduler) execute(ctx context.Context, job Job) {
+	ctx, span := tracing.Start(ctx, "jobs."+job.Name)
+	run := Run{Job: job.Name, StartedAt: time.Now().UTC()}
+
+	var err error
+	run.Status, err = s.call(ctx, job)
+	run.FinishedAt = time.Now().UTC()
+	tracing.End(span, err)
+
+	if err != nil {
+		run.Error = err.Error()
+		// a panic has been logged with its stack already
+		if run.Status == StatusFailed && ctx.Err() == nil {
+			s.Logger.ErrorContext(ctx, "job failed", "job", job.Name, logging.Err(err))
+		}
+	}
+
+	s.metrics.JobRun(job.Name, run.Status, run.FinishedAt.Sub(run.StartedAt))
+	s.record(run)
+}
+
+// call turns a panic of the job into a failed run, so that it neither
+// crashes the service nor stops the next runs.
+func (s *Scheduler) call(ctx context.Context, job Job) (status string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			s.Logger.ErrorContext(ctx, "job panicked", "job", job.Name, "panic", p, "stack", string(debug.Stack()))
+			status, err = StatusPanicked, fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	err = job.Run(ctx)
+	if err != nil {
+		return StatusFailed, err
+	}
+	return StatusOK, nil
+}
+
+func (s *Scheduler) record(run Run) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	runs := append(s.history[run.Job], run)
+	if len(runs) > s.historySize {
+		runs = runs[len(runs)-s.historySize:]
+	}
+	s.history[run.Job] = runs
+}
+
+func (s *Scheduler) isCompleted(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.completed[name]
+}
+
+func (s *Scheduler) markCompleted(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completed[name] = true
+}
+
+// History returns up to limit recorded runs of the job, or of every job if
+// name is empty, newest first. A limit of zero returns every recorded run.
+// The runs are kept in the memory of this replica only: the leader-only jobs
+// have no runs on the other replicas, and a restart forgets the history.
+func (s *Scheduler) History(name string, limit int) ([]Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	runs := []Run{}
+	if name != "" {
+		if !s.isRegistered(name) {
+			return nil, ErrUnknownJob
+		}
+		runs = append(runs, s.history[name]...)
+	} else {
+		for _, jobRuns := range s.history {
+			runs = append(runs, jobRuns...)
+		}
+	}
+
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].StartedAt.After(runs[j].StartedAt)
+	})
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+func (s *Scheduler) isRegistered(name string) bool {
+	for _, job := range s.jobs {
+		if job.Name == name {
+			return true
+		}
+	}
+	return false
+}
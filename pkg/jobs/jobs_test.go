@@ -0,0 +1,268 @@
+package jobs_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/jobs"
+	"usersegmentator/pkg/leader"
+	"usersegmentator/pkg/migrate"
+)
+
+const waitTimeout = 5 * time.Second
+
+// startScheduler runs the jobs without leader election until the test ends.
+func startScheduler(t *testing.T, historySize int, elector *leader.Elector, registered ...jobs.Job) *jobs.Scheduler {
+	t.Helper()
+
+	cfg := &config.Config{}
+	cfg.Jobs.HistorySize = historySize
+	if elector == nil {
+		var err error
+		elector, err = leader.NewElector(nil, cfg, leader.LeaseBackgroundJobs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := jobs.NewScheduler(cfg, elector, nil)
+	for _, job := range registered {
+		if err := s.Register(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Start(context.Background())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+		defer cancel()
+		if err := s.Stop(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+	return s
+}
+
+// waitForRuns waits until the job has recorded at least n runs and returns them.
+func waitForRuns(t *testing.T, s *jobs.Scheduler, job string, n int) []jobs.Run {
+	t.Helper()
+
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		runs, err := s.History(job, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) >= n {
+			return runs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s ran %d times, expected %d", job, len(runs), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRegisterRejectsInvalidJobs(t *testing.T) {
+	s := jobs.NewScheduler(&config.Config{}, nil, nil)
+	run := func(context.Context) error { return nil }
+
+	if err := s.Register(jobs.Job{Name: "valid", Run: run}); err != nil {
+		t.Fatal(err)
+	}
+	for name, job := range map[string]jobs.Job{
+		"duplicate":         {Name: "valid", Run: run},
+		"unnamed":           {Run: run},
+		"nothing to run":    {Name: "empty"},
+		"negative interval": {Name: "negative", Interval: -time.Second, Run: run},
+	} {
+		if err := s.Register(job); err == nil {
+			t.Fatalf("%s job registered", name)
+		}
+	}
+}
+
+func TestPanickedJobKeepsRunning(t *testing.T) {
+	var calls atomic.Int32
+	s := startScheduler(t, 10, nil, jobs.Job{
+		Name:     "flaky",
+		Interval: time.Millisecond,
+		Run: func(context.Context) error {
+			switch calls.Add(1) {
+			case 1:
+				panic("boom")
+			case 2:
+				return errors.New("failed")
+			}
+			return nil
+		},
+	})
+
+	runs := waitForRuns(t, s, "flaky", 3)
+	// newest first
+	first, second, third := runs[len(runs)-1], runs[len(runs)-2], runs[len(runs)-3]
+	if first.Status != jobs.StatusPanicked || first.Error != "panic: boom" {
+		t.Fatalf("first run %+v, expected a panic", first)
+	}
+	if second.Status != jobs.StatusFailed || second.Error != "failed" {
+		t.Fatalf("second run %+v, expected a failure", second)
+	}
+	if third.Status != jobs.StatusOK || third.Error != "" {
+		t.Fatalf("third run %+v, expected a success", third)
+	}
+}
+
+func TestOneOffJobRunsOnce(t *testing.T) {
+	var calls atomic.Int32
+	s := startScheduler(t, 10, nil, jobs.Job{
+		Name:  "once",
+		Delay: time.Millisecond,
+		Run: func(context.Context) error {
+			calls.Add(1)
+			return nil
+		},
+	})
+
+	waitForRuns(t, s, "once", 1)
+	time.Sleep(50 * time.Millisecond)
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("one-off job ran %d times", n)
+	}
+}
+
+func TestHistoryIsBounded(t *testing.T) {
+	var calls atomic.Int32
+	s := startScheduler(t, 3, nil,
+		jobs.Job{
+			Name:     "frequent",
+			Interval: time.Millisecond,
+			Run: func(context.Context) error {
+				calls.Add(1)
+				return nil
+			},
+		},
+		jobs.Job{Name: "once", Run: func(context.Context) error { return nil }},
+	)
+
+	waitForRuns(t, s, "once", 1)
+	deadline := time.Now().Add(waitTimeout)
+	for calls.Load() < 10 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	runs, err := s.History("frequent", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 3 {
+		t.Fatalf("%d runs kept, expected the last 3", len(runs))
+	}
+	for i := 1; i < len(runs); i++ {
+		if runs[i].StartedAt.After(runs[i-1].StartedAt) {
+			t.Fatalf("runs %+v not newest first", runs)
+		}
+	}
+
+	all, err := s.History("", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("%d runs returned, expected the limit of 2", len(all))
+	}
+	all, err = s.History("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) < 4 {
+		t.Fatalf("%d runs of every job, expected the runs of both jobs", len(all))
+	}
+
+	if _, err = s.History("missing", 0); !errors.Is(err, jobs.ErrUnknownJob) {
+		t.Fatalf("History of an unknown job returned %v", err)
+	}
+}
+
+func TestLeaderOnlyJobsStopWithLease(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Database.Backend = dialect.SQLite
+	cfg.Database.Timeout = 5
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "jobs.db")
+	cfg.Leader.Enabled = true
+	cfg.Leader.LeaseDuration = 2
+	cfg.Leader.RenewInterval = 1
+
+	db, err := dialect.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	migrator, err := migrate.NewMigrator(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	elector, err := leader.NewElector(db, cfg, leader.LeaseBackgroundJobs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started, cancelled := make(chan struct{}, 1), make(chan struct{}, 1)
+	var localRuns atomic.Int32
+	s := startScheduler(t, 10, elector,
+		jobs.Job{
+			Name:       "leader_only",
+			LeaderOnly: true,
+			Run: func(ctx context.Context) error {
+				started <- struct{}{}
+				<-ctx.Done()
+				cancelled <- struct{}{}
+				return ctx.Err()
+			},
+		},
+		jobs.Job{
+			Name:     "local",
+			Interval: time.Millisecond,
+			Run: func(context.Context) error {
+				localRuns.Add(1)
+				return nil
+			},
+		},
+	)
+
+	select {
+	case <-started:
+	case <-time.After(waitTimeout):
+		t.Fatal("leader-only job not started on the leader")
+	}
+
+	// another replica takes the lease over
+	_, err = db.Exec("UPDATE leases SET holder = ?, expires_at = ? WHERE name = ?",
+		"other", time.Now().UTC().Add(time.Hour), leader.LeaseBackgroundJobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(waitTimeout):
+		t.Fatal("leader-only job not cancelled when the lease was lost")
+	}
+
+	runs := waitForRuns(t, s, "leader_only", 1)
+	if runs[0].Status != jobs.StatusFailed || runs[0].Error != context.Canceled.Error() {
+		t.Fatalf("cancelled run %+v", runs[0])
+	}
+
+	// the other jobs go on without the lease
+	before := localRuns.Load()
+	time.Sleep(50 * time.Millisecond)
+	if localRuns.Load() == before {
+		t.Fatal("local job stopped with the lease")
+	}
+}
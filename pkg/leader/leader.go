@@ -0,0 +1,240 @@
+// Package leader elects one replica to run the background jobs. Replicas
+// compete for a named lease in the leases table; the holder renews it before
+// it runs out, and once it does another replica takes over.
+package leader
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/metrics"
+)
+
+// LeaseBackgroundJobs is the lease held by the replica running background jobs.
+const LeaseBackgroundJobs = "background_jobs"
+
+// Elector holds a lease on behalf of this replica. Expiry times come from the
+// replica clocks, so the lease duration must be well above their skew.
+type Elector struct {
+	db            *sql.DB
+	dialect       dialect.Dialect
+	name          string
+	holder        string
+	enabled       bool
+	leaseDuration time.Duration
+	renewInterval time.Duration
+	metrics       *metrics.Metrics
+	Logger        *slog.Logger
+
+	leading atomic.Bool
+	// leaseUntil is when the lease last renewed by this replica runs out
+	leaseUntil time.Time
+}
+
+func NewElector(db *sql.DB, cfg *config.Config, name string, m *metrics.Metrics) (*Elector, error) {
+	holder, err := holderID()
+	if err != nil {
+		return nil, err
+	}
+
+	leaseDuration := time.Duration(cfg.Leader.LeaseDuration) * time.Second
+	renewInterval := time.Duration(cfg.Leader.RenewInterval) * time.Second
+	if cfg.Leader.Enabled && (renewInterval <= 0 || renewInterval >= leaseDuration) {
+		return nil, fmt.Errorf("leader renew interval %s must be positive and shorter than the lease %s",
+			renewInterval, leaseDuration)
+	}
+
+	return &Elector{
+		db:            db,
+		dialect:       dialect.For(cfg),
+		name:          name,
+		holder:        holder,
+		enabled:       cfg.Leader.Enabled,
+		leaseDuration: leaseDuration,
+		renewInterval: renewInterval,
+		metrics:       m,
+		Logger:        logging.For("leader").With("lease", name, "holder", holder),
+	}, nil
+}
+
+// holderID identifies this process among the replicas, even across restarts of a pod.
+func holderID() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("error getting hostname: %w", err)
+	}
+
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return "", fmt.Errorf("error generating holder id: %w", err)
+	}
+	return hostname + "-" + hex.EncodeToString(suffix), nil
+}
+
+// IsLeader reports whether this replica holds the lease. Without leader
+// election every replica is the leader.
+func (e *Elector) IsLeader() bool {
+	return !e.enabled || e.leading.Load()
+}
+
+// Lead runs fn while this replica holds the lease, until ctx is done. The
+// context passed to fn is cancelled as soon as the lease is lost, and fn is
+// started again once it is regained. Lead must not be called twice on the
+// same Elector.
+func (e *Elector) Lead(ctx context.Context, fn func(ctx context.Context)) {
+	if !e.enabled {
+		fn(ctx)
+		return
+	}
+
+	e.Logger.Info("Leader election is running")
+	var running *run
+
+	ticker := time.NewTicker(e.renewInterval)
+	defer ticker.Stop()
+
+	for {
+		leading := e.renew(ctx)
+		if leading != e.leading.Load() {
+			e.leading.Store(leading)
+			e.metrics.LeaderChanged(e.name, leading)
+			if leading {
+				e.Logger.Info("Became the leader")
+			} else {
+				e.Logger.Warn("Lost the leadership")
+			}
+		}
+
+		switch {
+		case leading && running == nil:
+			running = start(ctx, fn)
+		case !leading && running != nil:
+			running.stop()
+			running = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if running != nil {
+				running.stop()
+			}
+			e.release()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// run is fn started by Lead while this replica is the leader.
+type run struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func start(ctx context.Context, fn func(ctx context.Context)) *run {
+	fnCtx, cancel := context.WithCancel(ctx)
+	r := &run{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		fn(fnCtx)
+	}()
+	return r
+}
+
+// stop cancels fn and waits for it to return.
+func (r *run) stop() {
+	r.cancel()
+	<-r.done
+}
+
+// renew takes the lease if it is free or expired and extends it if this
+// replica holds it. A failed renewal keeps the leadership only while the
+// lease certainly outlasts the next attempt.
+func (e *Elector) renew(ctx context.Context) bool {
+	now := time.Now().UTC()
+	expiresAt := now.Add(e.leaseDuration)
+
+	err := e.claim(ctx, now, expiresAt)
+	if err != nil {
+		if ctx.Err() == nil {
+			e.Logger.ErrorContext(ctx, "error renewing lease", logging.Err(err))
+		}
+		return e.leading.Load() && now.Add(e.renewInterval).Before(e.leaseUntil)
+	}
+
+	var holder string
+	err = e.db.QueryRowContext(ctx, e.dialect.Rebind("SELECT holder FROM leases WHERE name = ?"), e.name).Scan(&holder)
+	if err != nil {
+		if ctx.Err() == nil {
+			e.Logger.ErrorContext(ctx, "error reading lease", logging.Err(err))
+		}
+		return e.leading.Load() && now.Add(e.renewInterval).Before(e.leaseUntil)
+	}
+
+	if holder != e.holder {
+		return false
+	}
+	e.leaseUntil = expiresAt
+	return true
+}
+
+func (e *Elector) claim(ctx context.Context, now, expiresAt time.Time) error {
+	_, err := e.db.ExecContext(
+		ctx,
+		e.dialect.Rebind(e.dialect.InsertIgnore("INSERT INTO leases (name, holder, expires_at) VALUES (?, ?, ?)")),
+		e.name,
+		e.holder,
+		expiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	// the row count is not checked: MySQL reports 0 for a renewal within the same second
+	_, err = e.db.ExecContext(
+		ctx,
+		e.dialect.Rebind("UPDATE leases SET holder = ?, expires_at = ? WHERE name = ? AND (holder = ? OR expires_at < ?)"),
+		e.holder,
+		expiresAt,
+		e.name,
+		e.holder,
+		now,
+	)
+	return err
+}
+
+// release gives the lease up on shutdown, so that another replica takes over
+// without waiting for it to expire.
+func (e *Elector) release() {
+	if !e.leading.Load() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.renewInterval)
+	defer cancel()
+
+	_, err := e.db.ExecContext(
+		ctx,
+		e.dialect.Rebind("UPDATE leases SET expires_at = ? WHERE name = ? AND holder = ?"),
+		time.Unix(0, 0).UTC(),
+		e.name,
+		e.holder,
+	)
+	if err != nil {
+		e.Logger.Error("error releasing lease", logging.Err(err))
+	}
+
+	e.leading.Store(false)
+	e.metrics.LeaderChanged(e.name, false)
+	e.Logger.Info("Released the lease")
+}
@@ -0,0 +1,222 @@
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/migrate"
+)
+
+const (
+	testLease   = 300 * time.Millisecond
+	testRenew   = 50 * time.Millisecond
+	waitTimeout = 5 * time.Second
+)
+
+// newTestElectors returns replicas competing for one lease in a new SQLite database.
+func newTestElectors(t *testing.T, n int) ([]*Elector, *sql.DB) {
+	t.Helper()
+
+	cfg := &config.Config{}
+	cfg.Database.Backend = dialect.SQLite
+	cfg.Database.Timeout = 5
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "leader.db")
+	cfg.Leader.Enabled = true
+	cfg.Leader.LeaseDuration = 2
+	cfg.Leader.RenewInterval = 1
+
+	db, err := dialect.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	migrator, err := migrate.NewMigrator(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	electors := make([]*Elector, n)
+	for i := range electors {
+		electors[i], err = NewElector(db, cfg, LeaseBackgroundJobs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the configuration is in seconds, too slow for a test
+		electors[i].leaseDuration = testLease
+		electors[i].renewInterval = testRenew
+	}
+	return electors, db
+}
+
+func leaseHolder(t *testing.T, db *sql.DB) string {
+	t.Helper()
+
+	var holder string
+	err := db.QueryRow("SELECT holder FROM leases WHERE name = ?", LeaseBackgroundJobs).Scan(&holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return holder
+}
+
+// leadInBackground runs Lead until the test ends and reports the starts and
+// stops of fn.
+func leadInBackground(t *testing.T, e *Elector) (cancel context.CancelFunc, started, stopped chan struct{}) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started, stopped = make(chan struct{}, 10), make(chan struct{}, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Lead(ctx, func(ctx context.Context) {
+			started <- struct{}{}
+			<-ctx.Done()
+			stopped <- struct{}{}
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return cancel, started, stopped
+}
+
+func waitFor(t *testing.T, c chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-c:
+	case <-time.After(waitTimeout):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestRenewClaimsLease(t *testing.T) {
+	electors, db := newTestElectors(t, 2)
+	a, b := electors[0], electors[1]
+	ctx := context.Background()
+
+	// the first replica inserts the lease, the second one finds it held
+	if !a.renew(ctx) {
+		t.Fatal("free lease not claimed")
+	}
+	if b.renew(ctx) {
+		t.Fatal("lease claimed while held by another replica")
+	}
+	if holder := leaseHolder(t, db); holder != a.holder {
+		t.Fatalf("lease held by %s, expected %s", holder, a.holder)
+	}
+
+	// the holder extends the lease past its original expiry
+	for i := 0; i < 3; i++ {
+		time.Sleep(testLease / 2)
+		if !a.renew(ctx) {
+			t.Fatal("lease not renewed by its holder")
+		}
+		if b.renew(ctx) {
+			t.Fatal("renewed lease taken over")
+		}
+	}
+}
+
+func TestRenewTakesExpiredLease(t *testing.T) {
+	electors, db := newTestElectors(t, 2)
+	a, b := electors[0], electors[1]
+	ctx := context.Background()
+
+	if !a.renew(ctx) {
+		t.Fatal("free lease not claimed")
+	}
+	a.leading.Store(true)
+
+	// the holder stops renewing, e.g. it hangs
+	time.Sleep(testLease + testRenew)
+	if !b.renew(ctx) {
+		t.Fatal("expired lease not taken over")
+	}
+	if holder := leaseHolder(t, db); holder != b.holder {
+		t.Fatalf("lease held by %s, expected %s", holder, b.holder)
+	}
+	if a.renew(ctx) {
+		t.Fatal("former holder still leading after the takeover")
+	}
+}
+
+func TestLeadStopsOnLostLease(t *testing.T) {
+	electors, db := newTestElectors(t, 1)
+	a := electors[0]
+
+	_, started, stopped := leadInBackground(t, a)
+	waitFor(t, started, "the leader to start")
+	if !a.IsLeader() {
+		t.Fatal("running without being the leader")
+	}
+
+	// another replica took the lease over while this one was not renewing
+	_, err := db.Exec("UPDATE leases SET holder = ?, expires_at = ? WHERE name = ?",
+		"other", time.Now().UTC().Add(time.Hour), LeaseBackgroundJobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, stopped, "the leader to stop")
+	if a.IsLeader() {
+		t.Fatal("still the leader after losing the lease")
+	}
+
+	// and gives it up
+	_, err = db.Exec("UPDATE leases SET expires_at = ? WHERE name = ?", time.Unix(0, 0).UTC(), LeaseBackgroundJobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, started, "the leader to start again")
+}
+
+func TestLeadReleasesLeaseOnShutdown(t *testing.T) {
+	electors, db := newTestElectors(t, 2)
+	a, b := electors[0], electors[1]
+	// without the release b would wait for an hour
+	a.leaseDuration = time.Hour
+
+	stopA, startedA, stoppedA := leadInBackground(t, a)
+	waitFor(t, startedA, "the first replica to lead")
+	_, startedB, _ := leadInBackground(t, b)
+
+	time.Sleep(3 * testRenew)
+	select {
+	case <-startedB:
+		t.Fatal("two replicas leading at once")
+	default:
+	}
+
+	stopA()
+	waitFor(t, stoppedA, "the first replica to stop")
+	waitFor(t, startedB, "the second replica to take over")
+	if holder := leaseHolder(t, db); holder != b.holder {
+		t.Fatalf("lease held by %s, expected %s", holder, b.holder)
+	}
+	if a.IsLeader() || !b.IsLeader() {
+		t.Fatalf("first replica leading %t, second %t after the handover", a.IsLeader(), b.IsLeader())
+	}
+}
+
+func TestLeadWithoutElection(t *testing.T) {
+	e := &Elector{}
+	if !e.IsLeader() {
+		t.Fatal("replica not leading without leader election")
+	}
+
+	ran := false
+	e.Lead(context.Background(), func(context.Context) { ran = true })
+	if !ran {
+		t.Fatal("fn not run without leader election")
+	}
+}
@@ -0,0 +1,131 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"usersegmentator/config"
+)
+
+// Keys of the fields attached to every log line.
+const (
+	KeyComponent = "component"
+	KeyRequestID = "request_id"
+	KeyUserID    = "user_id"
+	KeySegment   = "segment"
+	KeyError     = "error"
+)
+
+type fieldsKey struct{}
+
+// fields are the request-scoped values carried by the context.
+type fields struct {
+	requestID string
+	userID    int
+	segments  []string
+}
+
+// New creates the JSON logger of the service. Records at error level and
+// above go to stderr, the rest to stdout.
+func New(cfg *config.Config) (*slog.Logger, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(cfg.Log.Level))
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", cfg.Log.Level, err)
+	}
+
+	return slog.New(&contextHandler{
+		out: newJSONHandler(os.Stdout, level),
+		err: newJSONHandler(os.Stderr, level),
+	}), nil
+}
+
+// For returns the default logger tagged with the component name.
+func For(component string) *slog.Logger {
+	return slog.Default().With(KeyComponent, component)
+}
+
+// Err is the attribute of an error.
+func Err(err error) slog.Attr {
+	return slog.Any(KeyError, err)
+}
+
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	f := fromContext(ctx)
+	f.requestID = requestID
+	return context.WithValue(ctx, fieldsKey{}, f)
+}
+
+func WithUserID(ctx context.Context, userID int) context.Context {
+	f := fromContext(ctx)
+	f.userID = userID
+	return context.WithValue(ctx, fieldsKey{}, f)
+}
+
+func WithSegments(ctx context.Context, segments ...string) context.Context {
+	f := fromContext(ctx)
+	f.segments = segments
+	return context.WithValue(ctx, fieldsKey{}, f)
+}
+
+// RequestIDFromContext returns the ID of the request being served, if any.
+func RequestIDFromContext(ctx context.Context) string {
+	return fromContext(ctx).requestID
+}
+
+func fromContext(ctx context.Context) fields {
+	f, _ := ctx.Value(fieldsKey{}).(fields)
+	return f
+}
+
+func newJSONHandler(w io.Writer, level slog.Level) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})
+}
+
+// contextHandler adds the request-scoped fields to each record
+// and routes it to stdout or stderr by level.
+type contextHandler struct {
+	out slog.Handler
+	err slog.Handler
+}
+
+func (h *contextHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.out.Enabled(ctx, level)
+}
+
+// Handle adds the context fields the record does not set itself, so that
+// a repository logging the segment it works on is not overridden by the request.
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	set := map[string]bool{}
+	record.Attrs(func(attr slog.Attr) bool {
+		set[attr.Key] = true
+		return true
+	})
+
+	f := fromContext(ctx)
+	if f.requestID != "" && !set[KeyRequestID] {
+		record.AddAttrs(slog.String(KeyRequestID, f.requestID))
+	}
+	if f.userID != 0 && !set[KeyUserID] {
+		record.AddAttrs(slog.Int(KeyUserID, f.userID))
+	}
+	if len(f.segments) != 0 && !set[KeySegment] {
+		record.AddAttrs(slog.String(KeySegment, strings.Join(f.segments, ",")))
+	}
+
+	if record.Level >= slog.LevelError {
+		return h.err.Handle(ctx, record)
+	}
+	return h.out.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{out: h.out.WithAttrs(attrs), err: h.err.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{out: h.out.WithGroup(name), err: h.err.WithGroup(name)}
+}
@@ -0,0 +1,34 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	HeaderRequestID = "X-Request-ID"
+
+	maxRequestIDLength = 128
+	requestIDBytes     = 16
+)
+
+// RequestID takes the request ID sent by the caller or generates one,
+// echoes it in the response and stores it in the request context.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(HeaderRequestID)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = newRequestID()
+		}
+
+		w.Header().Set(HeaderRequestID, requestID)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), requestID)))
+	})
+}
+
+func newRequestID() string {
+	buf := make([]byte, requestIDBytes)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
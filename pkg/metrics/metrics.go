@@ -0,0 +1,296 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+	"usersegmentator/pkg/httputil"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "usersegmentator"
+
+const (
+	SourceAPI           = "api"
+	SourceAutoAssign    = "auto_assign"
+	SourceSegmentDelete = "segment_delete"
+	SourceTTL           = "ttl"
+	SourceRamp          = "ramp"
+)
+
+const (
+	CacheHit   = "hit"
+	CacheMiss  = "miss"
+	CacheError = "error"
+)
+
+const (
+	IdempotencyStored   = "stored"
+	IdempotencyReplayed = "replayed"
+	IdempotencyConflict = "conflict"
+)
+
+// Metrics holds every collector of the service. All methods are safe to call
+// on a nil *Metrics, so components can be built without metrics in tests.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+
+	ttlRunDuration prometheus.Histogram
+	ttlBatches     prometheus.Counter
+	ttlExpired     prometheus.Counter
+	ttlFailures    prometheus.Counter
+	ttlLastSuccess prometheus.Gauge
+
+	assignments   *prometheus.CounterVec
+	unassignments *prometheus.CounterVec
+
+	reportDuration prometheus.Histogram
+	reportSize     prometheus.Histogram
+
+	cacheLookups *prometheus.CounterVec
+
+	leader *prometheus.GaugeVec
+
+	jobRuns        *prometheus.CounterVec
+	jobRunDuration *prometheus.HistogramVec
+
+	idempotentRequests *prometheus.CounterVec
+}
+
+func NewMetrics(db *sql.DB, dbName string) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route, method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+
+		ttlRunDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "ttl_checker_run_duration_seconds",
+			Help:      "Duration of TTL checker runs.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		ttlBatches: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ttl_checker_batches_total",
+			Help:      "Batches of expired memberships committed by the TTL checker.",
+		}),
+		ttlExpired: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ttl_checker_expired_total",
+			Help:      "Memberships expired by the TTL checker.",
+		}),
+		ttlFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ttl_checker_failures_total",
+			Help:      "Failed TTL checker runs.",
+		}),
+		ttlLastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "ttl_checker_last_success_timestamp_seconds",
+			Help:      "Unix time the TTL checker last completed a run.",
+		}),
+
+		assignments: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "segment_assignments_total",
+			Help:      "Users assigned to segments by source.",
+		}, []string{"source"}),
+		unassignments: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "segment_unassignments_total",
+			Help:      "Users unassigned from segments by source.",
+		}, []string{"source"}),
+
+		reportDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "report_generation_duration_seconds",
+			Help:      "Time spent generating history reports.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		reportSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "report_size_bytes",
+			Help:      "Size of generated history reports.",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+		}),
+
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_lookups_total",
+			Help:      "Cache lookups by cache and result: hit, miss or error.",
+		}, []string{"cache", "result"}),
+
+		leader: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "leader",
+			Help:      "1 while this replica holds the lease, 0 otherwise.",
+		}, []string{"lease"}),
+
+		jobRuns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "job_runs_total",
+			Help:      "Background job runs by job and status: ok, failed or panicked.",
+		}, []string{"job", "status"}),
+		jobRunDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "job_run_duration_seconds",
+			Help:      "Duration of background job runs by job.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"job"}),
+
+		idempotentRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "idempotent_requests_total",
+			Help:      "Requests with an idempotency key by result: stored, replayed or conflict.",
+		}, []string{"result"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(db, dbName),
+		m.requests,
+		m.requestDuration,
+		m.ttlRunDuration,
+		m.ttlBatches,
+		m.ttlExpired,
+		m.ttlFailures,
+		m.ttlLastSuccess,
+		m.assignments,
+		m.unassignments,
+		m.reportDuration,
+		m.reportSize,
+		m.cacheLookups,
+		m.leader,
+		m.jobRuns,
+		m.jobRunDuration,
+		m.idempotentRequests,
+	)
+	return m
+}
+
+// Registry exposes the registry so that other packages can add their own collectors.
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware counts requests and measures their latency per route template.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		start := time.Now()
+		recorder, r := httputil.Record(w, r)
+		next.ServeHTTP(recorder, r)
+
+		status := strconv.Itoa(recorder.Status)
+		m.requests.WithLabelValues(route, r.Method, status).Inc()
+		m.requestDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+func (m *Metrics) SegmentsAssigned(source string, n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.assignments.WithLabelValues(source).Add(float64(n))
+}
+
+func (m *Metrics) SegmentsUnassigned(source string, n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.unassignments.WithLabelValues(source).Add(float64(n))
+}
+
+// TTLBatch records a committed batch of n expired memberships, so that the
+// progress of a long run is visible before it ends.
+func (m *Metrics) TTLBatch(n int) {
+	if m == nil {
+		return
+	}
+	m.ttlBatches.Inc()
+	m.ttlExpired.Add(float64(n))
+}
+
+// TTLRun records a TTL checker run that took duration.
+func (m *Metrics) TTLRun(duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.ttlRunDuration.Observe(duration.Seconds())
+	if err != nil {
+		m.ttlFailures.Inc()
+		return
+	}
+	m.ttlLastSuccess.SetToCurrentTime()
+}
+
+func (m *Metrics) ReportGenerated(duration time.Duration, size int) {
+	if m == nil {
+		return
+	}
+	m.reportDuration.Observe(duration.Seconds())
+	m.reportSize.Observe(float64(size))
+}
+
+func (m *Metrics) CacheLookup(cache, result string) {
+	if m == nil {
+		return
+	}
+	m.cacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+func (m *Metrics) LeaderChanged(lease string, leading bool) {
+	if m == nil {
+		return
+	}
+	value := 0.0
+	if leading {
+		value = 1
+	}
+	m.leader.WithLabelValues(lease).Set(value)
+}
+
+func (m *Metrics) JobRun(job, status string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.jobRuns.WithLabelValues(job, status).Inc()
+	m.jobRunDuration.WithLabelValues(job).Observe(duration.Seconds())
+}
+
+func (m *Metrics) IdempotentRequest(result string) {
+	if m == nil {
+		return
+	}
+	m.idempotentRequests.WithLabelValues(result).Inc()
+}
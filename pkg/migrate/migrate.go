@@ -0,0 +1,429 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/logging"
+)
+
+//go:embed migrations
+var migrationsFS embed.FS
+
+const (
+	lockName         = "usersegmentator_schema_migrations"
+	lockPollInterval = 500 * time.Millisecond
+)
+
+// baselineVersion creates the tables db/items.sql used to create before the
+// migrations existed.
+const baselineVersion = 1
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a versioned schema change with the SQL to apply and revert it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	Dirty     bool       `json:"dirty,omitempty"`
+}
+
+// Migrator applies the embedded migrations. Replicas migrating at the same
+// time serialize on a database lock, so each migration runs once.
+type Migrator struct {
+	db          *sql.DB
+	dialect     dialect.Dialect
+	migrations  []Migration
+	lockTimeout time.Duration
+	Logger      *slog.Logger
+}
+
+func NewMigrator(db *sql.DB, cfg *config.Config) (*Migrator, error) {
+	d := dialect.For(cfg)
+	migrations, err := Load(d.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db:          db,
+		dialect:     d,
+		migrations:  migrations,
+		lockTimeout: time.Duration(cfg.Migrations.LockTimeout) * time.Second,
+		Logger:      logging.For("migrator"),
+	}, nil
+}
+
+// Load reads the migrations of the backend ordered by version.
+func Load(backend string) ([]Migration, error) {
+	dir := path.Join("migrations", backend)
+	entries, err := fs.ReadDir(migrationsFS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading migrations: %w", err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file name: %s", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		content, err := fs.ReadFile(migrationsFS, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration %s: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", m.Name, match[2], version)
+		}
+
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both up and down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Up applies up to steps pending migrations, every pending one if steps is 0.
+func (m *Migrator) Up(ctx context.Context, steps int) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		err = checkClean(applied)
+		if err != nil {
+			return err
+		}
+
+		done := 0
+		for _, migration := range m.migrations {
+			if steps > 0 && done == steps {
+				break
+			}
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if migration.Version == baselineVersion {
+				err = m.adoptBaseline(ctx, conn)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = m.run(ctx, conn, &migration, migration.Up, true)
+			if err != nil {
+				return err
+			}
+			done++
+		}
+
+		m.Logger.InfoContext(ctx, "Migrated up", "applied", done)
+		return nil
+	})
+}
+
+// Down reverts the last steps applied migrations.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		err = checkClean(applied)
+		if err != nil {
+			return err
+		}
+
+		done := 0
+		for i := len(m.migrations) - 1; i >= 0 && done < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+
+			err = m.run(ctx, conn, &migration, migration.Down, false)
+			if err != nil {
+				return err
+			}
+			done++
+		}
+
+		m.Logger.InfoContext(ctx, "Migrated down", "reverted", done)
+		return nil
+	})
+}
+
+// Force marks every migration up to version as applied and clears the dirty
+// flag, after a failed migration has been fixed by hand.
+func (m *Migrator) Force(ctx context.Context, version int) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(
+			ctx,
+			m.dialect.Rebind("DELETE FROM schema_migrations WHERE version > ? OR dirty = TRUE"),
+			version,
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if migration.Version > version {
+				break
+			}
+			_, err = conn.ExecContext(
+				ctx,
+				m.dialect.Rebind(m.dialect.InsertIgnore(
+					"INSERT INTO schema_migrations (version, name, applied_at, dirty) VALUES (?, ?, CURRENT_TIMESTAMP, FALSE)",
+				)),
+				migration.Version,
+				migration.Name,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		m.Logger.InfoContext(ctx, "Forced schema version", "version", version)
+		return nil
+	})
+}
+
+// Status lists every known migration and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = m.ensureTable(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if s, ok := applied[migration.Version]; ok {
+			status.AppliedAt = s.AppliedAt
+			status.Dirty = s.Dirty
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// run executes a migration and records it. The migration is marked dirty
+// while it runs, as MySQL cannot roll back schema changes that failed halfway.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, migration *Migration, query string, up bool) error {
+	direction := "down"
+	if up {
+		direction = "up"
+	}
+	m.Logger.InfoContext(ctx, "Running migration", "version", migration.Version, "name", migration.Name,
+		"direction", direction)
+
+	_, err := conn.ExecContext(
+		ctx,
+		m.dialect.Rebind(m.dialect.Upsert(
+			"INSERT INTO schema_migrations (version, name, dirty) VALUES (?, ?, TRUE)",
+			[]string{"version"},
+			"name = "+m.dialect.Excluded("name")+", dirty = TRUE",
+		)),
+		migration.Version,
+		migration.Name,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("migration %04d_%s %s failed, schema is dirty: %w", migration.Version, migration.Name,
+			direction, err)
+	}
+
+	if up {
+		_, err = conn.ExecContext(
+			ctx,
+			m.dialect.Rebind("UPDATE schema_migrations SET dirty = FALSE, applied_at = CURRENT_TIMESTAMP WHERE version = ?"),
+			migration.Version,
+		)
+	} else {
+		_, err = conn.ExecContext(ctx, m.dialect.Rebind("DELETE FROM schema_migrations WHERE version = ?"), migration.Version)
+	}
+	return err
+}
+
+// adoptBaseline adds the columns the baseline migration expects to a database
+// created from db/items.sql, as CREATE TABLE IF NOT EXISTS keeps its tables
+// as they are.
+func (m *Migrator) adoptBaseline(ctx context.Context, conn *sql.Conn) error {
+	if !selects(ctx, conn, "SELECT id FROM segments WHERE 1 = 0") ||
+		selects(ctx, conn, "SELECT owner_team FROM segments WHERE 1 = 0") {
+		return nil
+	}
+
+	m.Logger.WarnContext(ctx, "Adopting a database created from db/items.sql, adding segments.owner_team")
+	_, err := conn.ExecContext(ctx, "ALTER TABLE segments ADD COLUMN owner_team VARCHAR(100)")
+	if err != nil {
+		return fmt.Errorf("error adding segments.owner_team to the existing schema: %w", err)
+	}
+	return nil
+}
+
+// selects reports whether query runs, that is whether the table and columns it reads exist.
+func selects(ctx context.Context, conn *sql.Conn, query string) bool {
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return false
+	}
+	_ = rows.Close()
+	return true
+}
+
+// applied returns the recorded migrations by version.
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int]MigrationStatus, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, name, applied_at, dirty FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]MigrationStatus{}
+	for rows.Next() {
+		var status MigrationStatus
+		var appliedAt sql.NullTime
+		err = rows.Scan(&status.Version, &status.Name, &appliedAt, &status.Dirty)
+		if err != nil {
+			return nil, err
+		}
+		if appliedAt.Valid {
+			status.AppliedAt = &appliedAt.Time
+		}
+		applied[status.Version] = status
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// checkClean fails if a migration was interrupted, as the schema is then in an unknown state.
+func checkClean(applied map[int]MigrationStatus) error {
+	for _, status := range applied {
+		if status.Dirty {
+			return fmt.Errorf("migration %04d_%s is dirty, fix the schema and run migrate force",
+				status.Version, status.Name)
+		}
+	}
+	return nil
+}
+
+// locked runs fn on a connection holding the migrations lock.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = m.lock(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		// the lock belongs to the session, ctx may already be cancelled
+		rlErr := m.dialect.Unlock(context.Background(), conn, lockName)
+		if rlErr != nil {
+			m.Logger.Error("error releasing migrations lock", logging.Err(rlErr))
+		}
+	}()
+
+	err = m.ensureTable(ctx, conn)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// lock waits up to lockTimeout for the migrations lock.
+func (m *Migrator) lock(ctx context.Context, conn *sql.Conn) error {
+	deadline := time.Now().Add(m.lockTimeout)
+	for {
+		acquired, err := m.dialect.TryLock(ctx, conn, lockName)
+		if err != nil {
+			return fmt.Errorf("error acquiring migrations lock: %w", err)
+		}
+		if acquired {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("migrations lock is held by another process after %s", m.lockTimeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+func (m *Migrator) ensureTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations ("+
+		"version BIGINT NOT NULL PRIMARY KEY, "+
+		"name VARCHAR(255) NOT NULL, "+
+		"applied_at TIMESTAMP NULL, "+
+		"dirty BOOLEAN DEFAULT FALSE NOT NULL"+
+		")")
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+)
+
+// newTestMigrator opens a new SQLite database with the embedded migrations
+// pending.
+func newTestMigrator(t *testing.T) (*Migrator, *sql.DB) {
+	t.Helper()
+
+	cfg := &config.Config{}
+	cfg.Database.Backend = dialect.SQLite
+	cfg.Database.Timeout = 5
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "migrate.db")
+
+	db, err := dialect.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	m, err := NewMigrator(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, db
+}
+
+// sharedLock is a migrations lock the test takes and releases in place of
+// another replica, SQLite having no locks of its own.
+type sharedLock struct {
+	dialect.Dialect
+	held     bool
+	acquired int
+	released int
+}
+
+func (l *sharedLock) TryLock(context.Context, *sql.Conn, string) (bool, error) {
+	if l.held {
+		return false, nil
+	}
+	l.held = true
+	l.acquired++
+	return true, nil
+}
+
+func (l *sharedLock) Unlock(context.Context, *sql.Conn, string) error {
+	l.held = false
+	l.released++
+	return nil
+}
+
+func expectStatus(t *testing.T, m *Migrator, applied map[int]bool, dirty map[int]bool) {
+	t.Helper()
+
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != len(m.migrations) {
+		t.Fatalf("status of %d migrations, expected %d", len(statuses), len(m.migrations))
+	}
+	for i, status := range statuses {
+		migration := m.migrations[i]
+		if status.Version != migration.Version || status.Name != migration.Name {
+			t.Fatalf("status %d is %04d_%s, expected %04d_%s", i, status.Version, status.Name,
+				migration.Version, migration.Name)
+		}
+		if (status.AppliedAt != nil) != applied[status.Version] {
+			t.Fatalf("migration %04d applied at %v, expected applied %t", status.Version, status.AppliedAt,
+				applied[status.Version])
+		}
+		if status.Dirty != dirty[status.Version] {
+			t.Fatalf("migration %04d dirty %t, expected %t", status.Version, status.Dirty, dirty[status.Version])
+		}
+	}
+}
+
+func versionsUpTo(version int) map[int]bool {
+	versions := map[int]bool{}
+	for v := 1; v <= version; v++ {
+		versions[v] = true
+	}
+	return versions
+}
+
+func TestUpAndDown(t *testing.T) {
+	m, _ := newTestMigrator(t)
+	ctx := context.Background()
+	last := m.migrations[len(m.migrations)-1].Version
+
+	expectStatus(t, m, nil, nil)
+
+	if err := m.Up(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, m, versionsUpTo(2), nil)
+
+	if err := m.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, m, versionsUpTo(last), nil)
+
+	if err := m.Down(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, m, versionsUpTo(last-3), nil)
+
+	if err := m.Down(ctx, last); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, m, nil, nil)
+}
+
+func TestLockSerializesMigrations(t *testing.T) {
+	m, _ := newTestMigrator(t)
+	ctx := context.Background()
+	lock := &sharedLock{Dialect: m.dialect}
+	m.dialect = lock
+
+	// another replica holds the lock for longer than lockTimeout
+	lock.held = true
+	err := m.Up(ctx, 0)
+	if err == nil || !strings.Contains(err.Error(), "held by another process") {
+		t.Fatalf("Up returned %v while the lock is held, expected a lock timeout", err)
+	}
+	expectStatus(t, m, nil, nil)
+
+	lock.held = false
+	if err = m.Up(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if lock.held || lock.acquired != 1 || lock.released != 1 {
+		t.Fatalf("lock held %t, acquired %d and released %d times, expected once each",
+			lock.held, lock.acquired, lock.released)
+	}
+	expectStatus(t, m, versionsUpTo(1), nil)
+
+	// the lock is released when a migration fails as well
+	m.migrations[1].Up = "INSERT INTO missing_table VALUES (1)"
+	if err = m.Up(ctx, 0); err == nil {
+		t.Fatal("broken migration applied")
+	}
+	if lock.held || lock.released != 2 {
+		t.Fatalf("lock held %t after a failed migration", lock.held)
+	}
+}
+
+func TestDirtyMigrationBlocksUntilForced(t *testing.T) {
+	m, db := newTestMigrator(t)
+	ctx := context.Background()
+	last := m.migrations[len(m.migrations)-1].Version
+
+	fixed := m.migrations[1].Up
+	m.migrations[1].Up = "INSERT INTO missing_table VALUES (1)"
+
+	err := m.Up(ctx, 0)
+	if err == nil || !strings.Contains(err.Error(), "schema is dirty") {
+		t.Fatalf("Up returned %v, expected the migration to fail", err)
+	}
+	expectStatus(t, m, versionsUpTo(1), map[int]bool{2: true})
+
+	for name, run := range map[string]func() error{
+		"up":   func() error { return m.Up(ctx, 0) },
+		"down": func() error { return m.Down(ctx, 1) },
+	} {
+		err = run()
+		if err == nil || !strings.Contains(err.Error(), "is dirty") {
+			t.Fatalf("%s returned %v on a dirty schema, expected an error", name, err)
+		}
+	}
+
+	// the schema is fixed by hand, e.g. by applying the migration
+	if _, err = db.ExecContext(ctx, fixed); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Force(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, m, versionsUpTo(2), nil)
+
+	m.migrations[1].Up = fixed
+	if err = m.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, m, versionsUpTo(last), nil)
+}
+
+func TestForce(t *testing.T) {
+	m, _ := newTestMigrator(t)
+	ctx := context.Background()
+
+	if err := m.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// forcing an older version forgets the later migrations without reverting them
+	if err := m.Force(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, m, versionsUpTo(3), nil)
+
+	// forcing a newer version records the migrations in between as applied
+	if err := m.Force(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, m, versionsUpTo(5), nil)
+}
+
+func TestUpAdoptsBaselineSchema(t *testing.T) {
+	m, db := newTestMigrator(t)
+	ctx := context.Background()
+
+	// the tables db/items.sql created, without segments.owner_team
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, is_active BOOLEAN DEFAULT TRUE NOT NULL);
+		CREATE TABLE segments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			slug VARCHAR(50) NOT NULL UNIQUE,
+			is_active BOOLEAN DEFAULT TRUE NOT NULL
+		);
+		CREATE TABLE user_segment_relation (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INT NOT NULL REFERENCES users(id),
+			segment_id INT NOT NULL REFERENCES segments(id),
+			is_active BOOLEAN DEFAULT TRUE NOT NULL,
+			date_assigned DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+			date_unassigned DATETIME
+		);
+		INSERT INTO segments (slug) VALUES ('AVITO_VOICE_MESSAGES');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = m.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var slug string
+	var ownerTeam sql.NullString
+	err = db.QueryRowContext(ctx, "SELECT slug, owner_team FROM segments").Scan(&slug, &ownerTeam)
+	if err != nil {
+		t.Fatalf("error reading segments after migrating: %v", err)
+	}
+	if slug != "AVITO_VOICE_MESSAGES" || ownerTeam.Valid {
+		t.Fatalf("segment %q owned by %v, expected the existing segment without an owner", slug, ownerTeam)
+	}
+}
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS `webhook_subscriptions` (
+    `id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `url` VARCHAR(2048) NOT NULL,
+    `secret` VARCHAR(255) NOT NULL,
+    `segment_slug` VARCHAR(50),
+    `event_types` VARCHAR(255) NOT NULL,
+    `is_active` BOOL DEFAULT TRUE NOT NULL,
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `webhook_dead_letters` (
+    `id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `subscription_id` INT NOT NULL,
+    `event_type` VARCHAR(50) NOT NULL,
+    `payload` TEXT NOT NULL,
+    `attempts` INT NOT NULL,
+    `last_error` TEXT NOT NULL,
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    FOREIGN KEY (subscription_id) REFERENCES webhook_subscriptions(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
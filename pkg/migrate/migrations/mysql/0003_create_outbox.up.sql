@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS `outbox` (
+    `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `event_type` VARCHAR(50) NOT NULL,
+    `partition_key` VARCHAR(50) NOT NULL,
+    `payload` TEXT NOT NULL,
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    `published_at` DATETIME,
+    INDEX `outbox_unpublished` (`published_at`, `id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
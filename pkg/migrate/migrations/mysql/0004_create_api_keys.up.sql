@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS `api_keys` (
+    `id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `name` VARCHAR(100) NOT NULL,
+    `key_prefix` VARCHAR(16) NOT NULL,
+    `key_hash` CHAR(64) NOT NULL UNIQUE,
+    `scopes` VARCHAR(255) NOT NULL,
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    `revoked_at` DATETIME
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
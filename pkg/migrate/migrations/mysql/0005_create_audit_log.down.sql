@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS `audit_log_users`;
+DROP TABLE IF EXISTS `audit_log_segments`;
+DROP TABLE IF EXISTS `audit_log`;
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS `audit_log` (
+    `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    `actor` VARCHAR(255) NOT NULL,
+    `ip` VARCHAR(64) NOT NULL,
+    `method` VARCHAR(10) NOT NULL,
+    `endpoint` VARCHAR(255) NOT NULL,
+    `payload_digest` CHAR(64) NOT NULL,
+    `status` INT NOT NULL,
+    INDEX `audit_log_actor` (`actor`, `created_at`),
+    INDEX `audit_log_created_at` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `audit_log_segments` (
+    `audit_id` BIGINT NOT NULL,
+    `segment_slug` VARCHAR(50) NOT NULL,
+    PRIMARY KEY (`segment_slug`, `audit_id`),
+    FOREIGN KEY (audit_id) REFERENCES audit_log(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `audit_log_users` (
+    `audit_id` BIGINT NOT NULL,
+    `user_id` INT NOT NULL,
+    PRIMARY KEY (`user_id`, `audit_id`),
+    FOREIGN KEY (audit_id) REFERENCES audit_log(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1 @@
+DROP INDEX `user_segment_relation_expiry` ON `user_segment_relation`;
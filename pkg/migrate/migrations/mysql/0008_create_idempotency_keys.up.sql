@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS `idempotency_keys` (
+    `client` VARCHAR(255) NOT NULL,
+    `idempotency_key` VARCHAR(255) NOT NULL,
+    `request_hash` CHAR(64) NOT NULL,
+    `status` INT NOT NULL DEFAULT 0,
+    `content_type` VARCHAR(255) NOT NULL DEFAULT '',
+    `body` MEDIUMBLOB,
+    `created_at` DATETIME NOT NULL,
+    PRIMARY KEY (`client`, `idempotency_key`),
+    INDEX `idempotency_keys_created` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
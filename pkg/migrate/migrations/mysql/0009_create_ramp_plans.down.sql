@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `ramp_steps`;
+DROP TABLE IF EXISTS `ramp_plans`;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS `ramp_plans` (
+    `segment_id` INT(3) NOT NULL PRIMARY KEY,
+    `status` VARCHAR(16) NOT NULL,
+    `stage` INT NOT NULL DEFAULT 0,
+    `rollback_percent` INT NULL,
+    `created_at` DATETIME NOT NULL,
+    `updated_at` DATETIME NOT NULL,
+    INDEX `ramp_plans_status` (`status`),
+    FOREIGN KEY (segment_id) REFERENCES segments(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `ramp_steps` (
+    `segment_id` INT(3) NOT NULL,
+    `position` INT NOT NULL,
+    `starts_at` DATETIME NOT NULL,
+    `target_percent` INT NOT NULL,
+    PRIMARY KEY (`segment_id`, `position`),
+    FOREIGN KEY (segment_id) REFERENCES ramp_plans(segment_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
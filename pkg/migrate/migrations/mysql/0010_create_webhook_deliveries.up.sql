@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS `webhook_deliveries` (
+    `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `subscription_id` INT NOT NULL,
+    `event_id` BIGINT UNSIGNED NOT NULL,
+    `event_type` VARCHAR(50) NOT NULL,
+    `payload` TEXT NOT NULL,
+    `attempts` INT DEFAULT 0 NOT NULL,
+    `last_error` TEXT,
+    `next_attempt_at` DATETIME NOT NULL,
+    `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    INDEX `webhook_deliveries_due` (`next_attempt_at`),
+    FOREIGN KEY (subscription_id) REFERENCES webhook_subscriptions(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
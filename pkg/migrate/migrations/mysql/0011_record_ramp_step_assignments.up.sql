@@ -0,0 +1 @@
+ALTER TABLE `ramp_steps` ADD COLUMN `assigned` INT NOT NULL DEFAULT 0;
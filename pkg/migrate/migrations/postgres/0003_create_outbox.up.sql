@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    event_type VARCHAR(50) NOT NULL,
+    partition_key VARCHAR(50) NOT NULL,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    published_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS outbox_unpublished ON outbox (published_at, id);
@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    ip VARCHAR(64) NOT NULL,
+    method VARCHAR(10) NOT NULL,
+    endpoint VARCHAR(255) NOT NULL,
+    payload_digest CHAR(64) NOT NULL,
+    status INT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_actor ON audit_log (actor, created_at);
+CREATE INDEX IF NOT EXISTS audit_log_created_at ON audit_log (created_at);
+
+CREATE TABLE IF NOT EXISTS audit_log_segments (
+    audit_id BIGINT NOT NULL REFERENCES audit_log(id),
+    segment_slug VARCHAR(50) NOT NULL,
+    PRIMARY KEY (segment_slug, audit_id)
+);
+
+CREATE TABLE IF NOT EXISTS audit_log_users (
+    audit_id BIGINT NOT NULL REFERENCES audit_log(id),
+    user_id INT NOT NULL,
+    PRIMARY KEY (user_id, audit_id)
+);
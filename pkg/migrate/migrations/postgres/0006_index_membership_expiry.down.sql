@@ -0,0 +1 @@
+DROP INDEX IF EXISTS user_segment_relation_expiry;
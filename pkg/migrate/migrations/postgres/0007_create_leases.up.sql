@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS leases (
+    name VARCHAR(100) NOT NULL PRIMARY KEY,
+    holder VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
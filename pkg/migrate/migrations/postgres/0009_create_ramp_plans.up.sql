@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS ramp_plans (
+    segment_id INT NOT NULL PRIMARY KEY REFERENCES segments(id),
+    status VARCHAR(16) NOT NULL,
+    stage INT NOT NULL DEFAULT 0,
+    rollback_percent INT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS ramp_plans_status ON ramp_plans (status);
+
+CREATE TABLE IF NOT EXISTS ramp_steps (
+    segment_id INT NOT NULL REFERENCES ramp_plans(segment_id),
+    position INT NOT NULL,
+    starts_at TIMESTAMPTZ NOT NULL,
+    target_percent INT NOT NULL,
+    PRIMARY KEY (segment_id, position)
+);
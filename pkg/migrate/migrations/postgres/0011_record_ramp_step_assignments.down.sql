@@ -0,0 +1 @@
+ALTER TABLE ramp_steps DROP COLUMN assigned;
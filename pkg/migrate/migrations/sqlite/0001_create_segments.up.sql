@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    is_active BOOLEAN DEFAULT TRUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS segments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    slug VARCHAR(50) NOT NULL UNIQUE,
+    is_active BOOLEAN DEFAULT TRUE NOT NULL,
+    owner_team VARCHAR(100)
+);
+
+CREATE TABLE IF NOT EXISTS user_segment_relation (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INT NOT NULL REFERENCES users(id),
+    segment_id INT NOT NULL REFERENCES segments(id),
+    is_active BOOLEAN DEFAULT TRUE NOT NULL,
+    date_assigned DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    date_unassigned DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS user_segment_relation_user ON user_segment_relation (user_id, is_active);
+CREATE INDEX IF NOT EXISTS user_segment_relation_segment ON user_segment_relation (segment_id, is_active);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    segment_slug VARCHAR(50),
+    event_types VARCHAR(255) NOT NULL,
+    is_active BOOLEAN DEFAULT TRUE NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    subscription_id INT NOT NULL REFERENCES webhook_subscriptions(id),
+    event_type VARCHAR(50) NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INT NOT NULL,
+    last_error TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
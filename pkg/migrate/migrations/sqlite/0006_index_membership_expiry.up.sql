@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS user_segment_relation_expiry ON user_segment_relation (is_active, date_unassigned);
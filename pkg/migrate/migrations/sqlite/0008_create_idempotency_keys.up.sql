@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    client VARCHAR(255) NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    status INTEGER NOT NULL DEFAULT 0,
+    content_type VARCHAR(255) NOT NULL DEFAULT '',
+    body BLOB,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (client, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created ON idempotency_keys (created_at);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS ramp_plans (
+    segment_id INT NOT NULL PRIMARY KEY REFERENCES segments(id),
+    status VARCHAR(16) NOT NULL,
+    stage INTEGER NOT NULL DEFAULT 0,
+    rollback_percent INTEGER NULL,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS ramp_plans_status ON ramp_plans (status);
+
+CREATE TABLE IF NOT EXISTS ramp_steps (
+    segment_id INT NOT NULL REFERENCES ramp_plans(segment_id),
+    position INTEGER NOT NULL,
+    starts_at DATETIME NOT NULL,
+    target_percent INTEGER NOT NULL,
+    PRIMARY KEY (segment_id, position)
+);
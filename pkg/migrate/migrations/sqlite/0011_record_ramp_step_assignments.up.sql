@@ -0,0 +1 @@
+ALTER TABLE ramp_steps ADD COLUMN assigned INTEGER NOT NULL DEFAULT 0;
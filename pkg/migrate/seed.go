@@ -0,0 +1,43 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+)
+
+const seedBatchSize = 500
+
+// SeedUsers creates the test users with IDs from first to last, keeping the
+// ones that already exist. It returns the number of users created.
+func SeedUsers(ctx context.Context, db *sql.DB, cfg *config.Config, first, last int) (int64, error) {
+	d := dialect.For(cfg)
+
+	var created int64
+	for start := first; start <= last; start += seedBatchSize {
+		end := min(start+seedBatchSize-1, last)
+
+		placeholders := make([]string, 0, end-start+1)
+		args := make([]interface{}, 0, end-start+1)
+		for id := start; id <= end; id++ {
+			placeholders = append(placeholders, "(?)")
+			args = append(args, id)
+		}
+
+		result, err := db.ExecContext(
+			ctx,
+			d.Rebind(d.InsertIgnore("INSERT INTO users (id) VALUES "+strings.Join(placeholders, ", "))),
+			args...,
+		)
+		if err != nil {
+			return created, err
+		}
+
+		if affected, err := result.RowsAffected(); err == nil {
+			created += affected
+		}
+	}
+	return created, nil
+}
@@ -0,0 +1,63 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"time"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/events"
+)
+
+// Message is an outbox row on its way to the message broker.
+type Message struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Key       string          `json:"key"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Publisher sends a batch of messages to the message broker in the given order.
+// An error means that any of them may not have been published.
+type Publisher interface {
+	Publish(ctx context.Context, messages []Message) error
+	Close() error
+}
+
+// Enqueue writes the events to the outbox inside tx, so that they are
+// stored if and only if the change they describe is committed.
+func Enqueue(ctx context.Context, tx *sql.Tx, d dialect.Dialect, changes ...events.Event) error {
+	for i := range changes {
+		if changes[i].Time.IsZero() {
+			changes[i].Time = time.Now().UTC()
+		}
+
+		payload, err := json.Marshal(&changes[i])
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			d.Rebind("INSERT INTO outbox (event_type, partition_key, payload) VALUES (?, ?, ?)"),
+			changes[i].Type,
+			partitionKey(&changes[i]),
+			string(payload),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partitionKey keeps events of one user ordered; events concerning
+// a segment as a whole are ordered per segment.
+func partitionKey(e *events.Event) string {
+	if e.UserID != 0 {
+		return strconv.Itoa(e.UserID)
+	}
+	return "segment:" + e.Segment
+}
@@ -0,0 +1,156 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"usersegmentator/config"
+)
+
+const (
+	PublisherMemory = "memory"
+	PublisherKafka  = "kafka"
+
+	kafkaContentType = "application/vnd.kafka.json.v2+json"
+)
+
+func NewPublisher(cfg *config.Config) (Publisher, error) {
+	switch cfg.Outbox.Publisher {
+	case PublisherMemory:
+		return NewMemoryPublisher(), nil
+	case PublisherKafka:
+		return NewKafkaPublisher(cfg.Outbox.KafkaRESTURL, cfg.Outbox.Topic, cfg.Outbox.PublishTimeout), nil
+	default:
+		return nil, fmt.Errorf("unknown outbox publisher: %s", cfg.Outbox.Publisher)
+	}
+}
+
+// MemoryPublisher keeps published messages in memory. It is meant for tests
+// and local runs without a broker.
+type MemoryPublisher struct {
+	mu       sync.Mutex
+	messages []Message
+	err      error
+}
+
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{
+		messages: []Message{},
+	}
+}
+
+func (mp *MemoryPublisher) Publish(_ context.Context, messages []Message) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if mp.err != nil {
+		return mp.err
+	}
+	mp.messages = append(mp.messages, messages...)
+	return nil
+}
+
+func (mp *MemoryPublisher) Close() error {
+	return nil
+}
+
+// Messages returns a copy of everything published so far.
+func (mp *MemoryPublisher) Messages() []Message {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return append([]Message{}, mp.messages...)
+}
+
+// FailWith makes subsequent Publish calls return err; nil restores publishing.
+func (mp *MemoryPublisher) FailWith(err error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.err = err
+}
+
+// KafkaPublisher produces messages through the Kafka REST Proxy API (v2).
+// The partition key is used as the record key, so Kafka keeps each user's
+// events in one partition and in order.
+type KafkaPublisher struct {
+	topicURL string
+	client   *http.Client
+}
+
+func NewKafkaPublisher(restURL, topic string, timeout int) *KafkaPublisher {
+	return &KafkaPublisher{
+		topicURL: strings.TrimRight(restURL, "/") + "/topics/" + topic,
+		client:   &http.Client{Timeout: time.Duration(timeout) * time.Second},
+	}
+}
+
+type kafkaRecord struct {
+	Key   string   `json:"key"`
+	Value *Message `json:"value"`
+}
+
+type kafkaProduceRequest struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaProduceResponse struct {
+	Offsets []struct {
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+// Publish produces the messages with a single request.
+func (kp *KafkaPublisher) Publish(ctx context.Context, messages []Message) error {
+	records := make([]kafkaRecord, len(messages))
+	for i := range messages {
+		records[i] = kafkaRecord{Key: messages[i].Key, Value: &messages[i]}
+	}
+
+	body, err := json.Marshal(kafkaProduceRequest{Records: records})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, kp.topicURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", kafkaContentType)
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := kp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kafka rest proxy: unexpected status %d", resp.StatusCode)
+	}
+
+	produced := &kafkaProduceResponse{}
+	err = json.NewDecoder(resp.Body).Decode(produced)
+	if err != nil {
+		return fmt.Errorf("kafka rest proxy: %w", err)
+	}
+	for _, offset := range produced.Offsets {
+		if offset.ErrorCode != nil {
+			return fmt.Errorf("kafka rest proxy: error %d: %s", *offset.ErrorCode, offset.Error)
+		}
+	}
+	return nil
+}
+
+func (kp *KafkaPublisher) Close() error {
+	kp.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,92 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/logging"
+)
+
+// Relay moves committed outbox messages to the publisher and purges them
+// once they are older than the retention.
+type Relay struct {
+	repo          Repository
+	publisher     Publisher
+	batchSize     int
+	interval      time.Duration
+	retention     time.Duration
+	purgeInterval time.Duration
+	Logger        *slog.Logger
+}
+
+func NewRelay(repo Repository, publisher Publisher, cfg *config.Config) *Relay {
+	interval := time.Duration(cfg.Outbox.PollInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	batchSize := cfg.Outbox.BatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	return &Relay{
+		repo:          repo,
+		publisher:     publisher,
+		batchSize:     batchSize,
+		interval:      interval,
+		retention:     time.Duration(cfg.Outbox.Retention) * time.Second,
+		purgeInterval: time.Duration(cfg.Outbox.PurgeInterval) * time.Second,
+		Logger:        logging.For("outbox_relay"),
+	}
+}
+
+// Drain relays the committed messages batch by batch, going on while the
+// batches come back full. It is scheduled every interval.
+func (r *Relay) Drain(ctx context.Context) error {
+	for {
+		published, err := r.repo.RelayBatch(ctx, r.publisher, r.batchSize)
+		if err != nil {
+			return err
+		}
+		if published < r.batchSize {
+			return nil
+		}
+	}
+}
+
+func (r *Relay) Interval() time.Duration {
+	return r.interval
+}
+
+// Purge deletes the messages published longer than the retention ago, batch
+// by batch, so that a large backlog does not hold locks for long.
+func (r *Relay) Purge(ctx context.Context) error {
+	before := time.Now().Add(-r.retention)
+	total := 0
+	for {
+		purged, err := r.repo.PurgePublished(ctx, before, r.batchSize)
+		total += purged
+		if err != nil {
+			return fmt.Errorf("error purging outbox: %w", err)
+		}
+		if purged < r.batchSize {
+			break
+		}
+	}
+
+	if total > 0 {
+		r.Logger.InfoContext(ctx, "Purged outbox messages", "messages", total)
+	}
+	return nil
+}
+
+func (r *Relay) PurgeInterval() time.Duration {
+	return r.purgeInterval
+}
+
+// Close closes the publisher. It must be called once the relay job has stopped.
+func (r *Relay) Close() error {
+	return r.publisher.Close()
+}
@@ -0,0 +1,250 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/migrate"
+)
+
+type testEnv struct {
+	cfg       *config.Config
+	db        *sql.DB
+	repo      Repository
+	publisher *MemoryPublisher
+	relay     *Relay
+}
+
+// newTestEnv migrates a new SQLite database and relays it in batches of batchSize.
+func newTestEnv(t *testing.T, batchSize int) *testEnv {
+	t.Helper()
+
+	cfg := &config.Config{}
+	cfg.Database.Backend = dialect.SQLite
+	cfg.Database.Timeout = 5
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "outbox.db")
+	cfg.Outbox.BatchSize = batchSize
+	cfg.Outbox.Retention = 3600
+
+	db, err := dialect.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	migrator, err := migrate.NewMigrator(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewOutboxRepo(db, cfg)
+	publisher := NewMemoryPublisher()
+	return &testEnv{cfg: cfg, db: db, repo: repo, publisher: publisher, relay: NewRelay(repo, publisher, cfg)}
+}
+
+// enqueue commits one transaction per event.
+func (env *testEnv) enqueue(t *testing.T, changes ...events.Event) {
+	t.Helper()
+	ctx := context.Background()
+
+	for i := range changes {
+		tx, err := env.db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = Enqueue(ctx, tx, dialect.For(env.cfg), changes[i]); err != nil {
+			t.Fatal(err)
+		}
+		if err = tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (env *testEnv) drain(t *testing.T) {
+	t.Helper()
+
+	if err := env.relay.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (env *testEnv) count(t *testing.T, where string) int {
+	t.Helper()
+
+	var n int
+	if err := env.db.QueryRow("SELECT COUNT(*) FROM outbox WHERE " + where).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// expectPublished checks the users of the published messages, in publishing order.
+func expectPublished(t *testing.T, messages []Message, users ...int) {
+	t.Helper()
+
+	if len(messages) != len(users) {
+		t.Fatalf("published %d messages, expected %d", len(messages), len(users))
+	}
+	for i := range messages {
+		var e events.Event
+		if err := json.Unmarshal(messages[i].Payload, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.UserID != users[i] {
+			t.Fatalf("message %d is for user %d, expected %d", i, e.UserID, users[i])
+		}
+		if i > 0 && messages[i].ID <= messages[i-1].ID {
+			t.Fatalf("message %d published after message %d", messages[i].ID, messages[i-1].ID)
+		}
+	}
+}
+
+func assigned(userID int) events.Event {
+	return events.Event{Type: events.TypeAssigned, UserID: userID, Segment: "OUTBOX"}
+}
+
+func TestRelayPublishesInIDOrder(t *testing.T) {
+	env := newTestEnv(t, 2)
+	env.enqueue(t, assigned(3), assigned(1), assigned(2), assigned(1), assigned(3))
+
+	env.drain(t)
+	expectPublished(t, env.publisher.Messages(), 3, 1, 2, 1, 3)
+	if n := env.count(t, "published_at IS NULL"); n != 0 {
+		t.Fatalf("%d messages left unpublished", n)
+	}
+
+	// published messages are not published again
+	env.drain(t)
+	expectPublished(t, env.publisher.Messages(), 3, 1, 2, 1, 3)
+
+	if key := env.publisher.Messages()[0].Key; key != "3" {
+		t.Fatalf("partition key %q, expected the user", key)
+	}
+}
+
+func TestRelayRepublishesFailedBatch(t *testing.T) {
+	env := newTestEnv(t, 10)
+	env.enqueue(t, assigned(1), assigned(2))
+
+	env.publisher.FailWith(errors.New("broker unavailable"))
+	if err := env.relay.Drain(context.Background()); err == nil {
+		t.Fatal("failed publishing not reported")
+	}
+	if n := env.count(t, "published_at IS NULL"); n != 2 {
+		t.Fatalf("%d messages left unpublished after a failure, expected 2", n)
+	}
+
+	env.publisher.FailWith(nil)
+	env.drain(t)
+	expectPublished(t, env.publisher.Messages(), 1, 2)
+}
+
+// lostAckPublisher publishes the first batch but reports it as failed, like
+// a crash between publishing and marking the batch.
+type lostAckPublisher struct {
+	*MemoryPublisher
+	lost bool
+}
+
+func (p *lostAckPublisher) Publish(ctx context.Context, messages []Message) error {
+	err := p.MemoryPublisher.Publish(ctx, messages)
+	if err == nil && !p.lost {
+		p.lost = true
+		return errors.New("acknowledgement lost")
+	}
+	return err
+}
+
+func TestRelayDeliversAtLeastOnce(t *testing.T) {
+	env := newTestEnv(t, 10)
+	env.enqueue(t, assigned(1), assigned(2))
+
+	publisher := &lostAckPublisher{MemoryPublisher: NewMemoryPublisher()}
+	relay := NewRelay(env.repo, publisher, env.cfg)
+	if err := relay.Drain(context.Background()); err == nil {
+		t.Fatal("lost acknowledgement not reported")
+	}
+	if err := relay.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := publisher.Messages()
+	expectPublished(t, messages[:2], 1, 2)
+	expectPublished(t, messages[2:], 1, 2)
+}
+
+func TestRelayPublishesLateCommits(t *testing.T) {
+	env := newTestEnv(t, 10)
+	env.enqueue(t, assigned(1), assigned(2))
+
+	// the message with the smaller ID is not visible yet, as if it were not committed
+	var late struct {
+		id        int64
+		eventType string
+		key       string
+		payload   string
+	}
+	err := env.db.QueryRow("SELECT id, event_type, partition_key, payload FROM outbox ORDER BY id LIMIT 1").
+		Scan(&late.id, &late.eventType, &late.key, &late.payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = env.db.Exec("DELETE FROM outbox WHERE id = ?", late.id); err != nil {
+		t.Fatal(err)
+	}
+
+	env.drain(t)
+	expectPublished(t, env.publisher.Messages(), 2)
+
+	_, err = env.db.Exec("INSERT INTO outbox (id, event_type, partition_key, payload) VALUES (?, ?, ?, ?)",
+		late.id, late.eventType, late.key, late.payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.drain(t)
+	messages := env.publisher.Messages()
+	if len(messages) != 2 || messages[1].ID != late.id {
+		t.Fatalf("late message not published: %+v", messages)
+	}
+}
+
+func TestPurgePublished(t *testing.T) {
+	env := newTestEnv(t, 2)
+	env.enqueue(t, assigned(1), assigned(2), assigned(3))
+	env.drain(t)
+	env.enqueue(t, assigned(4))
+
+	// nothing is older than the retention yet
+	if err := env.relay.Purge(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := env.count(t, "1 = 1"); n != 4 {
+		t.Fatalf("%d messages left, expected 4", n)
+	}
+
+	old := time.Now().UTC().Add(-2 * time.Hour)
+	if _, err := env.db.Exec("UPDATE outbox SET published_at = ? WHERE published_at IS NOT NULL", old); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.relay.Purge(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := env.count(t, "1 = 1"); n != 1 {
+		t.Fatalf("%d messages left, expected the unpublished one", n)
+	}
+	if n := env.count(t, "published_at IS NULL"); n != 1 {
+		t.Fatalf("unpublished message purged")
+	}
+}
@@ -0,0 +1,147 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/logging"
+)
+
+type Repository interface {
+	RelayBatch(ctx context.Context, publisher Publisher, limit int) (int, error)
+	PurgePublished(ctx context.Context, before time.Time, limit int) (int, error)
+}
+
+type outboxRepository struct {
+	db      *sql.DB
+	dialect dialect.Dialect
+	cfg     *config.Config
+	Logger  *slog.Logger
+}
+
+func NewOutboxRepo(db *sql.DB, cfg *config.Config) Repository {
+	return &outboxRepository{
+		db:      db,
+		dialect: dialect.For(cfg),
+		cfg:     cfg,
+		Logger:  logging.For("outbox_repo"),
+	}
+}
+
+// RelayBatch publishes up to limit unpublished messages in ID order with a
+// single Publish call and then marks them as published. No rows are locked
+// while publishing, so that writers are never blocked by the broker; two
+// relays running at once would publish the same messages, which is why the
+// relay runs on the leader only. A failed Publish leaves the whole batch for
+// the next run, and a crash before the batch is marked republishes it:
+// delivery is at-least-once.
+//
+// IDs are allocated when a change is written, not when it commits, so a
+// message may become visible after messages with greater IDs have been
+// published; it is then published with the next batch, out of ID order.
+// Changes of the same user in the same segment still keep their order: they
+// lock the same membership row, so a change is only written once the
+// previous one has committed.
+func (ob *outboxRepository) RelayBatch(ctx context.Context, publisher Publisher, limit int) (int, error) {
+	rows, err := ob.db.QueryContext(
+		ctx,
+		ob.dialect.Rebind("SELECT id, event_type, partition_key, payload, created_at FROM outbox "+
+			"WHERE published_at IS NULL ORDER BY id LIMIT ?"),
+		limit,
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var msg Message
+		var payload string
+		err = rows.Scan(&msg.ID, &msg.Type, &msg.Key, &payload, &msg.CreatedAt)
+		if err != nil {
+			return 0, err
+		}
+		msg.Payload = []byte(payload)
+		messages = append(messages, msg)
+	}
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	err = publisher.Publish(ctx, messages)
+	if err != nil {
+		return 0, fmt.Errorf("error publishing outbox messages: %w", err)
+	}
+
+	args := []interface{}{time.Now().UTC()}
+	for i := range messages {
+		args = append(args, messages[i].ID)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(messages)), ", ")
+	_, err = ob.db.ExecContext(
+		ctx,
+		ob.dialect.Rebind("UPDATE outbox SET published_at = ? WHERE id IN ("+placeholders+")"),
+		args...,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error marking published outbox messages: %w", err)
+	}
+
+	ob.Logger.InfoContext(ctx, "RelayBatch", "published", len(messages))
+	return len(messages), nil
+}
+
+// PurgePublished deletes up to limit messages published before the given
+// time and returns how many it deleted.
+func (ob *outboxRepository) PurgePublished(ctx context.Context, before time.Time, limit int) (int, error) {
+	rows, err := ob.db.QueryContext(
+		ctx,
+		ob.dialect.Rebind("SELECT id FROM outbox WHERE published_at IS NOT NULL AND published_at < ? ORDER BY id LIMIT ?"),
+		before.UTC(),
+		limit,
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	ids := []interface{}{}
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	res, err := ob.db.ExecContext(ctx, ob.dialect.Rebind("DELETE FROM outbox WHERE id IN ("+placeholders+")"), ids...)
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", errors.ErrorGettingAffectedRows, err)
+	}
+	return int(purged), nil
+}
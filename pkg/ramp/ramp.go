@@ -0,0 +1,156 @@
+// Package ramp rolls segments out gradually. A ramp plan is a list of steps,
+// each raising the share of active users in the segment to a target
+// percentage from a moment on; the runner tops the segment up to the target
+// of the latest step reached, adding only the users that are missing.
+//
+// The runner is the only one changing the members of a segment for its plan:
+// a rollback is recorded on the plan and carried out by the runner as well,
+// so that it cannot be undone by a top-up already under way.
+//
+// A step adds users once, when the plan reaches it, and records how many it
+// has added. Those users keep counting towards the targets after they have
+// left the segment, so that the members removed through the API or by
+// expiry are not brought back by the next steps.
+package ramp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	StatusActive     = "active"
+	StatusPaused     = "paused"
+	StatusCompleted  = "completed"
+	StatusRolledBack = "rolled_back"
+	// StatusCancelled is set by the runner on the plans of deleted segments.
+	StatusCancelled = "cancelled"
+)
+
+// maxSteps caps the steps of a plan.
+const maxSteps = 20
+
+var (
+	ErrPlanNotFound      = errors.New("ramp plan not found")
+	ErrSegmentNotFound   = errors.New("segment not found")
+	ErrInvalidTransition = errors.New("invalid ramp plan status transition")
+)
+
+// transitions maps each status to the statuses a plan may be moved to it
+// from. A rollback may be repeated, to roll back further.
+var transitions = map[string][]string{
+	StatusActive:     {StatusPaused},
+	StatusPaused:     {StatusActive},
+	StatusRolledBack: {StatusActive, StatusPaused, StatusCompleted, StatusRolledBack},
+}
+
+func allowed(from []string, status string) bool {
+	for _, s := range from {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Step raises the segment to TargetPercent of the active users from At on.
+// Assigned is how many users the runner has added when the plan reached the
+// step; it is ignored in requests.
+type Step struct {
+	At            time.Time `json:"at"`
+	TargetPercent int       `json:"target_percent"`
+	Assigned      int       `json:"assigned"`
+}
+
+// Plan is the ramp plan of a segment. Stage is the number of steps reached so
+// far, CurrentPercent the target of the last of them. RollbackPercent is set
+// while a rollback waits for the runner to bring the segment down to it.
+type Plan struct {
+	SegmentSlug     string    `json:"segment_slug"`
+	Status          string    `json:"status"`
+	Steps           []Step    `json:"steps"`
+	Stage           int       `json:"stage"`
+	CurrentPercent  int       `json:"current_percent"`
+	NextStep        *Step     `json:"next_step,omitempty"`
+	RollbackPercent *int      `json:"rollback_percent,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+type RequestPlan struct {
+	SegmentSlug string `json:"segment_slug"`
+	Steps       []Step `json:"steps"`
+}
+
+// RequestStatus: Status is "paused", "active" to resume a paused plan or
+// "rolled_back". A rollback has the runner unassign random members until
+// TargetPercent of the active users are left in the segment, none by default.
+type RequestStatus struct {
+	SegmentSlug   string `json:"segment_slug"`
+	Status        string `json:"status"`
+	TargetPercent int    `json:"target_percent"`
+}
+
+// ValidateSteps accepts steps in chronological order whose targets never go
+// down; a rollout is reversed by rolling the plan back instead.
+func ValidateSteps(steps []Step) error {
+	if len(steps) == 0 || len(steps) > maxSteps {
+		return fmt.Errorf("a ramp plan has 1 to %d steps, got %d", maxSteps, len(steps))
+	}
+
+	for i, step := range steps {
+		if step.TargetPercent < 1 || step.TargetPercent > 100 {
+			return fmt.Errorf("step %d: invalid target percentage: %d", i+1, step.TargetPercent)
+		}
+		if i == 0 {
+			continue
+		}
+		if !step.At.After(steps[i-1].At) {
+			return fmt.Errorf("step %d does not come after step %d", i+1, i)
+		}
+		if step.TargetPercent < steps[i-1].TargetPercent {
+			return fmt.Errorf("step %d lowers the target of step %d", i+1, i)
+		}
+	}
+	return nil
+}
+
+// ValidateStatus accepts the statuses a plan may be moved to on request.
+func ValidateStatus(status string) error {
+	if _, ok := transitions[status]; !ok || status == StatusCompleted {
+		return fmt.Errorf("unknown ramp plan status %q", status)
+	}
+	return nil
+}
+
+// reached counts the steps whose time has come at now.
+func (p *Plan) reached(now time.Time) int {
+	stage := 0
+	for stage < len(p.Steps) && !p.Steps[stage].At.After(now) {
+		stage++
+	}
+	return stage
+}
+
+// assigned counts the users added by the steps reached so far.
+func (p *Plan) assigned() int {
+	total := 0
+	for _, step := range p.Steps {
+		total += step.Assigned
+	}
+	return total
+}
+
+// describe fills in the fields derived from the steps and the stage.
+func (p *Plan) describe() {
+	p.CurrentPercent = 0
+	if p.Stage > 0 {
+		p.CurrentPercent = p.Steps[p.Stage-1].TargetPercent
+	}
+	p.NextStep = nil
+	if p.Stage < len(p.Steps) && (p.Status == StatusActive || p.Status == StatusPaused) {
+		next := p.Steps[p.Stage]
+		p.NextStep = &next
+	}
+}
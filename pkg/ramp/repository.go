@@ -0,0 +1,362 @@
+package ramp
+
+import (
+	"context"
+	"database/sql"
+	stderrors "errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/logging"
+)
+
+type Repository interface {
+	// SetPlan replaces the plan of the segment with an active one made of steps.
+	SetPlan(ctx context.Context, segmentSlug string, steps []Step) (*Plan, error)
+	GetPlan(ctx context.Context, segmentSlug string) (*Plan, error)
+	// GetActivePlans returns the active plans of the segments that are not deleted.
+	GetActivePlans(ctx context.Context) ([]Plan, error)
+	// SetStatus moves the plan to status, if allowed from its current one.
+	// A rollback also records rollbackPercent as the plan's RollbackPercent.
+	SetStatus(ctx context.Context, segmentSlug, status string, rollbackPercent int) (*Plan, error)
+	// Advance records the stage reached by an active plan and its new status,
+	// and adds assigned to the users assigned by its step. A plan paused or
+	// rolled back in the meantime is left as it is, but for the users assigned.
+	Advance(ctx context.Context, segmentSlug string, stage int, status string, assigned int) error
+	// CancelOrphaned cancels the plans of deleted segments that are not
+	// finished yet, so that they are not resumed if the segment is created
+	// again, and returns how many it has cancelled.
+	CancelOrphaned(ctx context.Context) (int64, error)
+	// GetPendingRollbacks returns the rolled back plans of the segments that
+	// are not deleted whose RollbackPercent is yet to be reached.
+	GetPendingRollbacks(ctx context.Context) ([]Plan, error)
+	// FinishRollback clears the RollbackPercent of the plan, unless another
+	// rollback has changed it in the meantime.
+	FinishRollback(ctx context.Context, segmentSlug string, rollbackPercent int) error
+}
+
+type rampRepository struct {
+	db      *sql.DB
+	dialect dialect.Dialect
+	Logger  *slog.Logger
+}
+
+func NewRampRepo(db *sql.DB, cfg *config.Config) Repository {
+	return &rampRepository{
+		db:      db,
+		dialect: dialect.For(cfg),
+		Logger:  logging.For("ramp_repo"),
+	}
+}
+
+func (rr *rampRepository) SetPlan(ctx context.Context, segmentSlug string, steps []Step) (*Plan, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	tx, err := rr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", errors.ErrorBeginTransaction, err)
+	}
+
+	err = rr.setPlan(ctx, tx, segmentSlug, steps, now)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", errors.ErrorCommittingTransaction, err)
+	}
+
+	plan := &Plan{
+		SegmentSlug: segmentSlug,
+		Status:      StatusActive,
+		Steps:       steps,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	plan.describe()
+
+	rr.Logger.InfoContext(ctx, "SetPlan", logging.KeySegment, segmentSlug, "steps", len(steps))
+	return plan, nil
+}
+
+func (rr *rampRepository) setPlan(ctx context.Context, tx *sql.Tx, segmentSlug string, steps []Step, now time.Time) error {
+	var segmentID int
+	err := tx.QueryRowContext(
+		ctx,
+		rr.dialect.Rebind("SELECT id FROM segments WHERE slug = ? AND is_active = TRUE"),
+		segmentSlug,
+	).Scan(&segmentID)
+	if stderrors.Is(err, sql.ErrNoRows) {
+		return ErrSegmentNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, rr.dialect.Rebind("DELETE FROM ramp_steps WHERE segment_id = ?"), segmentID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		rr.dialect.Rebind(rr.dialect.Upsert(
+			"INSERT INTO ramp_plans (segment_id, status, stage, created_at, updated_at) VALUES (?, ?, 0, ?, ?)",
+			[]string{"segment_id"},
+			"status = "+rr.dialect.Excluded("status")+", stage = 0, "+
+				"created_at = "+rr.dialect.Excluded("created_at")+", updated_at = "+rr.dialect.Excluded("updated_at"),
+		)),
+		segmentID,
+		StatusActive,
+		now,
+		now,
+	)
+	if err != nil {
+		return err
+	}
+
+	for i, step := range steps {
+		_, err = tx.ExecContext(
+			ctx,
+			rr.dialect.Rebind("INSERT INTO ramp_steps (segment_id, position, starts_at, target_percent) VALUES (?, ?, ?, ?)"),
+			segmentID,
+			i,
+			step.At.UTC().Truncate(time.Second),
+			step.TargetPercent,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rr *rampRepository) GetPlan(ctx context.Context, segmentSlug string) (*Plan, error) {
+	plans, err := rr.getPlans(ctx, "s.slug = ?", segmentSlug)
+	if err != nil {
+		return nil, err
+	}
+	if len(plans) == 0 {
+		return nil, ErrPlanNotFound
+	}
+	return &plans[0], nil
+}
+
+func (rr *rampRepository) GetActivePlans(ctx context.Context) ([]Plan, error) {
+	return rr.getPlans(ctx, "p.status = ? AND s.is_active = TRUE", StatusActive)
+}
+
+func (rr *rampRepository) GetPendingRollbacks(ctx context.Context) ([]Plan, error) {
+	return rr.getPlans(ctx, "p.status = ? AND p.rollback_percent IS NOT NULL AND s.is_active = TRUE", StatusRolledBack)
+}
+
+// getPlans returns the plans matching the condition on plans p and their
+// segments s, with their steps.
+func (rr *rampRepository) getPlans(ctx context.Context, condition string, args ...interface{}) ([]Plan, error) {
+	rows, err := rr.db.QueryContext(
+		ctx,
+		rr.dialect.Rebind("SELECT p.segment_id, s.slug, p.status, p.stage, p.rollback_percent, p.created_at, p.updated_at "+
+			"FROM ramp_plans p "+
+			"JOIN segments s ON s.id = p.segment_id WHERE "+condition+" ORDER BY s.slug"),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []Plan{}
+	segmentIDs := []int{}
+	for rows.Next() {
+		var segmentID int
+		var rollbackPercent sql.NullInt64
+		plan := Plan{}
+		err = rows.Scan(&segmentID, &plan.SegmentSlug, &plan.Status, &plan.Stage, &rollbackPercent,
+			&plan.CreatedAt, &plan.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if rollbackPercent.Valid {
+			percent := int(rollbackPercent.Int64)
+			plan.RollbackPercent = &percent
+		}
+		plan.CreatedAt = plan.CreatedAt.UTC()
+		plan.UpdatedAt = plan.UpdatedAt.UTC()
+		plans = append(plans, plan)
+		segmentIDs = append(segmentIDs, segmentID)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range plans {
+		plans[i].Steps, err = rr.getSteps(ctx, segmentIDs[i])
+		if err != nil {
+			return nil, err
+		}
+		plans[i].describe()
+	}
+	return plans, nil
+}
+
+func (rr *rampRepository) getSteps(ctx context.Context, segmentID int) ([]Step, error) {
+	rows, err := rr.db.QueryContext(
+		ctx,
+		rr.dialect.Rebind("SELECT starts_at, target_percent, assigned FROM ramp_steps WHERE segment_id = ? ORDER BY position"),
+		segmentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	steps := []Step{}
+	for rows.Next() {
+		step := Step{}
+		err = rows.Scan(&step.At, &step.TargetPercent, &step.Assigned)
+		if err != nil {
+			return nil, err
+		}
+		step.At = step.At.UTC()
+		steps = append(steps, step)
+	}
+	return steps, rows.Err()
+}
+
+func (rr *rampRepository) SetStatus(ctx context.Context, segmentSlug, status string, rollbackPercent int) (*Plan, error) {
+	from, ok := transitions[status]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown status %q", ErrInvalidTransition, status)
+	}
+
+	var percent sql.NullInt64
+	if status == StatusRolledBack {
+		percent = sql.NullInt64{Int64: int64(rollbackPercent), Valid: true}
+	}
+	args := []interface{}{status, percent, time.Now().UTC().Truncate(time.Second), segmentSlug}
+	for _, fromStatus := range from {
+		args = append(args, fromStatus)
+	}
+	result, err := rr.db.ExecContext(
+		ctx,
+		rr.dialect.Rebind("UPDATE ramp_plans SET status = ?, rollback_percent = ?, updated_at = ? "+
+			"WHERE segment_id = (SELECT id FROM segments WHERE slug = ?) "+
+			"AND status IN (?"+strings.Repeat(", ?", len(from)-1)+")"),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", errors.ErrorGettingAffectedRows, err)
+	}
+
+	plan, err := rr.GetPlan(ctx, segmentSlug)
+	if err != nil {
+		return nil, err
+	}
+	// MySQL reports no rows for a repeated rollback within the same second
+	if rows == 0 && !(plan.Status == status && allowed(from, status)) {
+		return nil, fmt.Errorf("%w: from %s to %s", ErrInvalidTransition, plan.Status, status)
+	}
+
+	rr.Logger.InfoContext(ctx, "SetStatus", logging.KeySegment, segmentSlug, "status", status)
+	return plan, nil
+}
+
+func (rr *rampRepository) FinishRollback(ctx context.Context, segmentSlug string, rollbackPercent int) error {
+	_, err := rr.db.ExecContext(
+		ctx,
+		rr.dialect.Rebind("UPDATE ramp_plans SET rollback_percent = NULL "+
+			"WHERE segment_id = (SELECT id FROM segments WHERE slug = ?) AND status = ? AND rollback_percent = ?"),
+		segmentSlug,
+		StatusRolledBack,
+		rollbackPercent,
+	)
+	return err
+}
+
+func (rr *rampRepository) Advance(ctx context.Context, segmentSlug string, stage int, status string, assigned int) error {
+	tx, err := rr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", errors.ErrorBeginTransaction, err)
+	}
+
+	err = rr.advance(ctx, tx, segmentSlug, stage, status, assigned)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("%s: %w", errors.ErrorCommittingTransaction, err)
+	}
+	return nil
+}
+
+func (rr *rampRepository) advance(ctx context.Context, tx *sql.Tx, segmentSlug string, stage int, status string, assigned int) error {
+	if assigned > 0 {
+		_, err := tx.ExecContext(
+			ctx,
+			rr.dialect.Rebind("UPDATE ramp_steps SET assigned = assigned + ? "+
+				"WHERE segment_id = (SELECT id FROM segments WHERE slug = ?) AND position = ?"),
+			assigned,
+			segmentSlug,
+			stage-1,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.ExecContext(
+		ctx,
+		rr.dialect.Rebind("UPDATE ramp_plans SET stage = ?, status = ?, updated_at = ? "+
+			"WHERE segment_id = (SELECT id FROM segments WHERE slug = ?) AND status = ?"),
+		stage,
+		status,
+		time.Now().UTC().Truncate(time.Second),
+		segmentSlug,
+		StatusActive,
+	)
+	return err
+}
+
+func (rr *rampRepository) CancelOrphaned(ctx context.Context) (int64, error) {
+	result, err := rr.db.ExecContext(
+		ctx,
+		rr.dialect.Rebind("UPDATE ramp_plans SET status = ?, rollback_percent = NULL, updated_at = ? "+
+			"WHERE segment_id IN (SELECT id FROM segments WHERE is_active = FALSE) "+
+			"AND (status IN (?, ?) OR rollback_percent IS NOT NULL)"),
+		StatusCancelled,
+		time.Now().UTC().Truncate(time.Second),
+		StatusActive,
+		StatusPaused,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	cancelled, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", errors.ErrorGettingAffectedRows, err)
+	}
+	if cancelled > 0 {
+		rr.Logger.InfoContext(ctx, "CancelOrphaned", "plans", cancelled)
+	}
+	return cancelled, nil
+}
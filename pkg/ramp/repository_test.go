@@ -0,0 +1,182 @@
+package ramp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/migrate"
+	"usersegmentator/pkg/segment"
+)
+
+const testUsers = 100
+
+type testEnv struct {
+	cfg      *config.Config
+	ramp     Repository
+	segments segment.Repository
+}
+
+// newTestEnv migrates a new SQLite database and seeds it with testUsers users.
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	ctx := context.Background()
+
+	cfg := &config.Config{}
+	cfg.Database.Backend = dialect.SQLite
+	cfg.Database.Timeout = 5
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "ramp.db")
+
+	db, err := dialect.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	migrator, err := migrate.NewMigrator(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrate.SeedUsers(ctx, db, cfg, 1, testUsers); err != nil {
+		t.Fatal(err)
+	}
+
+	return &testEnv{
+		cfg:      cfg,
+		ramp:     NewRampRepo(db, cfg),
+		segments: segment.NewSegmentsRepo(db, cfg, events.NewBroker(cfg), nil),
+	}
+}
+
+// newPlan creates the segment and an active plan for it made of steps.
+func (env *testEnv) newPlan(t *testing.T, slug string, steps ...Step) {
+	t.Helper()
+	ctx := context.Background()
+
+	if err := env.segments.InsertSegment(ctx, slug, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.ramp.SetPlan(ctx, slug, steps); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (env *testEnv) expectMembers(t *testing.T, slug string, expected int) {
+	t.Helper()
+
+	members, err := env.segments.GetSegmentMembersAmount(context.Background(), slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members != expected {
+		t.Fatalf("segment %s has %d members, expected %d", slug, members, expected)
+	}
+}
+
+// unassignMembers unassigns n members of the segment.
+func (env *testEnv) unassignMembers(t *testing.T, slug string, n int) {
+	t.Helper()
+	ctx := context.Background()
+
+	userIDs := make([]int, testUsers)
+	for i := range userIDs {
+		userIDs[i] = i + 1
+	}
+	segments, err := env.segments.GetUsersSegments(ctx, userIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := []int{}
+	for userID, slugs := range segments.Users {
+		if len(slugs) > 0 && len(members) < n {
+			members = append(members, userID)
+		}
+	}
+	if err = env.segments.UnassignSegments(ctx, members, []string{slug}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetStatus(t *testing.T) {
+	tests := []struct {
+		from    string
+		to      string
+		allowed bool
+	}{
+		{StatusActive, StatusPaused, true},
+		{StatusActive, StatusActive, false},
+		{StatusActive, StatusRolledBack, true},
+		{StatusPaused, StatusActive, true},
+		{StatusPaused, StatusPaused, false},
+		{StatusPaused, StatusRolledBack, true},
+		{StatusCompleted, StatusActive, false},
+		{StatusCompleted, StatusPaused, false},
+		{StatusCompleted, StatusRolledBack, true},
+		{StatusRolledBack, StatusActive, false},
+		{StatusRolledBack, StatusPaused, false},
+		{StatusRolledBack, StatusRolledBack, true},
+	}
+
+	env := newTestEnv(t)
+	ctx := context.Background()
+	steps := []Step{{At: time.Now().UTC().Add(time.Hour), TargetPercent: 10}}
+
+	for i, tt := range tests {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			slug := fmt.Sprintf("SEGMENT_%d", i)
+			env.newPlan(t, slug, steps...)
+
+			var err error
+			switch tt.from {
+			case StatusPaused, StatusRolledBack:
+				_, err = env.ramp.SetStatus(ctx, slug, tt.from, 0)
+			case StatusCompleted:
+				err = env.ramp.Advance(ctx, slug, len(steps), StatusCompleted, 0)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plan, err := env.ramp.SetStatus(ctx, slug, tt.to, 5)
+			if !tt.allowed {
+				if !errors.Is(err, ErrInvalidTransition) {
+					t.Fatalf("expected %v, got %v", ErrInvalidTransition, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if plan.Status != tt.to {
+				t.Fatalf("plan status is %s, expected %s", plan.Status, tt.to)
+			}
+			rollingBack := plan.RollbackPercent != nil && *plan.RollbackPercent == 5
+			if rollingBack != (tt.to == StatusRolledBack) {
+				t.Fatalf("plan rollback percent is %v after moving to %s", plan.RollbackPercent, tt.to)
+			}
+		})
+	}
+}
+
+func TestSetStatusWithoutPlan(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	if err := env.segments.InsertSegment(ctx, "NO_PLAN", ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err := env.ramp.SetStatus(ctx, "NO_PLAN", StatusPaused, 0)
+	if !errors.Is(err, ErrPlanNotFound) {
+		t.Fatalf("expected %v, got %v", ErrPlanNotFound, err)
+	}
+}
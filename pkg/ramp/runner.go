@@ -0,0 +1,132 @@
+package ramp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/segment"
+)
+
+// Runner tops the segments of the active plans up to the target of a step
+// when they reach it, and carries out the rollbacks. A plan paused while a
+// run is in progress is left alone from the next run on.
+//
+// Runs must not overlap, which the leader-only background job ensures.
+type Runner struct {
+	repo     Repository
+	segments segment.Repository
+	interval time.Duration
+	Logger   *slog.Logger
+}
+
+func NewRunner(repo Repository, segments segment.Repository, cfg *config.Config) *Runner {
+	return &Runner{
+		repo:     repo,
+		segments: segments,
+		interval: time.Duration(cfg.Ramp.CheckInterval) * time.Second,
+		Logger:   logging.For("ramp"),
+	}
+}
+
+func (rn *Runner) Interval() time.Duration {
+	return rn.interval
+}
+
+// Advance cancels the plans of deleted segments, then runs every active plan
+// once and carries out the pending rollbacks. The rollbacks come last, so
+// that those requested during the run undo the top-ups it has made. A failing
+// plan does not hold the others back; the errors are returned joined.
+func (rn *Runner) Advance(ctx context.Context) error {
+	cancelled, err := rn.repo.CancelOrphaned(ctx)
+	if err != nil {
+		return fmt.Errorf("error cancelling ramp plans: %w", err)
+	}
+	if cancelled > 0 {
+		rn.Logger.InfoContext(ctx, "Cancelled ramp plans of deleted segments", "plans", cancelled)
+	}
+
+	plans, err := rn.repo.GetActivePlans(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting ramp plans: %w", err)
+	}
+
+	now := time.Now().UTC()
+	var failures []error
+	for i := range plans {
+		err = rn.advance(ctx, &plans[i], now)
+		if err != nil {
+			failures = append(failures, fmt.Errorf("segment %s: %w", plans[i].SegmentSlug, err))
+		}
+	}
+
+	rollbacks, err := rn.repo.GetPendingRollbacks(ctx)
+	if err != nil {
+		failures = append(failures, fmt.Errorf("error getting ramp rollbacks: %w", err))
+		return errors.Join(failures...)
+	}
+
+	for i := range rollbacks {
+		err = rn.rollBack(ctx, &rollbacks[i])
+		if err != nil {
+			failures = append(failures, fmt.Errorf("segment %s: %w", rollbacks[i].SegmentSlug, err))
+		}
+	}
+	return errors.Join(failures...)
+}
+
+// advance tops the segment up to the target of the latest step reached at
+// now, if the plan has reached a new step since the last run, and records the
+// stage. The users the plan has assigned before count towards the target, so
+// the members lost since are not brought back. A plan is completed once its
+// last step is reached.
+func (rn *Runner) advance(ctx context.Context, plan *Plan, now time.Time) error {
+	stage := plan.reached(now)
+	if stage <= plan.Stage {
+		return nil
+	}
+
+	target := plan.Steps[stage-1].TargetPercent
+	assigned, err := rn.segments.TopUpSegment(ctx, target, plan.SegmentSlug, nil, plan.assigned())
+	if err != nil {
+		return err
+	}
+	if assigned > 0 {
+		rn.Logger.InfoContext(ctx, "Topped up segment", logging.KeySegment, plan.SegmentSlug,
+			"target_percent", target, "assigned", assigned)
+	}
+
+	status := StatusActive
+	if stage == len(plan.Steps) {
+		status = StatusCompleted
+	}
+
+	err = rn.repo.Advance(ctx, plan.SegmentSlug, stage, status, assigned)
+	if err != nil {
+		return err
+	}
+	rn.Logger.InfoContext(ctx, "Ramp plan advanced", logging.KeySegment, plan.SegmentSlug,
+		"stage", stage, "steps", len(plan.Steps), "status", status)
+	return nil
+}
+
+// rollBack unassigns random members until the plan's RollbackPercent of the
+// active users are left in the segment.
+func (rn *Runner) rollBack(ctx context.Context, plan *Plan) error {
+	target := *plan.RollbackPercent
+	unassigned, err := rn.segments.TrimSegment(ctx, target, plan.SegmentSlug)
+	if err != nil {
+		return err
+	}
+
+	err = rn.repo.FinishRollback(ctx, plan.SegmentSlug, target)
+	if err != nil {
+		return err
+	}
+	rn.Logger.InfoContext(ctx, "Ramp plan rolled back", logging.KeySegment, plan.SegmentSlug,
+		"target_percent", target, "unassigned", unassigned)
+	return nil
+}
@@ -0,0 +1,249 @@
+package ramp
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+	"usersegmentator/pkg/segment"
+)
+
+func TestRunnerAdvance(t *testing.T) {
+	env := newTestEnv(t)
+	runner := NewRunner(env.ramp, env.segments, env.cfg)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	steps := []Step{
+		{At: now.Add(-2 * time.Hour), TargetPercent: 10},
+		{At: now.Add(-time.Hour), TargetPercent: 30},
+		{At: now.Add(time.Hour), TargetPercent: 100},
+	}
+	env.newPlan(t, "RAMPED", steps...)
+
+	// repeated runs top the segment up to the latest reached step only
+	for i := 0; i < 2; i++ {
+		if err := runner.Advance(ctx); err != nil {
+			t.Fatal(err)
+		}
+		env.expectMembers(t, "RAMPED", 30)
+	}
+
+	plan, err := env.ramp.GetPlan(ctx, "RAMPED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Status != StatusActive || plan.Stage != 2 || plan.CurrentPercent != 30 {
+		t.Fatalf("plan is %s at stage %d and %d%%, expected active at stage 2 and 30%%",
+			plan.Status, plan.Stage, plan.CurrentPercent)
+	}
+	if plan.NextStep == nil || !plan.NextStep.At.Equal(steps[2].At) {
+		t.Fatalf("next step is %v, expected %v", plan.NextStep, steps[2])
+	}
+	if plan.Steps[0].Assigned != 0 || plan.Steps[1].Assigned != 30 {
+		t.Fatalf("steps assigned %d and %d users, expected 0 and 30", plan.Steps[0].Assigned, plan.Steps[1].Assigned)
+	}
+
+	// members removed since are not brought back
+	env.unassignMembers(t, "RAMPED", 10)
+	if err = runner.Advance(ctx); err != nil {
+		t.Fatal(err)
+	}
+	env.expectMembers(t, "RAMPED", 20)
+
+	// nor by the next step, which adds its own share only
+	plans, err := env.ramp.GetActivePlans(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = runner.advance(ctx, &plans[0], now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	env.expectMembers(t, "RAMPED", 90)
+
+	plan, err = env.ramp.GetPlan(ctx, "RAMPED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Status != StatusCompleted || plan.Steps[2].Assigned != 70 {
+		t.Fatalf("plan is %s with %d users assigned by the last step, expected completed with 70",
+			plan.Status, plan.Steps[2].Assigned)
+	}
+}
+
+func TestRunnerCancelsPlanOfDeletedSegment(t *testing.T) {
+	env := newTestEnv(t)
+	runner := NewRunner(env.ramp, env.segments, env.cfg)
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	env.newPlan(t, "RAMPED",
+		Step{At: now.Add(-time.Hour), TargetPercent: 10},
+		Step{At: now.Add(time.Hour), TargetPercent: 50},
+	)
+	if err := runner.Advance(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.segments.DeleteSegment(ctx, "RAMPED"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := runner.Advance(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plan, err := env.ramp.GetPlan(ctx, "RAMPED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Status != StatusCancelled || plan.NextStep != nil {
+		t.Fatalf("plan is %s, expected cancelled", plan.Status)
+	}
+
+	// a segment created again does not resume the old plan
+	if err = env.segments.InsertSegment(ctx, "RAMPED", ""); err != nil {
+		t.Fatal(err)
+	}
+	plans, err := env.ramp.GetActivePlans(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 0 {
+		t.Fatalf("%d active plans, expected none", len(plans))
+	}
+}
+
+func TestRunnerCompletesPlan(t *testing.T) {
+	env := newTestEnv(t)
+	runner := NewRunner(env.ramp, env.segments, env.cfg)
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	env.newPlan(t, "RAMPED",
+		Step{At: now.Add(-2 * time.Hour), TargetPercent: 10},
+		Step{At: now.Add(-time.Hour), TargetPercent: 50},
+	)
+	if err := runner.Advance(ctx); err != nil {
+		t.Fatal(err)
+	}
+	env.expectMembers(t, "RAMPED", 50)
+
+	plan, err := env.ramp.GetPlan(ctx, "RAMPED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Status != StatusCompleted || plan.Stage != 2 || plan.NextStep != nil {
+		t.Fatalf("plan is %s at stage %d, expected completed at stage 2", plan.Status, plan.Stage)
+	}
+}
+
+func TestRunnerLeavesPausedPlan(t *testing.T) {
+	env := newTestEnv(t)
+	runner := NewRunner(env.ramp, env.segments, env.cfg)
+	ctx := context.Background()
+
+	env.newPlan(t, "RAMPED", Step{At: time.Now().UTC().Add(-time.Hour), TargetPercent: 20})
+	if _, err := env.ramp.SetStatus(ctx, "RAMPED", StatusPaused, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Advance(ctx); err != nil {
+		t.Fatal(err)
+	}
+	env.expectMembers(t, "RAMPED", 0)
+}
+
+func TestRunnerRollsBack(t *testing.T) {
+	env := newTestEnv(t)
+	runner := NewRunner(env.ramp, env.segments, env.cfg)
+	ctx := context.Background()
+
+	env.newPlan(t, "RAMPED", Step{At: time.Now().UTC().Add(-time.Hour), TargetPercent: 40})
+	if err := runner.Advance(ctx); err != nil {
+		t.Fatal(err)
+	}
+	env.expectMembers(t, "RAMPED", 40)
+
+	plan, err := env.ramp.SetStatus(ctx, "RAMPED", StatusRolledBack, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.RollbackPercent == nil || *plan.RollbackPercent != 15 {
+		t.Fatalf("rollback percent is %v, expected 15", plan.RollbackPercent)
+	}
+	// the members are left alone until the runner carries the rollback out
+	env.expectMembers(t, "RAMPED", 40)
+
+	if err = runner.Advance(ctx); err != nil {
+		t.Fatal(err)
+	}
+	env.expectMembers(t, "RAMPED", 15)
+
+	plan, err = env.ramp.GetPlan(ctx, "RAMPED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Status != StatusRolledBack || plan.RollbackPercent != nil {
+		t.Fatalf("plan is %s with rollback percent %v, expected a finished rollback", plan.Status, plan.RollbackPercent)
+	}
+}
+
+// blockingSegments holds the first top-up until released, so that the plan
+// can be rolled back while a run is under way.
+type blockingSegments struct {
+	segment.Repository
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (bs *blockingSegments) TopUpSegment(
+	ctx context.Context,
+	fraction int,
+	slug string,
+	expiresAt *time.Time,
+	assigned int,
+) (int, error) {
+	bs.once.Do(func() {
+		close(bs.started)
+		<-bs.release
+	})
+	return bs.Repository.TopUpSegment(ctx, fraction, slug, expiresAt, assigned)
+}
+
+func TestRollbackDuringAdvance(t *testing.T) {
+	env := newTestEnv(t)
+	segments := &blockingSegments{
+		Repository: env.segments,
+		started:    make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	runner := NewRunner(env.ramp, segments, env.cfg)
+	ctx := context.Background()
+
+	env.newPlan(t, "RAMPED", Step{At: time.Now().UTC().Add(-time.Hour), TargetPercent: 30})
+
+	done := make(chan error)
+	go func() { done <- runner.Advance(ctx) }()
+
+	// the runner has loaded the plan as active and is about to top it up
+	<-segments.started
+	if _, err := env.ramp.SetStatus(ctx, "RAMPED", StatusRolledBack, 5); err != nil {
+		t.Fatal(err)
+	}
+	close(segments.release)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	env.expectMembers(t, "RAMPED", 5)
+
+	plan, err := env.ramp.GetPlan(ctx, "RAMPED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Status != StatusRolledBack || plan.Stage != 0 || plan.RollbackPercent != nil {
+		t.Fatalf("plan is %s at stage %d with rollback percent %v, expected a finished rollback at stage 0",
+			plan.Status, plan.Stage, plan.RollbackPercent)
+	}
+}
@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// MemoryLimiter keeps the buckets of a single replica in memory.
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+func (ml *MemoryLimiter) Allow(_ context.Context, key string, rule Rule) (bool, time.Duration, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	now := ml.now()
+	ml.sweep(now)
+
+	b, ok := ml.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rule.Burst), last: now}
+		ml.buckets[key] = b
+	}
+
+	var wait time.Duration
+	b.tokens, wait = refill(b.tokens, now.Sub(b.last), rule)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, wait, nil
+	}
+	b.tokens--
+	return true, 0, nil
+}
+
+// sweep forgets buckets idle for longer than the sweep interval. A forgotten
+// bucket starts full again, which is where any rule refilling at least one
+// burst per interval would have brought it anyway.
+func (ml *MemoryLimiter) sweep(now time.Time) {
+	if now.Sub(ml.lastSweep) < sweepInterval {
+		return
+	}
+	for key, b := range ml.buckets {
+		if now.Sub(b.last) > sweepInterval {
+			delete(ml.buckets, key)
+		}
+	}
+	ml.lastSweep = now
+}
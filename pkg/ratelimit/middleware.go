@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"usersegmentator/config"
+	"usersegmentator/pkg/auth"
+	"usersegmentator/pkg/logging"
+
+	"github.com/gorilla/mux"
+)
+
+// Middleware limits requests per client and per endpoint. Clients are
+// identified by their API key or user, anonymous ones by IP address.
+// IPHandler additionally limits every IP address before authentication, so
+// that credentials cannot be tried at an unlimited rate.
+type Middleware struct {
+	limiter   Limiter
+	enabled   bool
+	fallback  Rule
+	endpoints map[string]Rule
+	perIP     Rule
+	Logger    *slog.Logger
+}
+
+func NewMiddleware(limiter Limiter, cfg *config.Config) *Middleware {
+	m := &Middleware{
+		limiter:   limiter,
+		enabled:   cfg.RateLimit.Enabled,
+		fallback:  Rule{Rate: cfg.RateLimit.Default.Rate, Burst: cfg.RateLimit.Default.Burst},
+		endpoints: make(map[string]Rule, len(cfg.RateLimit.Endpoints)),
+		perIP:     Rule{Rate: cfg.RateLimit.PerIP.Rate, Burst: cfg.RateLimit.PerIP.Burst},
+		Logger:    logging.For("rate_limit"),
+	}
+	for endpoint, rule := range cfg.RateLimit.Endpoints {
+		m.endpoints[endpoint] = Rule{Rate: rule.Rate, Burst: rule.Burst}
+	}
+	return m
+}
+
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		endpoint := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				endpoint = template
+			}
+		}
+
+		rule, ok := m.endpoints[endpoint]
+		if !ok {
+			rule = m.fallback
+		}
+
+		m.limit(w, r, next, auth.ClientKey(r)+":"+endpoint, rule)
+	})
+}
+
+// IPHandler limits the requests of each IP address across all endpoints.
+func (m *Middleware) IPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.enabled || m.perIP.Burst == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		m.limit(w, r, next, auth.IPKey(r), m.perIP)
+	})
+}
+
+// limit serves r if the bucket identified by key has a token left and
+// responds 429 Too Many Requests otherwise.
+func (m *Middleware) limit(w http.ResponseWriter, r *http.Request, next http.Handler, key string, rule Rule) {
+	allowed, wait, err := m.limiter.Allow(r.Context(), key, rule)
+	if err != nil {
+		// an unavailable limiter must not take the whole API down
+		m.Logger.ErrorContext(r.Context(), "rate limiter unavailable", logging.Err(err))
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	next.ServeHTTP(w, r)
+}
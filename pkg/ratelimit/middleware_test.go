@@ -0,0 +1,159 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/auth"
+
+	"github.com/gorilla/mux"
+)
+
+func rateLimitConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.RateLimit.Enabled = true
+	cfg.RateLimit.Default = config.RateLimitRule{Rate: 1, Burst: 3}
+	cfg.RateLimit.PerIP = config.RateLimitRule{Rate: 1, Burst: 5}
+	cfg.RateLimit.Endpoints = map[string]config.RateLimitRule{
+		"/users/{id}": {Rate: 0.5, Burst: 1},
+	}
+	return cfg
+}
+
+// newTestRouter limits per IP address and then per client, like the
+// service. Requests with an X-Principal header are served as that principal.
+func newTestRouter(cfg *config.Config, limiter Limiter) http.Handler {
+	m := NewMiddleware(limiter, cfg)
+
+	authenticate := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if name := r.Header.Get("X-Principal"); name != "" {
+				r = r.WithContext(auth.WithPrincipal(r.Context(), &auth.Principal{Name: name}))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	ok := func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	r := mux.NewRouter()
+	r.Use(m.IPHandler, authenticate, m.Handler)
+	r.HandleFunc("/segments", ok)
+	r.HandleFunc("/users/{id}", ok)
+	return r
+}
+
+func request(h http.Handler, path, ip, principal string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+	req.RemoteAddr = ip + ":1234"
+	if principal != "" {
+		req.Header.Set("X-Principal", principal)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int, retryAfter string) {
+	t.Helper()
+
+	if w.Code != status {
+		t.Fatalf("status %d, expected %d", w.Code, status)
+	}
+	if got := w.Header().Get("Retry-After"); got != retryAfter {
+		t.Fatalf("Retry-After %q, expected %q", got, retryAfter)
+	}
+}
+
+func newLimitedRouter(t *testing.T, cfg *config.Config) (http.Handler, *clock) {
+	c := newClock()
+	return newTestRouter(cfg, memoryLimiter(t, c)), c
+}
+
+func TestHandlerLimitsClients(t *testing.T) {
+	h, c := newLimitedRouter(t, rateLimitConfig())
+
+	for i := 0; i < 3; i++ {
+		expectStatus(t, request(h, "/segments", "10.0.0.1", "alice"), http.StatusOK, "")
+	}
+	expectStatus(t, request(h, "/segments", "10.0.0.1", "alice"), http.StatusTooManyRequests, "1")
+
+	// other clients have their own buckets, even from the same address
+	expectStatus(t, request(h, "/segments", "10.0.0.1", "bob"), http.StatusOK, "")
+
+	c.Advance(time.Second)
+	expectStatus(t, request(h, "/segments", "10.0.0.1", "alice"), http.StatusOK, "")
+}
+
+func TestHandlerAppliesEndpointRules(t *testing.T) {
+	h, c := newLimitedRouter(t, rateLimitConfig())
+
+	expectStatus(t, request(h, "/users/1", "10.0.0.1", "alice"), http.StatusOK, "")
+	// the rule is shared by every path of the route, and Retry-After is rounded up
+	c.Advance(500 * time.Millisecond)
+	expectStatus(t, request(h, "/users/2", "10.0.0.1", "alice"), http.StatusTooManyRequests, "2")
+
+	// other endpoints keep the default rule
+	expectStatus(t, request(h, "/segments", "10.0.0.1", "alice"), http.StatusOK, "")
+}
+
+func TestIPHandlerLimitsAddresses(t *testing.T) {
+	h, _ := newLimitedRouter(t, rateLimitConfig())
+
+	// the per-IP limit covers every client and endpoint behind the address
+	for i, principal := range []string{"a", "b", "c", "d", ""} {
+		path := []string{"/segments", "/users/1"}[i%2]
+		expectStatus(t, request(h, path, "10.0.0.1", principal), http.StatusOK, "")
+	}
+	expectStatus(t, request(h, "/segments", "10.0.0.1", "e"), http.StatusTooManyRequests, "1")
+
+	expectStatus(t, request(h, "/segments", "10.0.0.2", "e"), http.StatusOK, "")
+}
+
+func TestIPHandlerWithoutRule(t *testing.T) {
+	cfg := rateLimitConfig()
+	cfg.RateLimit.PerIP = config.RateLimitRule{}
+	h, _ := newLimitedRouter(t, cfg)
+
+	for _, principal := range []string{"a", "b", "c", "d", "e", "f"} {
+		expectStatus(t, request(h, "/segments", "10.0.0.1", principal), http.StatusOK, "")
+	}
+}
+
+func TestMiddlewareDisabled(t *testing.T) {
+	cfg := rateLimitConfig()
+	cfg.RateLimit.Enabled = false
+	h, _ := newLimitedRouter(t, cfg)
+
+	for i := 0; i < 10; i++ {
+		expectStatus(t, request(h, "/users/1", "10.0.0.1", "alice"), http.StatusOK, "")
+	}
+}
+
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(context.Context, string, Rule) (bool, time.Duration, error) {
+	return false, 0, errors.New("redis unavailable")
+}
+
+func TestMiddlewareFailsOpen(t *testing.T) {
+	h := newTestRouter(rateLimitConfig(), failingLimiter{})
+
+	for i := 0; i < 10; i++ {
+		expectStatus(t, request(h, "/users/1", "10.0.0.1", "alice"), http.StatusOK, "")
+	}
+}
+
+func TestRedisLimiterResponds429(t *testing.T) {
+	c := newClock()
+	h := newTestRouter(rateLimitConfig(), redisLimiter(t, c))
+
+	expectStatus(t, request(h, "/users/1", "10.0.0.1", "alice"), http.StatusOK, "")
+	expectStatus(t, request(h, "/users/1", "10.0.0.1", "alice"), http.StatusTooManyRequests, "2")
+
+	c.Advance(2 * time.Second)
+	expectStatus(t, request(h, "/users/1", "10.0.0.1", "alice"), http.StatusOK, "")
+}
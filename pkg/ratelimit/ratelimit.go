@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+	"usersegmentator/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	BackendMemory = "memory"
+	BackendRedis  = "redis"
+)
+
+// Rule is a token bucket refilled with Rate tokens per second up to Burst.
+type Rule struct {
+	Rate  float64
+	Burst int
+}
+
+// Limiter takes one token from the bucket identified by key. When the bucket
+// is empty it reports how long to wait for the next token.
+type Limiter interface {
+	Allow(ctx context.Context, key string, rule Rule) (bool, time.Duration, error)
+}
+
+func NewLimiter(cfg *config.Config) (Limiter, error) {
+	switch cfg.RateLimit.Backend {
+	case BackendMemory:
+		return NewMemoryLimiter(), nil
+	case BackendRedis:
+		return NewRedisLimiter(redis.NewClient(&redis.Options{
+			Addr:     cfg.RateLimit.RedisAddr,
+			Password: cfg.RateLimit.RedisPassword,
+		})), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit backend: %s", cfg.RateLimit.Backend)
+	}
+}
+
+// refill returns the tokens in a bucket after elapsed time and, if no whole
+// token is available, the wait until there is one.
+func refill(tokens float64, elapsed time.Duration, rule Rule) (float64, time.Duration) {
+	tokens = math.Min(float64(rule.Burst), tokens+elapsed.Seconds()*rule.Rate)
+	if tokens >= 1 || rule.Rate <= 0 {
+		return tokens, 0
+	}
+	return tokens, time.Duration((1 - tokens) / rule.Rate * float64(time.Second))
+}
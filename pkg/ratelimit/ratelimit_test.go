@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// clock is a manually advanced time source.
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newClock() *clock {
+	return &clock{now: time.Date(2023, 8, 31, 12, 0, 0, 0, time.UTC)}
+}
+
+type limiterFactory func(t *testing.T, c *clock) Limiter
+
+func memoryLimiter(_ *testing.T, c *clock) Limiter {
+	ml := NewMemoryLimiter()
+	ml.now = c.Now
+	ml.lastSweep = c.Now()
+	return ml
+}
+
+func redisLimiter(t *testing.T, c *clock) Limiter {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+
+	rl := NewRedisLimiter(client)
+	rl.now = c.Now
+	return rl
+}
+
+var limiters = map[string]limiterFactory{
+	"memory": memoryLimiter,
+	"redis":  redisLimiter,
+}
+
+func expectAllow(t *testing.T, l Limiter, key string, rule Rule, allowed bool, wait time.Duration) {
+	t.Helper()
+
+	gotAllowed, gotWait, err := l.Allow(context.Background(), key, rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotAllowed != allowed || gotWait != wait {
+		t.Fatalf("Allow(%s) = %v, %s; expected %v, %s", key, gotAllowed, gotWait, allowed, wait)
+	}
+}
+
+func TestLimiterBurstAndRefill(t *testing.T) {
+	rule := Rule{Rate: 2, Burst: 3}
+
+	for name, newLimiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			c := newClock()
+			l := newLimiter(t, c)
+
+			for i := 0; i < rule.Burst; i++ {
+				expectAllow(t, l, "client", rule, true, 0)
+			}
+			expectAllow(t, l, "client", rule, false, 500*time.Millisecond)
+
+			c.Advance(200 * time.Millisecond)
+			expectAllow(t, l, "client", rule, false, 300*time.Millisecond)
+
+			c.Advance(300 * time.Millisecond)
+			expectAllow(t, l, "client", rule, true, 0)
+			expectAllow(t, l, "client", rule, false, 500*time.Millisecond)
+
+			// the bucket does not grow past the burst
+			c.Advance(time.Hour)
+			for i := 0; i < rule.Burst; i++ {
+				expectAllow(t, l, "client", rule, true, 0)
+			}
+			expectAllow(t, l, "client", rule, false, 500*time.Millisecond)
+		})
+	}
+}
+
+func TestLimiterKeysAreIndependent(t *testing.T) {
+	rule := Rule{Rate: 1, Burst: 1}
+
+	for name, newLimiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			l := newLimiter(t, newClock())
+
+			expectAllow(t, l, "first", rule, true, 0)
+			expectAllow(t, l, "first", rule, false, time.Second)
+			expectAllow(t, l, "second", rule, true, 0)
+		})
+	}
+}
+
+func TestMemoryLimiterSweepsIdleBuckets(t *testing.T) {
+	c := newClock()
+	ml := memoryLimiter(t, c).(*MemoryLimiter)
+	rule := Rule{Rate: 1, Burst: 1}
+
+	expectAllow(t, ml, "idle", rule, true, 0)
+	c.Advance(2 * sweepInterval)
+	expectAllow(t, ml, "active", rule, true, 0)
+
+	if _, ok := ml.buckets["idle"]; ok {
+		t.Fatal("idle bucket not swept")
+	}
+	if _, ok := ml.buckets["active"]; !ok {
+		t.Fatal("active bucket swept")
+	}
+}
@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const keyPrefix = "ratelimit:"
+
+// tokenBucketScript atomically refills and takes a token from a bucket
+// stored as a hash. It returns {allowed, wait in milliseconds}.
+const tokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1]) or burst
+local last = tonumber(state[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - last) / 1000 * rate)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+elseif rate > 0 then
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', now)
+if rate > 0 then
+	redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+end
+return {allowed, wait}
+`
+
+// RedisLimiter shares buckets between replicas through Redis.
+type RedisLimiter struct {
+	client *redis.Client
+	script *redis.Script
+	now    func() time.Time
+}
+
+func NewRedisLimiter(client *redis.Client) *RedisLimiter {
+	return &RedisLimiter{
+		client: client,
+		script: redis.NewScript(tokenBucketScript),
+		now:    time.Now,
+	}
+}
+
+func (rl *RedisLimiter) Allow(ctx context.Context, key string, rule Rule) (bool, time.Duration, error) {
+	result, err := rl.script.Run(
+		ctx,
+		rl.client,
+		[]string{keyPrefix + key},
+		strconv.FormatFloat(rule.Rate, 'f', -1, 64),
+		rule.Burst,
+		rl.now().UnixMilli(),
+	).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
@@ -0,0 +1,110 @@
+package repotest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"path/filepath"
+	"usersegmentator/config"
+	"usersegmentator/pkg/cache"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/history"
+	"usersegmentator/pkg/migrate"
+	"usersegmentator/pkg/segment"
+)
+
+const (
+	sqliteConnTimeout = 5
+	cacheSize         = 1000
+	cacheTTL          = 60
+)
+
+// MemoryOpener opens in-memory repositories. With cached set, user segments
+// are read through an in-memory cache.
+func MemoryOpener(cached bool) Opener {
+	return func(context.Context) (*Repositories, func(), error) {
+		cfg := &config.Config{}
+		broker := events.NewBroker(cfg)
+		segments := segment.NewMemoryRepo(cfg, broker, nil)
+		for id := 1; id <= Users; id++ {
+			segments.AddUsers(id)
+		}
+
+		return &Repositories{
+			Segments: withCache(segments, cfg, broker, cached),
+			History:  history.NewMemoryRepo(segments, cfg, nil),
+		}, func() {}, nil
+	}
+}
+
+// SQLiteOpener opens repositories on a new SQLite database in dir for every check.
+func SQLiteOpener(dir string, cached bool) Opener {
+	opened := 0
+	return func(ctx context.Context) (*Repositories, func(), error) {
+		opened++
+		cfg := &config.Config{}
+		cfg.Database.Backend = dialect.SQLite
+		cfg.Database.Timeout = sqliteConnTimeout
+		cfg.SQLite.Path = filepath.Join(dir, fmt.Sprintf("check%d.db", opened))
+		return sqlOpen(ctx, cfg, cached)
+	}
+}
+
+// ServerOpener opens repositories on the MySQL or PostgreSQL database of cfg.
+// Its schema is migrated down and up again before every check, so it must be
+// a disposable one.
+func ServerOpener(cfg *config.Config, cached bool) Opener {
+	return func(ctx context.Context) (*Repositories, func(), error) {
+		return sqlOpen(ctx, cfg, cached)
+	}
+}
+
+// sqlOpen recreates the schema from the migrations and seeds the users.
+func sqlOpen(ctx context.Context, cfg *config.Config, cached bool) (*Repositories, func(), error) {
+	db, err := dialect.Open(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = resetSchema(ctx, db, cfg)
+	if err != nil {
+		_ = db.Close()
+		return nil, nil, err
+	}
+
+	broker := events.NewBroker(cfg)
+	return &Repositories{
+		Segments: withCache(segment.NewSegmentsRepo(db, cfg, broker, nil), cfg, broker, cached),
+		History:  history.NewHistoryRepo(db, cfg, nil),
+	}, func() { _ = db.Close() }, nil
+}
+
+func withCache(repo segment.Repository, cfg *config.Config, broker *events.Broker, cached bool) segment.Repository {
+	if !cached {
+		return repo
+	}
+	cacheCfg := *cfg
+	cacheCfg.Cache.TTL = cacheTTL
+	return segment.NewCachedRepo(repo, cache.NewMemoryCache(cacheSize), &cacheCfg, broker, nil)
+}
+
+func resetSchema(ctx context.Context, db *sql.DB, cfg *config.Config) error {
+	migrator, err := migrate.NewMigrator(db, cfg)
+	if err != nil {
+		return err
+	}
+
+	err = migrator.Down(ctx, math.MaxInt)
+	if err != nil {
+		return err
+	}
+	err = migrator.Up(ctx, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = migrate.SeedUsers(ctx, db, cfg, 1, Users)
+	return err
+}
@@ -0,0 +1,936 @@
+// Package repotest checks that segment.Repository and history.Repository
+// implementations behave alike, whatever storage they are backed by.
+package repotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/history"
+	"usersegmentator/pkg/segment"
+)
+
+// Users is the number of active users, with IDs 1 to Users, that an Opener
+// must create.
+const Users = 100
+
+const (
+	slugA = "AVITO_VOICE_MESSAGES"
+	slugB = "AVITO_PERFORMANCE_VAS"
+	slugC = "AVITO_DISCOUNT_30"
+)
+
+type Repositories struct {
+	Segments segment.Repository
+	History  history.Repository
+}
+
+// Opener returns repositories sharing one storage that holds nothing but the
+// users, and a function releasing them.
+type Opener func(ctx context.Context) (*Repositories, func(), error)
+
+type check struct {
+	name string
+	run  func(ctx context.Context, repos *Repositories) error
+}
+
+var checks = []check{
+	{"insert segment", checkInsertSegment},
+	{"assign segments", checkAssignSegments},
+	{"unknown segment or user", checkUnknown},
+	{"unassign segments", checkUnassignSegments},
+	{"batch user segments", checkUsersSegments},
+	{"batch user segments expiry", checkUsersSegmentsExpiry},
+	{"delete and reactivate segment", checkDeleteSegment},
+	{"ttl", checkTTL},
+	{"reassign active membership", checkReassign},
+	{"update expiry", checkUpdateExpiry},
+	{"expire memberships", checkExpireMemberships},
+	{"random users", checkRandomUsers},
+	{"auto assign", checkAutoAssign},
+	{"top up and trim", checkTopUpAndTrim},
+	{"dry run", checkDryRun},
+	{"change sets", checkChangeSets},
+	{"snapshot version", checkSnapshotVersion},
+	{"user history", checkUserHistory},
+}
+
+// Run runs every check on repositories from a fresh open and returns the
+// failed ones joined.
+func Run(ctx context.Context, open Opener) error {
+	var failures []error
+	for _, c := range checks {
+		repos, closeRepos, err := open(ctx)
+		if err != nil {
+			return fmt.Errorf("opening repositories: %w", err)
+		}
+
+		err = c.run(ctx, repos)
+		closeRepos()
+		if err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", c.name, err))
+		}
+	}
+	return errors.Join(failures...)
+}
+
+// expectSegments fails unless the user is in exactly the expected segments.
+func expectSegments(ctx context.Context, repos *Repositories, userID int, expected ...string) error {
+	userSegments, err := repos.Segments.GetUserSegments(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if expected == nil {
+		expected = []string{}
+	}
+	if !reflect.DeepEqual(userSegments.Segments, expected) {
+		return fmt.Errorf("user %d segments are %v, expected %v", userID, userSegments.Segments, expected)
+	}
+	return nil
+}
+
+func insertSegments(ctx context.Context, repos *Repositories, slugs ...string) error {
+	for _, slug := range slugs {
+		err := repos.Segments.InsertSegment(ctx, slug, "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkInsertSegment(ctx context.Context, repos *Repositories) error {
+	if err := repos.Segments.InsertSegment(ctx, "", ""); err == nil {
+		return fmt.Errorf("empty slug accepted")
+	}
+
+	err := repos.Segments.InsertSegment(ctx, slugA, "team-a")
+	if err != nil {
+		return err
+	}
+	first, err := repos.Segments.GetSegmentsIDs(ctx, []string{slugA})
+	if err != nil {
+		return err
+	}
+
+	err = repos.Segments.InsertSegment(ctx, slugA, "team-b")
+	if err != nil {
+		return fmt.Errorf("inserting an existing segment: %w", err)
+	}
+	second, err := repos.Segments.GetSegmentsIDs(ctx, []string{slugA})
+	if err != nil {
+		return err
+	}
+	if first[0] != second[0] {
+		return fmt.Errorf("inserting an existing segment changed its id from %d to %d", first[0], second[0])
+	}
+
+	err = repos.Segments.InsertSegment(ctx, slugB, "")
+	if err != nil {
+		return err
+	}
+
+	owners, err := repos.Segments.GetSegmentsOwners(ctx, []string{slugA, slugB, slugC})
+	if err != nil {
+		return err
+	}
+	expected := map[string]string{slugA: "team-a", slugB: ""}
+	if !reflect.DeepEqual(owners, expected) {
+		return fmt.Errorf("owners are %v, expected %v", owners, expected)
+	}
+	return nil
+}
+
+func checkAssignSegments(ctx context.Context, repos *Repositories) error {
+	err := insertSegments(ctx, repos, slugA, slugB, slugC)
+	if err != nil {
+		return err
+	}
+
+	err = repos.Segments.AssignSegments(ctx, []int{1, 2}, []string{slugB, slugA}, nil)
+	if err != nil {
+		return err
+	}
+	err = repos.Segments.AssignSegments(ctx, []int{2}, []string{slugC}, nil)
+	if err != nil {
+		return err
+	}
+	err = repos.Segments.AssignSegments(ctx, []int{3}, []string{}, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = expectSegments(ctx, repos, 1, slugB, slugA); err != nil {
+		return err
+	}
+	if err = expectSegments(ctx, repos, 2, slugC, slugB, slugA); err != nil {
+		return err
+	}
+	return expectSegments(ctx, repos, 3)
+}
+
+func checkUnknown(ctx context.Context, repos *Repositories) error {
+	err := insertSegments(ctx, repos, slugA)
+	if err != nil {
+		return err
+	}
+
+	if err = repos.Segments.AssignSegments(ctx, []int{1}, []string{slugA, slugC}, nil); err == nil {
+		return fmt.Errorf("assigned an unknown segment")
+	}
+	if err = repos.Segments.UnassignSegments(ctx, []int{1}, []string{slugC}); err == nil {
+		return fmt.Errorf("unassigned an unknown segment")
+	}
+	if err = repos.Segments.DeleteSegment(ctx, slugC); err == nil {
+		return fmt.Errorf("deleted an unknown segment")
+	}
+	if err = repos.Segments.AssignSegments(ctx, []int{1, Users + 1}, []string{slugA}, nil); err == nil {
+		return fmt.Errorf("assigned an unknown user")
+	}
+
+	// failed calls must not leave partial assignments behind
+	return expectSegments(ctx, repos, 1)
+}
+
+func checkUnassignSegments(ctx context.Context, repos *Repositories) error {
+	err := insertSegments(ctx, repos, slugA, slugB)
+	if err != nil {
+		return err
+	}
+
+	err = repos.Segments.AssignSegments(ctx, []int{1, 2}, []string{slugA, slugB}, nil)
+	if err != nil {
+		return err
+	}
+	err = repos.Segments.UnassignSegments(ctx, []int{1, 3}, []string{slugA})
+	if err != nil {
+		return err
+	}
+
+	if err = expectSegments(ctx, repos, 1, slugB); err != nil {
+		return err
+	}
+	if err = expectSegments(ctx, repos, 2, slugB, slugA); err != nil {
+		return err
+	}
+
+	// a user can come back to a segment after leaving it
+	err = repos.Segments.AssignSegments(ctx, []int{1}, []string{slugA}, nil)
+	if err != nil {
+		return err
+	}
+	return expectSegments(ctx, repos, 1, slugB, slugA)
+}
+
+func checkUsersSegments(ctx context.Context, repos *Repositories) error {
+	err := insertSegments(ctx, repos, slugA, slugB)
+	if err != nil {
+		return err
+	}
+
+	err = repos.Segments.AssignSegments(ctx, []int{1, 2}, []string{slugA}, nil)
+	if err != nil {
+		return err
+	}
+	err = repos.Segments.AssignSegments(ctx, []int{2}, []string{slugB}, nil)
+	if err != nil {
+		return err
+	}
+
+	expected := &segment.BatchUserSegments{
+		Users:        map[int][]string{1: {slugA}, 2: {slugB, slugA}, 3: {}},
+		UnknownUsers: []int{Users + 1},
+	}
+	if err = expectUsersSegments(ctx, repos, []int{2, 1, Users + 1, 3, 2}, expected); err != nil {
+		return err
+	}
+
+	err = repos.Segments.UnassignSegments(ctx, []int{1}, []string{slugA})
+	if err != nil {
+		return err
+	}
+	expected.Users[1] = []string{}
+	return expectUsersSegments(ctx, repos, []int{2, 1, Users + 1, 3, 2}, expected)
+}
+
+func expectUsersSegments(ctx context.Context, repos *Repositories, userIDs []int,
+	expected *segment.BatchUserSegments) error {
+	batch, err := repos.Segments.GetUsersSegments(ctx, userIDs)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(batch, expected) {
+		return fmt.Errorf("users %v segments are %+v, expected %+v", userIDs, batch, expected)
+	}
+	return nil
+}
+
+func checkDeleteSegment(ctx context.Context, repos *Repositories) error {
+	err := insertSegments(ctx, repos, slugA, slugB)
+	if err != nil {
+		return err
+	}
+
+	err = repos.Segments.AssignSegments(ctx, []int{1, 2, 3}, []string{slugA, slugB}, nil)
+	if err != nil {
+		return err
+	}
+	err = repos.Segments.DeleteSegment(ctx, slugA)
+	if err != nil {
+		return err
+	}
+
+	if err = expectSegments(ctx, repos, 1, slugB); err != nil {
+		return err
+	}
+	snapshot, err := repos.Segments.GetSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(snapshot.Segments, []string{slugB}) {
+		return fmt.Errorf("snapshot segments are %v after delete, expected [%s]", snapshot.Segments, slugB)
+	}
+
+	// reactivating a segment does not bring its former members back
+	err = repos.Segments.InsertSegment(ctx, slugA, "")
+	if err != nil {
+		return err
+	}
+	if err = expectSegments(ctx, repos, 1, slugB); err != nil {
+		return err
+	}
+	snapshot, err = repos.Segments.GetSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(snapshot.Segments, []string{slugB, slugA}) {
+		return fmt.Errorf("snapshot segments are %v after reactivation, expected [%s %s]", snapshot.Segments, slugB, slugA)
+	}
+	return nil
+}
+
+// checkUsersSegmentsExpiry makes sure that batch reads return the expiries,
+// also to the single reads following them, which a cache may serve.
+func checkUsersSegmentsExpiry(ctx context.Context, repos *Repositories) error {
+	err := insertSegments(ctx, repos, slugA, slugB)
+	if err != nil {
+		return err
+	}
+
+	expiry := time.Now().UTC().Add(36 * time.Hour).Truncate(time.Second)
+	err = repos.Segments.AssignSegments(ctx, []int{1}, []string{slugA}, &expiry)
+	if err != nil {
+		return err
+	}
+	err = repos.Segments.AssignSegments(ctx, []int{1}, []string{slugB}, nil)
+	if err != nil {
+		return err
+	}
+
+	// the second batch may be served from a cache filled by the first one
+	for i := 0; i < 2; i++ {
+		batch, err := repos.Segments.GetUsersSegments(ctx, []int{1, 2})
+		if err != nil {
+			return err
+		}
+		expected := map[int][]string{1: {slugB, slugA}, 2: {}}
+		if !reflect.DeepEqual(batch.Users, expected) {
+			return fmt.Errorf("users segments are %v, expected %v", batch.Users, expected)
+		}
+		expiries := batch.ExpiresAt[1]
+		if len(batch.ExpiresAt) != 1 || len(expiries) != 1 || !expiries[slugA].Equal(expiry) {
+			return fmt.Errorf("users expiries are %v, expected %s for user 1 in %s", batch.ExpiresAt, expiry, slugA)
+		}
+	}
+
+	return expectExpiry(ctx, repos, 1, map[string]time.Time{slugA: expiry})
+}
+
+func checkTTL(ctx context.Context, repos *Repositories) error {
+	err := insertSegments(ctx, repos, slugA, slugB)
+	if err != nil {
+		return err
+	}
+
+	expiry := time.Now().UTC().Add(36 * time.Hour).Truncate(time.Second)
+	err = repos.Segments.AssignSegments(ctx, []int{1}, []string{slugA}, &expiry)
+	if err != nil {
+		return err
+	}
+	err = repos.Segments.AssignSegments(ctx, []int{1}, []string{slugB}, nil)
+	if err != nil {
+		return err
+	}
+	// an expiry in the past yields a membership that has already expired
+	expired := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	err = repos.Segments.AssignSegments(ctx, []int{2}, []string{slugA}, &expired)
+	if err != nil {
+		return err
+	}
+
+	if err = expectSegments(ctx, repos, 1, slugB, slugA); err != nil {
+		return err
+	}
+	if err = expectSegments(ctx, repos, 2); err != nil {
+		return err
+	}
+	if err = expectExpiry(ctx, repos, 1, map[string]time.Time{slugA: expiry}); err != nil {
+		return err
+	}
+
+	snapshot, err := repos.Segments.GetSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	if len(snapshot.Memberships) != 2 {
+		return fmt.Errorf("snapshot has %d memberships, expected 2", len(snapshot.Memberships))
+	}
+
+	for _, membership := range snapshot.Memberships {
+		switch membership.Segment {
+		case slugA:
+			if membership.ExpiresAt == nil || !membership.ExpiresAt.Equal(expiry) {
+				return fmt.Errorf("membership in %s expires at %v, expected %v", slugA, membership.ExpiresAt, expiry)
+			}
+		case slugB:
+			if membership.ExpiresAt != nil {
+				return fmt.Errorf("membership without ttl expires at %v", membership.ExpiresAt)
+			}
+		}
+	}
+	return nil
+}
+
+func checkReassign(ctx context.Context, repos *Repositories) error {
+	err := insertSegments(ctx, repos, slugA, slugB)
+	if err != nil {
+		return err
+	}
+
+	expiry := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	err = repos.Segments.AssignSegments(ctx, []int{1}, []string{slugA}, &expiry)
+	if err != nil {
+		return err
+	}
+	// an active membership is kept as it is while the rest of the call goes on
+	err = repos.Segments.AssignSegments(ctx, []int{1, 2}, []string{slugA, slugB}, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = expectSegments(ctx, repos, 1, slugB, slugA); err != nil {
+		return err
+	}
+	if err = expectSegments(ctx, repos, 2, slugB, slugA); err != nil {
+		return err
+	}
+	return expectExpiry(ctx, repos, 1, map[string]time.Time{slugA: expiry})
+}
+
+func checkUpdateExpiry(ctx context.Context, repos *Repositories) error {
+	err := insertSegments(ctx, repos, slugA, slugB, slugC)
+	if err != nil {
+		return err
+	}
+
+	expiry := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	err = repos.Segments.AssignSegments(ctx, []int{1}, []string{slugA, slugB}, &expiry)
+	if err != nil {
+		return err
+	}
+
+	if _, err = repos.Segments.UpdateSegmentsExpiry(ctx, 1, []string{"AVITO_UNKNOWN"}, nil); err == nil {
+		return fmt.Errorf("updated the expiry in an unknown segment")
+	}
+
+	extended := expiry.Add(24 * time.Hour)
+	updated, err := repos.Segments.UpdateSegmentsExpiry(ctx, 1, []string{slugA, slugC}, &extended)
+	if err != nil {
+		return err
+	}
+	if updated != 1 {
+		return fmt.Errorf("updated %d memberships, expected 1", updated)
+	}
+
+	updated, err = repos.Segments.UpdateSegmentsExpiry(ctx, 1, []string{slugB}, nil)
+	if err != nil {
+		return err
+	}
+	if updated != 1 {
+		return fmt.Errorf("updated %d memberships, expected 1", updated)
+	}
+
+	if err = expectExpiry(ctx, repos, 1, map[string]time.Time{slugA: extended}); err != nil {
+		return err
+	}
+
+	// shortening the expiry into the past ends the membership
+	past := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	_, err = repos.Segments.UpdateSegmentsExpiry(ctx, 1, []string{slugA}, &past)
+	if err != nil {
+		return err
+	}
+	return expectSegments(ctx, repos, 1, slugB)
+}
+
+func checkExpireMemberships(ctx context.Context, repos *Repositories) error {
+	const batchSize = 2
+
+	err := insertSegments(ctx, repos, slugA, slugB)
+	if err != nil {
+		return err
+	}
+
+	past := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	future := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	err = repos.Segments.AssignSegments(ctx, []int{1, 2, 3}, []string{slugA}, &past)
+	if err != nil {
+		return err
+	}
+	err = repos.Segments.AssignSegments(ctx, []int{4}, []string{slugA}, &future)
+	if err != nil {
+		return err
+	}
+
+	for _, want := range []int{batchSize, 1, 0} {
+		expired, err := repos.Segments.ExpireMemberships(ctx, batchSize)
+		if err != nil {
+			return err
+		}
+		if expired != want {
+			return fmt.Errorf("expired %d memberships in a batch, expected %d", expired, want)
+		}
+	}
+
+	err = repos.Segments.AssignSegments(ctx, []int{5, 6, 7, 8, 9}, []string{slugB}, &past)
+	if err != nil {
+		return err
+	}
+	cfg := &config.Config{}
+	cfg.Segment.TTLBatchSize = batchSize
+	expired, err := segment.NewTTLWorker(repos.Segments, cfg, nil).RunOnce(ctx)
+	if err != nil {
+		return err
+	}
+	if expired != 5 {
+		return fmt.Errorf("TTL worker expired %d memberships, expected 5", expired)
+	}
+
+	snapshot, err := repos.Segments.GetSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	if len(snapshot.Memberships) != 1 || snapshot.Memberships[0].UserID != 4 {
+		return fmt.Errorf("snapshot memberships are %+v after expiry, expected only user 4", snapshot.Memberships)
+	}
+	return nil
+}
+
+func expectExpiry(ctx context.Context, repos *Repositories, userID int, expected map[string]time.Time) error {
+	userSegments, err := repos.Segments.GetUserSegments(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if len(userSegments.ExpiresAt) != len(expected) {
+		return fmt.Errorf("user %d expiries are %v, expected %v", userID, userSegments.ExpiresAt, expected)
+	}
+	for slug, expiry := range expected {
+		if actual, ok := userSegments.ExpiresAt[slug]; !ok || !actual.Equal(expiry) {
+			return fmt.Errorf("user %d expiries are %v, expected %v", userID, userSegments.ExpiresAt, expected)
+		}
+	}
+	return nil
+}
+
+func checkRandomUsers(ctx context.Context, repos *Repositories) error {
+	const members = 10
+
+	amount, err := repos.Segments.GetActiveUsersAmount(ctx)
+	if err != nil {
+		return err
+	}
+	if amount != Users {
+		return fmt.Errorf("%d active users, expected %d", amount, Users)
+	}
+
+	err = insertSegments(ctx, repos, slugA)
+	if err != nil {
+		return err
+	}
+	memberIDs := make([]int, 0, members)
+	for id := 1; id <= members; id++ {
+		memberIDs = append(memberIDs, id)
+	}
+	err = repos.Segments.AssignSegments(ctx, memberIDs, []string{slugA}, nil)
+	if err != nil {
+		return err
+	}
+
+	users, err := repos.Segments.GetNRandomUsersWithoutSegment(ctx, Users, slugA)
+	if err != nil {
+		return err
+	}
+	if len(users) != Users-members {
+		return fmt.Errorf("%d users without segment, expected %d", len(users), Users-members)
+	}
+	seen := map[int]bool{}
+	for _, id := range users {
+		if id <= members || seen[id] {
+			return fmt.Errorf("user %d returned twice or already in the segment", id)
+		}
+		seen[id] = true
+	}
+
+	users, err = repos.Segments.GetNRandomUsersWithoutSegment(ctx, members/2, slugA)
+	if err != nil {
+		return err
+	}
+	if len(users) != members/2 {
+		return fmt.Errorf("%d users returned, expected %d", len(users), members/2)
+	}
+	return nil
+}
+
+func checkAutoAssign(ctx context.Context, repos *Repositories) error {
+	const fraction = 10
+
+	err := insertSegments(ctx, repos, slugA)
+	if err != nil {
+		return err
+	}
+
+	if err = repos.Segments.AutoAssignSegment(ctx, 0, slugA, nil); err == nil {
+		return fmt.Errorf("zero fraction accepted")
+	}
+
+	for round := 1; round <= 2; round++ {
+		err = repos.Segments.AutoAssignSegment(ctx, fraction, slugA, nil)
+		if err != nil {
+			return err
+		}
+
+		snapshot, err := repos.Segments.GetSnapshot(ctx)
+		if err != nil {
+			return err
+		}
+		// each round picks users that are not in the segment yet
+		if expected := round * Users * fraction / 100; len(snapshot.Memberships) != expected {
+			return fmt.Errorf("%d members after round %d, expected %d", len(snapshot.Memberships), round, expected)
+		}
+	}
+	return nil
+}
+
+func checkTopUpAndTrim(ctx context.Context, repos *Repositories) error {
+	const members = 5
+
+	err := insertSegments(ctx, repos, slugA, slugB)
+	if err != nil {
+		return err
+	}
+	err = repos.Segments.AssignSegments(ctx, []int{1, 2, 3, 4, 5}, []string{slugA}, nil)
+	if err != nil {
+		return err
+	}
+
+	// the existing members count towards the target, whoever assigned them
+	for _, step := range []struct {
+		fraction, assigned int
+	}{{10, Users/10 - members}, {10, 0}, {30, Users * 20 / 100}} {
+		assigned, err := repos.Segments.TopUpSegment(ctx, step.fraction, slugA, nil, 0)
+		if err != nil {
+			return err
+		}
+		if assigned != step.assigned {
+			return fmt.Errorf("top up to %d%% assigned %d, expected %d", step.fraction, assigned, step.assigned)
+		}
+	}
+	if err = expectMembers(ctx, repos, slugA, Users*30/100); err != nil {
+		return err
+	}
+
+	// so do the users assigned before by the caller, even once they have left
+	err = repos.Segments.UnassignSegments(ctx, []int{1, 2, 3, 4, 5}, []string{slugA})
+	if err != nil {
+		return err
+	}
+	assigned, err := repos.Segments.TopUpSegment(ctx, 30, slugA, nil, Users*30/100)
+	if err != nil {
+		return err
+	}
+	if assigned != 0 {
+		return fmt.Errorf("top up replaced %d members that have left", assigned)
+	}
+	assigned, err = repos.Segments.TopUpSegment(ctx, 40, slugA, nil, Users*30/100)
+	if err != nil {
+		return err
+	}
+	if assigned != Users/10 {
+		return fmt.Errorf("top up to 40%% assigned %d, expected %d", assigned, Users/10)
+	}
+	if err = expectMembers(ctx, repos, slugA, Users*35/100); err != nil {
+		return err
+	}
+
+	for _, step := range []struct {
+		fraction, unassigned int
+	}{{10, Users * 25 / 100}, {10, 0}, {0, Users / 10}} {
+		unassigned, err := repos.Segments.TrimSegment(ctx, step.fraction, slugA)
+		if err != nil {
+			return err
+		}
+		if unassigned != step.unassigned {
+			return fmt.Errorf("trim to %d%% unassigned %d, expected %d", step.fraction, unassigned, step.unassigned)
+		}
+	}
+	if err = expectMembers(ctx, repos, slugA, 0); err != nil {
+		return err
+	}
+
+	err = repos.Segments.DeleteSegment(ctx, slugB)
+	if err != nil {
+		return err
+	}
+	if _, err = repos.Segments.TopUpSegment(ctx, 10, slugB, nil, 0); err == nil {
+		return fmt.Errorf("topped up a deleted segment")
+	}
+	if _, err = repos.Segments.TopUpSegment(ctx, 101, slugA, nil, 0); err == nil {
+		return fmt.Errorf("target above 100%% accepted")
+	}
+	return nil
+}
+
+func expectMembers(ctx context.Context, repos *Repositories, slug string, expected int) error {
+	amount, err := repos.Segments.GetSegmentMembersAmount(ctx, slug)
+	if err != nil {
+		return err
+	}
+	if amount != expected {
+		return fmt.Errorf("%d members in %s, expected %d", amount, slug, expected)
+	}
+	return nil
+}
+
+func checkDryRun(ctx context.Context, repos *Repositories) error {
+	err := insertSegments(ctx, repos, slugA)
+	if err != nil {
+		return err
+	}
+	err = repos.Segments.AssignSegments(ctx, []int{1, 2}, []string{slugA}, nil)
+	if err != nil {
+		return err
+	}
+	before, err := repos.Segments.GetSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	// a segment created in a dry run can be rolled out in the same dry run
+	diff, err := repos.Segments.DryRun(ctx, func(repo segment.Repository) error {
+		err := repo.InsertSegment(ctx, slugC, "")
+		if err != nil {
+			return err
+		}
+		return repo.AutoAssignSegment(ctx, 10, slugC, nil)
+	})
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(diff.CreatedSegments, []string{slugC}) || diff.Assigned != Users/10 || len(diff.Changes) != Users/10 {
+		return fmt.Errorf("rollout dry run created %v and assigned %d, expected [%s] and %d",
+			diff.CreatedSegments, diff.Assigned, slugC, Users/10)
+	}
+
+	diff, err = repos.Segments.DryRun(ctx, func(repo segment.Repository) error {
+		return repo.DeleteSegment(ctx, slugA)
+	})
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(diff.DeletedSegments, []string{slugA}) || diff.Unassigned != 2 {
+		return fmt.Errorf("delete dry run deleted %v and unassigned %d, expected [%s] and 2",
+			diff.DeletedSegments, diff.Unassigned, slugA)
+	}
+
+	diff, err = repos.Segments.DryRun(ctx, func(repo segment.Repository) error {
+		err := repo.AssignSegments(ctx, []int{1, 3}, []string{slugA}, nil)
+		if err != nil {
+			return err
+		}
+		return repo.UnassignSegments(ctx, []int{2}, []string{slugA})
+	})
+	if err != nil {
+		return err
+	}
+	expected := []segment.Change{
+		{Type: events.TypeAssigned, UserID: 3, Segment: slugA},
+		{Type: events.TypeUnassigned, UserID: 2, Segment: slugA},
+	}
+	if !reflect.DeepEqual(diff.Changes, expected) {
+		return fmt.Errorf("update dry run changed %+v, expected %+v", diff.Changes, expected)
+	}
+
+	_, err = repos.Segments.DryRun(ctx, func(repo segment.Repository) error {
+		err := repo.AssignSegments(ctx, []int{3}, []string{slugA}, nil)
+		if err != nil {
+			return err
+		}
+		return repo.DeleteSegment(ctx, "AVITO_UNKNOWN")
+	})
+	if err == nil {
+		return fmt.Errorf("failing dry run succeeded")
+	}
+
+	after, err := repos.Segments.GetSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	if after.Version != before.Version {
+		return fmt.Errorf("dry runs changed the snapshot: %v, expected %v", after.Memberships, before.Memberships)
+	}
+	return expectSegments(ctx, repos, 3)
+}
+
+func checkChangeSets(ctx context.Context, repos *Repositories) error {
+	err := insertSegments(ctx, repos, slugA, slugB, slugC)
+	if err != nil {
+		return err
+	}
+	err = repos.Segments.AssignSegments(ctx, []int{1}, []string{slugA}, nil)
+	if err != nil {
+		return err
+	}
+	err = repos.Segments.DeleteSegment(ctx, slugC)
+	if err != nil {
+		return err
+	}
+
+	outcomes, err := repos.Segments.ApplyChangeSets(ctx, []segment.ChangeSet{
+		{UserID: 1, Assign: []string{slugA, slugB, slugC}, Unassign: []string{"AVITO_UNKNOWN"}},
+		{UserID: 2, Unassign: []string{slugA}},
+		{UserID: 1, Unassign: []string{slugA}},
+	})
+	if err != nil {
+		return err
+	}
+	expected := []segment.Outcome{
+		{UserID: 1, Segment: "AVITO_UNKNOWN", Outcome: segment.OutcomeUnknownSegment},
+		{UserID: 1, Segment: slugA, Outcome: segment.OutcomeAlreadyMember},
+		{UserID: 1, Segment: slugB, Outcome: segment.OutcomeAssigned},
+		{UserID: 1, Segment: slugC, Outcome: segment.OutcomeUnknownSegment},
+		{UserID: 2, Segment: slugA, Outcome: segment.OutcomeNotMember},
+		{UserID: 1, Segment: slugA, Outcome: segment.OutcomeUnassigned},
+	}
+	if !reflect.DeepEqual(outcomes, expected) {
+		return fmt.Errorf("outcomes are %+v, expected %+v", outcomes, expected)
+	}
+	if err = expectSegments(ctx, repos, 1, slugB); err != nil {
+		return err
+	}
+
+	_, err = repos.Segments.ApplyChangeSets(ctx, []segment.ChangeSet{
+		{UserID: 2, Assign: []string{slugA}},
+		{UserID: 1, Assign: []string{slugA}, Unassign: []string{slugA}},
+	})
+	if err == nil {
+		return fmt.Errorf("applied a change set assigning and unassigning the same segment")
+	}
+
+	// an unknown user fails every change set, including the ones before it
+	_, err = repos.Segments.ApplyChangeSets(ctx, []segment.ChangeSet{
+		{UserID: 2, Assign: []string{slugA}},
+		{UserID: 1, Unassign: []string{slugB}},
+		{UserID: Users + 1, Assign: []string{slugA}},
+	})
+	if err == nil {
+		return fmt.Errorf("assigned an unknown user")
+	}
+	if err = expectSegments(ctx, repos, 2); err != nil {
+		return err
+	}
+	return expectSegments(ctx, repos, 1, slugB)
+}
+
+func checkSnapshotVersion(ctx context.Context, repos *Repositories) error {
+	err := insertSegments(ctx, repos, slugA)
+	if err != nil {
+		return err
+	}
+
+	first, err := repos.Segments.GetSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	second, err := repos.Segments.GetSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	if first.Version != second.Version {
+		return fmt.Errorf("version changed without changes: %s, %s", first.Version, second.Version)
+	}
+
+	err = repos.Segments.AssignSegments(ctx, []int{1}, []string{slugA}, nil)
+	if err != nil {
+		return err
+	}
+	third, err := repos.Segments.GetSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	if third.Version == second.Version {
+		return fmt.Errorf("version did not change after an assignment")
+	}
+	return nil
+}
+
+func checkUserHistory(ctx context.Context, repos *Repositories) error {
+	err := insertSegments(ctx, repos, slugA, slugB)
+	if err != nil {
+		return err
+	}
+
+	err = repos.Segments.AssignSegments(ctx, []int{1}, []string{slugA, slugB}, nil)
+	if err != nil {
+		return err
+	}
+	err = repos.Segments.UnassignSegments(ctx, []int{1}, []string{slugA})
+	if err != nil {
+		return err
+	}
+	err = repos.Segments.AssignSegments(ctx, []int{2}, []string{slugA}, nil)
+	if err != nil {
+		return err
+	}
+
+	month := time.Now().UTC().Format("2006-01")
+	dates, err := repos.History.ParseAndValidateDates(month, month)
+	if err != nil {
+		return err
+	}
+
+	rows, err := repos.History.GetUserHistory(ctx, 1, dates)
+	if err != nil {
+		return err
+	}
+
+	operations := map[string]int{}
+	for _, row := range rows {
+		if row.UserID != 1 {
+			return fmt.Errorf("report of user 1 has a row of user %d", row.UserID)
+		}
+		operations[row.Segment+" "+row.Operation]++
+	}
+	expected := map[string]int{
+		slugA + " assigned":   1,
+		slugA + " unassigned": 1,
+		slugB + " assigned":   1,
+	}
+	if !reflect.DeepEqual(operations, expected) {
+		return fmt.Errorf("report operations are %v, expected %v", operations, expected)
+	}
+	return nil
+}
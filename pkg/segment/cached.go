@@ -0,0 +1,167 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/cache"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/metrics"
+	"usersegmentator/pkg/tracing"
+)
+
+const (
+	userSegmentsCache     = "user_segments"
+	userSegmentsKeyPrefix = "user_segments:"
+	invalidationTimeout   = 5 * time.Second
+)
+
+// cachedRepository reads user segments through a cache and delegates
+// everything else to the wrapped repository.
+//
+// Entries are dropped on every published change of a user's memberships:
+// assignments, unassignments, expiry changes, segment deletions and TTL
+// expiry. Segments whose expiry has passed are filtered out on read. A read
+// racing with a write may still cache the old segments, so an entry is never
+// trusted for longer than the cache TTL.
+type cachedRepository struct {
+	Repository
+	cache   cache.Cache
+	ttl     time.Duration
+	metrics *metrics.Metrics
+	Logger  *slog.Logger
+}
+
+func NewCachedRepo(repo Repository, c cache.Cache, cfg *config.Config, broker *events.Broker,
+	m *metrics.Metrics) Repository {
+	cr := &cachedRepository{
+		Repository: repo,
+		cache:      c,
+		ttl:        time.Duration(cfg.Cache.TTL) * time.Second,
+		metrics:    m,
+		Logger:     logging.For("segments_cache"),
+	}
+
+	broker.OnPublish(cr.invalidate)
+	return cr
+}
+
+func (cr *cachedRepository) GetUserSegments(ctx context.Context, userID int) (_ *UserSegments, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsCache.GetUserSegments", tracing.AttrUserID.Int(userID))
+	defer func() { tracing.End(span, err) }()
+
+	userSegments, ok := cr.lookup(ctx, userID)
+	span.SetAttributes(tracing.AttrCacheHit.Bool(ok))
+	if ok {
+		return userSegments, nil
+	}
+
+	userSegments, err = cr.Repository.GetUserSegments(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	cr.store(ctx, userSegments)
+	return userSegments, nil
+}
+
+// lookup returns the cached segments of the user. A cache that fails is
+// treated as a miss, so that it never breaks reads.
+func (cr *cachedRepository) lookup(ctx context.Context, userID int) (*UserSegments, bool) {
+	cached, ok, err := cr.cache.Get(ctx, userSegmentsKey(userID))
+	switch {
+	case err != nil:
+		cr.Logger.WarnContext(ctx, "error reading cache", logging.KeyUserID, userID, logging.Err(err))
+		cr.metrics.CacheLookup(userSegmentsCache, metrics.CacheError)
+	case ok:
+		userSegments := &UserSegments{}
+		err = json.Unmarshal(cached, userSegments)
+		if err == nil {
+			cr.metrics.CacheLookup(userSegmentsCache, metrics.CacheHit)
+			return userSegments.withoutExpired(time.Now()), true
+		}
+		cr.Logger.WarnContext(ctx, "error decoding cached segments", logging.KeyUserID, userID, logging.Err(err))
+		cr.metrics.CacheLookup(userSegmentsCache, metrics.CacheError)
+	default:
+		cr.metrics.CacheLookup(userSegmentsCache, metrics.CacheMiss)
+	}
+	return nil, false
+}
+
+func (cr *cachedRepository) store(ctx context.Context, userSegments *UserSegments) {
+	encoded, err := json.Marshal(userSegments)
+	if err == nil {
+		err = cr.cache.Set(ctx, userSegmentsKey(userSegments.UserID), encoded, cr.ttl)
+	}
+	if err != nil {
+		cr.Logger.WarnContext(ctx, "error writing cache", logging.KeyUserID, userSegments.UserID, logging.Err(err))
+	}
+}
+
+// GetUsersSegments serves the cached users and reads the rest in one query.
+// Unknown users are not cached, as they may be created at any time.
+func (cr *cachedRepository) GetUsersSegments(ctx context.Context, userIDs []int) (_ *BatchUserSegments, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsCache.GetUsersSegments", tracing.AttrUserIDs.IntSlice(userIDs))
+	defer func() { tracing.End(span, err) }()
+
+	cachedUsers := make(map[int]*UserSegments, len(userIDs))
+	misses := []int{}
+	for _, userID := range userIDs {
+		if _, ok := cachedUsers[userID]; ok {
+			continue
+		}
+		if userSegments, ok := cr.lookup(ctx, userID); ok {
+			cachedUsers[userID] = userSegments
+			continue
+		}
+		misses = append(misses, userID)
+	}
+
+	batch, err := cr.Repository.GetUsersSegments(ctx, misses)
+	if err != nil {
+		return nil, err
+	}
+
+	for userID := range batch.Users {
+		cr.store(ctx, batch.user(userID))
+	}
+	for _, userSegments := range cachedUsers {
+		batch.setUser(userSegments)
+	}
+	return batch, nil
+}
+
+// invalidate drops the cached segments of every user the events concern.
+func (cr *cachedRepository) invalidate(changes []events.Event) {
+	seen := make(map[int]struct{})
+	keys := []string{}
+	for _, e := range changes {
+		if e.UserID == 0 {
+			continue
+		}
+		if _, ok := seen[e.UserID]; ok {
+			continue
+		}
+		seen[e.UserID] = struct{}{}
+		keys = append(keys, userSegmentsKey(e.UserID))
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), invalidationTimeout)
+	defer cancel()
+
+	err := cr.cache.Delete(ctx, keys...)
+	if err != nil {
+		cr.Logger.ErrorContext(ctx, "error invalidating cache", "users", len(keys), logging.Err(err))
+	}
+}
+
+func userSegmentsKey(userID int) string {
+	return userSegmentsKeyPrefix + strconv.Itoa(userID)
+}
@@ -0,0 +1,81 @@
+package segment
+
+import (
+	"fmt"
+	"time"
+	"usersegmentator/pkg/events"
+)
+
+const (
+	OutcomeAssigned       = "assigned"
+	OutcomeAlreadyMember  = "already_member"
+	OutcomeUnassigned     = "unassigned"
+	OutcomeNotMember      = "not_member"
+	OutcomeUnknownSegment = "unknown_segment"
+)
+
+// ChangeSet assigns and unassigns segments of a user. ExpiresAt applies to
+// the new memberships only, the active ones keep their expiry.
+type ChangeSet struct {
+	UserID    int
+	Assign    []string
+	Unassign  []string
+	ExpiresAt *time.Time
+}
+
+// Outcome is what applying a change set did to one membership. Unknown and
+// deleted segments are reported as OutcomeUnknownSegment and left alone.
+type Outcome struct {
+	UserID  int    `json:"user_id"`
+	Segment string `json:"segment"`
+	Outcome string `json:"outcome"`
+}
+
+type AppliedChanges struct {
+	Outcomes []Outcome `json:"outcomes"`
+}
+
+// validateChangeSets rejects a change set both assigning and unassigning a
+// segment, as the result would depend on the order they are applied in.
+func validateChangeSets(sets []ChangeSet) error {
+	for _, set := range sets {
+		assign := make(map[string]bool, len(set.Assign))
+		for _, slug := range set.Assign {
+			assign[slug] = true
+		}
+		for _, slug := range set.Unassign {
+			if assign[slug] {
+				return fmt.Errorf("segment %s is both assigned and unassigned for user %d", slug, set.UserID)
+			}
+		}
+	}
+	return nil
+}
+
+// changeSetSlugs lists the segments the change sets refer to, once each.
+func changeSetSlugs(sets []ChangeSet) []string {
+	seen := make(map[string]bool)
+	slugs := []string{}
+	for _, set := range sets {
+		for _, slug := range append(append([]string{}, set.Assign...), set.Unassign...) {
+			if !seen[slug] {
+				seen[slug] = true
+				slugs = append(slugs, slug)
+			}
+		}
+	}
+	return slugs
+}
+
+// countChanges counts the assignments and unassignments among the changes.
+func countChanges(changes []events.Event) (assigned, unassigned int) {
+	for _, change := range changes {
+		switch change.Type {
+		case events.TypeAssigned:
+			assigned++
+		case events.TypeUnassigned:
+			unassigned++
+		}
+	}
+	return assigned, unassigned
+}
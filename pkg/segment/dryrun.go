@@ -0,0 +1,70 @@
+package segment
+
+import (
+	"time"
+	"usersegmentator/pkg/events"
+)
+
+// maxDiffChanges caps the changes listed in a diff; the counts cover them all.
+const maxDiffChanges = 1000
+
+// DryRunFunc makes its changes through repo, which rolls them back afterwards.
+type DryRunFunc func(repo Repository) error
+
+// Change is a membership change made during a dry run.
+type Change struct {
+	Type      string     `json:"type"`
+	UserID    int        `json:"user_id"`
+	Segment   string     `json:"segment"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Diff is what a dry run would have changed. Changes lists the first
+// membership changes only, Truncated tells whether some were left out.
+type Diff struct {
+	CreatedSegments []string `json:"created_segments"`
+	DeletedSegments []string `json:"deleted_segments"`
+	Assigned        int      `json:"assigned"`
+	Unassigned      int      `json:"unassigned"`
+	ExpiryChanged   int      `json:"expiry_changed"`
+	Changes         []Change `json:"changes"`
+	Truncated       bool     `json:"truncated"`
+}
+
+func newDiff() *Diff {
+	return &Diff{
+		CreatedSegments: []string{},
+		DeletedSegments: []string{},
+		Changes:         []Change{},
+	}
+}
+
+// add records the changes a mutation would have published.
+func (d *Diff) add(changes ...events.Event) {
+	for _, change := range changes {
+		switch change.Type {
+		case events.TypeSegmentDeleted:
+			d.DeletedSegments = append(d.DeletedSegments, change.Segment)
+			continue
+		case events.TypeAssigned:
+			d.Assigned++
+		case events.TypeUnassigned, events.TypeExpired:
+			d.Unassigned++
+		case events.TypeExpiryChanged:
+			d.ExpiryChanged++
+		default:
+			continue
+		}
+
+		if len(d.Changes) == maxDiffChanges {
+			d.Truncated = true
+			continue
+		}
+		d.Changes = append(d.Changes, Change{
+			Type:      change.Type,
+			UserID:    change.UserID,
+			Segment:   change.Segment,
+			ExpiresAt: change.ExpiresAt,
+		})
+	}
+}
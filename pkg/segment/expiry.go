@@ -0,0 +1,71 @@
+package segment
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// isoDuration matches the ISO-8601 durations accepted for expires_at, such as
+// P30D, PT36H or P1W2DT12H30M. Fractions and negative durations are not supported.
+var isoDuration = regexp.MustCompile(`^P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// ParseExpiry resolves expires_at, either an RFC3339 timestamp or an ISO-8601
+// duration counted from now, to an absolute UTC time truncated to seconds.
+// The legacy ttl in days is used when expires_at is empty. Both empty mean
+// the membership never expires and nil is returned.
+func ParseExpiry(expiresAt string, ttlDays int, now time.Time) (*time.Time, error) {
+	if expiresAt != "" && ttlDays != 0 {
+		return nil, fmt.Errorf("expires_at and ttl are mutually exclusive")
+	}
+
+	var expiry time.Time
+	switch {
+	case expiresAt == "" && ttlDays == 0:
+		return nil, nil
+	case expiresAt == "":
+		expiry = now.AddDate(0, 0, ttlDays)
+	case expiresAt[0] == 'P':
+		var err error
+		expiry, err = addISODuration(now, expiresAt)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		var err error
+		expiry, err = time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("expires_at is neither an RFC3339 timestamp nor an ISO-8601 duration: %w", err)
+		}
+	}
+
+	expiry = expiry.UTC().Truncate(time.Second)
+	if !expiry.After(now) {
+		return nil, fmt.Errorf("expires_at %s is not in the future", expiry.Format(time.RFC3339))
+	}
+	return &expiry, nil
+}
+
+func addISODuration(t time.Time, duration string) (time.Time, error) {
+	match := isoDuration.FindStringSubmatch(duration)
+	if match == nil || duration == "P" || duration[len(duration)-1] == 'T' {
+		return time.Time{}, fmt.Errorf("invalid ISO-8601 duration: %s", duration)
+	}
+
+	parts := make([]int, len(match)-1)
+	for i, part := range match[1:] {
+		if part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid ISO-8601 duration: %s", duration)
+		}
+		parts[i] = n
+	}
+
+	years, months, weeks, days, hours, minutes, seconds := parts[0], parts[1], parts[2], parts[3], parts[4], parts[5], parts[6]
+	return t.AddDate(years, months, weeks*7+days).
+		Add(time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second), nil
+}
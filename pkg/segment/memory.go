@@ -0,0 +1,828 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/history"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/metrics"
+)
+
+type memorySegment struct {
+	id        int
+	slug      string
+	isActive  bool
+	ownerTeam string
+}
+
+type memoryRelation struct {
+	userID         int
+	segmentID      int
+	isActive       bool
+	dateAssigned   time.Time
+	dateUnassigned *time.Time
+}
+
+// MemoryRepository keeps users, segments and memberships in memory with the
+// same semantics as the database-backed repository. It is meant for tests and
+// local development; nothing survives a restart.
+type MemoryRepository struct {
+	cfg     *config.Config
+	events  *events.Broker
+	metrics *metrics.Metrics
+	Logger  *slog.Logger
+
+	mu        sync.Mutex
+	users     map[int]bool
+	segments  []*memorySegment
+	bySlug    map[string]*memorySegment
+	relations []*memoryRelation
+
+	// diff is set on the copy passed to a DryRun function
+	diff *Diff
+}
+
+func NewMemoryRepo(cfg *config.Config, broker *events.Broker, m *metrics.Metrics) *MemoryRepository {
+	return &MemoryRepository{
+		cfg:     cfg,
+		events:  broker,
+		metrics: m,
+		Logger:  logging.For("segments_repo"),
+		users:   make(map[int]bool),
+		bySlug:  make(map[string]*memorySegment),
+	}
+}
+
+// AddUsers creates active users, the in-memory counterpart of migrate seed.
+func (mr *MemoryRepository) AddUsers(userIDs ...int) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for _, id := range userIDs {
+		mr.users[id] = true
+	}
+}
+
+// DryRun calls fn with a copy of the repository and returns what fn changed
+// in it. Nothing is published.
+func (mr *MemoryRepository) DryRun(ctx context.Context, fn DryRunFunc) (*Diff, error) {
+	if mr.diff != nil {
+		return nil, fmt.Errorf("nested dry run")
+	}
+
+	dryRepo := NewMemoryRepo(mr.cfg, mr.events, mr.metrics)
+	dryRepo.diff = newDiff()
+
+	mr.mu.Lock()
+	for id, isActive := range mr.users {
+		dryRepo.users[id] = isActive
+	}
+	for _, segment := range mr.segments {
+		segmentCopy := *segment
+		dryRepo.segments = append(dryRepo.segments, &segmentCopy)
+		dryRepo.bySlug[segmentCopy.slug] = &segmentCopy
+	}
+	for _, relation := range mr.relations {
+		relationCopy := *relation
+		dryRepo.relations = append(dryRepo.relations, &relationCopy)
+	}
+	mr.mu.Unlock()
+
+	err := fn(dryRepo)
+	if err != nil {
+		return nil, err
+	}
+
+	mr.Logger.InfoContext(ctx, "DryRun", "assigned", dryRepo.diff.Assigned, "unassigned", dryRepo.diff.Unassigned)
+	return dryRepo.diff, nil
+}
+
+// publish publishes the changes and reports whether it did. In a dry run the
+// changes go to the diff instead.
+func (mr *MemoryRepository) publish(changes []events.Event) bool {
+	if mr.diff != nil {
+		mr.diff.add(changes...)
+		return false
+	}
+	mr.events.Publish(changes...)
+	return true
+}
+
+// now is truncated to seconds, the precision of the database columns.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+func (mr *MemoryRepository) ExpireMemberships(ctx context.Context, limit int) (int, error) {
+	mr.mu.Lock()
+
+	current := now()
+	due := []*memoryRelation{}
+	for _, relation := range mr.relations {
+		if relation.isActive && relation.dateUnassigned != nil && !relation.dateUnassigned.After(current) {
+			due = append(due, relation)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].dateUnassigned.Before(*due[j].dateUnassigned) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	expired := make([]events.Event, 0, len(due))
+	for _, relation := range due {
+		relation.isActive = false
+		expired = append(expired, events.Event{
+			Type:    events.TypeExpired,
+			UserID:  relation.userID,
+			Segment: mr.segments[relation.segmentID-1].slug,
+		})
+	}
+	mr.mu.Unlock()
+
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	if !mr.publish(expired) {
+		return len(expired), nil
+	}
+	mr.events.Publish(summarizeExpired(expired)...)
+	mr.metrics.SegmentsUnassigned(metrics.SourceTTL, len(expired))
+
+	mr.Logger.InfoContext(ctx, "ExpireMemberships", "expired", len(expired))
+	return len(expired), nil
+}
+
+func (mr *MemoryRepository) AutoAssignSegment(ctx context.Context, fraction int, slug string, expiresAt *time.Time) error {
+	if fraction < 1 || fraction > 100 {
+		mr.Logger.ErrorContext(ctx, "invalid fraction value", logging.KeySegment, slug, "fraction", fraction)
+		return fmt.Errorf("invalid fraction value: %d", fraction)
+	}
+
+	activeUsers, err := mr.GetActiveUsersAmount(ctx)
+	if err != nil {
+		return err
+	}
+
+	sampleSize := rolloutSize(activeUsers, fraction)
+
+	users, err := mr.GetNRandomUsersWithoutSegment(ctx, sampleSize, slug)
+	if err != nil {
+		return err
+	}
+
+	err = mr.assignSegments(ctx, users, []string{slug}, expiresAt, metrics.SourceAutoAssign)
+	if err != nil {
+		mr.Logger.ErrorContext(ctx, "auto assignment failed", logging.KeySegment, slug, logging.Err(err))
+		return err
+	}
+
+	if mr.diff == nil {
+		mr.events.Publish(events.Event{Type: events.TypeRolloutCompleted, Segment: slug, Count: len(users)})
+	}
+	return nil
+}
+
+func (mr *MemoryRepository) TopUpSegment(
+	ctx context.Context,
+	fraction int,
+	slug string,
+	expiresAt *time.Time,
+	assigned int,
+) (int, error) {
+	err := validateTarget(fraction)
+	if err != nil {
+		return 0, err
+	}
+
+	activeUsers, err := mr.GetActiveUsersAmount(ctx)
+	if err != nil {
+		return 0, err
+	}
+	members, err := mr.GetSegmentMembersAmount(ctx, slug)
+	if err != nil {
+		return 0, err
+	}
+
+	missing := rolloutSize(activeUsers, fraction) - max(members, assigned)
+	if missing <= 0 {
+		return 0, nil
+	}
+
+	users, err := mr.GetNRandomUsersWithoutSegment(ctx, missing, slug)
+	if err != nil {
+		return 0, err
+	}
+
+	err = mr.assignSegments(ctx, users, []string{slug}, expiresAt, metrics.SourceRamp)
+	if err != nil {
+		mr.Logger.ErrorContext(ctx, "top up failed", logging.KeySegment, slug, logging.Err(err))
+		return 0, err
+	}
+
+	if mr.diff == nil && len(users) > 0 {
+		mr.events.Publish(events.Event{Type: events.TypeRolloutCompleted, Segment: slug, Count: len(users)})
+	}
+	return len(users), nil
+}
+
+func (mr *MemoryRepository) TrimSegment(ctx context.Context, fraction int, slug string) (int, error) {
+	err := validateTarget(fraction)
+	if err != nil {
+		return 0, err
+	}
+
+	activeUsers, err := mr.GetActiveUsersAmount(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	mr.mu.Lock()
+	members, err := mr.segmentMembersLocked(slug)
+	mr.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	surplus := len(members) - rolloutSize(activeUsers, fraction)
+	if surplus <= 0 {
+		return 0, nil
+	}
+
+	rand.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+	users := members[:surplus]
+
+	err = mr.unassignSegments(ctx, users, []string{slug}, metrics.SourceRamp)
+	if err != nil {
+		mr.Logger.ErrorContext(ctx, "trim failed", logging.KeySegment, slug, logging.Err(err))
+		return 0, err
+	}
+	return len(users), nil
+}
+
+func (mr *MemoryRepository) GetSegmentMembersAmount(_ context.Context, slug string) (int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	members, err := mr.segmentMembersLocked(slug)
+	if err != nil {
+		return 0, err
+	}
+	return len(members), nil
+}
+
+// segmentMembersLocked lists the active users in the segment, failing if it
+// does not exist or is deleted. The caller must hold mu.
+func (mr *MemoryRepository) segmentMembersLocked(slug string) ([]int, error) {
+	segment, ok := mr.bySlug[slug]
+	if !ok || !segment.isActive {
+		return nil, fmt.Errorf("segment %s not found", slug)
+	}
+
+	members := []int{}
+	for _, relation := range mr.relations {
+		if relation.isActive && relation.segmentID == segment.id && mr.users[relation.userID] {
+			members = append(members, relation.userID)
+		}
+	}
+	return members, nil
+}
+
+// segmentsLocked resolves slugs to segments, failing on the first unknown one.
+// The caller must hold mu.
+func (mr *MemoryRepository) segmentsLocked(segmentSlugs []string) ([]*memorySegment, error) {
+	segments := make([]*memorySegment, 0, len(segmentSlugs))
+	for _, slug := range segmentSlugs {
+		segment, ok := mr.bySlug[slug]
+		if !ok {
+			return nil, fmt.Errorf("segment %s not found", slug)
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+func (mr *MemoryRepository) GetSegmentsIDs(_ context.Context, segmentSlugs []string) ([]int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	segments, err := mr.segmentsLocked(segmentSlugs)
+	if err != nil {
+		return []int{}, err
+	}
+
+	ids := make([]int, 0, len(segments))
+	for _, segment := range segments {
+		ids = append(ids, segment.id)
+	}
+	return ids, nil
+}
+
+func (mr *MemoryRepository) GetSegmentsOwners(_ context.Context, segmentSlugs []string) (map[string]string, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	owners := make(map[string]string, len(segmentSlugs))
+	for _, slug := range segmentSlugs {
+		if segment, ok := mr.bySlug[slug]; ok {
+			owners[slug] = segment.ownerTeam
+		}
+	}
+	return owners, nil
+}
+
+func (mr *MemoryRepository) GetNRandomUsersWithoutSegment(_ context.Context, n int, slug string) ([]int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	members := map[int]bool{}
+	if segment, ok := mr.bySlug[slug]; ok {
+		for _, relation := range mr.relations {
+			if relation.isActive && relation.segmentID == segment.id {
+				members[relation.userID] = true
+			}
+		}
+	}
+
+	userIDs := []int{}
+	for id, isActive := range mr.users {
+		if isActive && !members[id] {
+			userIDs = append(userIDs, id)
+		}
+	}
+
+	rand.Shuffle(len(userIDs), func(i, j int) { userIDs[i], userIDs[j] = userIDs[j], userIDs[i] })
+	if len(userIDs) > n {
+		userIDs = userIDs[:n]
+	}
+	return userIDs, nil
+}
+
+func (mr *MemoryRepository) GetActiveUsersAmount(context.Context) (int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	amount := 0
+	for _, isActive := range mr.users {
+		if isActive {
+			amount++
+		}
+	}
+	return amount, nil
+}
+
+func (mr *MemoryRepository) InsertSegment(ctx context.Context, segmentSlug, ownerTeam string) error {
+	if segmentSlug == "" {
+		return fmt.Errorf("empty segment slug")
+	}
+
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	segment, ok := mr.bySlug[segmentSlug]
+	if mr.diff != nil && (!ok || !segment.isActive) {
+		mr.diff.CreatedSegments = append(mr.diff.CreatedSegments, segmentSlug)
+	}
+	if !ok {
+		segment = &memorySegment{id: len(mr.segments) + 1, slug: segmentSlug}
+		mr.segments = append(mr.segments, segment)
+		mr.bySlug[segmentSlug] = segment
+	}
+	segment.isActive = true
+	if segment.ownerTeam == "" {
+		segment.ownerTeam = ownerTeam
+	}
+
+	mr.Logger.InfoContext(ctx, "InsertSegment", logging.KeySegment, segmentSlug)
+	return nil
+}
+
+func (mr *MemoryRepository) DeleteSegment(ctx context.Context, segmentSlug string) error {
+	mr.mu.Lock()
+
+	segments, err := mr.segmentsLocked([]string{segmentSlug})
+	if err != nil {
+		mr.mu.Unlock()
+		return err
+	}
+	segments[0].isActive = false
+
+	current := now()
+	changes := []events.Event{{Type: events.TypeSegmentDeleted, Segment: segmentSlug}}
+	for _, relation := range mr.relations {
+		if relation.isActive && relation.segmentID == segments[0].id {
+			relation.isActive = false
+			relation.dateUnassigned = &current
+			changes = append(changes, events.Event{Type: events.TypeUnassigned, UserID: relation.userID, Segment: segmentSlug})
+		}
+	}
+	mr.mu.Unlock()
+
+	if !mr.publish(changes) {
+		return nil
+	}
+	mr.metrics.SegmentsUnassigned(metrics.SourceSegmentDelete, len(changes)-1)
+
+	mr.Logger.InfoContext(ctx, "DeleteSegment", logging.KeySegment, segmentSlug)
+	return nil
+}
+
+func (mr *MemoryRepository) UnassignSegments(ctx context.Context, userID []int, segmentsToUnassign []string) error {
+	return mr.unassignSegments(ctx, userID, segmentsToUnassign, metrics.SourceAPI)
+}
+
+func (mr *MemoryRepository) unassignSegments(
+	ctx context.Context,
+	userID []int,
+	segmentsToUnassign []string,
+	source string,
+) error {
+	if len(segmentsToUnassign) == 0 {
+		return nil
+	}
+
+	mr.mu.Lock()
+
+	segments, err := mr.segmentsLocked(segmentsToUnassign)
+	if err != nil {
+		mr.mu.Unlock()
+		return err
+	}
+
+	current := now()
+	changes := []events.Event{}
+	for _, usr := range userID {
+		for _, segment := range segments {
+			relation := mr.activeRelationLocked(usr, segment.id)
+			if relation == nil {
+				continue
+			}
+			relation.isActive = false
+			relation.dateUnassigned = &current
+			changes = append(changes, events.Event{Type: events.TypeUnassigned, UserID: usr, Segment: segment.slug})
+		}
+	}
+	mr.mu.Unlock()
+
+	if !mr.publish(changes) {
+		return nil
+	}
+	mr.metrics.SegmentsUnassigned(source, len(changes))
+
+	mr.Logger.InfoContext(ctx, "UnassignSegments", "user_ids", userID, "unassigned", len(changes))
+	return nil
+}
+
+func (mr *MemoryRepository) UpdateSegmentsExpiry(
+	ctx context.Context,
+	userID int,
+	segments []string,
+	expiresAt *time.Time,
+) (int, error) {
+	if len(segments) == 0 {
+		return 0, nil
+	}
+
+	mr.mu.Lock()
+
+	found, err := mr.segmentsLocked(segments)
+	if err != nil {
+		mr.mu.Unlock()
+		return 0, err
+	}
+
+	current := now()
+	changes := []events.Event{}
+	for _, segment := range found {
+		relation := mr.activeRelationLocked(userID, segment.id)
+		if relation == nil || (relation.dateUnassigned != nil && !relation.dateUnassigned.After(current)) {
+			continue
+		}
+		relation.dateUnassigned = nil
+		if expiresAt != nil {
+			unassignTime := expiresAt.UTC().Truncate(time.Second)
+			relation.dateUnassigned = &unassignTime
+		}
+		changes = append(changes, events.Event{
+			Type:      events.TypeExpiryChanged,
+			UserID:    userID,
+			Segment:   segment.slug,
+			ExpiresAt: expiresAt,
+		})
+	}
+	mr.mu.Unlock()
+
+	if !mr.publish(changes) {
+		return len(changes), nil
+	}
+
+	mr.Logger.InfoContext(ctx, "UpdateSegmentsExpiry", logging.KeyUserID, userID, "updated", len(changes))
+	return len(changes), nil
+}
+
+// activeRelationLocked returns the active membership of the user in the
+// segment, or nil. The caller must hold mu.
+func (mr *MemoryRepository) activeRelationLocked(userID, segmentID int) *memoryRelation {
+	for _, relation := range mr.relations {
+		if relation.isActive && relation.userID == userID && relation.segmentID == segmentID {
+			return relation
+		}
+	}
+	return nil
+}
+
+func (mr *MemoryRepository) AssignSegments(
+	ctx context.Context,
+	userID []int,
+	segmentsToAssign []string,
+	expiresAt *time.Time,
+) error {
+	return mr.assignSegments(ctx, userID, segmentsToAssign, expiresAt, metrics.SourceAPI)
+}
+
+func (mr *MemoryRepository) assignSegments(
+	ctx context.Context,
+	userID []int,
+	segmentsToAssign []string,
+	expiresAt *time.Time,
+	source string,
+) error {
+	if len(segmentsToAssign) == 0 {
+		return nil
+	}
+
+	mr.mu.Lock()
+
+	segments, err := mr.segmentsLocked(segmentsToAssign)
+	if err != nil {
+		mr.mu.Unlock()
+		return err
+	}
+	// like a foreign key violation, an unknown user fails the whole call
+	for _, usr := range userID {
+		if _, ok := mr.users[usr]; !ok {
+			mr.mu.Unlock()
+			return fmt.Errorf("user %d not found", usr)
+		}
+	}
+
+	current := now()
+	changes := []events.Event{}
+	for _, usr := range userID {
+		for _, segment := range segments {
+			if mr.activeRelationLocked(usr, segment.id) != nil {
+				continue
+			}
+
+			relation := &memoryRelation{
+				userID:       usr,
+				segmentID:    segment.id,
+				isActive:     true,
+				dateAssigned: current,
+			}
+			if expiresAt != nil {
+				unassignTime := expiresAt.UTC().Truncate(time.Second)
+				relation.dateUnassigned = &unassignTime
+			}
+			mr.relations = append(mr.relations, relation)
+			changes = append(changes, events.Event{
+				Type:      events.TypeAssigned,
+				UserID:    usr,
+				Segment:   segment.slug,
+				ExpiresAt: expiresAt,
+			})
+		}
+	}
+	mr.mu.Unlock()
+
+	if !mr.publish(changes) {
+		return nil
+	}
+	mr.metrics.SegmentsAssigned(source, len(changes))
+
+	mr.Logger.InfoContext(ctx, "AssignSegments", "user_ids", userID, "assigned", len(changes))
+	return nil
+}
+
+func (mr *MemoryRepository) ApplyChangeSets(ctx context.Context, sets []ChangeSet) ([]Outcome, error) {
+	err := validateChangeSets(sets)
+	if err != nil {
+		return nil, err
+	}
+
+	mr.mu.Lock()
+
+	// like a foreign key violation, an unknown user gaining a membership
+	// fails the whole call, so it is checked before anything changes
+	for _, set := range sets {
+		if mr.users[set.UserID] {
+			continue
+		}
+		for _, slug := range set.Assign {
+			if segment, ok := mr.bySlug[slug]; ok && segment.isActive {
+				mr.mu.Unlock()
+				return nil, fmt.Errorf("user %d not found", set.UserID)
+			}
+		}
+	}
+
+	current := now()
+	outcomes := []Outcome{}
+	changes := []events.Event{}
+	for _, set := range sets {
+		for _, slug := range set.Unassign {
+			outcome := Outcome{UserID: set.UserID, Segment: slug, Outcome: OutcomeUnknownSegment}
+			if segment, ok := mr.bySlug[slug]; ok && segment.isActive {
+				outcome.Outcome = OutcomeNotMember
+				if relation := mr.activeRelationLocked(set.UserID, segment.id); relation != nil {
+					relation.isActive = false
+					relation.dateUnassigned = &current
+					outcome.Outcome = OutcomeUnassigned
+					changes = append(changes, events.Event{Type: events.TypeUnassigned, UserID: set.UserID, Segment: slug})
+				}
+			}
+			outcomes = append(outcomes, outcome)
+		}
+
+		for _, slug := range set.Assign {
+			outcome := Outcome{UserID: set.UserID, Segment: slug, Outcome: OutcomeUnknownSegment}
+			if segment, ok := mr.bySlug[slug]; ok && segment.isActive {
+				outcome.Outcome = OutcomeAlreadyMember
+				if mr.activeRelationLocked(set.UserID, segment.id) == nil {
+					relation := &memoryRelation{
+						userID:       set.UserID,
+						segmentID:    segment.id,
+						isActive:     true,
+						dateAssigned: current,
+					}
+					if set.ExpiresAt != nil {
+						unassignTime := set.ExpiresAt.UTC().Truncate(time.Second)
+						relation.dateUnassigned = &unassignTime
+					}
+					mr.relations = append(mr.relations, relation)
+					outcome.Outcome = OutcomeAssigned
+					changes = append(changes, events.Event{
+						Type:      events.TypeAssigned,
+						UserID:    set.UserID,
+						Segment:   slug,
+						ExpiresAt: set.ExpiresAt,
+					})
+				}
+			}
+			outcomes = append(outcomes, outcome)
+		}
+	}
+	mr.mu.Unlock()
+
+	if !mr.publish(changes) {
+		return outcomes, nil
+	}
+	assigned, unassigned := countChanges(changes)
+	mr.metrics.SegmentsAssigned(metrics.SourceAPI, assigned)
+	mr.metrics.SegmentsUnassigned(metrics.SourceAPI, unassigned)
+
+	mr.Logger.InfoContext(ctx, "ApplyChangeSets", "change_sets", len(sets), "assigned", assigned, "unassigned", unassigned)
+	return outcomes, nil
+}
+
+func (mr *MemoryRepository) GetUserSegments(ctx context.Context, userID int) (*UserSegments, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	userSegments := mr.userSegments(userID, now())
+
+	mr.Logger.InfoContext(ctx, "GetUserSegments", logging.KeyUserID, userID)
+	return userSegments, nil
+}
+
+func (mr *MemoryRepository) GetUsersSegments(ctx context.Context, userIDs []int) (*BatchUserSegments, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	current := now()
+	batch := &BatchUserSegments{
+		Users:        make(map[int][]string, len(userIDs)),
+		UnknownUsers: []int{},
+	}
+	for _, id := range userIDs {
+		if _, ok := mr.users[id]; ok {
+			batch.setUser(mr.userSegments(id, current))
+		}
+	}
+	batch.UnknownUsers = unknownUsers(userIDs, batch.Users)
+
+	mr.Logger.InfoContext(ctx, "GetUsersSegments", "users", len(userIDs), "unknown", len(batch.UnknownUsers))
+	return batch, nil
+}
+
+// userSegments returns the active segments of the user at current sorted by
+// slug, with their expiry. The caller must hold mr.mu.
+func (mr *MemoryRepository) userSegments(userID int, current time.Time) *UserSegments {
+	active := map[string]*memoryRelation{}
+	slugs := []string{}
+	for _, relation := range mr.relations {
+		if !relation.isActive || relation.userID != userID {
+			continue
+		}
+		if relation.dateUnassigned != nil && !relation.dateUnassigned.After(current) {
+			continue
+		}
+		segment := mr.segments[relation.segmentID-1]
+		if _, ok := active[segment.slug]; segment.isActive && !ok {
+			active[segment.slug] = relation
+			slugs = append(slugs, segment.slug)
+		}
+	}
+	sort.Strings(slugs)
+
+	userSegments := &UserSegments{
+		UserID:   userID,
+		Segments: []string{},
+	}
+	for _, slug := range slugs {
+		userSegments.add(slug, active[slug].dateUnassigned)
+	}
+	return userSegments
+}
+
+func (mr *MemoryRepository) GetSnapshot(ctx context.Context) (*Snapshot, error) {
+	mr.mu.Lock()
+
+	current := now()
+	snapshot := &Snapshot{
+		GeneratedAt: time.Now().UTC(),
+		Segments:    []string{},
+		Memberships: []SnapshotMembership{},
+	}
+	for _, segment := range mr.segments {
+		if segment.isActive {
+			snapshot.Segments = append(snapshot.Segments, segment.slug)
+		}
+	}
+	for _, relation := range mr.relations {
+		segment := mr.segments[relation.segmentID-1]
+		if !relation.isActive || !segment.isActive {
+			continue
+		}
+		if relation.dateUnassigned != nil && !relation.dateUnassigned.After(current) {
+			continue
+		}
+
+		membership := SnapshotMembership{UserID: relation.userID, Segment: segment.slug}
+		if relation.dateUnassigned != nil {
+			expiry := *relation.dateUnassigned
+			membership.ExpiresAt = &expiry
+		}
+		snapshot.Memberships = append(snapshot.Memberships, membership)
+	}
+	mr.mu.Unlock()
+
+	sort.Strings(snapshot.Segments)
+	sort.Slice(snapshot.Memberships, func(i, j int) bool {
+		a, b := snapshot.Memberships[i], snapshot.Memberships[j]
+		if a.UserID != b.UserID {
+			return a.UserID < b.UserID
+		}
+		return a.Segment < b.Segment
+	})
+
+	err := snapshot.ComputeVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	mr.Logger.InfoContext(ctx, "GetSnapshot", "version", snapshot.Version)
+	return snapshot, nil
+}
+
+// UserMemberships lists every membership the user ever had, oldest first,
+// so that a history.Repository can report from the same data.
+func (mr *MemoryRepository) UserMemberships(userID int) []history.Membership {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	memberships := []history.Membership{}
+	for _, relation := range mr.relations {
+		if relation.userID != userID {
+			continue
+		}
+
+		membership := history.Membership{
+			Segment:    mr.segments[relation.segmentID-1].slug,
+			AssignedAt: relation.dateAssigned,
+		}
+		if relation.dateUnassigned != nil {
+			unassigned := *relation.dateUnassigned
+			membership.UnassignedAt = &unassigned
+		}
+		memberships = append(memberships, membership)
+	}
+	return memberships
+}
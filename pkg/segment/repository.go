@@ -3,145 +3,451 @@ package segment
 import (
 	"context"
 	"database/sql"
+	stderrors "errors"
 	"fmt"
-	"log"
-	"math"
-	"os"
+	"log/slog"
+	"strings"
 	"time"
 	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
 	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/metrics"
+	"usersegmentator/pkg/outbox"
+	"usersegmentator/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Repository interface {
-	InsertSegment(ctx context.Context, segmentSlug string) error
+	InsertSegment(ctx context.Context, segmentSlug, ownerTeam string) error
 	DeleteSegment(ctx context.Context, segmentSlug string) error
 	UnassignSegments(ctx context.Context, userID []int, segmentsToUnassign []string) error
-	AssignSegments(ctx context.Context, userID []int, segmentsToAssign []string, ttl int) error
+	AssignSegments(ctx context.Context, userID []int, segmentsToAssign []string, expiresAt *time.Time) error
+	ApplyChangeSets(ctx context.Context, sets []ChangeSet) ([]Outcome, error)
+	UpdateSegmentsExpiry(ctx context.Context, userID int, segments []string, expiresAt *time.Time) (int, error)
 	GetUserSegments(ctx context.Context, userID int) (*UserSegments, error)
-	GetNRandomUsersWithoutSegment(n int, slug string) ([]int, error)
+	GetUsersSegments(ctx context.Context, userIDs []int) (*BatchUserSegments, error)
+	GetNRandomUsersWithoutSegment(ctx context.Context, n int, slug string) ([]int, error)
 	GetActiveUsersAmount(ctx context.Context) (int, error)
 	GetSegmentsIDs(ctx context.Context, segmentSlugs []string) ([]int, error)
-	AutoAssignSegment(ctx context.Context, fraction int, slug string, ttl int) error
-	RunTTLChecker()
+	GetSegmentsOwners(ctx context.Context, segmentSlugs []string) (map[string]string, error)
+	AutoAssignSegment(ctx context.Context, fraction int, slug string, expiresAt *time.Time) error
+	TopUpSegment(ctx context.Context, fraction int, slug string, expiresAt *time.Time, assigned int) (int, error)
+	TrimSegment(ctx context.Context, fraction int, slug string) (int, error)
+	GetSegmentMembersAmount(ctx context.Context, slug string) (int, error)
+	GetSnapshot(ctx context.Context) (*Snapshot, error)
+	ExpireMemberships(ctx context.Context, limit int) (int, error)
+	DryRun(ctx context.Context, fn DryRunFunc) (*Diff, error)
 }
 
 type segmentsRepository struct {
 	db      *sql.DB
+	dialect dialect.Dialect
 	cfg     *config.Config
-	InfoLog *log.Logger
-	ErrLog  *log.Logger
+	events  *events.Broker
+	metrics *metrics.Metrics
+	Logger  *slog.Logger
+
+	// tx and diff are set on the repository passed to a DryRun function:
+	// every call joins tx, and the changes are recorded in diff instead of
+	// being committed
+	tx   *sql.Tx
+	diff *Diff
 }
 
-func NewSegmentsRepo(db *sql.DB, cfg *config.Config) Repository {
-	sr := &segmentsRepository{
+func NewSegmentsRepo(db *sql.DB, cfg *config.Config, broker *events.Broker, m *metrics.Metrics) Repository {
+	return &segmentsRepository{
 		db:      db,
+		dialect: dialect.For(cfg),
 		cfg:     cfg,
-		InfoLog: log.New(os.Stdout, "INFO\tSEGMENTS REPO\t", log.Ldate|log.Ltime),
-		ErrLog:  log.New(os.Stdout, "ERROR\tSEGMENTS REPO\t", log.Ldate|log.Ltime),
+		events:  broker,
+		metrics: m,
+		Logger:  logging.For("segments_repo"),
+	}
+}
+
+// DryRun calls fn with a repository making its changes in a single
+// transaction, rolls the transaction back and returns what fn changed.
+// Nothing is published; the rows fn touched stay locked until it returns.
+func (sr *segmentsRepository) DryRun(ctx context.Context, fn DryRunFunc) (_ *Diff, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.DryRun")
+	defer func() { tracing.End(span, err) }()
+
+	if sr.tx != nil {
+		return nil, fmt.Errorf("nested dry run")
+	}
+
+	tx, err := sr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", errors.ErrorBeginTransaction, err)
+	}
+
+	dryRepo := *sr
+	dryRepo.tx = tx
+	dryRepo.diff = newDiff()
+
+	err = fn(&dryRepo)
+	// a failed call has rolled tx back already
+	rbErr := tx.Rollback()
+	if err != nil {
+		return nil, err
+	}
+	if rbErr != nil && !stderrors.Is(rbErr, sql.ErrTxDone) {
+		return nil, fmt.Errorf("rollback error: %w", rbErr)
 	}
 
-	go func() {
-		sr.RunTTLChecker()
-	}()
-	return sr
+	sr.Logger.InfoContext(ctx, "DryRun", "assigned", dryRepo.diff.Assigned, "unassigned", dryRepo.diff.Unassigned)
+	return dryRepo.diff, nil
 }
 
-func (sr *segmentsRepository) RunTTLChecker() {
-	sr.InfoLog.Printf("TTL checker is running")
-	ticker := time.NewTicker(time.Minute)
-	defer ticker.Stop()
+// conn is the dry run transaction, if any, or the database.
+func (sr *segmentsRepository) conn() dialect.Querier {
+	if sr.tx != nil {
+		return sr.tx
+	}
+	return sr.db
+}
 
-	ctx := context.Background()
+// begin starts a transaction, or joins the one of the dry run.
+func (sr *segmentsRepository) begin(ctx context.Context) (*sql.Tx, error) {
+	if sr.tx != nil {
+		return sr.tx, nil
+	}
+	return sr.db.BeginTx(ctx, nil)
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			tx, err := sr.db.BeginTx(ctx, nil)
-			if err != nil {
-				sr.ErrLog.Printf("%s: %s", errors.ErrorBeginTransaction, err)
-				continue
-			}
+// commit commits tx and reports whether the changes are to be published. In
+// a dry run the changes go to the diff instead and tx stays open.
+func (sr *segmentsRepository) commit(tx *sql.Tx, changes []events.Event) (bool, error) {
+	if sr.diff != nil {
+		sr.diff.add(changes...)
+		return false, nil
+	}
+	return true, tx.Commit()
+}
 
-			rows, err := tx.QueryContext(ctx, "SELECT id FROM user_segment_relation "+
-				"WHERE date_unassigned <= CURRENT_TIMESTAMP AND is_active = TRUE")
+// ExpireMemberships deactivates up to limit memberships past their
+// date_unassigned, oldest first, and records an expiry event for each of them.
+// It returns how many memberships were expired.
+func (sr *segmentsRepository) ExpireMemberships(ctx context.Context, limit int) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.ExpireMemberships", attribute.Int("db.limit", limit))
+	defer func() { tracing.End(span, err) }()
 
-			if err != nil {
-				sr.ErrLog.Printf("error checking table for ttl: %s", err)
-				if rbErr := tx.Rollback(); rbErr != nil {
-					sr.ErrLog.Printf("rollback error: %s", rbErr)
-					continue
-				}
-			}
+	tx, err := sr.begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", errors.ErrorBeginTransaction, err)
+	}
 
-			var curID int
-			ids := []int{}
+	// concurrent checkers wait on the row locks and then skip the rows expired meanwhile
+	rows, err := tx.QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT r.id, r.user_id, s.slug FROM user_segment_relation r "+
+			"JOIN segments s ON r.segment_id = s.id "+
+			"WHERE r.is_active = TRUE AND r.date_unassigned <= CURRENT_TIMESTAMP "+
+			"ORDER BY r.date_unassigned LIMIT ?"+sr.dialect.ForUpdate()),
+		limit,
+	)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return 0, fmt.Errorf("error selecting expired memberships: %w, rollback error: %s", err, rbErr)
+		}
+		return 0, fmt.Errorf("error selecting expired memberships: %w", err)
+	}
+	defer rows.Close()
 
-			for rows.Next() {
-				err = rows.Scan(&curID)
-				if err != nil {
-					sr.ErrLog.Printf("error reading row: %s", err)
-					continue
-				}
-				ids = append(ids, curID)
+	ids := []interface{}{}
+	expired := []events.Event{}
+	for rows.Next() {
+		var id int64
+		expiredEvent := events.Event{Type: events.TypeExpired}
+		err = rows.Scan(&id, &expiredEvent.UserID, &expiredEvent.Segment)
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				return 0, fmt.Errorf("error reading expired memberships: %w, rollback error: %s", err, rbErr)
 			}
+			return 0, fmt.Errorf("error reading expired memberships: %w", err)
+		}
+		ids = append(ids, id)
+		expired = append(expired, expiredEvent)
+	}
+	err = rows.Err()
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return 0, fmt.Errorf("error reading expired memberships: %w, rollback error: %s", err, rbErr)
+		}
+		return 0, fmt.Errorf("error reading expired memberships: %w", err)
+	}
 
-			err = rows.Close()
-			if err != nil {
-				sr.ErrLog.Printf("error closing rows: %s", err)
-			}
+	if len(ids) == 0 {
+		_, err = sr.commit(tx, nil)
+		return 0, err
+	}
 
-			for _, id := range ids {
-				_, err := tx.ExecContext(ctx, "UPDATE user_segment_relation SET is_active = FALSE WHERE id = ?", id)
-				if err != nil {
-					sr.ErrLog.Printf("error unassigning segments: %s", err)
-					if rbErr := tx.Rollback(); rbErr != nil {
-						sr.ErrLog.Printf("rollback error: %s", rbErr)
-					}
-				}
-			}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	_, err = tx.ExecContext(
+		ctx,
+		sr.dialect.Rebind("UPDATE user_segment_relation SET is_active = FALSE WHERE id IN ("+placeholders+")"),
+		ids...,
+	)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return 0, fmt.Errorf("error expiring memberships: %w, rollback error: %s", err, rbErr)
+		}
+		return 0, fmt.Errorf("error expiring memberships: %w", err)
+	}
 
-			err = tx.Commit()
-			if err != nil {
-				sr.ErrLog.Printf("%s: %s", errors.ErrorCommittingTransaction, err)
-			}
+	err = outbox.Enqueue(ctx, tx, sr.dialect, expired...)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return 0, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
 		}
+		return 0, err
 	}
+
+	committed, err := sr.commit(tx, expired)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", errors.ErrorCommittingTransaction, err)
+	}
+	if !committed {
+		return len(expired), nil
+	}
+
+	sr.events.Publish(expired...)
+	sr.events.Publish(summarizeExpired(expired)...)
+	sr.metrics.SegmentsUnassigned(metrics.SourceTTL, len(expired))
+	span.SetAttributes(tracing.AttrRows.Int(len(expired)))
+
+	sr.Logger.InfoContext(ctx, "ExpireMemberships", "expired", len(expired))
+	return len(expired), nil
 }
 
-func (sr *segmentsRepository) AutoAssignSegment(ctx context.Context, fraction int, slug string, ttl int) error {
+func (sr *segmentsRepository) AutoAssignSegment(
+	ctx context.Context,
+	fraction int,
+	slug string,
+	expiresAt *time.Time,
+) (err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.AutoAssignSegment", tracing.AttrSegment.String(slug), attribute.Int("segment.fraction", fraction))
+	defer func() { tracing.End(span, err) }()
+
 	if fraction < 1 || fraction > 100 {
-		sr.ErrLog.Printf("invalid fraction value: %d", fraction)
+		sr.Logger.ErrorContext(ctx, "invalid fraction value", logging.KeySegment, slug, "fraction", fraction)
 		return fmt.Errorf("invalid fraction value: %d", fraction)
 	}
 
 	activeUsers, err := sr.GetActiveUsersAmount(ctx)
 	if err != nil {
-		sr.ErrLog.Printf("%s", err)
+		sr.Logger.ErrorContext(ctx, "auto assignment failed", logging.KeySegment, slug, logging.Err(err))
 		return err
 	}
 
-	sampleSize := int(math.Ceil(float64(activeUsers) * (float64(fraction) / 100))) //nolint:gomnd // creating percents
+	sampleSize := rolloutSize(activeUsers, fraction)
 
-	users, err := sr.GetNRandomUsersWithoutSegment(sampleSize, slug)
+	users, err := sr.GetNRandomUsersWithoutSegment(ctx, sampleSize, slug)
 	if err != nil {
-		sr.ErrLog.Printf("%s", err)
+		sr.Logger.ErrorContext(ctx, "auto assignment failed", logging.KeySegment, slug, logging.Err(err))
 		return err
 	}
+	span.SetAttributes(tracing.AttrRows.Int(len(users)))
 
-	err = sr.AssignSegments(ctx, users, []string{slug}, ttl)
+	err = sr.assignSegments(ctx, users, []string{slug}, expiresAt, metrics.SourceAutoAssign)
 	if err != nil {
-		sr.ErrLog.Printf("%s", err)
+		sr.Logger.ErrorContext(ctx, "auto assignment failed", logging.KeySegment, slug, logging.Err(err))
 		return err
 	}
 
+	if sr.diff == nil {
+		sr.events.Publish(events.Event{Type: events.TypeRolloutCompleted, Segment: slug, Count: len(users)})
+	}
 	return nil
 }
 
-func (sr *segmentsRepository) GetSegmentsIDs(ctx context.Context, segmentSlugs []string) ([]int, error) {
+// TopUpSegment assigns random users to the segment until fraction percent of
+// the active users are its members, whoever assigned them, and returns how
+// many users it assigned. Unlike AutoAssignSegment it never overshoots the
+// target when called again. assigned is how many users the caller has
+// assigned to the segment before: they count towards the target even once
+// they have left, so that the members removed since are not replaced.
+func (sr *segmentsRepository) TopUpSegment(
+	ctx context.Context,
+	fraction int,
+	slug string,
+	expiresAt *time.Time,
+	assigned int,
+) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.TopUpSegment", tracing.AttrSegment.String(slug), attribute.Int("segment.fraction", fraction))
+	defer func() { tracing.End(span, err) }()
+
+	err = validateTarget(fraction)
+	if err != nil {
+		return 0, err
+	}
+
+	activeUsers, err := sr.GetActiveUsersAmount(ctx)
+	if err != nil {
+		return 0, err
+	}
+	members, err := sr.GetSegmentMembersAmount(ctx, slug)
+	if err != nil {
+		return 0, err
+	}
+
+	missing := rolloutSize(activeUsers, fraction) - max(members, assigned)
+	if missing <= 0 {
+		return 0, nil
+	}
+
+	users, err := sr.GetNRandomUsersWithoutSegment(ctx, missing, slug)
+	if err != nil {
+		return 0, err
+	}
+	span.SetAttributes(tracing.AttrRows.Int(len(users)))
+
+	err = sr.assignSegments(ctx, users, []string{slug}, expiresAt, metrics.SourceRamp)
+	if err != nil {
+		sr.Logger.ErrorContext(ctx, "top up failed", logging.KeySegment, slug, logging.Err(err))
+		return 0, err
+	}
+
+	if sr.diff == nil && len(users) > 0 {
+		sr.events.Publish(events.Event{Type: events.TypeRolloutCompleted, Segment: slug, Count: len(users)})
+	}
+	return len(users), nil
+}
+
+// TrimSegment unassigns random members of the segment until at most fraction
+// percent of the active users are left in it, and returns how many members
+// it unassigned.
+func (sr *segmentsRepository) TrimSegment(ctx context.Context, fraction int, slug string) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.TrimSegment", tracing.AttrSegment.String(slug), attribute.Int("segment.fraction", fraction))
+	defer func() { tracing.End(span, err) }()
+
+	err = validateTarget(fraction)
+	if err != nil {
+		return 0, err
+	}
+
+	activeUsers, err := sr.GetActiveUsersAmount(ctx)
+	if err != nil {
+		return 0, err
+	}
+	members, err := sr.GetSegmentMembersAmount(ctx, slug)
+	if err != nil {
+		return 0, err
+	}
+
+	surplus := members - rolloutSize(activeUsers, fraction)
+	if surplus <= 0 {
+		return 0, nil
+	}
+
+	users, err := sr.getNRandomSegmentMembers(ctx, surplus, slug)
+	if err != nil {
+		return 0, err
+	}
+	span.SetAttributes(tracing.AttrRows.Int(len(users)))
+
+	err = sr.unassignSegments(ctx, users, []string{slug}, metrics.SourceRamp)
+	if err != nil {
+		sr.Logger.ErrorContext(ctx, "trim failed", logging.KeySegment, slug, logging.Err(err))
+		return 0, err
+	}
+	return len(users), nil
+}
+
+// GetSegmentMembersAmount counts the active users in the segment. It fails
+// if the segment does not exist or is deleted.
+func (sr *segmentsRepository) GetSegmentMembersAmount(ctx context.Context, slug string) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.GetSegmentMembersAmount", tracing.AttrSegment.String(slug))
+	defer func() { tracing.End(span, err) }()
+
+	var segmentID int
+	err = sr.conn().QueryRowContext(
+		ctx,
+		sr.dialect.Rebind("SELECT id FROM segments WHERE slug = ? AND is_active = TRUE"),
+		slug,
+	).Scan(&segmentID)
+	if stderrors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("segment %s not found", slug)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var amount int
+	err = sr.conn().QueryRowContext(
+		ctx,
+		sr.dialect.Rebind("SELECT COUNT(r.id) FROM user_segment_relation r "+
+			"JOIN users u ON u.id = r.user_id "+
+			"WHERE r.segment_id = ? AND r.is_active = TRUE AND u.is_active = TRUE"),
+		segmentID,
+	).Scan(&amount)
+	if err != nil {
+		return 0, err
+	}
+	return amount, nil
+}
+
+func (sr *segmentsRepository) getNRandomSegmentMembers(ctx context.Context, n int, slug string) ([]int, error) {
+	rows, err := sr.conn().QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT r.user_id FROM user_segment_relation r "+
+			"JOIN users u ON u.id = r.user_id "+
+			"JOIN segments s ON s.id = r.segment_id "+
+			"WHERE s.slug = ? AND r.is_active = TRUE AND u.is_active = TRUE "+
+			"ORDER BY "+sr.dialect.Random()+" LIMIT ?"),
+		slug,
+		n,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIDs := []int{}
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+// summarizeExpired groups per-membership expirations into one event per segment.
+func summarizeExpired(expired []events.Event) []events.Event {
+	counts := map[string]int{}
+	order := []string{}
+	for _, e := range expired {
+		if counts[e.Segment] == 0 {
+			order = append(order, e.Segment)
+		}
+		counts[e.Segment]++
+	}
+
+	summary := make([]events.Event, 0, len(order))
+	for _, slug := range order {
+		summary = append(summary, events.Event{Type: events.TypeExpiredBulk, Segment: slug, Count: counts[slug]})
+	}
+	return summary
+}
+
+func (sr *segmentsRepository) GetSegmentsIDs(ctx context.Context, segmentSlugs []string) (_ []int, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.GetSegmentsIDs", tracing.AttrSegments.StringSlice(segmentSlugs))
+	defer func() { tracing.End(span, err) }()
+
 	ids := []int{}
 	for _, f := range segmentSlugs {
 		var curID int
-		row, err := sr.db.QueryContext(ctx, "SELECT id FROM segments WHERE slug = ? LIMIT 1", f)
+		row, err := sr.conn().QueryContext(ctx, sr.dialect.Rebind("SELECT id FROM segments WHERE slug = ? LIMIT 1"), f)
 		if err != nil {
 			return []int{}, err
 		}
@@ -161,11 +467,43 @@ func (sr *segmentsRepository) GetSegmentsIDs(ctx context.Context, segmentSlugs [
 	return ids, nil
 }
 
-func (sr *segmentsRepository) GetNRandomUsersWithoutSegment(n int, slug string) ([]int, error) {
+// GetSegmentsOwners returns the owner team of each existing segment.
+// Segments without an owner are mapped to an empty string, unknown ones are omitted.
+func (sr *segmentsRepository) GetSegmentsOwners(
+	ctx context.Context,
+	segmentSlugs []string,
+) (_ map[string]string, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.GetSegmentsOwners", tracing.AttrSegments.StringSlice(segmentSlugs))
+	defer func() { tracing.End(span, err) }()
+
+	owners := make(map[string]string, len(segmentSlugs))
+	for _, slug := range segmentSlugs {
+		var owner sql.NullString
+		err := sr.conn().QueryRowContext(
+			ctx,
+			sr.dialect.Rebind("SELECT owner_team FROM segments WHERE slug = ? LIMIT 1"),
+			slug,
+		).Scan(&owner)
+		if stderrors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		owners[slug] = owner.String
+	}
+	return owners, nil
+}
+
+func (sr *segmentsRepository) GetNRandomUsersWithoutSegment(ctx context.Context, n int, slug string) (_ []int, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.GetNRandomUsersWithoutSegment", tracing.AttrSegment.String(slug))
+	defer func() { tracing.End(span, err) }()
+
 	userIDs := []int{}
 
-	rows, err := sr.db.Query(
-		`SELECT DISTINCT u.id FROM users u
+	rows, err := sr.conn().QueryContext(
+		ctx,
+		sr.dialect.Rebind(`SELECT u.id FROM users u
 				WHERE (SELECT user_id 
 					   FROM user_segment_relation 
 					   WHERE user_id = u.id 
@@ -178,13 +516,14 @@ func (sr *segmentsRepository) GetNRandomUsersWithoutSegment(n int, slug string)
 					   ORDER BY date_assigned 
 					   LIMIT 1) IS NULL 
 					   AND is_active = TRUE
-				ORDER BY RAND() LIMIT ?`,
+				ORDER BY `+sr.dialect.Random()+` LIMIT ?`),
 		slug,
 		n,
 	)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var id int
@@ -194,18 +533,22 @@ func (sr *segmentsRepository) GetNRandomUsersWithoutSegment(n int, slug string)
 		}
 		userIDs = append(userIDs, id)
 	}
-	err = rows.Close()
+	err = rows.Err()
 	if err != nil {
 		return nil, err
 	}
 
+	span.SetAttributes(tracing.AttrRows.Int(len(userIDs)))
 	return userIDs, nil
 }
 
-func (sr *segmentsRepository) GetActiveUsersAmount(ctx context.Context) (int, error) {
+func (sr *segmentsRepository) GetActiveUsersAmount(ctx context.Context) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.GetActiveUsersAmount")
+	defer func() { tracing.End(span, err) }()
+
 	var amount int
 
-	row, err := sr.db.QueryContext(ctx, "SELECT COUNT(id) FROM users WHERE is_active = TRUE")
+	row, err := sr.conn().QueryContext(ctx, "SELECT COUNT(id) FROM users WHERE is_active = TRUE")
 	if err != nil {
 		return -1, err
 	}
@@ -224,38 +567,104 @@ func (sr *segmentsRepository) GetActiveUsersAmount(ctx context.Context) (int, er
 	return amount, nil
 }
 
-func (sr *segmentsRepository) InsertSegment(ctx context.Context, segmentSlug string) error {
+// InsertSegment creates the segment or reactivates a deleted one. A segment
+// keeps its owner team once set; an empty ownerTeam leaves it unowned.
+func (sr *segmentsRepository) InsertSegment(ctx context.Context, segmentSlug, ownerTeam string) (err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.InsertSegment", tracing.AttrSegment.String(segmentSlug))
+	defer func() { tracing.End(span, err) }()
+
 	if segmentSlug == "" {
 		return fmt.Errorf("empty segment slug")
 	}
 
-	_, err := sr.db.ExecContext(
+	var owner sql.NullString
+	if ownerTeam != "" {
+		owner = sql.NullString{String: ownerTeam, Valid: true}
+	}
+
+	if sr.diff != nil {
+		var isActive bool
+		err = sr.conn().QueryRowContext(
+			ctx,
+			sr.dialect.Rebind("SELECT is_active FROM segments WHERE slug = ?"),
+			segmentSlug,
+		).Scan(&isActive)
+		if err != nil && !stderrors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if !isActive {
+			sr.diff.CreatedSegments = append(sr.diff.CreatedSegments, segmentSlug)
+		}
+	}
+
+	_, err = sr.conn().ExecContext(
 		ctx,
-		"INSERT INTO segments (`slug`) VALUES (?) ON DUPLICATE KEY UPDATE is_active = TRUE",
+		sr.dialect.Rebind(sr.dialect.Upsert(
+			"INSERT INTO segments (slug, owner_team) VALUES (?, ?)",
+			[]string{"slug"},
+			"is_active = TRUE, owner_team = COALESCE(segments.owner_team, "+sr.dialect.Excluded("owner_team")+")",
+		)),
 		segmentSlug,
+		owner,
 	)
 	if err != nil {
 		return err
 	}
 
-	sr.InfoLog.Printf("InsertSegment — %s\n", segmentSlug)
+	sr.Logger.InfoContext(ctx, "InsertSegment", logging.KeySegment, segmentSlug)
 	return nil
 }
 
-func (sr *segmentsRepository) DeleteSegment(ctx context.Context, segmentSlug string) error {
+func (sr *segmentsRepository) DeleteSegment(ctx context.Context, segmentSlug string) (err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.DeleteSegment", tracing.AttrSegment.String(segmentSlug))
+	defer func() { tracing.End(span, err) }()
+
 	segmentID, err := sr.GetSegmentsIDs(ctx, []string{segmentSlug})
 	if err != nil {
-		sr.ErrLog.Printf("%s: %s", errors.ErrorGettingSegmentID, err)
+		sr.Logger.ErrorContext(ctx, errors.ErrorGettingSegmentID, logging.Err(err))
 		return err
 	}
 
-	tx, err := sr.db.BeginTx(ctx, nil)
+	tx, err := sr.begin(ctx)
 	if err != nil {
-		sr.ErrLog.Printf("%s: %s", errors.ErrorBeginTransaction, err)
+		sr.Logger.ErrorContext(ctx, errors.ErrorBeginTransaction, logging.Err(err))
 		return err
 	}
 
-	_, err = tx.ExecContext(ctx, "UPDATE segments SET is_active = FALSE WHERE id = ?", segmentID[0])
+	_, err = tx.ExecContext(ctx, sr.dialect.Rebind("UPDATE segments SET is_active = FALSE WHERE id = ?"), segmentID[0])
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return err
+	}
+
+	changes := []events.Event{{Type: events.TypeSegmentDeleted, Segment: segmentSlug}}
+	rows, err := tx.QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT user_id FROM user_segment_relation WHERE segment_id = ? AND is_active = TRUE"),
+		segmentID[0],
+	)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		unassigned := events.Event{Type: events.TypeUnassigned, Segment: segmentSlug}
+		err = rows.Scan(&unassigned.UserID)
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+			}
+			return err
+		}
+		changes = append(changes, unassigned)
+	}
+	err = rows.Err()
 	if err != nil {
 		if rbErr := tx.Rollback(); rbErr != nil {
 			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
@@ -265,9 +674,9 @@ func (sr *segmentsRepository) DeleteSegment(ctx context.Context, segmentSlug str
 
 	_, err = tx.ExecContext(
 		ctx,
-		"UPDATE user_segment_relation "+
+		sr.dialect.Rebind("UPDATE user_segment_relation "+
 			"SET is_active = FALSE, date_unassigned = CURRENT_TIMESTAMP "+
-			"WHERE segment_id = ?",
+			"WHERE segment_id = ? AND is_active = TRUE"),
 		segmentID[0],
 	)
 	if err != nil {
@@ -277,17 +686,54 @@ func (sr *segmentsRepository) DeleteSegment(ctx context.Context, segmentSlug str
 		return err
 	}
 
-	err = tx.Commit()
+	err = outbox.Enqueue(ctx, tx, sr.dialect, changes...)
 	if err != nil {
-		sr.ErrLog.Printf("%s: %s", errors.ErrorCommittingTransaction, err)
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
 		return err
 	}
 
-	sr.InfoLog.Printf("DeleteSegment — %s\n", segmentSlug)
+	committed, err := sr.commit(tx, changes)
+	if err != nil {
+		sr.Logger.ErrorContext(ctx, errors.ErrorCommittingTransaction, logging.Err(err))
+		return err
+	}
+	if !committed {
+		return nil
+	}
+
+	sr.events.Publish(changes...)
+	// changes also holds the segment_deleted event itself
+	sr.metrics.SegmentsUnassigned(metrics.SourceSegmentDelete, len(changes)-1)
+	span.SetAttributes(tracing.AttrRows.Int(len(changes) - 1))
+
+	sr.Logger.InfoContext(ctx, "DeleteSegment", logging.KeySegment, segmentSlug)
 	return nil
 }
 
-func (sr *segmentsRepository) UnassignSegments(ctx context.Context, userID []int, segmentsToUnassign []string) error {
+func (sr *segmentsRepository) UnassignSegments(
+	ctx context.Context,
+	userID []int,
+	segmentsToUnassign []string,
+) error {
+	return sr.unassignSegments(ctx, userID, segmentsToUnassign, metrics.SourceAPI)
+}
+
+// unassignSegments is UnassignSegments recording the source of the unassignments in metrics.
+func (sr *segmentsRepository) unassignSegments(
+	ctx context.Context,
+	userID []int,
+	segmentsToUnassign []string,
+	source string,
+) (err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.UnassignSegments",
+		tracing.AttrUserIDs.IntSlice(userID),
+		tracing.AttrSegments.StringSlice(segmentsToUnassign),
+		attribute.String("segment.source", source),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	if len(segmentsToUnassign) == 0 {
 		return nil
 	}
@@ -297,39 +743,56 @@ func (sr *segmentsRepository) UnassignSegments(ctx context.Context, userID []int
 		return err
 	}
 
-	tx, err := sr.db.BeginTx(ctx, nil)
+	tx, err := sr.begin(ctx)
 	if err != nil {
-		sr.ErrLog.Printf("%s: %s", errors.ErrorBeginTransaction, err)
+		sr.Logger.ErrorContext(ctx, errors.ErrorBeginTransaction, logging.Err(err))
 		return err
 	}
 
+	changes := []events.Event{}
 	for _, usr := range userID {
-		for _, id := range ids {
-			_, err = tx.ExecContext(
-				ctx,
-				"UPDATE user_segment_relation "+
-					"SET is_active = FALSE, date_unassigned = CURRENT_TIMESTAMP "+
-					"WHERE user_id = ? AND segment_id = ? AND is_active = TRUE",
-				usr,
-				id,
-			)
-
+		for i, id := range ids {
+			var unassigned bool
+			unassigned, err = sr.unassignTx(ctx, tx, usr, id)
 			if err != nil {
 				if rbErr := tx.Rollback(); rbErr != nil {
 					return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
 				}
 				return err
 			}
+
+			if unassigned {
+				changes = append(changes, events.Event{
+					Type:    events.TypeUnassigned,
+					UserID:  usr,
+					Segment: segmentsToUnassign[i],
+				})
+			}
 		}
 	}
 
-	err = tx.Commit()
+	err = outbox.Enqueue(ctx, tx, sr.dialect, changes...)
 	if err != nil {
-		sr.ErrLog.Printf("%s: %s", errors.ErrorCommittingTransaction, err)
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
 		return err
 	}
 
-	sr.InfoLog.Printf("UnassignSegments — %d\n", userID)
+	committed, err := sr.commit(tx, changes)
+	if err != nil {
+		sr.Logger.ErrorContext(ctx, errors.ErrorCommittingTransaction, logging.Err(err))
+		return err
+	}
+	if !committed {
+		return nil
+	}
+
+	sr.events.Publish(changes...)
+	sr.metrics.SegmentsUnassigned(source, len(changes))
+	span.SetAttributes(tracing.AttrRows.Int(len(changes)))
+
+	sr.Logger.InfoContext(ctx, "UnassignSegments", "user_ids", userID, "unassigned", len(changes))
 	return nil
 }
 
@@ -337,11 +800,27 @@ func (sr *segmentsRepository) AssignSegments(
 	ctx context.Context,
 	userID []int,
 	segmentsToAssign []string,
-	ttl int,
+	expiresAt *time.Time,
 ) error {
-	if len(segmentsToAssign) == 0 {
-		return nil
-	}
+	return sr.assignSegments(ctx, userID, segmentsToAssign, expiresAt, metrics.SourceAPI)
+}
+
+// assignSegments is AssignSegments recording the source of the assignments in metrics.
+// Memberships that are already active are left as they are, expiry included.
+func (sr *segmentsRepository) assignSegments(
+	ctx context.Context,
+	userID []int,
+	segmentsToAssign []string,
+	expiresAt *time.Time,
+	source string,
+) (err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.AssignSegments",
+		tracing.AttrUserIDs.IntSlice(userID),
+		tracing.AttrSegments.StringSlice(segmentsToAssign),
+		attribute.String("segment.source", source),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	if len(segmentsToAssign) == 0 {
 		return nil
 	}
@@ -351,22 +830,17 @@ func (sr *segmentsRepository) AssignSegments(
 		return err
 	}
 
-	tx, err := sr.db.BeginTx(ctx, nil)
+	tx, err := sr.begin(ctx)
 	if err != nil {
-		sr.ErrLog.Printf("%s: %s", errors.ErrorBeginTransaction, err)
+		sr.Logger.ErrorContext(ctx, errors.ErrorBeginTransaction, logging.Err(err))
 		return err
 	}
 
+	changes := []events.Event{}
 	for _, usr := range userID {
-		for _, segmentID := range ids {
-			var rows *sql.Rows
-			rows, err = tx.QueryContext(
-				ctx,
-				"SELECT id FROM user_segment_relation WHERE is_active = TRUE AND user_id = ? AND segment_id = ?",
-				usr,
-				segmentID,
-			)
-
+		for i, segmentID := range ids {
+			var assigned bool
+			assigned, err = sr.assignTx(ctx, tx, usr, segmentID, expiresAt)
 			if err != nil {
 				if rbErr := tx.Rollback(); rbErr != nil {
 					return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
@@ -374,65 +848,255 @@ func (sr *segmentsRepository) AssignSegments(
 				return err
 			}
 
-			ok := rows.Next()
-
-			err = rows.Close()
-			if err != nil {
-				return err
+			if !assigned {
+				continue
 			}
 
-			if ok {
-				return nil
-			}
+			changes = append(changes, events.Event{
+				Type:      events.TypeAssigned,
+				UserID:    usr,
+				Segment:   segmentsToAssign[i],
+				ExpiresAt: expiresAt,
+			})
+		}
+	}
 
-			result, err := tx.ExecContext(
-				ctx,
-				"INSERT INTO user_segment_relation (`user_id`, `segment_id`) VALUES (?, ?)",
-				usr,
-				segmentID,
-			)
-			if err != nil {
-				if rbErr := tx.Rollback(); rbErr != nil {
-					return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+	err = outbox.Enqueue(ctx, tx, sr.dialect, changes...)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return err
+	}
+
+	committed, err := sr.commit(tx, changes)
+	if err != nil {
+		sr.Logger.ErrorContext(ctx, errors.ErrorCommittingTransaction, logging.Err(err))
+		return err
+	}
+	if !committed {
+		return nil
+	}
+
+	sr.events.Publish(changes...)
+	sr.metrics.SegmentsAssigned(source, len(changes))
+	span.SetAttributes(tracing.AttrRows.Int(len(changes)))
+
+	sr.Logger.InfoContext(ctx, "AssignSegments", "user_ids", userID, "assigned", len(changes))
+	return nil
+}
+
+// ApplyChangeSets applies the change sets in a single transaction: either all
+// of them take effect or none does. Segments are unassigned before the new
+// ones are assigned; a segment that is unknown or deleted is skipped, while
+// an unknown user fails the whole call. The outcomes follow the order of the
+// change sets.
+func (sr *segmentsRepository) ApplyChangeSets(ctx context.Context, sets []ChangeSet) (_ []Outcome, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.ApplyChangeSets", attribute.Int("segment.change_sets", len(sets)))
+	defer func() { tracing.End(span, err) }()
+
+	err = validateChangeSets(sets)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := sr.begin(ctx)
+	if err != nil {
+		sr.Logger.ErrorContext(ctx, errors.ErrorBeginTransaction, logging.Err(err))
+		return nil, err
+	}
+
+	outcomes, changes, err := sr.applyChangeSets(ctx, tx, sets)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return nil, err
+	}
+
+	err = outbox.Enqueue(ctx, tx, sr.dialect, changes...)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return nil, err
+	}
+
+	committed, err := sr.commit(tx, changes)
+	if err != nil {
+		sr.Logger.ErrorContext(ctx, errors.ErrorCommittingTransaction, logging.Err(err))
+		return nil, err
+	}
+	if !committed {
+		return outcomes, nil
+	}
+
+	sr.events.Publish(changes...)
+	assigned, unassigned := countChanges(changes)
+	sr.metrics.SegmentsAssigned(metrics.SourceAPI, assigned)
+	sr.metrics.SegmentsUnassigned(metrics.SourceAPI, unassigned)
+	span.SetAttributes(tracing.AttrRows.Int(len(changes)))
+
+	sr.Logger.InfoContext(ctx, "ApplyChangeSets", "change_sets", len(sets), "assigned", assigned, "unassigned", unassigned)
+	return outcomes, nil
+}
+
+func (sr *segmentsRepository) applyChangeSets(
+	ctx context.Context,
+	tx *sql.Tx,
+	sets []ChangeSet,
+) ([]Outcome, []events.Event, error) {
+	ids, err := sr.activeSegmentsIDs(ctx, tx, changeSetSlugs(sets))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	outcomes := []Outcome{}
+	changes := []events.Event{}
+	for _, set := range sets {
+		for _, slug := range set.Unassign {
+			outcome := Outcome{UserID: set.UserID, Segment: slug, Outcome: OutcomeUnknownSegment}
+			if id, ok := ids[slug]; ok {
+				unassigned, err := sr.unassignTx(ctx, tx, set.UserID, id)
+				if err != nil {
+					return nil, nil, err
+				}
+				outcome.Outcome = OutcomeNotMember
+				if unassigned {
+					outcome.Outcome = OutcomeUnassigned
+					changes = append(changes, events.Event{Type: events.TypeUnassigned, UserID: set.UserID, Segment: slug})
 				}
-				return err
 			}
+			outcomes = append(outcomes, outcome)
+		}
 
-			if lastID, err := result.LastInsertId(); err == nil && ttl != 0 {
-				unassignTime := time.Now().AddDate(0, 0, ttl)
-				_, err = tx.ExecContext(
-					ctx,
-					"UPDATE user_segment_relation SET date_unassigned = ? WHERE id = ?",
-					unassignTime,
-					lastID,
-				)
+		for _, slug := range set.Assign {
+			outcome := Outcome{UserID: set.UserID, Segment: slug, Outcome: OutcomeUnknownSegment}
+			if id, ok := ids[slug]; ok {
+				assigned, err := sr.assignTx(ctx, tx, set.UserID, id, set.ExpiresAt)
+				if err != nil {
+					return nil, nil, err
+				}
+				outcome.Outcome = OutcomeAlreadyMember
+				if assigned {
+					outcome.Outcome = OutcomeAssigned
+					changes = append(changes, events.Event{
+						Type:      events.TypeAssigned,
+						UserID:    set.UserID,
+						Segment:   slug,
+						ExpiresAt: set.ExpiresAt,
+					})
+				}
 			}
+			outcomes = append(outcomes, outcome)
 		}
 	}
+	return outcomes, changes, nil
+}
 
-	err = tx.Commit()
+// activeSegmentsIDs maps the slugs of the segments that exist and are not
+// deleted to their IDs.
+func (sr *segmentsRepository) activeSegmentsIDs(
+	ctx context.Context,
+	tx *sql.Tx,
+	segmentSlugs []string,
+) (map[string]int, error) {
+	ids := make(map[string]int, len(segmentSlugs))
+	for _, slug := range segmentSlugs {
+		var id int
+		err := tx.QueryRowContext(
+			ctx,
+			sr.dialect.Rebind("SELECT id FROM segments WHERE slug = ? AND is_active = TRUE"),
+			slug,
+		).Scan(&id)
+		if stderrors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids[slug] = id
+	}
+	return ids, nil
+}
+
+// assignTx makes the user a member of the segment unless they already are,
+// and reports whether they were not.
+func (sr *segmentsRepository) assignTx(
+	ctx context.Context,
+	tx *sql.Tx,
+	userID, segmentID int,
+	expiresAt *time.Time,
+) (bool, error) {
+	rows, err := tx.QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT id FROM user_segment_relation WHERE is_active = TRUE AND user_id = ? AND segment_id = ?"),
+		userID,
+		segmentID,
+	)
 	if err != nil {
-		sr.ErrLog.Printf("%s: %s", errors.ErrorCommittingTransaction, err)
-		return err
+		return false, err
 	}
 
-	sr.InfoLog.Printf("AssignSegments — %d\n", userID)
-	return nil
+	active := rows.Next()
+
+	err = rows.Close()
+	if err != nil || active {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		sr.dialect.Rebind("INSERT INTO user_segment_relation (user_id, segment_id, date_unassigned) VALUES (?, ?, ?)"),
+		userID,
+		segmentID,
+		expiresAt,
+	)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func (sr *segmentsRepository) GetUserSegments(ctx context.Context, userID int) (*UserSegments, error) {
-	rows, err := sr.db.QueryContext(
+// unassignTx ends the active membership of the user in the segment, if any,
+// and reports whether there was one.
+func (sr *segmentsRepository) unassignTx(ctx context.Context, tx *sql.Tx, userID, segmentID int) (bool, error) {
+	result, err := tx.ExecContext(
 		ctx,
-		"SELECT slug FROM segments "+
-			"WHERE id IN ("+
-			"SELECT segment_id FROM user_segment_relation "+
-			"WHERE user_id = ? AND is_active = TRUE"+
-			") AND is_active = TRUE",
+		sr.dialect.Rebind("UPDATE user_segment_relation "+
+			"SET is_active = FALSE, date_unassigned = CURRENT_TIMESTAMP "+
+			"WHERE user_id = ? AND segment_id = ? AND is_active = TRUE"),
+		userID,
+		segmentID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", errors.ErrorGettingAffectedRows, err)
+	}
+	return affected > 0, nil
+}
+
+func (sr *segmentsRepository) GetUserSegments(ctx context.Context, userID int) (_ *UserSegments, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.GetUserSegments", tracing.AttrUserID.Int(userID))
+	defer func() { tracing.End(span, err) }()
+
+	rows, err := sr.conn().QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT s.slug, r.date_unassigned FROM user_segment_relation r "+
+			"JOIN segments s ON s.id = r.segment_id "+
+			"WHERE r.user_id = ? AND r.is_active = TRUE AND s.is_active = TRUE "+
+			"AND (r.date_unassigned IS NULL OR r.date_unassigned > CURRENT_TIMESTAMP) "+
+			"ORDER BY s.slug"),
 		userID,
 	)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	userSegments := &UserSegments{
 		UserID:   userID,
@@ -441,17 +1105,274 @@ func (sr *segmentsRepository) GetUserSegments(ctx context.Context, userID int) (
 
 	for rows.Next() {
 		var segment string
-		err = rows.Scan(&segment)
+		var expiresAt sql.NullTime
+		err = rows.Scan(&segment, &expiresAt)
 		if err != nil {
 			return nil, err
 		}
-		userSegments.Segments = append(userSegments.Segments, segment)
+		if expiresAt.Valid {
+			expiry := expiresAt.Time.UTC()
+			userSegments.add(segment, &expiry)
+		} else {
+			userSegments.add(segment, nil)
+		}
 	}
-	err = rows.Close()
+	err = rows.Err()
 	if err != nil {
 		return nil, err
 	}
 
-	sr.InfoLog.Printf("GetSegments — %d\n", userID)
+	span.SetAttributes(tracing.AttrRows.Int(len(userSegments.Segments)))
+	sr.Logger.InfoContext(ctx, "GetUserSegments", logging.KeyUserID, userID)
 	return userSegments, nil
 }
+
+// UpdateSegmentsExpiry moves the expiry of the user's active memberships in
+// segments to expiresAt, or removes it if expiresAt is nil. It returns how
+// many memberships were changed.
+func (sr *segmentsRepository) UpdateSegmentsExpiry(
+	ctx context.Context,
+	userID int,
+	segments []string,
+	expiresAt *time.Time,
+) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.UpdateSegmentsExpiry",
+		tracing.AttrUserID.Int(userID),
+		tracing.AttrSegments.StringSlice(segments),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	if len(segments) == 0 {
+		return 0, nil
+	}
+
+	ids, err := sr.GetSegmentsIDs(ctx, segments)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := sr.begin(ctx)
+	if err != nil {
+		sr.Logger.ErrorContext(ctx, errors.ErrorBeginTransaction, logging.Err(err))
+		return 0, err
+	}
+
+	changes := []events.Event{}
+	for i, id := range ids {
+		var result sql.Result
+		result, err = tx.ExecContext(
+			ctx,
+			sr.dialect.Rebind("UPDATE user_segment_relation SET date_unassigned = ? "+
+				"WHERE user_id = ? AND segment_id = ? AND is_active = TRUE "+
+				"AND (date_unassigned IS NULL OR date_unassigned > CURRENT_TIMESTAMP)"),
+			expiresAt,
+			userID,
+			id,
+		)
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				return 0, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+			}
+			return 0, err
+		}
+
+		var affected int64
+		affected, err = result.RowsAffected()
+		if err != nil {
+			sr.Logger.ErrorContext(ctx, errors.ErrorGettingAffectedRows, logging.Err(err))
+			if rbErr := tx.Rollback(); rbErr != nil {
+				return 0, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+			}
+			return 0, err
+		}
+		if affected > 0 {
+			changes = append(changes, events.Event{
+				Type:      events.TypeExpiryChanged,
+				UserID:    userID,
+				Segment:   segments[i],
+				ExpiresAt: expiresAt,
+			})
+		}
+	}
+
+	err = outbox.Enqueue(ctx, tx, sr.dialect, changes...)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return 0, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return 0, err
+	}
+
+	committed, err := sr.commit(tx, changes)
+	if err != nil {
+		sr.Logger.ErrorContext(ctx, errors.ErrorCommittingTransaction, logging.Err(err))
+		return 0, err
+	}
+	if !committed {
+		return len(changes), nil
+	}
+
+	sr.events.Publish(changes...)
+	span.SetAttributes(tracing.AttrRows.Int(len(changes)))
+
+	sr.Logger.InfoContext(ctx, "UpdateSegmentsExpiry", logging.KeyUserID, userID, "updated", len(changes))
+	return len(changes), nil
+}
+
+// GetUsersSegments reads the segments of many users in a single query.
+func (sr *segmentsRepository) GetUsersSegments(ctx context.Context, userIDs []int) (_ *BatchUserSegments, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.GetUsersSegments", tracing.AttrUserIDs.IntSlice(userIDs))
+	defer func() { tracing.End(span, err) }()
+
+	batch := &BatchUserSegments{
+		Users:        make(map[int][]string, len(userIDs)),
+		UnknownUsers: []int{},
+	}
+	if len(userIDs) == 0 {
+		return batch, nil
+	}
+
+	args := make([]interface{}, 0, len(userIDs))
+	for _, id := range userIDs {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(userIDs)), ", ")
+
+	rows, err := sr.conn().QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT DISTINCT u.id, s.slug, r.date_unassigned FROM users u "+
+			"LEFT JOIN user_segment_relation r ON r.user_id = u.id AND r.is_active = TRUE "+
+			"AND (r.date_unassigned IS NULL OR r.date_unassigned > CURRENT_TIMESTAMP) "+
+			"LEFT JOIN segments s ON s.id = r.segment_id AND s.is_active = TRUE "+
+			"WHERE u.id IN ("+placeholders+") ORDER BY u.id, s.slug"),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[int]*UserSegments, len(userIDs))
+	for rows.Next() {
+		var userID int
+		var slug sql.NullString
+		var expiresAt sql.NullTime
+		err = rows.Scan(&userID, &slug, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		userSegments, ok := users[userID]
+		if !ok {
+			userSegments = &UserSegments{UserID: userID, Segments: []string{}}
+			users[userID] = userSegments
+		}
+		// users without segments come back once with a NULL slug
+		if !slug.Valid {
+			continue
+		}
+		if expiresAt.Valid {
+			expiry := expiresAt.Time.UTC()
+			userSegments.add(slug.String, &expiry)
+		} else {
+			userSegments.add(slug.String, nil)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, userSegments := range users {
+		batch.setUser(userSegments)
+	}
+
+	batch.UnknownUsers = unknownUsers(userIDs, batch.Users)
+	span.SetAttributes(tracing.AttrRows.Int(len(batch.Users)))
+	sr.Logger.InfoContext(ctx, "GetUsersSegments", "users", len(userIDs), "unknown", len(batch.UnknownUsers))
+	return batch, nil
+}
+
+// unknownUsers returns the distinct requested IDs missing from found, in request order.
+func unknownUsers(userIDs []int, found map[int][]string) []int {
+	unknown := []int{}
+	seen := make(map[int]bool, len(userIDs))
+	for _, id := range userIDs {
+		if _, ok := found[id]; ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		unknown = append(unknown, id)
+	}
+	return unknown
+}
+
+func (sr *segmentsRepository) GetSnapshot(ctx context.Context) (_ *Snapshot, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentsRepo.GetSnapshot")
+	defer func() { tracing.End(span, err) }()
+
+	snapshot := &Snapshot{
+		GeneratedAt: time.Now().UTC(),
+		Segments:    []string{},
+		Memberships: []SnapshotMembership{},
+	}
+
+	rows, err := sr.conn().QueryContext(ctx, "SELECT slug FROM segments WHERE is_active = TRUE ORDER BY slug")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var slug string
+		err = rows.Scan(&slug)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Segments = append(snapshot.Segments, slug)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = sr.conn().QueryContext(
+		ctx,
+		`SELECT usr.user_id, s.slug, usr.date_unassigned
+		FROM user_segment_relation usr
+		JOIN segments s ON usr.segment_id = s.id
+		WHERE usr.is_active = TRUE AND s.is_active = TRUE
+		AND (usr.date_unassigned IS NULL OR usr.date_unassigned > CURRENT_TIMESTAMP)
+		ORDER BY usr.user_id, s.slug`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var membership SnapshotMembership
+		var expiresAt sql.NullTime
+		err = rows.Scan(&membership.UserID, &membership.Segment, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			expiry := expiresAt.Time.UTC()
+			membership.ExpiresAt = &expiry
+		}
+		snapshot.Memberships = append(snapshot.Memberships, membership)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	err = snapshot.ComputeVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	span.SetAttributes(tracing.AttrRows.Int(len(snapshot.Memberships)))
+	sr.Logger.InfoContext(ctx, "GetSnapshot", "version", snapshot.Version)
+	return snapshot, nil
+}
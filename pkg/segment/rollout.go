@@ -0,0 +1,21 @@
+package segment
+
+import (
+	"fmt"
+	"math"
+)
+
+// rolloutSize is the number of members making up fraction percent of the
+// active users, rounded up so that a rollout never misses its target.
+func rolloutSize(activeUsers, fraction int) int {
+	return int(math.Ceil(float64(activeUsers) * (float64(fraction) / 100))) //nolint:gomnd // creating percents
+}
+
+// validateTarget accepts a percentage of the active users to keep a segment
+// at, zero included.
+func validateTarget(fraction int) error {
+	if fraction < 0 || fraction > 100 {
+		return fmt.Errorf("invalid target percentage: %d", fraction)
+	}
+	return nil
+}
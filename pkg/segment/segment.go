@@ -1,32 +1,143 @@
 package segment
 
+import "time"
+
 type Template struct {
 	SegmentSlug      string   `json:"segment_slug,omitempty"`
 	Segments         []string `json:"segments,omitempty"`
 	UserID           int      `json:"user_id,omitempty"`
+	UserIDs          []int    `json:"user_ids,omitempty"`
 	AssignSegments   []string `json:"assign_segments,omitempty"`
 	UnassignSegments []string `json:"unassign_segments,omitempty"`
 	Fraction         int      `json:"fraction,omitempty"`
 	TTL              int      `json:"ttl"`
+	ExpiresAt        string   `json:"expires_at,omitempty"`
+	DryRun           bool     `json:"dry_run,omitempty"`
 }
 
 type RequestUserID struct {
 	UserID int `json:"user_id"`
 }
 
+type RequestUserIDs struct {
+	UserIDs []int `json:"user_ids"`
+}
+
+// RequestSegmentSlug: with DryRun set nothing is changed, the response is the
+// Diff of what would be.
 type RequestSegmentSlug struct {
 	SegmentSlug string `json:"segment_slug"`
 	Fraction    int    `json:"fraction"`
+	DryRun      bool   `json:"dry_run"`
 }
 
+// RequestUpdateSegments: ExpiresAt is an RFC3339 timestamp or an ISO-8601
+// duration such as PT36H. TTL in days is deprecated in its favour.
 type RequestUpdateSegments struct {
 	UserID           int      `json:"user_id"`
 	AssignSegments   []string `json:"assign_segments"`
 	UnassignSegments []string `json:"unassign_segments"`
 	TTL              int      `json:"ttl"`
+	ExpiresAt        string   `json:"expires_at"`
+	DryRun           bool     `json:"dry_run"`
+}
+
+// RequestUpdateUsersSegments applies the same change to every user, as
+// RequestUpdateSegments does to one.
+type RequestUpdateUsersSegments struct {
+	UserIDs          []int    `json:"user_ids"`
+	AssignSegments   []string `json:"assign_segments"`
+	UnassignSegments []string `json:"unassign_segments"`
+	TTL              int      `json:"ttl"`
+	ExpiresAt        string   `json:"expires_at"`
+	DryRun           bool     `json:"dry_run"`
+}
+
+// RequestUpdateExpiry: an empty ExpiresAt makes the memberships permanent.
+type RequestUpdateExpiry struct {
+	UserID    int      `json:"user_id"`
+	Segments  []string `json:"segments"`
+	ExpiresAt string   `json:"expires_at"`
+	DryRun    bool     `json:"dry_run"`
+}
+
+type UpdatedMemberships struct {
+	Updated int `json:"updated"`
 }
 
+// UserSegments: ExpiresAt holds the expiry of the segments that have one.
 type UserSegments struct {
-	UserID   int      `json:"user_id"`
-	Segments []string `json:"segments"`
+	UserID    int                  `json:"user_id"`
+	Segments  []string             `json:"segments"`
+	ExpiresAt map[string]time.Time `json:"expires_at,omitempty"`
+}
+
+// BatchUserSegments maps every requested user to their segments and, for the
+// users with expiring memberships, to the expiry of those segments. Users that
+// do not exist are listed in UnknownUsers instead of getting no segments.
+type BatchUserSegments struct {
+	Users        map[int][]string             `json:"users"`
+	ExpiresAt    map[int]map[string]time.Time `json:"expires_at,omitempty"`
+	UnknownUsers []int                        `json:"unknown_users"`
+}
+
+// setUser puts the segments of one user into the batch.
+func (b *BatchUserSegments) setUser(us *UserSegments) {
+	b.Users[us.UserID] = us.Segments
+	if len(us.ExpiresAt) == 0 {
+		return
+	}
+	if b.ExpiresAt == nil {
+		b.ExpiresAt = make(map[int]map[string]time.Time)
+	}
+	b.ExpiresAt[us.UserID] = us.ExpiresAt
+}
+
+// user returns the segments of one user of the batch.
+func (b *BatchUserSegments) user(userID int) *UserSegments {
+	return &UserSegments{UserID: userID, Segments: b.Users[userID], ExpiresAt: b.ExpiresAt[userID]}
+}
+
+// add appends a membership of slug; the memberships are added in slug order.
+// A user may hold several active memberships of a segment: they count once,
+// with the expiry of the one kept longest, whichever of them comes first.
+func (us *UserSegments) add(slug string, expiresAt *time.Time) {
+	if n := len(us.Segments); n > 0 && us.Segments[n-1] == slug {
+		current, expires := us.ExpiresAt[slug]
+		switch {
+		case !expires:
+		case expiresAt == nil:
+			delete(us.ExpiresAt, slug)
+		case expiresAt.After(current):
+			us.ExpiresAt[slug] = *expiresAt
+		}
+		return
+	}
+
+	us.Segments = append(us.Segments, slug)
+	if expiresAt == nil {
+		return
+	}
+	if us.ExpiresAt == nil {
+		us.ExpiresAt = make(map[string]time.Time)
+	}
+	us.ExpiresAt[slug] = *expiresAt
+}
+
+// withoutExpired drops the segments whose expiry is not after now.
+func (us *UserSegments) withoutExpired(now time.Time) *UserSegments {
+	current := &UserSegments{
+		UserID:   us.UserID,
+		Segments: []string{},
+	}
+	for _, slug := range us.Segments {
+		expiresAt, ok := us.ExpiresAt[slug]
+		switch {
+		case !ok:
+			current.add(slug, nil)
+		case expiresAt.After(now):
+			current.add(slug, &expiresAt)
+		}
+	}
+	return current
 }
@@ -0,0 +1,67 @@
+package segment_test
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"usersegmentator/config"
+	"usersegmentator/pkg/repotest"
+)
+
+// serverBackendsEnv lists the database servers to run the conformance suite
+// against as well, e.g. "mysql,postgres". They are configured like the
+// service, from config.yml and the environment, and their schema is recreated
+// for every check, so they must point at a disposable database.
+const serverBackendsEnv = "CONFORMANCE_BACKENDS"
+
+func TestMain(m *testing.M) {
+	// repositories log every call at info level
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	os.Exit(m.Run())
+}
+
+type backend struct {
+	name string
+	open func(t *testing.T, cached bool) repotest.Opener
+}
+
+func TestConformance(t *testing.T) {
+	backends := []backend{
+		{"memory", func(_ *testing.T, cached bool) repotest.Opener { return repotest.MemoryOpener(cached) }},
+		{"sqlite", func(t *testing.T, cached bool) repotest.Opener { return repotest.SQLiteOpener(t.TempDir(), cached) }},
+	}
+
+	if servers := os.Getenv(serverBackendsEnv); servers != "" {
+		for _, name := range strings.Split(servers, ",") {
+			name := name
+			backends = append(backends, backend{name, func(t *testing.T, cached bool) repotest.Opener {
+				cfg, err := config.ReadConfig(filepath.Join("..", "..", "config", "config.yml"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg.Database.Backend = name
+				return repotest.ServerOpener(cfg, cached)
+			}})
+		}
+	}
+
+	for _, b := range backends {
+		b := b
+		for _, cached := range []bool{false, true} {
+			cached := cached
+			name := b.name
+			if cached {
+				name += "/cached"
+			}
+			t.Run(name, func(t *testing.T) {
+				err := repotest.Run(context.Background(), b.open(t, cached))
+				if err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
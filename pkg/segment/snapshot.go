@@ -0,0 +1,86 @@
+package segment
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Snapshot is a point-in-time export of every active segment and membership.
+// It carries enough data to answer GetUserSegments without calling the service.
+type Snapshot struct {
+	Version     string               `json:"version"`
+	GeneratedAt time.Time            `json:"generated_at"`
+	Segments    []string             `json:"segments"`
+	Memberships []SnapshotMembership `json:"memberships"`
+
+	active map[string]bool
+	byUser map[int][]SnapshotMembership
+}
+
+type SnapshotMembership struct {
+	UserID    int        `json:"user_id"`
+	Segment   string     `json:"segment"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// ComputeVersion derives the snapshot version from its content, so two
+// snapshots with the same segments and memberships share the same version.
+func (s *Snapshot) ComputeVersion() error {
+	content, err := json.Marshal(struct {
+		Segments    []string             `json:"segments"`
+		Memberships []SnapshotMembership `json:"memberships"`
+	}{s.Segments, s.Memberships})
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(content)
+	s.Version = hex.EncodeToString(sum[:])
+	return nil
+}
+
+// Index builds lookup tables so that UserSegments does not scan every
+// membership. It must be called before the snapshot is shared between goroutines.
+func (s *Snapshot) Index() {
+	s.active = make(map[string]bool, len(s.Segments))
+	for _, slug := range s.Segments {
+		s.active[slug] = true
+	}
+
+	s.byUser = make(map[int][]SnapshotMembership)
+	for _, m := range s.Memberships {
+		s.byUser[m.UserID] = append(s.byUser[m.UserID], m)
+	}
+}
+
+// UserSegments evaluates the snapshot for a single user the same way the
+// repository does: a membership counts while both it and its segment are
+// active and its expiry, if any, is still in the future. Duplicate
+// memberships of a segment count once, with the longest expiry.
+func (s *Snapshot) UserSegments(userID int, now time.Time) *UserSegments {
+	if s.byUser == nil {
+		s.Index()
+	}
+
+	userSegments := &UserSegments{
+		UserID:   userID,
+		Segments: []string{},
+	}
+
+	memberships := append([]SnapshotMembership{}, s.byUser[userID]...)
+	sort.Slice(memberships, func(i, j int) bool { return memberships[i].Segment < memberships[j].Segment })
+
+	for _, m := range memberships {
+		if !s.active[m.Segment] {
+			continue
+		}
+		if m.ExpiresAt != nil && !m.ExpiresAt.After(now) {
+			continue
+		}
+		userSegments.add(m.Segment, m.ExpiresAt)
+	}
+	return userSegments
+}
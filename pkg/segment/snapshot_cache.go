@@ -0,0 +1,88 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/logging"
+	"usersegmentator/pkg/metrics"
+	"usersegmentator/pkg/tracing"
+)
+
+const segmentsSnapshotCache = "segments_snapshot"
+
+// SnapshotCache keeps the last snapshot and its JSON encoding, so that
+// polls do not export the whole membership table each time.
+//
+// The snapshot is dropped on every change published by this instance.
+// Changes made through other instances are picked up once the snapshot is
+// older than the TTL; a zero TTL disables the cache. Only one rebuild runs at
+// a time, and polls arriving meanwhile wait for its result.
+type SnapshotCache struct {
+	repo    Repository
+	ttl     time.Duration
+	metrics *metrics.Metrics
+	Logger  *slog.Logger
+
+	// generation is advanced on every published change; a snapshot is only
+	// reused while the generation it was built in is current
+	generation atomic.Uint64
+
+	mu       sync.Mutex
+	snapshot *Snapshot
+	encoded  []byte
+	builtIn  uint64
+	builtAt  time.Time
+}
+
+func NewSnapshotCache(repo Repository, cfg *config.Config, broker *events.Broker, m *metrics.Metrics) *SnapshotCache {
+	sc := &SnapshotCache{
+		repo:    repo,
+		ttl:     time.Duration(cfg.Segment.SnapshotTTL) * time.Second,
+		metrics: m,
+		Logger:  logging.For("snapshot_cache"),
+	}
+
+	broker.OnPublish(func([]events.Event) { sc.generation.Add(1) })
+	return sc
+}
+
+// Get returns the current snapshot together with its JSON encoding.
+func (sc *SnapshotCache) Get(ctx context.Context) (_ *Snapshot, _ []byte, err error) {
+	ctx, span := tracing.Start(ctx, "SnapshotCache.Get")
+	defer func() { tracing.End(span, err) }()
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	generation := sc.generation.Load()
+	hit := sc.snapshot != nil && sc.builtIn == generation && time.Since(sc.builtAt) < sc.ttl
+	span.SetAttributes(tracing.AttrCacheHit.Bool(hit))
+	if hit {
+		sc.metrics.CacheLookup(segmentsSnapshotCache, metrics.CacheHit)
+		return sc.snapshot, sc.encoded, nil
+	}
+	sc.metrics.CacheLookup(segmentsSnapshotCache, metrics.CacheMiss)
+
+	builtAt := time.Now()
+	snapshot, err := sc.repo.GetSnapshot(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encoded, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// a change published during the export may be missing from it; the
+	// generation is read before the export, so the next poll rebuilds then
+	sc.snapshot, sc.encoded, sc.builtIn, sc.builtAt = snapshot, encoded, generation, builtAt
+	sc.Logger.DebugContext(ctx, "snapshot rebuilt", "version", snapshot.Version, "size", len(encoded))
+	return snapshot, encoded, nil
+}
@@ -0,0 +1,95 @@
+package segment_test
+
+import (
+	"context"
+	"testing"
+	"usersegmentator/config"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/segment"
+)
+
+// countingRepo counts the snapshot exports.
+type countingRepo struct {
+	segment.Repository
+	exports int
+}
+
+func (cr *countingRepo) GetSnapshot(ctx context.Context) (*segment.Snapshot, error) {
+	cr.exports++
+	return cr.Repository.GetSnapshot(ctx)
+}
+
+func newSnapshotCache(t *testing.T, ttl int) (*segment.SnapshotCache, *countingRepo) {
+	t.Helper()
+
+	cfg := &config.Config{}
+	cfg.Segment.SnapshotTTL = ttl
+	broker := events.NewBroker(cfg)
+	t.Cleanup(broker.Close)
+
+	memory := segment.NewMemoryRepo(cfg, broker, nil)
+	memory.AddUsers(1, 2)
+	if err := memory.InsertSegment(context.Background(), "SNAPSHOT", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &countingRepo{Repository: memory}
+	return segment.NewSnapshotCache(repo, cfg, broker, nil), repo
+}
+
+func getSnapshot(t *testing.T, sc *segment.SnapshotCache) *segment.Snapshot {
+	t.Helper()
+
+	snapshot, encoded, err := sc.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encoded) == 0 {
+		t.Fatal("snapshot not encoded")
+	}
+	return snapshot
+}
+
+func TestSnapshotCacheReusesSnapshot(t *testing.T) {
+	sc, repo := newSnapshotCache(t, 60)
+
+	first := getSnapshot(t, sc)
+	second := getSnapshot(t, sc)
+	if repo.exports != 1 {
+		t.Fatalf("exported %d times, want 1", repo.exports)
+	}
+	if first.Version != second.Version {
+		t.Fatalf("version changed without changes: %s -> %s", first.Version, second.Version)
+	}
+}
+
+func TestSnapshotCacheRebuildsAfterPublishedChange(t *testing.T) {
+	sc, repo := newSnapshotCache(t, 60)
+	ctx := context.Background()
+
+	before := getSnapshot(t, sc)
+	if err := repo.AssignSegments(ctx, []int{1}, []string{"SNAPSHOT"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	after := getSnapshot(t, sc)
+	if repo.exports != 2 {
+		t.Fatalf("exported %d times, want 2", repo.exports)
+	}
+	if before.Version == after.Version {
+		t.Fatal("version unchanged after assignment")
+	}
+	if got := after.UserSegments(1, after.GeneratedAt).Segments; len(got) != 1 || got[0] != "SNAPSHOT" {
+		t.Fatalf("user 1 segments: %v", got)
+	}
+}
+
+func TestSnapshotCacheDisabled(t *testing.T) {
+	sc, repo := newSnapshotCache(t, 0)
+
+	getSnapshot(t, sc)
+	getSnapshot(t, sc)
+	if repo.exports != 2 {
+		t.Fatalf("exported %d times, want 2", repo.exports)
+	}
+}
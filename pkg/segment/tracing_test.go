@@ -0,0 +1,177 @@
+package segment_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/migrate"
+	"usersegmentator/pkg/segment"
+	"usersegmentator/pkg/tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTracedRepo opens a SQL repository on a new SQLite database seeded with
+// users 1 to 10, and records the spans it starts.
+func newTracedRepo(t *testing.T) (segment.Repository, *tracetest.SpanRecorder) {
+	t.Helper()
+	ctx := context.Background()
+
+	cfg := &config.Config{}
+	cfg.Database.Backend = dialect.SQLite
+	cfg.Database.Timeout = 5
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "tracing.db")
+
+	db, err := dialect.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	migrator, err := migrate.NewMigrator(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrate.SeedUsers(ctx, db, cfg, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	broker := events.NewBroker(cfg)
+	t.Cleanup(broker.Close)
+	repo := segment.NewSegmentsRepo(db, cfg, broker, nil)
+	if err = repo.InsertSegment(ctx, "TRACED", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := otel.GetTracerProvider()
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return repo, recorder
+}
+
+// findSpan returns the only ended span named name.
+func findSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+
+	var found []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			found = append(found, span)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("recorded %d %s spans, expected 1", len(found), name)
+	}
+	return found[0]
+}
+
+func expectSpanAttributes(t *testing.T, span sdktrace.ReadOnlySpan, expected ...attribute.KeyValue) {
+	t.Helper()
+
+	got := map[attribute.Key]attribute.Value{}
+	for _, attr := range span.Attributes() {
+		got[attr.Key] = attr.Value
+	}
+	for _, attr := range expected {
+		value, ok := got[attr.Key]
+		if !ok {
+			t.Fatalf("span %s has no %s attribute", span.Name(), attr.Key)
+		}
+		if value.Emit() != attr.Value.Emit() {
+			t.Fatalf("span %s has %s = %s, expected %s", span.Name(), attr.Key, value.Emit(), attr.Value.Emit())
+		}
+	}
+}
+
+func TestRepoSpansAutoAssign(t *testing.T) {
+	repo, recorder := newTracedRepo(t)
+
+	if err := repo.AutoAssignSegment(context.Background(), 50, "TRACED", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	root := findSpan(t, recorder, "SegmentsRepo.AutoAssignSegment")
+	expectSpanAttributes(t, root,
+		tracing.AttrSegment.String("TRACED"),
+		attribute.Int("segment.fraction", 50),
+		tracing.AttrRows.Int(5),
+	)
+	if root.Status().Code != codes.Unset {
+		t.Fatalf("span status %+v", root.Status())
+	}
+
+	sample := findSpan(t, recorder, "SegmentsRepo.GetNRandomUsersWithoutSegment")
+	expectSpanAttributes(t, sample, tracing.AttrSegment.String("TRACED"), tracing.AttrRows.Int(5))
+
+	assign := findSpan(t, recorder, "SegmentsRepo.AssignSegments")
+	expectSpanAttributes(t, assign,
+		tracing.AttrSegments.StringSlice([]string{"TRACED"}),
+		tracing.AttrRows.Int(5),
+	)
+
+	// the queries of the call are traced under its span
+	for _, child := range []sdktrace.ReadOnlySpan{
+		findSpan(t, recorder, "SegmentsRepo.GetActiveUsersAmount"), sample, assign,
+	} {
+		if child.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Fatalf("span %s not started under %s", child.Name(), root.Name())
+		}
+	}
+}
+
+func TestRepoSpansUserSegments(t *testing.T) {
+	repo, recorder := newTracedRepo(t)
+	ctx := context.Background()
+
+	if err := repo.AssignSegments(ctx, []int{3}, []string{"TRACED"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetUserSegments(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetUsersSegments(ctx, []int{3, 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectSpanAttributes(t, findSpan(t, recorder, "SegmentsRepo.AssignSegments"),
+		tracing.AttrUserIDs.IntSlice([]int{3}),
+		tracing.AttrSegments.StringSlice([]string{"TRACED"}),
+		tracing.AttrRows.Int(1),
+	)
+	expectSpanAttributes(t, findSpan(t, recorder, "SegmentsRepo.GetUserSegments"),
+		tracing.AttrUserID.Int(3),
+		tracing.AttrRows.Int(1),
+	)
+	expectSpanAttributes(t, findSpan(t, recorder, "SegmentsRepo.GetUsersSegments"),
+		tracing.AttrUserIDs.IntSlice([]int{3, 4}),
+		tracing.AttrRows.Int(2),
+	)
+}
+
+func TestRepoSpansRecordErrors(t *testing.T) {
+	repo, recorder := newTracedRepo(t)
+
+	if err := repo.AutoAssignSegment(context.Background(), 0, "TRACED", nil); err == nil {
+		t.Fatal("invalid fraction accepted")
+	}
+
+	span := findSpan(t, recorder, "SegmentsRepo.AutoAssignSegment")
+	expectSpanAttributes(t, span, tracing.AttrSegment.String("TRACED"), attribute.Int("segment.fraction", 0))
+	if span.Status().Code != codes.Error {
+		t.Fatalf("span status %+v, expected an error", span.Status())
+	}
+	if events := span.Events(); len(events) != 1 || events[0].Name != "exception" {
+		t.Fatalf("error not recorded: %+v", events)
+	}
+}
@@ -0,0 +1,89 @@
+package segment
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/metrics"
+)
+
+// TTLWorker expires the memberships past their date_unassigned.
+type TTLWorker struct {
+	repo      Repository
+	interval  time.Duration
+	batchSize int
+	metrics   *metrics.Metrics
+
+	// heartbeat is the UnixNano time the worker last completed a run
+	heartbeat atomic.Int64
+}
+
+func NewTTLWorker(repo Repository, cfg *config.Config, m *metrics.Metrics) *TTLWorker {
+	interval := time.Duration(cfg.Segment.TTLCheckInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	batchSize := cfg.Segment.TTLBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	return &TTLWorker{
+		repo:      repo,
+		interval:  interval,
+		batchSize: batchSize,
+		metrics:   m,
+	}
+}
+
+// Expire is RunOnce for the job scheduler, which runs it every interval.
+func (w *TTLWorker) Expire(ctx context.Context) error {
+	_, err := w.RunOnce(ctx)
+	return err
+}
+
+// RunOnce expires every due membership batch by batch, going on while the
+// batches come back full, and returns how many memberships it expired. A
+// failed batch ends the run; the batches committed before it stay expired.
+func (w *TTLWorker) RunOnce(ctx context.Context) (int, error) {
+	start := time.Now()
+	total := 0
+
+	var err error
+	for ctx.Err() == nil {
+		var expired int
+		expired, err = w.repo.ExpireMemberships(ctx, w.batchSize)
+		if err != nil {
+			break
+		}
+		total += expired
+		w.metrics.TTLBatch(expired)
+		if expired < w.batchSize {
+			break
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	w.metrics.TTLRun(time.Since(start), err)
+	if err == nil {
+		w.heartbeat.Store(time.Now().UnixNano())
+	}
+	return total, err
+}
+
+// Heartbeat returns when the worker last completed a run, or the zero time
+// if it has not completed one yet.
+func (w *TTLWorker) Heartbeat() time.Time {
+	heartbeat := w.heartbeat.Load()
+	if heartbeat == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, heartbeat)
+}
+
+func (w *TTLWorker) Interval() time.Duration {
+	return w.interval
+}
@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"fmt"
+	"net/http"
+	"usersegmentator/pkg/httputil"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware starts a server span per request, named after the route template
+// and continuing the trace context sent by the caller.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer(instrumentationName).Start(
+			ctx,
+			fmt.Sprintf("%s %s", r.Method, route),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethod(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.ClientAddress(r.RemoteAddr),
+			),
+		)
+		defer span.End()
+
+		recorder, r := httputil.Record(w, r.WithContext(ctx))
+		next.ServeHTTP(recorder, r)
+
+		span.SetAttributes(semconv.HTTPStatusCode(recorder.Status))
+		if recorder.Status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.Status))
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"usersegmentator/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "usersegmentator"
+
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterMemory = "memory"
+	ExporterOTLP   = "otlp"
+)
+
+// Span attributes shared by handlers and repositories.
+const (
+	AttrSegment  = attribute.Key("segment.slug")
+	AttrSegments = attribute.Key("segment.slugs")
+	AttrUserID   = attribute.Key("user.id")
+	AttrUserIDs  = attribute.Key("user.ids")
+	AttrRows     = attribute.Key("db.rows")
+	AttrCacheHit = attribute.Key("cache.hit")
+	AttrDryRun   = attribute.Key("request.dry_run")
+)
+
+// NewExporter creates the span exporter selected in the config,
+// or nil when tracing is turned off.
+func NewExporter(ctx context.Context, cfg *config.Config) (sdktrace.SpanExporter, error) {
+	switch cfg.Tracing.Exporter {
+	case ExporterNone, "":
+		return nil, nil
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterMemory:
+		return tracetest.NewInMemoryExporter(), nil
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Tracing.OTLPEndpoint)}
+		if cfg.Tracing.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter: %s", cfg.Tracing.Exporter)
+	}
+}
+
+// NewTracerProvider installs a global tracer provider batching spans into
+// exporter, and the W3C trace context propagator. A nil exporter leaves
+// the no-op provider in place and only propagates incoming trace context.
+// Tests may pass a tracetest.InMemoryExporter and read the spans back.
+func NewTracerProvider(exporter sdktrace.SpanExporter, cfg *config.Config) *sdktrace.TracerProvider {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if exporter == nil {
+		return nil
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Tracing.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(cfg.UserSegmentator.Name),
+			semconv.ServiceVersion(cfg.UserSegmentator.Version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider
+}
+
+// Start starts a span named name as a child of the span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on span, if any, and ends it. It is meant to be deferred
+// with a named error result: defer func() { tracing.End(span, err) }().
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
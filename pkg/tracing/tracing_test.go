@@ -0,0 +1,218 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"usersegmentator/config"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newRecorder installs a global tracer provider recording every span,
+// and restores the previous one when the test ends.
+func newRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	previous := otel.GetTracerProvider()
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	// installs the propagator only
+	NewTracerProvider(nil, &config.Config{})
+	return recorder
+}
+
+func onlySpan(t *testing.T, recorder *tracetest.SpanRecorder) sdktrace.ReadOnlySpan {
+	t.Helper()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, expected 1", len(spans))
+	}
+	return spans[0]
+}
+
+func expectAttributes(t *testing.T, span sdktrace.ReadOnlySpan, expected ...attribute.KeyValue) {
+	t.Helper()
+
+	got := map[attribute.Key]attribute.Value{}
+	for _, attr := range span.Attributes() {
+		got[attr.Key] = attr.Value
+	}
+	for _, attr := range expected {
+		value, ok := got[attr.Key]
+		if !ok {
+			t.Fatalf("span %s has no %s attribute", span.Name(), attr.Key)
+		}
+		if value != attr.Value {
+			t.Fatalf("span %s has %s = %s, expected %s", span.Name(), attr.Key, value.Emit(), attr.Value.Emit())
+		}
+	}
+}
+
+func newTestRouter(status int) http.Handler {
+	r := mux.NewRouter()
+	r.Use(Middleware)
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+	}).Methods(http.MethodGet)
+	return r
+}
+
+func serve(h http.Handler, header http.Header) {
+	req := httptest.NewRequest(http.MethodGet, "/users/7", http.NoBody)
+	req.RemoteAddr = "10.0.0.1:1234"
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestMiddlewareSpan(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		code   codes.Code
+	}{
+		{"ok", http.StatusOK, codes.Unset},
+		{"client error", http.StatusNotFound, codes.Unset},
+		{"server error", http.StatusServiceUnavailable, codes.Error},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := newRecorder(t)
+			serve(newTestRouter(tt.status), nil)
+
+			span := onlySpan(t, recorder)
+			if span.Name() != "GET /users/{id}" {
+				t.Fatalf("span named %q, expected the route template", span.Name())
+			}
+			if span.SpanKind() != trace.SpanKindServer {
+				t.Fatalf("span kind %s, expected server", span.SpanKind())
+			}
+			expectAttributes(t, span,
+				semconv.HTTPMethod(http.MethodGet),
+				semconv.HTTPRoute("/users/{id}"),
+				semconv.ClientAddress("10.0.0.1:1234"),
+				semconv.HTTPStatusCode(tt.status),
+			)
+			if span.Status().Code != tt.code {
+				t.Fatalf("span status %s, expected %s", span.Status().Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestMiddlewareContinuesTrace(t *testing.T) {
+	recorder := newRecorder(t)
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	serve(newTestRouter(http.StatusOK), header)
+
+	span := onlySpan(t, recorder)
+	if got := span.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("trace %s, expected the caller's", got)
+	}
+	if got := span.Parent().SpanID().String(); got != "00f067aa0ba902b7" || !span.Parent().IsRemote() {
+		t.Fatalf("parent span %s, expected the caller's", got)
+	}
+}
+
+func TestMiddlewareUnmatchedRoute(t *testing.T) {
+	recorder := newRecorder(t)
+	serve(Middleware(http.NotFoundHandler()), nil)
+
+	span := onlySpan(t, recorder)
+	if span.Name() != "GET unmatched" {
+		t.Fatalf("span named %q, expected an unmatched route", span.Name())
+	}
+	expectAttributes(t, span, semconv.HTTPRoute("unmatched"), semconv.HTTPStatusCode(http.StatusNotFound))
+}
+
+func TestEnd(t *testing.T) {
+	recorder := newRecorder(t)
+	ctx := context.Background()
+
+	ctx, parent := Start(ctx, "parent", AttrSegment.String("TRACED"))
+	_, child := Start(ctx, "child", AttrRows.Int(3))
+	End(child, errors.New("query failed"))
+	End(parent, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, expected 2", len(spans))
+	}
+	failed, succeeded := spans[0], spans[1]
+
+	if failed.Parent().SpanID() != succeeded.SpanContext().SpanID() {
+		t.Fatal("child span not started under its parent")
+	}
+	expectAttributes(t, failed, AttrRows.Int(3))
+	expectAttributes(t, succeeded, AttrSegment.String("TRACED"))
+
+	if status := failed.Status(); status.Code != codes.Error || status.Description != "query failed" {
+		t.Fatalf("failed span status %+v", status)
+	}
+	if events := failed.Events(); len(events) != 1 || events[0].Name != "exception" {
+		t.Fatalf("error not recorded: %+v", events)
+	}
+	if status := succeeded.Status(); status.Code != codes.Unset || len(succeeded.Events()) != 0 {
+		t.Fatalf("succeeded span status %+v", status)
+	}
+}
+
+func TestNewTracerProviderExports(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	cfg := &config.Config{}
+	cfg.Tracing.Exporter = ExporterMemory
+	cfg.Tracing.SampleRatio = 1
+	cfg.UserSegmentator.Name = "usersegmentator"
+	cfg.UserSegmentator.Version = "test"
+
+	exporter, err := NewExporter(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := NewTracerProvider(exporter, cfg)
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+
+	_, span := Start(context.Background(), "exported")
+	End(span, nil)
+	if err = provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.(*tracetest.InMemoryExporter).GetSpans()
+	if len(spans) != 1 || spans[0].Name != "exported" {
+		t.Fatalf("exported %+v, expected one span", spans)
+	}
+	resource := map[attribute.Key]attribute.Value{}
+	for _, attr := range spans[0].Resource.Attributes() {
+		resource[attr.Key] = attr.Value
+	}
+	if resource[semconv.ServiceNameKey].AsString() != "usersegmentator" ||
+		resource[semconv.ServiceVersionKey].AsString() != "test" {
+		t.Fatalf("unexpected resource %v", spans[0].Resource.Attributes())
+	}
+}
+
+func TestNewTracerProviderWithoutExporter(t *testing.T) {
+	if provider := NewTracerProvider(nil, &config.Config{}); provider != nil {
+		t.Fatal("provider installed without an exporter")
+	}
+}
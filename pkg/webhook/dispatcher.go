@@ -0,0 +1,347 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/logging"
+)
+
+const (
+	resubscribeDelay = time.Second
+	// minDeliveryLease is the shortest time a claimed delivery is hidden from other workers
+	minDeliveryLease = time.Minute
+)
+
+// Dispatcher delivers broker events to the matching webhook subscriptions.
+//
+// Run matches the events against the subscriptions and queues a delivery for
+// every match in the database; Deliver, run as a background job, sends the
+// due deliveries. Failed deliveries are retried with exponential backoff and
+// end up in the dead-letter table once the attempts are exhausted. Queued
+// deliveries survive restarts; events published right before a crash and not
+// queued yet are lost.
+type Dispatcher struct {
+	repo             Repository
+	broker           *events.Broker
+	client           *http.Client
+	maxAttempts      int
+	initialBackoff   time.Duration
+	maxBackoff       time.Duration
+	workers          int
+	batchSize        int
+	interval         time.Duration
+	lease            time.Duration
+	subscriptionsTTL time.Duration
+	Logger           *slog.Logger
+
+	// subscriptions are only used by Run
+	subscriptions []Subscription
+	loadedAt      time.Time
+}
+
+func NewDispatcher(repo Repository, broker *events.Broker, cfg *config.Config) *Dispatcher {
+	workers := cfg.Webhooks.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	batchSize := cfg.Webhooks.BatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	interval := time.Duration(cfg.Webhooks.PollInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	timeout := time.Duration(cfg.Webhooks.DeliveryTimeout) * time.Second
+
+	return &Dispatcher{
+		repo:             repo,
+		broker:           broker,
+		client:           &http.Client{Timeout: timeout},
+		maxAttempts:      cfg.Webhooks.MaxAttempts,
+		initialBackoff:   time.Duration(cfg.Webhooks.InitialBackoff) * time.Second,
+		maxBackoff:       time.Duration(cfg.Webhooks.MaxBackoff) * time.Second,
+		workers:          workers,
+		batchSize:        batchSize,
+		interval:         interval,
+		lease:            max(2*timeout, minDeliveryLease),
+		subscriptionsTTL: time.Duration(cfg.Webhooks.SubscriptionsTTL) * time.Second,
+		Logger:           logging.For("webhooks_dispatcher"),
+	}
+}
+
+// Run queues the deliveries of broker events until ctx is done. If the
+// broker drops the subscription or queueing fails, Run resubscribes from the
+// last queued event.
+func (d *Dispatcher) Run(ctx context.Context) {
+	d.Logger.Info("Webhooks dispatcher is running")
+
+	var lastID uint64
+	for {
+		lastID = d.consume(ctx, lastID)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(resubscribeDelay):
+		}
+	}
+}
+
+// consume queues the deliveries of the events published after lastID in
+// batches, and returns the ID of the last queued event once it has to
+// resubscribe.
+func (d *Dispatcher) consume(ctx context.Context, lastID uint64) uint64 {
+	sub, backlog := d.broker.Subscribe(events.Filter{}, lastID)
+	defer sub.Close()
+
+	for len(backlog) > 0 {
+		n := min(len(backlog), d.batchSize)
+		if err := d.enqueue(ctx, backlog[:n]); err != nil {
+			return lastID
+		}
+		lastID = backlog[n-1].ID
+		backlog = backlog[n:]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return lastID
+		case e, ok := <-sub.C:
+			if !ok {
+				return lastID
+			}
+			if lastID == 0 {
+				// IDs are consecutive, so a failed first batch is found in the backlog
+				lastID = e.ID - 1
+			}
+
+			batch := d.collect(e, sub.C)
+			if err := d.enqueue(ctx, batch); err != nil {
+				return lastID
+			}
+			lastID = batch[len(batch)-1].ID
+		}
+	}
+}
+
+// collect adds the events already waiting in c to first, up to a batch.
+func (d *Dispatcher) collect(first events.Event, c <-chan events.Event) []events.Event {
+	batch := []events.Event{first}
+	for len(batch) < d.batchSize {
+		select {
+		case e, ok := <-c:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, e)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (d *Dispatcher) enqueue(ctx context.Context, batch []events.Event) error {
+	subscriptions, err := d.getSubscriptions(ctx)
+	if err != nil {
+		d.Logger.ErrorContext(ctx, "error getting webhook subscriptions", logging.Err(err))
+		return err
+	}
+
+	now := time.Now()
+	deliveries := []Delivery{}
+	for i := range batch {
+		var payload []byte
+		for j := range subscriptions {
+			if !subscriptions[j].Matches(&batch[i]) {
+				continue
+			}
+
+			if payload == nil {
+				payload, err = json.Marshal(&batch[i])
+				if err != nil {
+					d.Logger.ErrorContext(ctx, "error encoding event", "event_id", batch[i].ID, logging.Err(err))
+					break
+				}
+			}
+			deliveries = append(deliveries, Delivery{
+				SubscriptionID: subscriptions[j].ID,
+				EventID:        batch[i].ID,
+				EventType:      batch[i].Type,
+				Payload:        string(payload),
+				NextAttemptAt:  now,
+			})
+		}
+	}
+
+	err = d.repo.EnqueueDeliveries(ctx, deliveries)
+	if err != nil {
+		d.Logger.ErrorContext(ctx, "error queueing webhook deliveries", "events", len(batch), logging.Err(err))
+		return err
+	}
+	return nil
+}
+
+// getSubscriptions returns the active subscriptions, read again once they
+// are older than the subscriptions TTL.
+func (d *Dispatcher) getSubscriptions(ctx context.Context) ([]Subscription, error) {
+	if d.subscriptions != nil && time.Since(d.loadedAt) < d.subscriptionsTTL {
+		return d.subscriptions, nil
+	}
+
+	subscriptions, err := d.repo.GetSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	d.subscriptions, d.loadedAt = subscriptions, time.Now()
+	return subscriptions, nil
+}
+
+// Deliver sends the due deliveries batch by batch, going on while the
+// batches come back full. It is scheduled every interval; replicas running it
+// at the same time claim different deliveries.
+func (d *Dispatcher) Deliver(ctx context.Context) error {
+	for ctx.Err() == nil {
+		now := time.Now()
+		deliveries, err := d.repo.ClaimDeliveries(ctx, d.batchSize, now, now.Add(d.lease))
+		if err != nil {
+			return err
+		}
+
+		workers := make(chan struct{}, d.workers)
+		var wg sync.WaitGroup
+		for i := range deliveries {
+			workers <- struct{}{}
+			wg.Add(1)
+			go func(delivery *Delivery) {
+				defer func() {
+					<-workers
+					wg.Done()
+				}()
+				d.attempt(ctx, delivery)
+			}(&deliveries[i])
+		}
+		wg.Wait()
+
+		if len(deliveries) < d.batchSize {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (d *Dispatcher) Interval() time.Duration {
+	return d.interval
+}
+
+// attempt sends the delivery once and records the outcome. A delivery
+// interrupted by ctx stays claimed and is sent again once its lease is over.
+func (d *Dispatcher) attempt(ctx context.Context, delivery *Delivery) {
+	if !delivery.Active {
+		if err := d.repo.CompleteDelivery(ctx, delivery.ID); err != nil {
+			d.Logger.ErrorContext(ctx, "error dropping webhook delivery", "webhook_id", delivery.SubscriptionID,
+				logging.Err(err))
+		}
+		return
+	}
+
+	err := d.send(ctx, delivery)
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err == nil {
+		d.Logger.InfoContext(ctx, "Delivered event", "event_id", delivery.EventID, "webhook_id", delivery.SubscriptionID,
+			"event_type", delivery.EventType)
+		err = d.repo.CompleteDelivery(ctx, delivery.ID)
+		if err != nil {
+			d.Logger.ErrorContext(ctx, "error completing webhook delivery", "event_id", delivery.EventID,
+				"webhook_id", delivery.SubscriptionID, logging.Err(err))
+		}
+		return
+	}
+
+	delivery.Attempts++
+	delivery.LastError = err.Error()
+	d.Logger.WarnContext(ctx, "webhook delivery failed", "event_id", delivery.EventID, "webhook_id", delivery.SubscriptionID,
+		"attempt", delivery.Attempts, "event_type", delivery.EventType, logging.Err(err))
+
+	if delivery.Attempts >= d.maxAttempts {
+		err = d.repo.DeadLetterDelivery(ctx, delivery)
+	} else {
+		delivery.NextAttemptAt = time.Now().Add(d.backoff(delivery.Attempts))
+		err = d.repo.RetryDelivery(ctx, delivery)
+	}
+	if err != nil {
+		d.Logger.ErrorContext(ctx, "error rescheduling webhook delivery", "event_id", delivery.EventID,
+			"webhook_id", delivery.SubscriptionID, logging.Err(err))
+	}
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := d.initialBackoff
+	for i := 1; i < attempts && backoff < d.maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, d.maxBackoff)
+}
+
+func (d *Dispatcher) send(ctx context.Context, delivery *Delivery) error {
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, strconv.FormatUint(delivery.EventID, 10))
+	req.Header.Set(SignatureHeader, "sha256="+Sign(delivery.Secret, payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex-encoded HMAC-SHA256 of payload, which receivers
+// compare with the X-Webhook-Signature header.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Subscription) Matches(e *events.Event) bool {
+	if s.SegmentSlug != "" && s.SegmentSlug != e.Segment {
+		return false
+	}
+	for _, eventType := range s.EventTypes {
+		if eventType == e.Type {
+			return true
+		}
+	}
+	return false
+}
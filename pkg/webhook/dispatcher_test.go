@@ -0,0 +1,301 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/migrate"
+)
+
+const testSecret = "s3cr3t"
+
+type testEnv struct {
+	cfg    *config.Config
+	db     *sql.DB
+	repo   Repository
+	broker *events.Broker
+}
+
+// newTestEnv migrates a new SQLite database.
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	cfg := &config.Config{}
+	cfg.Database.Backend = dialect.SQLite
+	cfg.Database.Timeout = 5
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "webhooks.db")
+	cfg.Events.BufferSize = 100
+	cfg.Webhooks.Workers = 2
+	cfg.Webhooks.MaxAttempts = 2
+	cfg.Webhooks.BatchSize = 10
+	cfg.Webhooks.DeliveryTimeout = 5
+
+	db, err := dialect.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	migrator, err := migrate.NewMigrator(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	broker := events.NewBroker(cfg)
+	t.Cleanup(broker.Close)
+
+	return &testEnv{cfg: cfg, db: db, repo: NewWebhooksRepo(db, cfg), broker: broker}
+}
+
+func (env *testEnv) dispatcher() *Dispatcher {
+	return NewDispatcher(NewWebhooksRepo(env.db, env.cfg), env.broker, env.cfg)
+}
+
+func (env *testEnv) subscribe(t *testing.T, url string, eventTypes ...string) int {
+	t.Helper()
+
+	id, err := env.repo.InsertSubscription(context.Background(), &Subscription{
+		URL:        url,
+		Secret:     testSecret,
+		EventTypes: eventTypes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func (env *testEnv) expectQueued(t *testing.T, expected int) {
+	t.Helper()
+
+	var queued int
+	if err := env.db.QueryRow("SELECT COUNT(*) FROM webhook_deliveries").Scan(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued != expected {
+		t.Fatalf("%d deliveries queued, expected %d", queued, expected)
+	}
+}
+
+// receiver records the deliveries it gets and answers with status.
+type receiver struct {
+	mu         sync.Mutex
+	status     int
+	deliveries []*http.Request
+	payloads   [][]byte
+}
+
+func newReceiver(t *testing.T, status int) (*receiver, string) {
+	rc := &receiver{status: status}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		rc.deliveries = append(rc.deliveries, r)
+		rc.payloads = append(rc.payloads, payload)
+		w.WriteHeader(rc.status)
+	}))
+	t.Cleanup(server.Close)
+	return rc, server.URL
+}
+
+func (rc *receiver) received() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.deliveries)
+}
+
+func TestDeliverQueuedEvents(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	rc, url := newReceiver(t, http.StatusOK)
+	env.subscribe(t, url, events.TypeSegmentDeleted)
+
+	err := env.dispatcher().enqueue(ctx, []events.Event{
+		{ID: 1, Type: events.TypeSegmentDeleted, Segment: "A"},
+		{ID: 2, Type: events.TypeAssigned, UserID: 1, Segment: "A"},
+		{ID: 3, Type: events.TypeSegmentDeleted, Segment: "B"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.expectQueued(t, 2)
+
+	// a new dispatcher sends what the previous one queued
+	if err = env.dispatcher().Deliver(ctx); err != nil {
+		t.Fatal(err)
+	}
+	env.expectQueued(t, 0)
+
+	if rc.received() != 2 {
+		t.Fatalf("received %d deliveries, expected 2", rc.received())
+	}
+	for i, r := range rc.deliveries {
+		if r.Header.Get(EventHeader) != events.TypeSegmentDeleted {
+			t.Fatalf("delivery %d: event header %q", i, r.Header.Get(EventHeader))
+		}
+		if r.Header.Get(SignatureHeader) != "sha256="+Sign(testSecret, rc.payloads[i]) {
+			t.Fatalf("delivery %d: bad signature", i)
+		}
+
+		var e events.Event
+		if err = json.Unmarshal(rc.payloads[i], &e); err != nil {
+			t.Fatal(err)
+		}
+		if r.Header.Get(DeliveryHeader) != map[uint64]string{1: "1", 3: "3"}[e.ID] {
+			t.Fatalf("delivery %d: delivery header %q for event %d", i, r.Header.Get(DeliveryHeader), e.ID)
+		}
+	}
+}
+
+func TestDeliverRetriesThenDeadLetters(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	rc, url := newReceiver(t, http.StatusInternalServerError)
+	subscriptionID := env.subscribe(t, url, events.TypeSegmentDeleted)
+
+	d := env.dispatcher()
+	if err := d.enqueue(ctx, []events.Event{{ID: 1, Type: events.TypeSegmentDeleted, Segment: "A"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// with no backoff the retry is due right away
+	for attempt := 1; attempt <= env.cfg.Webhooks.MaxAttempts; attempt++ {
+		if err := d.Deliver(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if rc.received() != attempt {
+			t.Fatalf("received %d deliveries after attempt %d", rc.received(), attempt)
+		}
+	}
+	env.expectQueued(t, 0)
+
+	deadLetters, err := env.repo.GetDeadLetters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deadLetters) != 1 || deadLetters[0].SubscriptionID != subscriptionID ||
+		deadLetters[0].Attempts != env.cfg.Webhooks.MaxAttempts || deadLetters[0].LastError == "" {
+		t.Fatalf("unexpected dead letters: %+v", deadLetters)
+	}
+}
+
+func TestDeliverSkipsClaimedDeliveries(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	rc, url := newReceiver(t, http.StatusOK)
+	env.subscribe(t, url, events.TypeSegmentDeleted)
+
+	if err := env.dispatcher().enqueue(ctx, []events.Event{{ID: 1, Type: events.TypeSegmentDeleted}}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claimed, err := env.repo.ClaimDeliveries(ctx, 10, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 {
+		t.Fatalf("claimed %d deliveries, expected 1", len(claimed))
+	}
+
+	if err = env.dispatcher().Deliver(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rc.received() != 0 {
+		t.Fatalf("claimed delivery sent %d times", rc.received())
+	}
+	env.expectQueued(t, 1)
+}
+
+func TestDeleteSubscriptionDropsQueue(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	rc, url := newReceiver(t, http.StatusOK)
+	id := env.subscribe(t, url, events.TypeSegmentDeleted)
+
+	d := env.dispatcher()
+	d.subscriptionsTTL = time.Hour
+	if err := d.enqueue(ctx, []events.Event{{ID: 1, Type: events.TypeSegmentDeleted}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.repo.DeleteSubscription(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	env.expectQueued(t, 0)
+
+	// the dispatcher matches the deleted subscription until it reads the subscriptions again
+	if err := d.enqueue(ctx, []events.Event{{ID: 2, Type: events.TypeSegmentDeleted}}); err != nil {
+		t.Fatal(err)
+	}
+	env.expectQueued(t, 1)
+	if err := d.Deliver(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rc.received() != 0 {
+		t.Fatalf("deleted subscription received %d deliveries", rc.received())
+	}
+	env.expectQueued(t, 0)
+}
+
+func TestRunQueuesPublishedEvents(t *testing.T) {
+	env := newTestEnv(t)
+	rc, url := newReceiver(t, http.StatusOK)
+	env.subscribe(t, url, events.TypeRolloutCompleted)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := env.dispatcher()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Run subscribes asynchronously, so keep publishing until an event gets through
+	deadline := time.Now().Add(5 * time.Second)
+	for rc.received() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("published event not delivered")
+		}
+		env.broker.Publish(events.Event{Type: events.TypeRolloutCompleted, Segment: "A", Count: 1})
+		time.Sleep(10 * time.Millisecond)
+		if err := d.Deliver(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{initialBackoff: time.Second, maxBackoff: 5 * time.Second}
+
+	expected := map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		4:  5 * time.Second,
+		10: 5 * time.Second,
+	}
+	for attempts, backoff := range expected {
+		if got := d.backoff(attempts); got != backoff {
+			t.Fatalf("backoff after %d attempts: %s, expected %s", attempts, got, backoff)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/events"
+	"usersegmentator/pkg/logging"
+)
+
+type Repository interface {
+	InsertSubscription(ctx context.Context, sub *Subscription) (int, error)
+	DeleteSubscription(ctx context.Context, id int) error
+	GetSubscriptions(ctx context.Context) ([]Subscription, error)
+	EnqueueDeliveries(ctx context.Context, deliveries []Delivery) error
+	ClaimDeliveries(ctx context.Context, limit int, now, leaseUntil time.Time) ([]Delivery, error)
+	CompleteDelivery(ctx context.Context, id int64) error
+	RetryDelivery(ctx context.Context, delivery *Delivery) error
+	DeadLetterDelivery(ctx context.Context, delivery *Delivery) error
+	GetDeadLetters(ctx context.Context) ([]DeadLetter, error)
+}
+
+// enqueueChunkSize bounds the rows inserted by one statement, keeping it
+// below the placeholder limits of the databases.
+const enqueueChunkSize = 1000
+
+type webhooksRepository struct {
+	db      *sql.DB
+	dialect dialect.Dialect
+	cfg     *config.Config
+	Logger  *slog.Logger
+}
+
+func NewWebhooksRepo(db *sql.DB, cfg *config.Config) Repository {
+	return &webhooksRepository{
+		db:      db,
+		dialect: dialect.For(cfg),
+		cfg:     cfg,
+		Logger:  logging.For("webhooks_repo"),
+	}
+}
+
+func (wr *webhooksRepository) InsertSubscription(ctx context.Context, sub *Subscription) (int, error) {
+	parsedURL, err := url.Parse(sub.URL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return -1, fmt.Errorf("invalid webhook url: %s", sub.URL)
+	}
+	if sub.Secret == "" {
+		return -1, fmt.Errorf("empty webhook secret")
+	}
+	if len(sub.EventTypes) == 0 {
+		return -1, fmt.Errorf("no event types to subscribe to")
+	}
+	for _, eventType := range sub.EventTypes {
+		if !events.IsValidType(eventType) {
+			return -1, fmt.Errorf("unknown event type: %s", eventType)
+		}
+	}
+
+	var segmentSlug sql.NullString
+	if sub.SegmentSlug != "" {
+		segmentSlug = sql.NullString{String: sub.SegmentSlug, Valid: true}
+	}
+
+	id, err := wr.dialect.InsertID(
+		ctx,
+		wr.db,
+		wr.dialect.Rebind("INSERT INTO webhook_subscriptions (url, secret, segment_slug, event_types) VALUES (?, ?, ?, ?)"),
+		sub.URL,
+		sub.Secret,
+		segmentSlug,
+		strings.Join(sub.EventTypes, ","),
+	)
+	if err != nil {
+		return -1, err
+	}
+
+	wr.Logger.InfoContext(ctx, "InsertSubscription", "webhook_id", id, "url", sub.URL)
+	return int(id), nil
+}
+
+// DeleteSubscription deactivates the subscription and drops its queued deliveries.
+func (wr *webhooksRepository) DeleteSubscription(ctx context.Context, id int) error {
+	tx, err := wr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", errors.ErrorBeginTransaction, err)
+	}
+
+	result, err := tx.ExecContext(
+		ctx,
+		wr.dialect.Rebind("UPDATE webhook_subscriptions SET is_active = FALSE WHERE id = ? AND is_active = TRUE"),
+		id,
+	)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return fmt.Errorf("%s: %w", errors.ErrorGettingAffectedRows, err)
+	}
+	if affected == 0 {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("rollback error: %w", rbErr)
+		}
+		return fmt.Errorf("webhook subscription %d not found", id)
+	}
+
+	_, err = tx.ExecContext(ctx, wr.dialect.Rebind("DELETE FROM webhook_deliveries WHERE subscription_id = ?"), id)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("%s: %w", errors.ErrorCommittingTransaction, err)
+	}
+
+	wr.Logger.InfoContext(ctx, "DeleteSubscription", "webhook_id", id)
+	return nil
+}
+
+func (wr *webhooksRepository) GetSubscriptions(ctx context.Context) ([]Subscription, error) {
+	rows, err := wr.db.QueryContext(
+		ctx,
+		"SELECT id, url, secret, segment_slug, event_types, created_at "+
+			"FROM webhook_subscriptions WHERE is_active = TRUE ORDER BY id",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []Subscription{}
+	for rows.Next() {
+		var sub Subscription
+		var segmentSlug sql.NullString
+		var eventTypes string
+		err = rows.Scan(&sub.ID, &sub.URL, &sub.Secret, &segmentSlug, &eventTypes, &sub.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		sub.SegmentSlug = segmentSlug.String
+		sub.EventTypes = strings.Split(eventTypes, ",")
+		subscriptions = append(subscriptions, sub)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+// EnqueueDeliveries queues the deliveries, due at their NextAttemptAt.
+func (wr *webhooksRepository) EnqueueDeliveries(ctx context.Context, deliveries []Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	tx, err := wr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", errors.ErrorBeginTransaction, err)
+	}
+
+	for start := 0; start < len(deliveries); start += enqueueChunkSize {
+		chunk := deliveries[start:min(start+enqueueChunkSize, len(deliveries))]
+
+		args := make([]interface{}, 0, len(chunk)*5)
+		for i := range chunk {
+			args = append(args, chunk[i].SubscriptionID, chunk[i].EventID, chunk[i].EventType, chunk[i].Payload,
+				chunk[i].NextAttemptAt.UTC().Truncate(time.Second))
+		}
+
+		values := strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?, ?), ", len(chunk)), ", ")
+		_, err = tx.ExecContext(
+			ctx,
+			wr.dialect.Rebind("INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, payload, next_attempt_at) "+
+				"VALUES "+values),
+			args...,
+		)
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+			}
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("%s: %w", errors.ErrorCommittingTransaction, err)
+	}
+
+	wr.Logger.DebugContext(ctx, "EnqueueDeliveries", "deliveries", len(deliveries))
+	return nil
+}
+
+// ClaimDeliveries returns up to limit deliveries due at now, oldest first,
+// and postpones them until leaseUntil, so that no other worker claims them
+// while they are being sent. A delivery whose worker dies is claimed again
+// once the lease is over.
+func (wr *webhooksRepository) ClaimDeliveries(ctx context.Context, limit int, now, leaseUntil time.Time) ([]Delivery, error) {
+	tx, err := wr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", errors.ErrorBeginTransaction, err)
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		wr.dialect.Rebind("SELECT d.id, d.subscription_id, d.event_id, d.event_type, d.payload, d.attempts, "+
+			"s.url, s.secret, s.is_active "+
+			"FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.id = d.subscription_id "+
+			"WHERE d.next_attempt_at <= ? ORDER BY d.next_attempt_at, d.id LIMIT ?"+wr.dialect.ForUpdate()),
+		now.UTC().Truncate(time.Second),
+		limit,
+	)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var delivery Delivery
+		err = rows.Scan(&delivery.ID, &delivery.SubscriptionID, &delivery.EventID, &delivery.EventType,
+			&delivery.Payload, &delivery.Attempts, &delivery.URL, &delivery.Secret, &delivery.Active)
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				return nil, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+			}
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	err = rows.Err()
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return nil, err
+	}
+
+	if len(deliveries) == 0 {
+		return deliveries, tx.Commit()
+	}
+
+	args := []interface{}{leaseUntil.UTC().Truncate(time.Second)}
+	for i := range deliveries {
+		args = append(args, deliveries[i].ID)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(deliveries)), ", ")
+	_, err = tx.ExecContext(
+		ctx,
+		wr.dialect.Rebind("UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id IN ("+placeholders+")"),
+		args...,
+	)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", errors.ErrorCommittingTransaction, err)
+	}
+	return deliveries, nil
+}
+
+func (wr *webhooksRepository) CompleteDelivery(ctx context.Context, id int64) error {
+	_, err := wr.db.ExecContext(ctx, wr.dialect.Rebind("DELETE FROM webhook_deliveries WHERE id = ?"), id)
+	return err
+}
+
+// RetryDelivery records a failed attempt and reschedules the delivery at its NextAttemptAt.
+func (wr *webhooksRepository) RetryDelivery(ctx context.Context, delivery *Delivery) error {
+	_, err := wr.db.ExecContext(
+		ctx,
+		wr.dialect.Rebind("UPDATE webhook_deliveries SET attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?"),
+		delivery.Attempts,
+		delivery.LastError,
+		delivery.NextAttemptAt.UTC().Truncate(time.Second),
+		delivery.ID,
+	)
+	return err
+}
+
+// DeadLetterDelivery moves a delivery whose attempts are exhausted to the dead-letter table.
+func (wr *webhooksRepository) DeadLetterDelivery(ctx context.Context, delivery *Delivery) error {
+	tx, err := wr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", errors.ErrorBeginTransaction, err)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		wr.dialect.Rebind("INSERT INTO webhook_dead_letters (subscription_id, event_type, payload, attempts, last_error) "+
+			"VALUES (?, ?, ?, ?, ?)"),
+		delivery.SubscriptionID,
+		delivery.EventType,
+		delivery.Payload,
+		delivery.Attempts,
+		delivery.LastError,
+	)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, wr.dialect.Rebind("DELETE FROM webhook_deliveries WHERE id = ?"), delivery.ID)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("%s: %w", errors.ErrorCommittingTransaction, err)
+	}
+
+	wr.Logger.InfoContext(ctx, "DeadLetterDelivery", "webhook_id", delivery.SubscriptionID, "event_type", delivery.EventType)
+	return nil
+}
+
+func (wr *webhooksRepository) GetDeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	rows, err := wr.db.QueryContext(
+		ctx,
+		"SELECT id, subscription_id, event_type, payload, attempts, last_error, created_at "+
+			"FROM webhook_dead_letters ORDER BY id",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deadLetters := []DeadLetter{}
+	for rows.Next() {
+		var deadLetter DeadLetter
+		err = rows.Scan(
+			&deadLetter.ID,
+			&deadLetter.SubscriptionID,
+			&deadLetter.EventType,
+			&deadLetter.Payload,
+			&deadLetter.Attempts,
+			&deadLetter.LastError,
+			&deadLetter.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return deadLetters, nil
+}
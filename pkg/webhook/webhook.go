@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+type Subscription struct {
+	ID          int       `json:"id"`
+	URL         string    `json:"url"`
+	Secret      string    `json:"-"`
+	SegmentSlug string    `json:"segment_slug,omitempty"`
+	EventTypes  []string  `json:"event_types"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Delivery is an event queued for one subscription. It stays in the queue
+// until it is delivered, dead-lettered or its subscription is deleted.
+type Delivery struct {
+	ID             int64
+	SubscriptionID int
+	EventID        uint64
+	EventType      string
+	Payload        string
+	Attempts       int
+	LastError      string
+	NextAttemptAt  time.Time
+
+	// the subscription as of claiming the delivery
+	URL    string
+	Secret string
+	Active bool
+}
+
+type DeadLetter struct {
+	ID             int       `json:"id"`
+	SubscriptionID int       `json:"subscription_id"`
+	EventType      string    `json:"event_type"`
+	Payload        string    `json:"payload"`
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"last_error"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type RequestCreateSubscription struct {
+	URL         string   `json:"url"`
+	Secret      string   `json:"secret"`
+	SegmentSlug string   `json:"segment_slug"`
+	EventTypes  []string `json:"event_types"`
+}
+
+type RequestSubscriptionID struct {
+	ID int `json:"id"`
+}
+
+type ResponseSubscriptionID struct {
+	ID int `json:"id"`
+}